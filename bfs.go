@@ -6,6 +6,7 @@ import (
 	"bfs/config"
 	"bfs/server/blockserver"
 	"bfs/server/nameserver"
+	"bfs/util/etcd"
 	"bfs/util/logging"
 	"bfs/util/size"
 	"context"
@@ -13,6 +14,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"google.golang.org/grpc"
@@ -38,6 +40,13 @@ type Config struct {
 	ExtraArgs []string
 }
 
+// Values of the server -durability flag.
+var durabilityModes = map[string]config.Durability{
+	"none":           config.Durability_DURABILITY_NONE,
+	"fsync-file":     config.Durability_DURABILITY_FSYNC_FILE,
+	"fsync-file+dir": config.Durability_DURABILITY_FSYNC_FILE_AND_DIR,
+}
+
 type ListValue []string
 
 func (this *ListValue) Set(value string) error {
@@ -74,20 +83,49 @@ func (this *BFSServer) Run() error {
 
 func (this *BFSServer) configure() error {
 	var volumePaths ListValue
+	var memoryVolumes ListValue
 	var allowAutoInit bool
 	var port int
 	var hostLabels ListValue
 	var nsPath string
 	var hostId string
+	var scrubInterval time.Duration
+	var scrubRate uint64
+	var orphanPolicy string
+	var durability string
+	var keyFile string
+	var reservedBytes uint64
+	var maxBytes uint64
+	var writeGracePeriod time.Duration
+	var readRate uint64
+	var writeRate uint64
+	var callerReadRate uint64
+	var callerWriteRate uint64
 
 	serverFlags := flag.NewFlagSet("server", flag.ContinueOnError)
 	serverFlags.Var(&volumePaths, "volume", "physical volume directory (repeatable)")
+	serverFlags.Var(&memoryVolumes, "memory-volume", "name of a physical volume kept in memory (repeatable)")
 	serverFlags.BoolVar(&allowAutoInit, "auto-init", false, "allow auto-initialization of physical volumes")
 	serverFlags.BoolVar(&allowAutoInit, "a", false, "allow auto-initialization of physical volumes")
 	serverFlags.IntVar(&port, "port", 60000, "bind port")
 	serverFlags.StringVar(&nsPath, "ns", "", "namespace directory")
 	serverFlags.StringVar(&hostId, "id", "", "node id")
 	serverFlags.Var(&hostLabels, "label", "host labels")
+	serverFlags.DurationVar(&scrubInterval, "scrub-interval", 0, "time between block scrub passes (0 disables scrubbing)")
+	serverFlags.Uint64Var(&scrubRate, "scrub-rate", 0, "maximum scrub rate in bytes per second (0 uses the default)")
+	serverFlags.StringVar(&orphanPolicy, "orphan-policy", "delete", "handling of orphaned temp files (delete | quarantine)")
+	serverFlags.StringVar(&durability, "durability", "none", "block write durability (none | fsync-file | fsync-file+dir)")
+	serverFlags.StringVar(&keyFile, "key-file", "", "file of keys with which to encrypt blocks at rest")
+	serverFlags.Uint64Var(&reservedBytes, "reserved-bytes", 0, "free space to keep on each volume's file system (0 disables)")
+	serverFlags.Uint64Var(&maxBytes, "max-bytes", 0, "maximum block data per volume (0 is unlimited)")
+	serverFlags.DurationVar(&writeGracePeriod, "write-grace-period", blockservice.DefaultWriteGracePeriod,
+		"time an interrupted block write is kept so it may be resumed")
+	serverFlags.Uint64Var(&readRate, "read-rate", 0, "maximum block read rate per volume in bytes per second (0 is unlimited)")
+	serverFlags.Uint64Var(&writeRate, "write-rate", 0, "maximum block write rate per volume in bytes per second (0 is unlimited)")
+	serverFlags.Uint64Var(&callerReadRate, "caller-read-rate", 0,
+		"maximum block read rate per volume for each identified caller in bytes per second (0 is unlimited)")
+	serverFlags.Uint64Var(&callerWriteRate, "caller-write-rate", 0,
+		"maximum block write rate per volume for each identified caller in bytes per second (0 is unlimited)")
 
 	flag.CommandLine.VisitAll(func(f *flag.Flag) {
 		serverFlags.Var(f.Value, f.Name, f.Usage)
@@ -99,9 +137,24 @@ func (this *BFSServer) configure() error {
 
 	flag.Parse()
 
-	pvConfigs := make([]*config.PhysicalVolumeConfig, 0, len(volumePaths))
+	parsedOrphanPolicy, ok := config.OrphanPolicy_value["ORPHAN_"+strings.ToUpper(orphanPolicy)]
+	if !ok {
+		return fmt.Errorf("unknown orphan policy %s", orphanPolicy)
+	}
+
+	parsedDurability, ok := durabilityModes[durability]
+	if !ok {
+		return fmt.Errorf("unknown durability %s", durability)
+	}
+
+	pvConfigs := make([]*config.PhysicalVolumeConfig, 0, len(volumePaths)+len(memoryVolumes))
+
+	for i, pathSpec := range append(volumePaths, memoryVolumes...) {
+		storage := config.VolumeStorage_STORAGE_LOCAL
+		if i >= len(volumePaths) {
+			storage = config.VolumeStorage_STORAGE_MEMORY
+		}
 
-	for _, pathSpec := range volumePaths {
 		components := strings.Split(pathSpec, ":")
 		var labels map[string]string
 
@@ -115,12 +168,25 @@ func (this *BFSServer) configure() error {
 			}
 		}
 
-		glog.V(logging.LogLevelDebug).Infof("Configure volume path %s auto-initialize: %t labels: %v", components[0], allowAutoInit, labels)
+		glog.V(logging.LogLevelDebug).Infof("Configure volume path %s storage: %s auto-initialize: %t labels: %v",
+			components[0], storage, allowAutoInit, labels)
 
 		pvConfigs = append(pvConfigs, &config.PhysicalVolumeConfig{
-			Path:                components[0],
-			AllowAutoInitialize: allowAutoInit,
-			Labels:              labels,
+			Path:                      components[0],
+			Storage:                   storage,
+			AllowAutoInitialize:       allowAutoInit,
+			Labels:                    labels,
+			ScrubIntervalSeconds:      int64(scrubInterval / time.Second),
+			ScrubBytesPerSecond:       scrubRate,
+			OrphanPolicy:              config.OrphanPolicy(parsedOrphanPolicy),
+			KeyFile:                   keyFile,
+			ReservedBytes:             reservedBytes,
+			MaxBytes:                  maxBytes,
+			WriteGracePeriodSeconds:   int64(writeGracePeriod / time.Second),
+			ReadBytesPerSecond:        readRate,
+			WriteBytesPerSecond:       writeRate,
+			CallerReadBytesPerSecond:  callerReadRate,
+			CallerWriteBytesPerSecond: callerWriteRate,
 		})
 	}
 
@@ -163,6 +229,7 @@ func (this *BFSServer) configure() error {
 		Hostname:      hostname,
 		Port:          int32(port),
 		VolumeConfigs: pvConfigs,
+		Durability:    parsedDurability,
 	}
 	hostConfig := &config.HostConfig{
 		Id:                 hostId,
@@ -230,16 +297,83 @@ func (this *BFSServer) start() error {
 		return err
 	}
 
-	// Register or update host config
-	_, err = etcdClient.Put(
-		context.Background(),
-		filepath.Join(client.DefaultEtcdPrefix, client.EtcdHostsPrefix, client.EtcdHostsConfigPrefix, this.HostConfig.Id),
-		proto.MarshalTextString(this.HostConfig),
+	if err := this.publishHostConfig(etcdClient); err != nil {
+		return err
+	}
+
+	// Add and remove volumes as operators configure them, and publish the host config again so clients see them.
+	volumeConfigPrefix := filepath.Join(client.DefaultEtcdPrefix, client.EtcdHostVolumesPrefix, this.HostConfig.Id)
+
+	volumeConfigWatcher := etcd.NewWatcher(
+		etcdClient,
+		volumeConfigPrefix+"/",
+		true,
+		func(kv *mvccpb.KeyValue) error {
+			pvConfig := &config.PhysicalVolumeConfig{}
+			if err := proto.UnmarshalText(string(kv.Value), pvConfig); err != nil {
+				glog.Errorf("Ignoring invalid volume config %s - %v", kv.Key, err)
+				return nil
+			}
+
+			pvConfig.Path = strings.TrimPrefix(string(kv.Key), volumeConfigPrefix)
+			if _, err := this.blockServer.AddVolume(pvConfig); err != nil {
+				glog.Errorf("Unable to add volume at %s - %v", pvConfig.Path, err)
+				return nil
+			}
+
+			this.publishHostConfig(etcdClient)
+			return nil
+		},
+		func(kv *mvccpb.KeyValue) error {
+			path := strings.TrimPrefix(string(kv.Key), volumeConfigPrefix)
+
+			for _, pvConfig := range this.blockServer.VolumeConfigs() {
+				if filepath.Clean(pvConfig.Path) != filepath.Clean(path) {
+					continue
+				}
+
+				if err := this.blockServer.RemoveVolume(pvConfig.Id); err != nil {
+					glog.Errorf("Unable to remove volume %s at %s - %v", pvConfig.Id, path, err)
+					return nil
+				}
+
+				this.publishHostConfig(etcdClient)
+			}
+
+			return nil
+		},
+		nil,
+		true,
+		clientv3.WithPrefix(),
 	)
-	if err != nil {
-		glog.Errorf("Unable to set or update host config - %v", err)
+	if err := volumeConfigWatcher.Start(); err != nil {
+		glog.Errorf("Unable to watch volume configs - %v", err)
+		return err
+	}
+	defer volumeConfigWatcher.Stop()
+
+	// Apply operator-set volume states now and whenever they change. Removing a volume's state reopens it.
+	volumeStateWatcher := etcd.NewWatcher(
+		etcdClient,
+		filepath.Join(client.DefaultEtcdPrefix, client.EtcdVolumeStatePrefix),
+		true,
+		func(kv *mvccpb.KeyValue) error {
+			this.setVolumeState(filepath.Base(string(kv.Key)), string(kv.Value))
+			return nil
+		},
+		func(kv *mvccpb.KeyValue) error {
+			this.setVolumeState(filepath.Base(string(kv.Key)), blockservice.StateOpen)
+			return nil
+		},
+		nil,
+		true,
+		clientv3.WithPrefix(),
+	)
+	if err := volumeStateWatcher.Start(); err != nil {
+		glog.Errorf("Unable to watch volume states - %v", err)
 		return err
 	}
+	defer volumeStateWatcher.Stop()
 
 	// Start signal handler routine
 	signalChan := make(chan os.Signal, 8)
@@ -268,46 +402,41 @@ func (this *BFSServer) start() error {
 	// Start health and status routine
 	go func() {
 		for t := range ticker.C {
-			volumeStats := make(map[string]*config.PhysicalVolumeStatus, len(this.BlockServiceConfig.VolumeConfigs))
+			volumeConfigs := this.blockServer.VolumeConfigs()
+			volumeStats := make(map[string]*config.PhysicalVolumeStatus, len(volumeConfigs))
 
-			for _, pvConfig := range this.blockServer.Config.VolumeConfigs {
-				fsStat := syscall.Statfs_t{}
-				err := syscall.Statfs(pvConfig.Path, &fsStat)
-				if err != nil {
-					glog.Errorf("Unable to get filesystem info for %s - %v", pvConfig.Path, err)
-					continue
+			for _, pvConfig := range volumeConfigs {
+				volumeStat := &config.PhysicalVolumeStatus{Id: pvConfig.Id}
+				if pv := this.blockServer.PhysicalVolume(pvConfig.Id); pv != nil {
+					volumeStat = pv.Status()
 				}
 
-				devicePath := make([]rune, 0, 1024)
-				for _, c := range fsStat.Mntfromname {
-					if c == 0x0 {
-						break
+				volumeStat.Path = pvConfig.Path
+
+				// Memory volumes have no filesystem; their status describes their capacity instead, and there's nothing to
+				// describe once they're gone.
+				if pvConfig.Storage == config.VolumeStorage_STORAGE_MEMORY {
+					if volumeStat.FileSystemStatus == nil {
+						continue
 					}
-					devicePath = append(devicePath, rune(c))
-				}
-				mountPath := make([]rune, 0, 1024)
-				for _, c := range fsStat.Mntonname {
-					if c == 0x0 {
-						break
+				} else {
+					fsStatus, err := fileSystemStatus(pvConfig.Path)
+					if err != nil {
+						glog.Errorf("Unable to get filesystem info for %s - %v", pvConfig.Path, err)
+						continue
 					}
-					mountPath = append(mountPath, rune(c))
+
+					volumeStat.FileSystemStatus = fsStatus
 				}
 
-				volumeStat := &config.PhysicalVolumeStatus{
-					Id:   pvConfig.Id,
-					Path: pvConfig.Path,
-					FileSystemStatus: &config.FileSystemStatus{
-						MountPath:       string(mountPath),
-						DevicePath:      string(devicePath),
-						IoSize:          fsStat.Iosize,
-						Files:           fsStat.Files,
-						FilesFree:       fsStat.Ffree,
-						Blocks:          fsStat.Blocks,
-						BlockSize:       fsStat.Bsize,
-						BlocksAvailable: fsStat.Bavail,
-						BlocksFree:      fsStat.Bfree,
-					},
+				if scrubber := this.blockServer.Scrubber(pvConfig.Id); scrubber != nil {
+					volumeStat.CorruptBlockIds = scrubber.CorruptBlockIds()
+
+					if lastCompleted := scrubber.LastCompleted(); !lastCompleted.IsZero() {
+						volumeStat.LastScrubCompleted = lastCompleted.UnixNano()
+					}
 				}
+
 				volumeStats[pvConfig.Id] = volumeStat
 			}
 
@@ -346,6 +475,90 @@ func (this *BFSServer) start() error {
 	return nil
 }
 
+// Register or update the host config, including the block server's current volumes.
+//
+// Volumes are only added and removed by the volume config watcher, which calls this afterwards, so the config isn't
+// changed while it is published.
+func (this *BFSServer) publishHostConfig(etcdClient *clientv3.Client) error {
+	_, err := etcdClient.Put(
+		context.Background(),
+		filepath.Join(client.DefaultEtcdPrefix, client.EtcdHostsPrefix, client.EtcdHostsConfigPrefix, this.HostConfig.Id),
+		proto.MarshalTextString(this.HostConfig),
+	)
+	if err != nil {
+		glog.Errorf("Unable to set or update host config - %v", err)
+	}
+
+	return err
+}
+
+// Apply an operator-set state to a volume. States for volumes on other hosts are ignored.
+func (this *BFSServer) setVolumeState(pvId string, state string) {
+	pv := this.blockServer.PhysicalVolume(pvId)
+	if pv == nil {
+		return
+	}
+
+	if err := pv.SetState(state); err != nil {
+		glog.Errorf("Unable to change state of volume %s to '%s' - %v", pvId, state, err)
+	}
+}
+
+// Describe the filesystem holding a volume on local disk.
+func fileSystemStatus(path string) (*config.FileSystemStatus, error) {
+	fsStat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &fsStat); err != nil {
+		return nil, err
+	}
+
+	devicePath := make([]rune, 0, 1024)
+	for _, c := range fsStat.Mntfromname {
+		if c == 0x0 {
+			break
+		}
+		devicePath = append(devicePath, rune(c))
+	}
+	mountPath := make([]rune, 0, 1024)
+	for _, c := range fsStat.Mntonname {
+		if c == 0x0 {
+			break
+		}
+		mountPath = append(mountPath, rune(c))
+	}
+
+	return &config.FileSystemStatus{
+		MountPath:       string(mountPath),
+		DevicePath:      string(devicePath),
+		IoSize:          fsStat.Iosize,
+		Files:           fsStat.Files,
+		FilesFree:       fsStat.Ffree,
+		Blocks:          fsStat.Blocks,
+		BlockSize:       fsStat.Bsize,
+		BlocksAvailable: fsStat.Bavail,
+		BlocksFree:      fsStat.Bfree,
+	}, nil
+}
+
+func printDecommissionStatus(status *config.DecommissionStatus) {
+	fmt.Printf("%s: %s after %d passes - moved %d blocks (%s), %d failed, %d unreferenced, %d removed, %d on volume"+
+		" (%s elapsed)\n",
+		status.PvId,
+		strings.TrimPrefix(status.State.String(), "DECOMMISSION_"),
+		status.Passes,
+		status.BlocksMoved,
+		size.Bytes(float64(status.BytesMoved)).String(),
+		status.BlocksFailed,
+		status.BlocksUnreferenced,
+		status.BlocksRemoved,
+		status.BlocksOnVolume,
+		time.Unix(0, status.Updated).Sub(time.Unix(0, status.Started)).Truncate(time.Second).String(),
+	)
+
+	if status.LastError != "" {
+		fmt.Printf("%s: last error: %s\n", status.PvId, status.LastError)
+	}
+}
+
 type BFSClient struct {
 	Client *client.Client
 }
@@ -353,10 +566,12 @@ type BFSClient struct {
 func (this *BFSClient) Run() error {
 	var etcdEndpoints string
 	var blockSize int
+	var caller string
 
 	clientFlags := flag.NewFlagSet("client", flag.ContinueOnError)
 	clientFlags.StringVar(&etcdEndpoints, "etcd", "http://localhost:2379", "comma separated list of etcd host:port")
 	clientFlags.IntVar(&blockSize, "block-size", 8, "block size for write (in MB)")
+	clientFlags.StringVar(&caller, "caller", "", "identity given to block servers, which may limit bandwidth per caller")
 	flag.CommandLine.VisitAll(func(f *flag.Flag) {
 		clientFlags.Var(f.Value, f.Name, f.Usage)
 	})
@@ -367,6 +582,14 @@ func (this *BFSClient) Run() error {
 	rmFlags := flag.NewFlagSet("rm", flag.ContinueOnError)
 	rmRecursive := rmFlags.Bool("R", false, "recursively delete files under the given path")
 
+	decommissionFlags := flag.NewFlagSet("decommission", flag.ContinueOnError)
+	decommissionStatus := decommissionFlags.Bool("status", false, "show progress without starting or resuming")
+	decommissionForce := decommissionFlags.Bool("force", false, "remove blocks no file references and retire the volume")
+
+	pvaddFlags := flag.NewFlagSet("pvadd", flag.ContinueOnError)
+	pvaddAutoInit := pvaddFlags.Bool("a", false, "allow auto-initialization of the physical volume")
+	pvaddMemory := pvaddFlags.Bool("memory", false, "keep the physical volume in memory, naming it by path")
+
 	clientFlags.Parse(os.Args[2:])
 
 	flag.Parse()
@@ -377,6 +600,8 @@ func (this *BFSClient) Run() error {
 		return err
 	}
 
+	cli.Caller = caller
+
 	switch clientArgs[0] {
 	case "ls":
 		startKey := ""
@@ -442,6 +667,32 @@ func (this *BFSClient) Run() error {
 		}
 
 		fmt.Printf("Copied %s -> %s (%d bytes)\n", clientArgs[1], clientArgs[2], writeLen)
+	case "append":
+		if len(clientArgs) != 3 {
+			return errors.New("usage: append <source file> <dest file>")
+		}
+
+		reader, err := os.Open(clientArgs[1])
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		writer, err := cli.Append(clientArgs[2])
+		if err != nil {
+			return err
+		}
+
+		writeLen, err := io.Copy(writer, reader)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if err := writer.Close(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Appended %s -> %s (%d bytes)\n", clientArgs[1], clientArgs[2], writeLen)
 	case "get":
 		if len(clientArgs) != 3 {
 			return errors.New("usage: get <source file> <dest file>")
@@ -488,8 +739,13 @@ func (this *BFSClient) Run() error {
 			time.Unix(entry.Mtime.Seconds, entry.Mtime.Nanos).UTC().String(),
 		)
 
+		if ec := entry.ErasureCoding; ec != nil {
+			fmt.Printf("  erasure coding: %d+%d cell-size: %d\n", ec.DataFragments, ec.ParityFragments, ec.CellSize)
+		}
+
 		for i, block := range entry.Blocks {
-			fmt.Printf("  %3d: block: %s pv: %s\n", i, block.BlockId, block.PvId)
+			fmt.Printf("  %3d: block: %s pvs: %s checksum: %08x size: %d stored: %d\n", i, block.BlockId,
+				strings.Join(block.PvIds, ","), block.Checksum, block.Size, block.StoredSize)
 		}
 	case "mv":
 		if len(clientArgs) != 3 {
@@ -633,6 +889,33 @@ func (this *BFSClient) Run() error {
 					volumeStats.FileSystemStatus.DevicePath,
 					volumeStats.FileSystemStatus.MountPath,
 				)
+
+				if volumeStats.State != "" && volumeStats.State != blockservice.StateOpen {
+					fmt.Printf("%18s  state: %s\n", "", volumeStats.State)
+				}
+
+				if io := volumeStats.Io; io != nil {
+					fmt.Printf("%18s  read: %.2fMB in %d (%d errors) p50/p99: %s/%s active: %d throttled: %s\n", "",
+						size.Bytes(float64(io.BytesRead)).ToMegabytes(), io.Reads, io.ReadErrors,
+						time.Duration(io.ReadLatencyP50)*time.Microsecond,
+						time.Duration(io.ReadLatencyP99)*time.Microsecond, io.ActiveReads,
+						time.Duration(io.ReadThrottledMicros)*time.Microsecond)
+					fmt.Printf("%18s  write: %.2fMB in %d (%d errors) p50/p99: %s/%s active: %d throttled: %s\n", "",
+						size.Bytes(float64(io.BytesWritten)).ToMegabytes(), io.Writes, io.WriteErrors,
+						time.Duration(io.WriteLatencyP50)*time.Microsecond,
+						time.Duration(io.WriteLatencyP99)*time.Microsecond, io.ActiveWrites,
+						time.Duration(io.WriteThrottledMicros)*time.Microsecond)
+					fmt.Printf("%18s  deletes: %d (%d errors)\n", "", io.Deletes, io.DeleteErrors)
+				}
+
+				if volumeStats.LastScrubCompleted != 0 {
+					fmt.Printf("%18s  last scrub: %s corrupt blocks: %d\n", "",
+						time.Unix(0, volumeStats.LastScrubCompleted).String(), len(volumeStats.CorruptBlockIds))
+				}
+
+				for _, blockId := range volumeStats.CorruptBlockIds {
+					fmt.Printf("%18s  corrupt: %s\n", "", blockId)
+				}
 			}
 
 			fmt.Printf("%15s:\n", "labels")
@@ -641,6 +924,131 @@ func (this *BFSClient) Run() error {
 			}
 			fmt.Println()
 		}
+	case "pvstate":
+		if len(clientArgs) != 3 {
+			return fmt.Errorf("usage: pvstate <pv> <%s>", strings.Join(blockservice.OperatorStates, " | "))
+		}
+
+		if err := cli.SetPhysicalVolumeState(clientArgs[1], clientArgs[2]); err != nil {
+			return err
+		}
+
+		fmt.Printf("Set volume %s to %s\n", clientArgs[1], clientArgs[2])
+	case "pvadd":
+		if err := pvaddFlags.Parse(clientArgs[1:]); err != nil {
+			return err
+		}
+
+		clientArgs = pvaddFlags.Args()
+		if len(clientArgs) < 2 || len(clientArgs) > 3 {
+			return errors.New("usage: pvadd [-a] [-memory] <host> <path> [label=value,...]")
+		}
+
+		labels := make(map[string]string)
+		if len(clientArgs) > 2 {
+			for _, labelStr := range strings.Split(clientArgs[2], ",") {
+				labelComponents := strings.SplitN(labelStr, "=", 2)
+				if len(labelComponents) != 2 {
+					return fmt.Errorf("invalid label '%s' - must be label=value", labelStr)
+				}
+
+				labels[labelComponents[0]] = labelComponents[1]
+			}
+		}
+
+		pvConfig := &config.PhysicalVolumeConfig{
+			Path:                clientArgs[1],
+			AllowAutoInitialize: *pvaddAutoInit,
+			Labels:              labels,
+		}
+
+		if *pvaddMemory {
+			pvConfig.Storage = config.VolumeStorage_STORAGE_MEMORY
+		}
+
+		if err := cli.AddPhysicalVolume(clientArgs[0], pvConfig); err != nil {
+			return err
+		}
+
+		fmt.Printf("Added volume %s to %s\n", clientArgs[1], clientArgs[0])
+	case "pvremove":
+		if len(clientArgs) != 3 {
+			return errors.New("usage: pvremove <host> <path>")
+		}
+
+		removed, err := cli.RemovePhysicalVolume(clientArgs[1], clientArgs[2])
+		if err != nil {
+			return err
+		}
+
+		if !removed {
+			return fmt.Errorf("no volume %s was added to %s", clientArgs[2], clientArgs[1])
+		}
+
+		fmt.Printf("Removed volume %s from %s\n", clientArgs[2], clientArgs[1])
+	case "decommission":
+		if err := decommissionFlags.Parse(clientArgs[1:]); err != nil {
+			return err
+		}
+
+		clientArgs = decommissionFlags.Args()
+		if len(clientArgs) != 1 {
+			return errors.New("usage: decommission [-status] [-force] <pv>")
+		}
+
+		if *decommissionStatus {
+			status, err := cli.DecommissionStatus(clientArgs[0])
+			if err != nil {
+				return err
+			}
+
+			if status == nil {
+				fmt.Printf("Volume %s has not been decommissioned\n", clientArgs[0])
+			} else {
+				printDecommissionStatus(status)
+			}
+
+			break
+		}
+
+		if err := cli.Decommission(clientArgs[0], *decommissionForce, printDecommissionStatus); err != nil {
+			return err
+		}
+
+		fmt.Printf("Decommissioned volume %s\n", clientArgs[0])
+	case "blocks":
+		if len(clientArgs) != 2 {
+			return errors.New("usage: blocks <pv>")
+		}
+
+		blockCount := 0
+		var totalSize uint64
+
+		for listEntry := range cli.ListBlocks(clientArgs[1]) {
+			if listEntry.Err != nil {
+				return listEntry.Err
+			}
+
+			blockInfo := listEntry.Block
+			blockCount++
+			totalSize += blockInfo.Size
+
+			fmt.Printf("%s %d %s\n", blockInfo.BlockId, blockInfo.Size, time.Unix(0, blockInfo.Mtime).UTC().String())
+		}
+
+		fmt.Printf("%d blocks, %s\n", blockCount, size.Bytes(float64(totalSize)).String())
+	case "blockstat":
+		if len(clientArgs) != 3 {
+			return errors.New("usage: blockstat <pv> <block>")
+		}
+
+		blockInfo, err := cli.StatBlock(clientArgs[1], clientArgs[2])
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s (pv: %s size: %d modified: %s)\n", blockInfo.BlockId, blockInfo.VolumeId, blockInfo.Size,
+			time.Unix(0, blockInfo.Mtime).UTC().String())
 	default:
 		return fmt.Errorf("unknown command %s", clientArgs[0])
 	}
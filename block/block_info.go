@@ -0,0 +1,111 @@
+package block
+
+import (
+	"github.com/pborman/uuid"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// The number of directory entries read at a time when listing blocks.
+	listBatchSize = 1024
+
+	// The length of a block ID in its canonical UUID form.
+	blockIdLength = 36
+)
+
+// Summary information about a committed block.
+type BlockInfo struct {
+	BlockId string
+	Size    uint64
+	ModTime time.Time
+}
+
+// Describe the given block.
+//
+// Errors satisfying os.IsNotExist() are returned as-is for blocks that do not exist.
+func Stat(rootPath string, blockId string) (*BlockInfo, error) {
+	info, err := os.Stat(filepath.Join(rootPath, blockId))
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockInfo{BlockId: blockId, Size: uint64(info.Size()), ModTime: info.ModTime()}, nil
+}
+
+// Visit every committed block under rootPath, in no particular order.
+//
+// Only files named by a block UUID are visited; temp files, checksum and reference sidecars, and other files are
+// skipped. Listing stops early if visitor returns false or an error, and the error is returned.
+func List(rootPath string, visitor func(info *BlockInfo) (bool, error)) error {
+	dir, err := os.Open(rootPath)
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+
+	for {
+		infos, err := dir.Readdir(listBatchSize)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			if !info.Mode().IsRegular() || uuid.Parse(info.Name()) == nil {
+				continue
+			}
+
+			blockInfo := &BlockInfo{BlockId: info.Name(), Size: uint64(info.Size()), ModTime: info.ModTime()}
+
+			if ok, err := visitor(blockInfo); err != nil {
+				return err
+			} else if !ok {
+				return nil
+			}
+		}
+	}
+}
+
+// Determine whether a file name is that of a block, checksum, or reference count temp file.
+//
+// Writers create temp files named .<blockId>-<random> and .<blockId>.crc-<random> and rename them into place when a
+// block is committed, and reference counts are replaced through .<blockId>.refs-<random>. Any that remain belong to
+// writes that never completed.
+func IsTempFile(name string) bool {
+	if !strings.HasPrefix(name, ".") || len(name) <= 1+blockIdLength {
+		return false
+	}
+
+	blockId := name[1 : 1+blockIdLength]
+	suffix := name[1+blockIdLength:]
+
+	if uuid.Parse(blockId) == nil {
+		return false
+	}
+
+	return strings.HasPrefix(suffix, "-") || strings.HasPrefix(suffix, ChecksumSuffix+"-") ||
+		strings.HasPrefix(suffix, RefsSuffix+"-")
+}
+
+// Returns the ID of the block a committed checksum or reference count sidecar belongs to, or false if name is not that
+// of a committed sidecar.
+func SidecarBlockId(name string) (string, bool) {
+	for _, suffix := range []string{ChecksumSuffix, RefsSuffix} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		blockId := strings.TrimSuffix(name, suffix)
+		if blockUUID := uuid.Parse(blockId); blockUUID != nil && blockUUID.String() == blockId {
+			return blockId, true
+		}
+	}
+
+	return "", false
+}
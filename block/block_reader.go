@@ -1,9 +1,12 @@
 package block
 
 import (
+	"bfs/util/bufpool"
 	"bfs/util/fsm"
 	"bfs/util/logging"
+	"fmt"
 	"github.com/golang/glog"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
@@ -26,44 +29,343 @@ type LocalBlockReader struct {
 	BlockId string
 	Reader  *os.File
 
+	// Range state. If limited is false, the reader continues to the end of the block.
+	remaining uint64
+	limited   bool
+
+	// Checksum state. The sidecar is nil for blocks written without checksums.
+	sidecar  *checksumSidecar
+	chunk    []byte
+	chunkBuf *bufpool.Buffer
+	chunkPos int
+	chunkIdx int
+
+	// Decoding state for blocks stored with a codec or encrypted.
+	codec   Codec
+	cipher  *chunkCipher
+	encoded []byte
+	opened  []byte
+
 	fsm *fsm.FSMInstance
 }
 
 func NewReader(rootPath string, blockId string) (*LocalBlockReader, error) {
+	return NewRangeReader(rootPath, blockId, 0, 0)
+}
+
+// Open a reader over a range of a block.
+//
+// The reader starts at the given byte position within the block and returns at most length bytes. A length of zero
+// reads to the end of the block. Positions past the end of the block produce a reader that immediately returns io.EOF.
+func NewRangeReader(rootPath string, blockId string, position uint64, length uint64) (*LocalBlockReader, error) {
+	return NewRangeReaderWithKeys(rootPath, blockId, position, length, nil)
+}
+
+// Open a reader over a range of a block that may be encrypted.
+//
+// Encrypted blocks are decrypted with the key from keys named by the block's header. Unencrypted blocks are read as
+// usual, and keys may be nil if no blocks are encrypted.
+func NewRangeReaderWithKeys(rootPath string, blockId string, position uint64, length uint64,
+	keys *KeyRing) (*LocalBlockReader, error) {
+
 	path := filepath.Join(rootPath, blockId)
 
-	glog.V(logging.LogLevelDebug).Infof("Open block %v @ %v for read", blockId, path)
+	glog.V(logging.LogLevelDebug).Infof("Open block %v @ %v for read - position: %d length: %d", blockId, path,
+		position, length)
 
 	fsmInst := readerWriterFSM.NewInstance()
 
 	if reader, err := os.Open(path); err == nil {
+		sidecar, err := readChecksumSidecar(rootPath, blockId)
+		if os.IsNotExist(err) {
+			glog.Warningf("Block %v has no checksums - reads will not be verified", blockId)
+		} else if err != nil {
+			reader.Close()
+			return nil, fsmInst.ToWithErr(StateError, err)
+		}
+
 		if err := fsmInst.To(StateOpen); err != nil {
+			reader.Close()
 			return nil, err
 		}
 
-		return &LocalBlockReader{
-			BlockId: blockId,
-			Reader:  reader,
-			fsm:     fsmInst,
-		}, nil
+		this := &LocalBlockReader{
+			BlockId:   blockId,
+			Reader:    reader,
+			remaining: length,
+			limited:   length > 0,
+			sidecar:   sidecar,
+			fsm:       fsmInst,
+		}
+
+		if sidecar != nil {
+			this.chunkBuf = bufpool.Get(sidecar.ChunkSize)
+			this.chunk = this.chunkBuf.Bytes[:0]
+
+			if this.codec, err = LookupCodec(sidecar.Codec); err != nil {
+				reader.Close()
+				return nil, this.fsm.ToWithErr(StateError, err)
+			}
+
+			if sidecar.Encrypted {
+				if this.cipher, err = openEncryptedBlock(reader, blockId, keys); err != nil {
+					reader.Close()
+					return nil, this.fsm.ToWithErr(StateError, err)
+				}
+
+				// Chunk offsets and checksums are only trusted once the sidecar is authenticated.
+				if _, err := this.cipher.openChecksum(sidecar); err != nil {
+					reader.Close()
+					return nil, this.fsm.ToWithErr(StateError, err)
+				}
+			}
+		}
+
+		if position > 0 {
+			if err := this.seek(position); err != nil {
+				reader.Close()
+				return nil, this.fsm.ToWithErr(StateError, err)
+			}
+		}
+
+		return this, nil
 	} else {
 		return nil, fsmInst.ToWithErr(StateError, err)
 	}
 }
 
 func (this *LocalBlockReader) Read(buffer []byte) (int, error) {
-	glog.V(logging.LogLevelTrace).Infof("Reading up to %v bytes from block %v", len(buffer), this.BlockId)
+	if glog.V(logging.LogLevelTrace) {
+		glog.Infof("Reading up to %v bytes from block %v", len(buffer), this.BlockId)
+	}
 
 	if err := this.fsm.Is(StateOpen); err != nil {
 		return 0, err
 	}
 
-	readLen, err := this.Reader.Read(buffer)
+	if this.limited {
+		if this.remaining == 0 {
+			return 0, io.EOF
+		}
+
+		if uint64(len(buffer)) > this.remaining {
+			buffer = buffer[:this.remaining]
+		}
+	}
+
+	var readLen int
+
+	if this.sidecar == nil {
+		var err error
+
+		readLen, err = this.Reader.Read(buffer)
+		if err != nil {
+			return 0, this.fsm.ToWithErr(StateError, err)
+		}
+	} else {
+		if this.chunkPos == len(this.chunk) {
+			if err := this.nextChunk(); err == io.EOF {
+				return 0, err
+			} else if err != nil {
+				return 0, this.fsm.ToWithErr(StateError, err)
+			}
+		}
+
+		readLen = copy(buffer, this.chunk[this.chunkPos:])
+		this.chunkPos += readLen
+	}
+
+	if this.limited {
+		this.remaining -= uint64(readLen)
+	}
+
+	return readLen, nil
+}
+
+// Position the reader at the given byte offset within the block.
+//
+// When checksums are present, the reader is positioned at the start of the chunk containing the offset and the chunk
+// is verified before any of it is returned.
+func (this *LocalBlockReader) seek(position uint64) error {
+	if this.sidecar == nil {
+		_, err := this.Reader.Seek(int64(position), io.SeekStart)
+		return err
+	}
+
+	if int64(position) > this.sidecar.Size {
+		position = uint64(this.sidecar.Size)
+	}
+
+	chunkSize := uint64(this.sidecar.ChunkSize)
+	chunkIdx := position / chunkSize
+
+	// Encoded chunks vary in size, so their offsets come from the sidecar.
+	offset := int64(chunkIdx * chunkSize)
+	if this.decoding() {
+		if chunkIdx < uint64(len(this.sidecar.Offsets)) {
+			offset = this.sidecar.Offsets[chunkIdx]
+		} else {
+			offset = this.sidecar.StoredSize
+		}
+	}
+
+	if _, err := this.Reader.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	this.chunkIdx = int(chunkIdx)
+
+	if offset := int(position - chunkIdx*chunkSize); offset > 0 {
+		if err := this.nextChunk(); err != nil {
+			return err
+		}
+
+		if offset > len(this.chunk) {
+			offset = len(this.chunk)
+		}
+
+		this.chunkPos = offset
+	}
+
+	return nil
+}
+
+// Read and verify the next chunk of the block.
+//
+// Data is only made available to callers once the entire chunk containing it has been verified against the
+// checksum sidecar. Returns io.EOF if the block is exhausted, or a *CorruptBlockError if verification fails.
+func (this *LocalBlockReader) nextChunk() error {
+	var chunkLen int
+	var err error
+
+	if this.decoding() {
+		chunkLen, err = this.readEncodedChunk()
+	} else {
+		chunkLen, err = io.ReadFull(this.Reader, this.chunk[:cap(this.chunk)])
+	}
+
+	if err == io.EOF {
+		if this.chunkIdx != len(this.sidecar.Chunks) {
+			// The block is shorter than the data the checksums were computed over.
+			return &CorruptBlockError{BlockId: this.BlockId, Chunk: this.chunkIdx, Expected: this.sidecar.Chunks[this.chunkIdx]}
+		}
+
+		return io.EOF
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	// Encrypted chunks are verified as stored, before they are opened.
+	if this.cipher == nil {
+		actual := crc32.Checksum(this.chunk[:chunkLen], crcTable)
+
+		if this.chunkIdx >= len(this.sidecar.Chunks) {
+			// The block is longer than the data the checksums were computed over.
+			return &CorruptBlockError{BlockId: this.BlockId, Chunk: this.chunkIdx, Actual: actual}
+		}
+
+		if expected := this.sidecar.Chunks[this.chunkIdx]; expected != actual {
+			return &CorruptBlockError{BlockId: this.BlockId, Chunk: this.chunkIdx, Expected: expected, Actual: actual}
+		}
+	}
+
+	this.chunk = this.chunk[:chunkLen]
+	this.chunkPos = 0
+	this.chunkIdx++
+
+	return nil
+}
+
+// Determine whether the block is stored in encoded chunks, rather than as written.
+func (this *LocalBlockReader) decoding() bool {
+	return this.codec != nil || this.cipher != nil
+}
+
+// Read and decode the next chunk of an encoded block into the chunk buffer, returning its decoded length.
+//
+// Chunks that can not be read in full or decoded are reported as a *CorruptBlockError.
+func (this *LocalBlockReader) readEncodedChunk() (int, error) {
+	if this.chunkIdx >= len(this.sidecar.Offsets) {
+		return 0, io.EOF
+	}
+
+	end := this.sidecar.StoredSize
+	if this.chunkIdx+1 < len(this.sidecar.Offsets) {
+		end = this.sidecar.Offsets[this.chunkIdx+1]
+	}
+
+	corruptErr := &CorruptBlockError{BlockId: this.BlockId, Chunk: this.chunkIdx, Expected: this.sidecar.Chunks[this.chunkIdx]}
+
+	encodedLen := end - this.sidecar.Offsets[this.chunkIdx]
+	if encodedLen < 0 {
+		return 0, corruptErr
+	}
+
+	if int64(cap(this.encoded)) < encodedLen {
+		this.encoded = make([]byte, encodedLen)
+	}
+
+	this.encoded = this.encoded[:encodedLen]
+
+	if _, err := io.ReadFull(this.Reader, this.encoded); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, corruptErr
+	} else if err != nil {
+		return 0, err
+	}
+
+	data := this.encoded
+
+	if this.cipher != nil {
+		if actual := crc32.Checksum(data, crcTable); actual != corruptErr.Expected {
+			corruptErr.Actual = actual
+			return 0, corruptErr
+		}
+
+		last := this.chunkIdx == len(this.sidecar.Chunks)-1
+
+		opened, err := this.cipher.open(this.opened[:0], data, this.chunkIdx, last)
+		if err != nil {
+			glog.Errorf("Unable to decrypt chunk %d of block %s - %v", this.chunkIdx, this.BlockId, err)
+			return 0, corruptErr
+		}
+
+		this.opened = opened
+		data = opened
+	}
+
+	if this.codec == nil {
+		this.chunk = append(this.chunk[:0], data...)
+		return len(this.chunk), nil
+	}
+
+	chunk, err := this.codec.Decode(this.chunk[:0], data)
+	if err != nil {
+		glog.Errorf("Unable to decode chunk %d of block %s - %v", this.chunkIdx, this.BlockId, err)
+		return 0, corruptErr
+	}
+
+	this.chunk = chunk
+
+	return len(chunk), nil
+}
+
+// Read the header of an encrypted block and prepare to decrypt its chunks with the key it names.
+func openEncryptedBlock(reader io.Reader, blockId string, keys *KeyRing) (*chunkCipher, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("block %s is encrypted but no keys are available", blockId)
+	}
+
+	header, err := readEncryptionHeader(reader)
 	if err != nil {
-		return 0, this.fsm.ToWithErr(StateError, err)
+		return nil, fmt.Errorf("unable to read encryption header of block %s - %v", blockId, err)
 	}
 
-	return readLen, err
+	key, err := keys.Key(header.keyId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt block %s - %v", blockId, err)
+	}
+
+	return newChunkCipher(key, header, blockId), nil
 }
 
 func (this *LocalBlockReader) Close() error {
@@ -73,6 +375,11 @@ func (this *LocalBlockReader) Close() error {
 		return err
 	}
 
+	// The chunk buffer is returned even if the file can't be closed, as the reader can't be used again either way.
+	this.chunk = nil
+	bufpool.Put(this.chunkBuf)
+	this.chunkBuf = nil
+
 	if err := this.Reader.Close(); err != nil {
 		return this.fsm.ToWithErr(StateError, err)
 	}
@@ -2,8 +2,10 @@ package block
 
 import (
 	"bfs/test"
+	"bytes"
 	"github.com/golang/glog"
 	"github.com/stretchr/testify/require"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -40,3 +42,89 @@ func TestLocalBlockReader(t *testing.T) {
 
 	require.NoError(t, reader.Close())
 }
+
+func TestLocalBlockReader_Corruption(t *testing.T) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	writer, err := NewWriter(testDir.Path, "1")
+	require.NoError(t, err)
+
+	_, err = writer.Write(bytes.Repeat([]byte{1}, ChecksumChunkSize*2))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	// Flip a byte in the second chunk.
+	f, err := os.OpenFile(filepath.Join(testDir.Path, "1"), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{2}, ChecksumChunkSize+1)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	reader, err := NewReader(testDir.Path, "1")
+	require.NoError(t, err)
+
+	buffer := make([]byte, ChecksumChunkSize)
+	readLen, err := io.ReadFull(reader, buffer)
+	require.NoError(t, err)
+	require.Equal(t, ChecksumChunkSize, readLen)
+
+	_, err = reader.Read(buffer)
+	require.Error(t, err)
+	require.IsType(t, &CorruptBlockError{}, err)
+	require.Equal(t, 1, err.(*CorruptBlockError).Chunk)
+
+	require.NoError(t, reader.Close())
+}
+
+func TestLocalBlockReader_Range(t *testing.T) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	data := make([]byte, ChecksumChunkSize*3+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	writer, err := NewWriter(testDir.Path, "1")
+	require.NoError(t, err)
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	testCases := []struct {
+		name     string
+		position uint64
+		length   uint64
+		expected []byte
+	}{
+		{"whole-block", 0, 0, data},
+		{"mid-chunk", 100, 0, data[100:]},
+		{"mid-chunk-with-length", ChecksumChunkSize + 7, 10, data[ChecksumChunkSize+7 : ChecksumChunkSize+17]},
+		{"across-chunks", ChecksumChunkSize - 5, ChecksumChunkSize + 10, data[ChecksumChunkSize-5 : ChecksumChunkSize*2+5]},
+		{"chunk-boundary", ChecksumChunkSize * 2, 0, data[ChecksumChunkSize*2:]},
+		{"last-partial-chunk", ChecksumChunkSize*3 + 50, 0, data[ChecksumChunkSize*3+50:]},
+		{"length-past-end", ChecksumChunkSize * 3, ChecksumChunkSize, data[ChecksumChunkSize*3:]},
+		{"position-past-end", uint64(len(data)) + 1, 0, []byte{}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			reader, err := NewRangeReader(testDir.Path, "1", testCase.position, testCase.length)
+			require.NoError(t, err)
+
+			var buffer bytes.Buffer
+			_, err = io.Copy(&buffer, reader)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expected, buffer.Bytes())
+
+			require.NoError(t, reader.Close())
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package block
 
 import (
+	"bfs/util/bufpool"
 	"bfs/util/fsm"
 	"bfs/util/logging"
 	"fmt"
 	"github.com/golang/glog"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
@@ -18,18 +20,65 @@ import (
 type BlockWriter interface {
 	io.Writer
 	io.Closer
+
+	// Returns the CRC32C of all data written to the block.
+	Checksum() uint32
+
+	// Returns the number of bytes stored for the block, after encoding.
+	StoredSize() uint64
+
+	// Abandon the block, removing the data written so far.
+	Abort() error
 }
 
 /*
  * LocalBlockWriter
  */
 
+// How much of a block is flushed to stable storage before Close() returns.
+type SyncMode int
+
+const (
+	// Leave flushing to the operating system.
+	SyncNone SyncMode = iota
+	// Fsync the block and checksum files before they are renamed into place.
+	SyncFile
+	// Fsync the block and checksum files, then fsync the directory after they are renamed into place.
+	SyncFileAndDir
+)
+
 type LocalBlockWriter struct {
 	BlockId  string
 	RootPath string
 	Size     int
 	writer   *os.File
 
+	// The durability required of Close(). Set before Close() is called.
+	Sync SyncMode
+
+	// The codec used to encode block data, or nil to store it as written. Set before the first Write().
+	Codec Codec
+
+	// The key used to encrypt block data, after encoding, or nil to store it unencrypted. Set before the first Write().
+	Key *Key
+
+	// Checksum state.
+	checksum       uint32
+	chunkChecksums []uint32
+	chunkChecksum  uint32
+	chunkLen       int
+
+	// Encoding state. Data is buffered until a full chunk can be encoded and encrypted, and encrypted blocks record the
+	// checksums of their sealed chunks.
+	pending         []byte
+	pendingBuf      *bufpool.Buffer
+	encoded         []byte
+	sealed          []byte
+	cipher          *chunkCipher
+	offsets         []int64
+	sealedChecksums []uint32
+	storedSize      int64
+
 	fsm *fsm.FSMInstance
 }
 
@@ -46,10 +95,11 @@ func NewWriter(rootPath string, blockId string) (*LocalBlockWriter, error) {
 		}
 
 		return &LocalBlockWriter{
-			BlockId:  blockId,
-			RootPath: rootPath,
-			writer:   writer,
-			fsm:      fsmInst,
+			BlockId:        blockId,
+			RootPath:       rootPath,
+			writer:         writer,
+			chunkChecksums: make([]uint32, 0, 16),
+			fsm:            fsmInst,
 		}, nil
 	} else {
 		return nil, fsmInst.ToWithErr(StateError, err)
@@ -63,42 +113,235 @@ func (this *LocalBlockWriter) WriteString(text string) (int, error) {
 		return 0, err
 	}
 
-	size, err := io.WriteString(this.writer, text)
-	if err != nil {
-		return size, this.fsm.ToWithErr(StateError, err)
-	}
-
-	this.Size += size
-
-	return size, nil
+	return this.write([]byte(text))
 }
 
 func (this *LocalBlockWriter) Write(buffer []byte) (int, error) {
-	glog.V(logging.LogLevelTrace).Infof("Write %d bytes to block %v", len(buffer), this.BlockId)
+	if glog.V(logging.LogLevelTrace) {
+		glog.Infof("Write %d bytes to block %v", len(buffer), this.BlockId)
+	}
 
 	if err := this.fsm.Is(StateOpen); err != nil {
 		return 0, err
 	}
 
+	return this.write(buffer)
+}
+
+func (this *LocalBlockWriter) write(buffer []byte) (int, error) {
+	if this.encoding() {
+		return this.writeEncoded(buffer)
+	}
+
 	size, err := this.writer.Write(buffer)
+
+	this.updateChecksums(buffer[:size])
+	this.Size += size
+
 	if err != nil {
 		return size, this.fsm.ToWithErr(StateError, err)
 	}
 
-	this.Size += size
-
 	return size, nil
 }
 
+// Determine whether data is transformed in chunks before it is stored, rather than written as-is.
+func (this *LocalBlockWriter) encoding() bool {
+	return this.Codec != nil || this.Key != nil
+}
+
+// Buffer data for encoding, encoding and writing each chunk as it fills.
+func (this *LocalBlockWriter) writeEncoded(buffer []byte) (int, error) {
+	if this.pendingBuf == nil {
+		this.pendingBuf = bufpool.Get(ChecksumChunkSize)
+		this.pending = this.pendingBuf.Bytes[:0]
+	}
+
+	totalWritten := 0
+
+	for len(buffer) > 0 {
+		// Full chunks are flushed once more data arrives, so the last chunk is known to be the last when it is sealed.
+		if len(this.pending) == ChecksumChunkSize {
+			if err := this.flushEncoded(false); err != nil {
+				return totalWritten, this.fsm.ToWithErr(StateError, err)
+			}
+		}
+
+		writeLen := ChecksumChunkSize - len(this.pending)
+		if writeLen > len(buffer) {
+			writeLen = len(buffer)
+		}
+
+		this.pending = append(this.pending, buffer[:writeLen]...)
+		this.updateChecksums(buffer[:writeLen])
+		this.Size += writeLen
+		totalWritten += writeLen
+		buffer = buffer[writeLen:]
+	}
+
+	return totalWritten, nil
+}
+
+// Encode, encrypt, and write the pending chunk, recording where it starts in the block file.
+func (this *LocalBlockWriter) flushEncoded(last bool) error {
+	if this.Key != nil && this.cipher == nil {
+		if err := this.writeEncryptionHeader(); err != nil {
+			return err
+		}
+	}
+
+	encoded := this.pending
+
+	if this.Codec != nil {
+		var err error
+		if this.encoded, err = this.Codec.Encode(this.encoded[:0], this.pending); err != nil {
+			return err
+		}
+
+		encoded = this.encoded
+	}
+
+	if this.cipher != nil {
+		this.sealed = this.cipher.seal(this.sealed[:0], encoded, len(this.offsets), last)
+		this.sealedChecksums = append(this.sealedChecksums, crc32.Checksum(this.sealed, crcTable))
+		encoded = this.sealed
+	}
+
+	this.offsets = append(this.offsets, this.storedSize)
+	this.pending = this.pending[:0]
+
+	writeLen, err := this.writer.Write(encoded)
+	this.storedSize += int64(writeLen)
+
+	return err
+}
+
+// Start an encrypted block with a header identifying its key and nonce prefix.
+func (this *LocalBlockWriter) writeEncryptionHeader() error {
+	header, err := newEncryptionHeader(this.Key.Id)
+	if err != nil {
+		return err
+	}
+
+	writeLen, err := this.writer.Write(header.marshal())
+	this.storedSize += int64(writeLen)
+
+	if err != nil {
+		return err
+	}
+
+	this.cipher = newChunkCipher(this.Key, header, this.BlockId)
+
+	return nil
+}
+
+// Fold newly written data into the block and chunk checksums.
+func (this *LocalBlockWriter) updateChecksums(buffer []byte) {
+	this.checksum = crc32.Update(this.checksum, crcTable, buffer)
+
+	for len(buffer) > 0 {
+		chunkRemaining := ChecksumChunkSize - this.chunkLen
+		if chunkRemaining > len(buffer) {
+			chunkRemaining = len(buffer)
+		}
+
+		this.chunkChecksum = crc32.Update(this.chunkChecksum, crcTable, buffer[:chunkRemaining])
+		this.chunkLen += chunkRemaining
+		buffer = buffer[chunkRemaining:]
+
+		if this.chunkLen == ChecksumChunkSize {
+			this.chunkChecksums = append(this.chunkChecksums, this.chunkChecksum)
+			this.chunkChecksum = 0
+			this.chunkLen = 0
+		}
+	}
+}
+
+func (this *LocalBlockWriter) Checksum() uint32 {
+	return this.checksum
+}
+
+func (this *LocalBlockWriter) StoredSize() uint64 {
+	if !this.encoding() {
+		return uint64(this.Size)
+	}
+
+	return uint64(this.storedSize)
+}
+
 func (this *LocalBlockWriter) Close() error {
 	if err := this.fsm.IsOneOf(StateOpen, StateError); err != nil {
 		return err
 	}
 
+	if this.encoding() && len(this.pending) > 0 {
+		if err := this.flushEncoded(true); err != nil {
+			this.writer.Close()
+			return this.fsm.ToWithErr(StateError, err)
+		}
+	}
+
+	this.releasePending()
+
+	// Empty blocks still get a header so they are recognizably encrypted.
+	if this.Key != nil && this.cipher == nil {
+		if err := this.writeEncryptionHeader(); err != nil {
+			this.writer.Close()
+			return this.fsm.ToWithErr(StateError, err)
+		}
+	}
+
+	if this.Sync >= SyncFile {
+		if err := this.writer.Sync(); err != nil {
+			this.writer.Close()
+			return this.fsm.ToWithErr(StateError, err)
+		}
+	}
+
 	if err := this.writer.Close(); err != nil {
 		return this.fsm.ToWithErr(StateError, err)
 	}
 
+	if this.chunkLen > 0 {
+		this.chunkChecksums = append(this.chunkChecksums, this.chunkChecksum)
+		this.chunkChecksum = 0
+		this.chunkLen = 0
+	}
+
+	sidecar := &checksumSidecar{
+		ChunkSize: ChecksumChunkSize,
+		Size:      int64(this.Size),
+		Checksum:  this.checksum,
+		Chunks:    this.chunkChecksums,
+	}
+
+	if this.encoding() {
+		if this.Codec != nil {
+			sidecar.Codec = this.Codec.Name()
+		}
+
+		sidecar.Encrypted = this.Key != nil
+		sidecar.StoredSize = this.storedSize
+		sidecar.Offsets = this.offsets
+	}
+
+	// Encrypted blocks record the checksums of their sealed chunks, and only a sealed checksum of their data.
+	if this.cipher != nil {
+		sidecar.Checksum = 0
+		sidecar.Chunks = this.sealedChecksums
+		sidecar.Seal = this.cipher.sealChecksum(sidecar, this.checksum)
+	}
+
+	sidecarPath, err := writeChecksumSidecar(this.RootPath, this.BlockId, sidecar, this.Sync >= SyncFile)
+	if err != nil {
+		return this.fsm.ToWithErr(StateError, err)
+	}
+
+	// The sidecar is moved into place first so a committed block always has checksums.
+	if err := os.Rename(sidecarPath, checksumPath(this.RootPath, this.BlockId)); err != nil {
+		return this.fsm.ToWithErr(StateError, err)
+	}
+
 	path := filepath.Join(this.RootPath, this.BlockId)
 
 	glog.V(logging.LogLevelDebug).Infof("Committing block %v - move %v -> %v", this.BlockId, this.writer.Name(), path)
@@ -107,7 +350,53 @@ func (this *LocalBlockWriter) Close() error {
 		return this.fsm.ToWithErr(StateError, err)
 	}
 
+	// Both renames are only durable once the directory itself is flushed.
+	if this.Sync >= SyncFileAndDir {
+		if err := syncDir(this.RootPath); err != nil {
+			return this.fsm.ToWithErr(StateError, err)
+		}
+	}
+
 	glog.V(logging.LogLevelTrace).Infof("Block %v committed", this.BlockId)
 
-	return nil
+	return this.fsm.To(StateClosed)
+}
+
+func (this *LocalBlockWriter) Abort() error {
+	if err := this.fsm.IsOneOf(StateOpen, StateError); err != nil {
+		return err
+	}
+
+	glog.V(logging.LogLevelDebug).Infof("Aborting block %v - removing %v", this.BlockId, this.writer.Name())
+
+	// The file may already be closed if a failed Close() got that far.
+	this.writer.Close()
+	this.releasePending()
+
+	if err := os.Remove(this.writer.Name()); err != nil && !os.IsNotExist(err) {
+		return this.fsm.ToWithErr(StateError, err)
+	}
+
+	return this.fsm.To(StateClosed)
+}
+
+// Return the pending chunk buffer to its pool once no more data will be written.
+func (this *LocalBlockWriter) releasePending() {
+	this.pending = nil
+	bufpool.Put(this.pendingBuf)
+	this.pendingBuf = nil
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+
+	return dir.Close()
 }
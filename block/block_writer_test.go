@@ -2,8 +2,13 @@ package block
 
 import (
 	"bfs/test"
+	"bfs/util/size"
+	"fmt"
 	"github.com/golang/glog"
+	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -28,4 +33,177 @@ func TestLocalBlockWriter(t *testing.T) {
 	info, err := os.Stat(filepath.Join(testDir.Path, "1"))
 	require.NoError(t, err)
 	require.True(t, info.Mode().IsRegular())
+
+	require.Equal(t, crc32.Checksum([]byte("Hello world"), crcTable), writer.Checksum())
+
+	sidecar, err := readChecksumSidecar(testDir.Path, "1")
+	require.NoError(t, err)
+	require.Equal(t, int64(11), sidecar.Size)
+	require.Equal(t, writer.Checksum(), sidecar.Checksum)
+	require.Len(t, sidecar.Chunks, 1)
+}
+
+func TestLocalBlockWriter_Sync(t *testing.T) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	for _, sync := range []SyncMode{SyncNone, SyncFile, SyncFileAndDir} {
+		blockId := uuid.NewRandom().String()
+
+		writer, err := NewWriter(testDir.Path, blockId)
+		require.NoError(t, err)
+		writer.Sync = sync
+
+		_, err = writer.Write([]byte("Hello world"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		sidecar, err := readChecksumSidecar(testDir.Path, blockId)
+		require.NoError(t, err)
+		require.Equal(t, writer.Checksum(), sidecar.Checksum)
+	}
+}
+
+func TestLocalBlockWriter_Abort(t *testing.T) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	blockId := uuid.NewRandom().String()
+
+	writer, err := NewWriter(testDir.Path, blockId)
+	require.NoError(t, err)
+
+	_, err = writer.Write([]byte("Hello world"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Abort())
+
+	// Nothing is left behind, and the block can't be committed.
+	infos, err := ioutil.ReadDir(testDir.Path)
+	require.NoError(t, err)
+	require.Empty(t, infos)
+
+	require.Error(t, writer.Close())
+
+	// Committed blocks can't be aborted.
+	writer, err = NewWriter(testDir.Path, blockId)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.Error(t, writer.Abort())
+
+	size, checksum, err := ReadChecksum(testDir.Path, blockId, nil)
+	require.NoError(t, err)
+	require.Zero(t, size)
+	require.Zero(t, checksum)
+}
+
+func TestIsTempFile(t *testing.T) {
+	blockId := "0b5e9a3e-8a8c-4d3f-9f63-2c1d6f0a7e11"
+
+	require.True(t, IsTempFile("."+blockId+"-123456"))
+	require.True(t, IsTempFile("."+blockId+ChecksumSuffix+"-123456"))
+	require.True(t, IsTempFile("."+blockId+RefsSuffix+"-123456"))
+	require.False(t, IsTempFile(blockId))
+	require.False(t, IsTempFile(blockId+ChecksumSuffix))
+	require.False(t, IsTempFile(blockId+RefsSuffix))
+	require.False(t, IsTempFile("."+blockId))
+	require.False(t, IsTempFile(".scrub-123456"))
+	require.False(t, IsTempFile("id"))
+}
+
+func TestSidecarBlockId(t *testing.T) {
+	blockId := "0b5e9a3e-8a8c-4d3f-9f63-2c1d6f0a7e11"
+
+	for _, name := range []string{blockId + ChecksumSuffix, blockId + RefsSuffix} {
+		sidecarBlockId, ok := SidecarBlockId(name)
+		require.True(t, ok, name)
+		require.Equal(t, blockId, sidecarBlockId)
+	}
+
+	for _, name := range []string{blockId, "." + blockId + ChecksumSuffix + "-123456", "id" + ChecksumSuffix, "scrub"} {
+		_, ok := SidecarBlockId(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	blockId := "0b5e9a3e-8a8c-4d3f-9f63-2c1d6f0a7e11"
+
+	// Blocks without a sidecar have a single reference.
+	references, err := ReadReferences(testDir.Path, blockId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), references)
+
+	require.NoError(t, WriteReferences(testDir.Path, blockId, 3, true))
+
+	references, err = ReadReferences(testDir.Path, blockId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), references)
+
+	require.NoError(t, RemoveReferences(testDir.Path, blockId))
+	require.NoError(t, RemoveReferences(testDir.Path, blockId))
+
+	references, err = ReadReferences(testDir.Path, blockId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), references)
+}
+
+// Benchmark the cost of each sync mode when committing blocks.
+//
+// Blocks of 1 and 8MB are written in 1MB buffers and committed. The cost of syncing depends heavily on the underlying
+// storage, so results are only comparable between modes on the same machine.
+func BenchmarkLocalBlockWriter_Sync(b *testing.B) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", b.Name())
+	require.NoError(b, testDir.Create())
+	defer testDir.Destroy()
+
+	buffer := make([]byte, size.MB)
+
+	modes := []struct {
+		name string
+		sync SyncMode
+	}{
+		{"none", SyncNone},
+		{"fsync-file", SyncFile},
+		{"fsync-file+dir", SyncFileAndDir},
+	}
+
+	for _, blockSize := range []int{size.MB, 8 * size.MB} {
+		for _, mode := range modes {
+			b.Run(fmt.Sprintf("block=%dMB/sync=%s", blockSize/size.MB, mode.name), func(b *testing.B) {
+				b.SetBytes(int64(blockSize))
+
+				for i := 0; i < b.N; i++ {
+					blockId := uuid.NewRandom().String()
+
+					writer, err := NewWriter(testDir.Path, blockId)
+					require.NoError(b, err)
+					writer.Sync = mode.sync
+
+					for written := 0; written < blockSize; written += len(buffer) {
+						_, err := writer.Write(buffer)
+						require.NoError(b, err)
+					}
+
+					require.NoError(b, writer.Close())
+
+					b.StopTimer()
+					require.NoError(b, os.Remove(filepath.Join(testDir.Path, blockId)))
+					require.NoError(b, RemoveChecksums(testDir.Path, blockId))
+					b.StartTimer()
+				}
+			})
+		}
+	}
 }
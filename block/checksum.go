@@ -0,0 +1,207 @@
+package block
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// The number of block bytes covered by each chunk checksum.
+	ChecksumChunkSize = 64 * 1024
+
+	// The file name suffix of the checksum sidecar kept next to each block file.
+	ChecksumSuffix = ".crc"
+
+	// The chunk reported by a CorruptBlockError when the checksum sidecar itself fails verification.
+	SidecarChunk = -1
+)
+
+// The CRC32C (Castagnoli) table used for all block checksums.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// The error produced when block data does not match its recorded checksums.
+type CorruptBlockError struct {
+	BlockId  string
+	Chunk    int
+	Expected uint32
+	Actual   uint32
+}
+
+func (this *CorruptBlockError) Error() string {
+	if this.Chunk == SidecarChunk {
+		return fmt.Sprintf("corrupt block %s - checksums failed authentication", this.BlockId)
+	}
+
+	return fmt.Sprintf("corrupt block %s - chunk %d checksum mismatch (expected: %08x actual: %08x)",
+		this.BlockId, this.Chunk, this.Expected, this.Actual)
+}
+
+// Integrity data for a single block.
+//
+// A sidecar holds a CRC32C for each ChunkSize range of the block, in order, as well as a checksum of the entire block.
+// It is serialized as JSON to a file named <blockId>.crc next to the block file.
+//
+// Checksums cover the block's logical (decoded) data. For blocks stored with a codec or encrypted, the sidecar also
+// records the codec, whether the block is encrypted, the size of the block file, and the offset in the block file at
+// which each encoded chunk starts. Encryption keys are identified by a header in the block file itself.
+//
+// Encrypted blocks are the exception: their chunk checksums cover each sealed chunk as stored, and the checksum of the
+// entire block is sealed, authenticating the rest of the sidecar. See crypto.go.
+type checksumSidecar struct {
+	ChunkSize  int      `json:"chunkSize"`
+	Size       int64    `json:"size"`
+	Checksum   uint32   `json:"checksum"`
+	Chunks     []uint32 `json:"chunks"`
+	Codec      string   `json:"codec,omitempty"`
+	Encrypted  bool     `json:"encrypted,omitempty"`
+	StoredSize int64    `json:"storedSize,omitempty"`
+	Offsets    []int64  `json:"offsets,omitempty"`
+	Seal       []byte   `json:"seal,omitempty"`
+}
+
+// Returns the fields of the sidecar authenticated by an encrypted block's sealed checksum: all but the seal itself.
+func (this *checksumSidecar) authenticatedData(blockId string) []byte {
+	data := make([]byte, 0, len(blockId)+len(this.Codec)+40+len(this.Chunks)*16)
+	field := make([]byte, 8)
+
+	appendUint := func(value uint64) {
+		binary.BigEndian.PutUint64(field, value)
+		data = append(data, field...)
+	}
+
+	data = append(data, blockId...)
+	appendUint(uint64(this.ChunkSize))
+	appendUint(uint64(this.Size))
+	appendUint(uint64(this.Checksum))
+	appendUint(uint64(this.StoredSize))
+	appendUint(uint64(len(this.Chunks)))
+
+	for i, chunk := range this.Chunks {
+		appendUint(uint64(chunk))
+		appendUint(uint64(this.Offsets[i]))
+	}
+
+	data = append(data, this.Codec...)
+
+	return data
+}
+
+func checksumPath(rootPath string, blockId string) string {
+	return filepath.Join(rootPath, blockId+ChecksumSuffix)
+}
+
+// Read the checksum sidecar for the given block.
+//
+// Errors satisfying os.IsNotExist() are returned as-is for blocks written before checksums were recorded.
+func readChecksumSidecar(rootPath string, blockId string) (*checksumSidecar, error) {
+	value, err := ioutil.ReadFile(checksumPath(rootPath, blockId))
+	if err != nil {
+		return nil, err
+	}
+
+	sidecar := &checksumSidecar{}
+	if err := json.Unmarshal(value, sidecar); err != nil {
+		return nil, fmt.Errorf("unable to parse checksums for block %s - %v", blockId, err)
+	}
+
+	if sidecar.ChunkSize <= 0 {
+		return nil, fmt.Errorf("unable to parse checksums for block %s - invalid chunk size %d", blockId, sidecar.ChunkSize)
+	}
+
+	if (sidecar.Codec != "" || sidecar.Encrypted) && len(sidecar.Offsets) != len(sidecar.Chunks) {
+		return nil, fmt.Errorf("unable to parse checksums for block %s - %d chunk offsets for %d chunks", blockId,
+			len(sidecar.Offsets), len(sidecar.Chunks))
+	}
+
+	if sidecar.Encrypted && len(sidecar.Seal) == 0 {
+		return nil, fmt.Errorf("unable to parse checksums for block %s - encrypted block has no sealed checksum",
+			blockId)
+	}
+
+	return sidecar, nil
+}
+
+// Write the checksum sidecar for the given block to a temp file, returning its path.
+//
+// The temp file is renamed into place by the caller when the block is committed. If sync is set, the file is flushed to
+// stable storage first.
+func writeChecksumSidecar(rootPath string, blockId string, sidecar *checksumSidecar, sync bool) (string, error) {
+	value, err := json.Marshal(sidecar)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := ioutil.TempFile(rootPath, fmt.Sprintf(".%s%s-", blockId, ChecksumSuffix))
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := file.Write(value); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	if sync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return "", err
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// Remove the checksum sidecar for the given block, if there is one.
+func RemoveChecksums(rootPath string, blockId string) error {
+	if err := os.Remove(checksumPath(rootPath, blockId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the logical size and CRC32C of a committed block, as recorded when it was written. The checksum of an
+// encrypted block is opened with the key from keys named by the block's header.
+//
+// Errors satisfying os.IsNotExist() are returned as-is for blocks written before checksums were recorded.
+func ReadChecksum(rootPath string, blockId string, keys *KeyRing) (uint64, uint32, error) {
+	sidecar, err := readChecksumSidecar(rootPath, blockId)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !sidecar.Encrypted {
+		return uint64(sidecar.Size), sidecar.Checksum, nil
+	}
+
+	file, err := os.Open(filepath.Join(rootPath, blockId))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer file.Close()
+
+	cipher, err := openEncryptedBlock(file, blockId, keys)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	checksum, err := cipher.openChecksum(sidecar)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uint64(sidecar.Size), checksum, nil
+}
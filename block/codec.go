@@ -0,0 +1,186 @@
+package block
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+ * Codec
+ */
+
+// A block codec transforms chunks of block data for storage.
+//
+// Blocks are encoded one checksum chunk at a time, and each chunk must be decodable on its own so a ranged read only
+// needs to decode the chunks it covers.
+type Codec interface {
+	// The name recorded in a block's metadata and used to look the codec up when the block is read.
+	Name() string
+
+	// Append the encoded form of src to dst, returning the extended buffer.
+	Encode(dst []byte, src []byte) ([]byte, error)
+
+	// Append the decoded form of src to dst, returning the extended buffer.
+	Decode(dst []byte, src []byte) ([]byte, error)
+}
+
+const (
+	CodecGzip  = "gzip"
+	CodecFlate = "flate"
+)
+
+var codecs = struct {
+	sync.RWMutex
+	idx map[string]Codec
+}{idx: make(map[string]Codec)}
+
+func init() {
+	RegisterCodec(NewFlateCodec(CodecFlate, flate.DefaultCompression, false))
+	RegisterCodec(NewFlateCodec(CodecGzip, gzip.DefaultCompression, true))
+}
+
+// Make a codec available to writers and readers by name. Registering a name again replaces the existing codec.
+func RegisterCodec(codec Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	codecs.idx[codec.Name()] = codec
+}
+
+// Find a registered codec. The empty name returns a nil codec, which stores blocks unencoded.
+func LookupCodec(name string) (Codec, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	if codec, ok := codecs.idx[name]; ok {
+		return codec, nil
+	}
+
+	return nil, fmt.Errorf("unknown block codec '%s'", name)
+}
+
+/*
+ * FlateCodec
+ */
+
+// A codec using DEFLATE from the standard library, optionally with gzip framing.
+//
+// Compressors are expensive to allocate, so they are pooled and reset between chunks.
+type FlateCodec struct {
+	name  string
+	level int
+	gzip  bool
+
+	writers sync.Pool
+}
+
+func NewFlateCodec(name string, level int, gzip bool) *FlateCodec {
+	return &FlateCodec{
+		name:  name,
+		level: level,
+		gzip:  gzip,
+	}
+}
+
+func (this *FlateCodec) Name() string {
+	return this.name
+}
+
+// Adapts a []byte to io.Writer, appending to it.
+type appendWriter struct {
+	buffer []byte
+}
+
+func (this *appendWriter) Write(p []byte) (int, error) {
+	this.buffer = append(this.buffer, p...)
+	return len(p), nil
+}
+
+func (this *FlateCodec) Encode(dst []byte, src []byte) ([]byte, error) {
+	output := &appendWriter{buffer: dst}
+
+	compressor, err := this.compressor(output)
+	if err != nil {
+		return dst, err
+	}
+
+	defer this.writers.Put(compressor)
+
+	if _, err := compressor.Write(src); err != nil {
+		return dst, err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return dst, err
+	}
+
+	return output.buffer, nil
+}
+
+// Fetch a pooled compressor, or allocate one, writing to output.
+func (this *FlateCodec) compressor(output io.Writer) (io.WriteCloser, error) {
+	if pooled := this.writers.Get(); pooled != nil {
+		switch compressor := pooled.(type) {
+		case *gzip.Writer:
+			compressor.Reset(output)
+			return compressor, nil
+		case *flate.Writer:
+			compressor.Reset(output)
+			return compressor, nil
+		}
+	}
+
+	if this.gzip {
+		return gzip.NewWriterLevel(output, this.level)
+	}
+
+	return flate.NewWriter(output, this.level)
+}
+
+func (this *FlateCodec) Decode(dst []byte, src []byte) ([]byte, error) {
+	var decompressor io.ReadCloser
+
+	if this.gzip {
+		reader, err := gzip.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return dst, err
+		}
+
+		decompressor = reader
+	} else {
+		decompressor = flate.NewReader(bytes.NewReader(src))
+	}
+
+	defer decompressor.Close()
+
+	// Decode into the spare capacity of dst, only growing it once the data is known not to fit, so pooled buffers sized
+	// for a chunk are used as is. A truncated stream fails with io.ErrUnexpectedEOF rather than io.EOF.
+	decoded := dst
+	var probe [1]byte
+
+	for {
+		var n int
+		var err error
+
+		if len(decoded) < cap(decoded) {
+			n, err = decompressor.Read(decoded[len(decoded):cap(decoded)])
+			decoded = decoded[:len(decoded)+n]
+		} else if n, err = decompressor.Read(probe[:]); n > 0 {
+			decoded = append(decoded, probe[0])
+		}
+
+		if err == io.EOF {
+			return decoded, nil
+		} else if err != nil {
+			return dst, err
+		}
+	}
+}
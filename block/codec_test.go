@@ -0,0 +1,175 @@
+package block
+
+import (
+	"bfs/test"
+	"bytes"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	data := bytes.Repeat([]byte("2018-01-01 00:00:00 INFO request complete\n"), 1000)
+
+	for _, name := range []string{CodecGzip, CodecFlate} {
+		codec, err := LookupCodec(name)
+		require.NoError(t, err)
+		require.Equal(t, name, codec.Name())
+
+		encoded, err := codec.Encode([]byte("prefix"), data)
+		require.NoError(t, err)
+		require.Equal(t, "prefix", string(encoded[:6]))
+		require.True(t, len(encoded) < len(data)/5, "%s encoded %d bytes to %d", name, len(data), len(encoded))
+
+		decoded, err := codec.Decode(nil, encoded[6:])
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, decoded))
+
+		// Data that exactly fills the capacity of dst is decoded in place.
+		dst := make([]byte, 3, 3+len(data))
+		decoded, err = codec.Decode(dst, encoded[6:])
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, decoded[3:]))
+		require.Equal(t, &dst[0], &decoded[0])
+		require.Equal(t, cap(dst), cap(decoded))
+
+		_, err = codec.Decode(nil, encoded[6:len(encoded)-4])
+		require.Error(t, err)
+
+		// Compressors are reused.
+		encodedAgain, err := codec.Encode(nil, data)
+		require.NoError(t, err)
+		require.Equal(t, encoded[6:], encodedAgain)
+	}
+
+	codec, err := LookupCodec("")
+	require.NoError(t, err)
+	require.Nil(t, codec)
+
+	_, err = LookupCodec("lzma")
+	require.Error(t, err)
+}
+
+func TestLocalBlockWriter_Codec(t *testing.T) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	codec, err := LookupCodec(CodecGzip)
+	require.NoError(t, err)
+
+	// Several full chunks plus a partial one.
+	data := make([]byte, ChecksumChunkSize*3+ChecksumChunkSize/3)
+	for i := range data {
+		data[i] = byte(i / 1024)
+	}
+
+	writer, err := NewWriter(testDir.Path, "1")
+	require.NoError(t, err)
+	writer.Codec = codec
+
+	for pos := 0; pos < len(data); pos += 1000 {
+		end := pos + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+
+		_, err := writer.Write(data[pos:end])
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	info, err := os.Stat(filepath.Join(testDir.Path, "1"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(info.Size()), writer.StoredSize())
+	require.True(t, writer.StoredSize() < uint64(len(data)))
+
+	sidecar, err := readChecksumSidecar(testDir.Path, "1")
+	require.NoError(t, err)
+	require.Equal(t, CodecGzip, sidecar.Codec)
+	require.Equal(t, int64(len(data)), sidecar.Size)
+	require.Equal(t, info.Size(), sidecar.StoredSize)
+	require.Len(t, sidecar.Offsets, 4)
+
+	reader, err := NewReader(testDir.Path, "1")
+	require.NoError(t, err)
+	readData, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.True(t, bytes.Equal(data, readData))
+
+	ranges := []struct {
+		position uint64
+		length   uint64
+	}{
+		{0, 10},
+		{ChecksumChunkSize - 5, 10},
+		{ChecksumChunkSize * 2, ChecksumChunkSize},
+		{ChecksumChunkSize*3 + 7, 0},
+		{uint64(len(data)), 0},
+	}
+
+	for _, r := range ranges {
+		t.Run(fmt.Sprintf("position=%d,length=%d", r.position, r.length), func(t *testing.T) {
+			reader, err := NewRangeReader(testDir.Path, "1", r.position, r.length)
+			require.NoError(t, err)
+			defer reader.Close()
+
+			readData, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+
+			end := uint64(len(data))
+			if r.length > 0 {
+				end = r.position + r.length
+			}
+
+			require.True(t, bytes.Equal(data[r.position:end], readData))
+		})
+	}
+}
+
+func TestLocalBlockReader_CodecCorruption(t *testing.T) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	codec, err := LookupCodec(CodecFlate)
+	require.NoError(t, err)
+
+	writer, err := NewWriter(testDir.Path, "1")
+	require.NoError(t, err)
+	writer.Codec = codec
+
+	_, err = writer.Write(bytes.Repeat([]byte{1}, ChecksumChunkSize*2))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	sidecar, err := readChecksumSidecar(testDir.Path, "1")
+	require.NoError(t, err)
+
+	// Damage the encoded form of the second chunk.
+	f, err := os.OpenFile(filepath.Join(testDir.Path, "1"), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, sidecar.Offsets[1])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	reader, err := NewRangeReader(testDir.Path, "1", ChecksumChunkSize, 0)
+	require.NoError(t, err)
+
+	_, err = ioutil.ReadAll(reader)
+	require.Error(t, err)
+	require.IsType(t, &CorruptBlockError{}, err)
+	require.Equal(t, 1, err.(*CorruptBlockError).Chunk)
+
+	require.NoError(t, reader.Close())
+}
@@ -0,0 +1,285 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+/*
+ * Block encryption.
+ *
+ * Encrypted block files start with a header identifying the key used to write them, followed by each chunk sealed with
+ * AES-GCM. A chunk's nonce is the random prefix from the header followed by the chunk index. Every chunk is
+ * authenticated with the block ID, its index, and whether it is the last chunk, with the last also authenticating the
+ * number of chunks, so chunks can't be reordered, moved between blocks, or dropped from the end without detection.
+ *
+ * The checksum sidecar of an encrypted block checksums the sealed chunks rather than the data, so it reveals nothing
+ * about the data. The block's checksum is sealed in the sidecar with the block's key, authenticating the rest of the
+ * sidecar along with it.
+ */
+
+const (
+	// The magic number at the start of every encrypted block file.
+	encryptionMagic = "BFSE"
+	// The version of the encrypted block header.
+	encryptionVersion = 2
+	// The number of random nonce bytes in the header. The remaining nonce bytes hold the chunk index.
+	noncePrefixSize = 8
+	// The nonce index reserved for the sealed checksum in the sidecar. Blocks never have this many chunks.
+	checksumNonceIndex = math.MaxUint32
+)
+
+var errNotEncrypted = errors.New("block is not encrypted")
+
+// An AES key used to encrypt blocks.
+type Key struct {
+	Id   string
+	aead cipher.AEAD
+}
+
+func NewKey(id string, key []byte) (*Key, error) {
+	if id == "" || len(id) > 255 || strings.ContainsAny(id, " \t\n") {
+		return nil, fmt.Errorf("invalid key id '%s'", id)
+	}
+
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %s - %v", id, err)
+	}
+
+	aead, err := cipher.NewGCM(blockCipher)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{Id: id, aead: aead}, nil
+}
+
+// The set of keys available to a volume.
+//
+// New blocks are encrypted with the current key. Older keys are kept so blocks written with them can still be read;
+// rotating keys means adding a new current key while retaining the old ones.
+type KeyRing struct {
+	keys    map[string]*Key
+	current *Key
+}
+
+// Create a key ring. The last key is the current key.
+func NewKeyRing(keys ...*Key) (*KeyRing, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("key ring has no keys")
+	}
+
+	this := &KeyRing{
+		keys:    make(map[string]*Key, len(keys)),
+		current: keys[len(keys)-1],
+	}
+
+	for _, key := range keys {
+		if _, ok := this.keys[key.Id]; ok {
+			return nil, fmt.Errorf("duplicate key id '%s'", key.Id)
+		}
+
+		this.keys[key.Id] = key
+	}
+
+	return this, nil
+}
+
+// Load a key ring from a file.
+//
+// Each line of the file holds a key ID and a hex encoded 16, 24, or 32 byte AES key, separated by whitespace. Blank
+// lines and lines starting with # are ignored. The last key in the file is the current key.
+func LoadKeyRing(path string) (*KeyRing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var keys []*Key
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d - expected '<key id> <hex key>'", path, lineNum)
+		}
+
+		keyBytes, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d - invalid key - %v", path, lineNum, err)
+		}
+
+		key, err := NewKey(fields[0], keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d - %v", path, lineNum, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	keyRing, err := NewKeyRing(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("%s - %v", path, err)
+	}
+
+	return keyRing, nil
+}
+
+// The key with which new blocks are encrypted.
+func (this *KeyRing) Current() *Key {
+	return this.current
+}
+
+func (this *KeyRing) Key(id string) (*Key, error) {
+	if key, ok := this.keys[id]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown key id '%s'", id)
+}
+
+// The per-block encryption header.
+type encryptionHeader struct {
+	keyId       string
+	noncePrefix []byte
+}
+
+func newEncryptionHeader(keyId string) (*encryptionHeader, error) {
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+
+	return &encryptionHeader{keyId: keyId, noncePrefix: noncePrefix}, nil
+}
+
+func (this *encryptionHeader) marshal() []byte {
+	buffer := make([]byte, 0, len(encryptionMagic)+2+len(this.keyId)+noncePrefixSize)
+
+	buffer = append(buffer, encryptionMagic...)
+	buffer = append(buffer, encryptionVersion, byte(len(this.keyId)))
+	buffer = append(buffer, this.keyId...)
+	buffer = append(buffer, this.noncePrefix...)
+
+	return buffer
+}
+
+func readEncryptionHeader(reader io.Reader) (*encryptionHeader, error) {
+	fixed := make([]byte, len(encryptionMagic)+2)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(fixed[:len(encryptionMagic)], []byte(encryptionMagic)) {
+		return nil, errNotEncrypted
+	}
+
+	if version := fixed[len(encryptionMagic)]; version != encryptionVersion {
+		return nil, fmt.Errorf("unsupported encryption header version %d", version)
+	}
+
+	variable := make([]byte, int(fixed[len(encryptionMagic)+1])+noncePrefixSize)
+	if _, err := io.ReadFull(reader, variable); err != nil {
+		return nil, err
+	}
+
+	return &encryptionHeader{
+		keyId:       string(variable[:len(variable)-noncePrefixSize]),
+		noncePrefix: variable[len(variable)-noncePrefixSize:],
+	}, nil
+}
+
+// Holds the state needed to seal or open the chunks of one block.
+type chunkCipher struct {
+	key     *Key
+	header  *encryptionHeader
+	blockId string
+	nonce   []byte
+	aad     []byte
+}
+
+func newChunkCipher(key *Key, header *encryptionHeader, blockId string) *chunkCipher {
+	nonce := make([]byte, key.aead.NonceSize())
+	copy(nonce, header.noncePrefix)
+
+	// The block ID, followed by the chunk index, the last chunk flag, and the number of chunks.
+	aad := make([]byte, len(blockId)+9)
+	copy(aad, blockId)
+
+	return &chunkCipher{key: key, header: header, blockId: blockId, nonce: nonce, aad: aad}
+}
+
+func (this *chunkCipher) chunkNonce(index uint32) []byte {
+	binary.BigEndian.PutUint32(this.nonce[noncePrefixSize:], index)
+	return this.nonce
+}
+
+// Returns the data authenticated with a chunk. The number of chunks is only known, and authenticated, for the last.
+func (this *chunkCipher) chunkData(chunkIdx int, last bool) []byte {
+	fields := this.aad[len(this.blockId):]
+
+	binary.BigEndian.PutUint32(fields, uint32(chunkIdx))
+	fields[4] = 0
+	binary.BigEndian.PutUint32(fields[5:], 0)
+
+	if last {
+		fields[4] = 1
+		binary.BigEndian.PutUint32(fields[5:], uint32(chunkIdx+1))
+	}
+
+	return this.aad
+}
+
+// Append the sealed form of the chunk to dst. The last chunk of the block must be sealed as such.
+func (this *chunkCipher) seal(dst []byte, chunk []byte, chunkIdx int, last bool) []byte {
+	return this.key.aead.Seal(dst, this.chunkNonce(uint32(chunkIdx)), chunk, this.chunkData(chunkIdx, last))
+}
+
+// Append the opened form of the sealed chunk to dst. Fails if the chunk was modified, or wasn't sealed as the last
+// chunk when it is expected to be, or the other way around.
+func (this *chunkCipher) open(dst []byte, sealed []byte, chunkIdx int, last bool) ([]byte, error) {
+	return this.key.aead.Open(dst, this.chunkNonce(uint32(chunkIdx)), sealed, this.chunkData(chunkIdx, last))
+}
+
+// Seal a block's checksum, authenticating the rest of its sidecar with it.
+func (this *chunkCipher) sealChecksum(sidecar *checksumSidecar, checksum uint32) []byte {
+	plaintext := make([]byte, 4)
+	binary.BigEndian.PutUint32(plaintext, checksum)
+
+	return this.key.aead.Seal(nil, this.chunkNonce(checksumNonceIndex), plaintext,
+		sidecar.authenticatedData(this.blockId))
+}
+
+// Open a block's sealed checksum. Fails with a *CorruptBlockError if any of the sidecar was modified.
+func (this *chunkCipher) openChecksum(sidecar *checksumSidecar) (uint32, error) {
+	plaintext, err := this.key.aead.Open(nil, this.chunkNonce(checksumNonceIndex), sidecar.Seal,
+		sidecar.authenticatedData(this.blockId))
+	if err != nil || len(plaintext) != 4 {
+		return 0, &CorruptBlockError{BlockId: this.blockId, Chunk: SidecarChunk}
+	}
+
+	return binary.BigEndian.Uint32(plaintext), nil
+}
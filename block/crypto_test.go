@@ -0,0 +1,263 @@
+package block
+
+import (
+	"bfs/test"
+	"bytes"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(t *testing.T, id string, fill byte) *Key {
+	key, err := NewKey(id, bytes.Repeat([]byte{fill}, 32))
+	require.NoError(t, err)
+
+	return key
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	keyPath := filepath.Join(testDir.Path, "keys")
+
+	require.NoError(t, ioutil.WriteFile(keyPath, []byte(
+		"# Rotated 2018-01-01\n"+
+			"k1 "+fmt.Sprintf("%x", bytes.Repeat([]byte{1}, 32))+"\n"+
+			"\n"+
+			"k2 "+fmt.Sprintf("%x", bytes.Repeat([]byte{2}, 16))+"\n"), 0600))
+
+	keys, err := LoadKeyRing(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, "k2", keys.Current().Id)
+
+	_, err = keys.Key("k1")
+	require.NoError(t, err)
+	_, err = keys.Key("k3")
+	require.Error(t, err)
+
+	invalid := []string{
+		"",
+		"k1\n",
+		"k1 zz\n",
+		"k1 0102\n",
+		"k1 " + fmt.Sprintf("%x", bytes.Repeat([]byte{1}, 32)) + "\nk1 " + fmt.Sprintf("%x", bytes.Repeat([]byte{2}, 32)),
+	}
+
+	for _, contents := range invalid {
+		require.NoError(t, ioutil.WriteFile(keyPath, []byte(contents), 0600))
+
+		_, err := LoadKeyRing(keyPath)
+		require.Error(t, err, "contents: %q", contents)
+	}
+}
+
+func TestLocalBlockWriter_Encryption(t *testing.T) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	keys, err := NewKeyRing(testKey(t, "k1", 1))
+	require.NoError(t, err)
+
+	gzipCodec, err := LookupCodec(CodecGzip)
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("secret secret secret\n"), ChecksumChunkSize/5)
+
+	for _, codec := range []Codec{nil, gzipCodec} {
+		t.Run(fmt.Sprintf("codec=%v", codec != nil), func(t *testing.T) {
+			writer, err := NewWriter(testDir.Path, "1")
+			require.NoError(t, err)
+			writer.Codec = codec
+			writer.Key = keys.Current()
+
+			_, err = writer.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, writer.Close())
+
+			stored, err := ioutil.ReadFile(filepath.Join(testDir.Path, "1"))
+			require.NoError(t, err)
+			require.Equal(t, uint64(len(stored)), writer.StoredSize())
+			require.True(t, bytes.HasPrefix(stored, []byte(encryptionMagic)))
+			require.False(t, bytes.Contains(stored, []byte("secret")))
+
+			reader, err := NewRangeReaderWithKeys(testDir.Path, "1", 0, 0, keys)
+			require.NoError(t, err)
+			readData, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+			require.True(t, bytes.Equal(data, readData))
+
+			position := uint64(ChecksumChunkSize*2 + 17)
+			reader, err = NewRangeReaderWithKeys(testDir.Path, "1", position, 100, keys)
+			require.NoError(t, err)
+			readData, err = ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+			require.True(t, bytes.Equal(data[position:position+100], readData))
+
+			// Encrypted blocks can't be read without keys.
+			_, err = NewReader(testDir.Path, "1")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLocalBlockWriter_KeyRotation(t *testing.T) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	writeBlock := func(blockId string, key *Key) {
+		writer, err := NewWriter(testDir.Path, blockId)
+		require.NoError(t, err)
+		writer.Key = key
+
+		_, err = writer.WriteString("block " + blockId)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	}
+
+	readBlock := func(blockId string, keys *KeyRing) (string, error) {
+		reader, err := NewRangeReaderWithKeys(testDir.Path, blockId, 0, 0, keys)
+		if err != nil {
+			return "", err
+		}
+
+		defer reader.Close()
+
+		data, err := ioutil.ReadAll(reader)
+
+		return string(data), err
+	}
+
+	oldKeys, err := NewKeyRing(testKey(t, "k1", 1))
+	require.NoError(t, err)
+
+	writeBlock("old", oldKeys.Current())
+	writeBlock("plain", nil)
+
+	newKeys, err := NewKeyRing(testKey(t, "k1", 1), testKey(t, "k2", 2))
+	require.NoError(t, err)
+
+	writeBlock("new", newKeys.Current())
+
+	for _, blockId := range []string{"old", "new", "plain"} {
+		data, err := readBlock(blockId, newKeys)
+		require.NoError(t, err)
+		require.Equal(t, "block "+blockId, data)
+	}
+
+	// Blocks written with a key that's no longer available can't be read.
+	_, err = readBlock("new", oldKeys)
+	require.Error(t, err)
+
+	// A key with the right ID but the wrong contents fails authentication.
+	wrongKeys, err := NewKeyRing(testKey(t, "k2", 3))
+	require.NoError(t, err)
+
+	_, err = readBlock("new", wrongKeys)
+	require.IsType(t, &CorruptBlockError{}, err)
+}
+
+func TestLocalBlockReader_EncryptionTampering(t *testing.T) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	keys, err := NewKeyRing(testKey(t, "k1", 1))
+	require.NoError(t, err)
+
+	writer, err := NewWriter(testDir.Path, "1")
+	require.NoError(t, err)
+	writer.Key = keys.Current()
+
+	_, err = writer.Write(bytes.Repeat([]byte{1}, ChecksumChunkSize*2))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	sidecar, err := readChecksumSidecar(testDir.Path, "1")
+	require.NoError(t, err)
+	require.True(t, sidecar.Encrypted)
+
+	f, err := os.OpenFile(filepath.Join(testDir.Path, "1"), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, sidecar.Offsets[1]+10)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	reader, err := NewRangeReaderWithKeys(testDir.Path, "1", 0, 0, keys)
+	require.NoError(t, err)
+
+	_, err = ioutil.ReadAll(reader)
+	require.IsType(t, &CorruptBlockError{}, err)
+	require.Equal(t, 1, err.(*CorruptBlockError).Chunk)
+
+	require.NoError(t, reader.Close())
+
+	// The sidecar reveals nothing about the data, but the block's checksum can be opened with its key.
+	chunkChecksum := crc32.Checksum(bytes.Repeat([]byte{1}, ChecksumChunkSize), crcTable)
+	require.Zero(t, sidecar.Checksum)
+	require.NotContains(t, sidecar.Chunks, chunkChecksum)
+
+	size, checksum, err := ReadChecksum(testDir.Path, "1", keys)
+	require.NoError(t, err)
+	require.Equal(t, uint64(ChecksumChunkSize*2), size)
+	require.Equal(t, crc32.Checksum(bytes.Repeat([]byte{1}, ChecksumChunkSize*2), crcTable), checksum)
+
+	// Sidecars modified to drop chunks are refused.
+	sidecar.Size = ChecksumChunkSize
+	sidecar.Chunks = sidecar.Chunks[:1]
+	sidecar.Offsets = sidecar.Offsets[:1]
+
+	sidecarPath, err := writeChecksumSidecar(testDir.Path, "1", sidecar, false)
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(sidecarPath, checksumPath(testDir.Path, "1")))
+
+	_, err = NewRangeReaderWithKeys(testDir.Path, "1", 0, 0, keys)
+	require.IsType(t, &CorruptBlockError{}, err)
+	require.Equal(t, SidecarChunk, err.(*CorruptBlockError).Chunk)
+
+	_, _, err = ReadChecksum(testDir.Path, "1", keys)
+	require.IsType(t, &CorruptBlockError{}, err)
+}
+
+func TestChunkCipher_LastChunk(t *testing.T) {
+	header, err := newEncryptionHeader("k1")
+	require.NoError(t, err)
+
+	cipher := newChunkCipher(testKey(t, "k1", 1), header, "1")
+	data := []byte("chunk")
+
+	// A block cut short ends with a chunk that wasn't sealed as the last.
+	sealed := cipher.seal(nil, data, 0, false)
+	_, err = cipher.open(nil, sealed, 0, true)
+	require.Error(t, err)
+
+	opened, err := cipher.open(nil, sealed, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, data, opened)
+
+	sealed = cipher.seal(nil, data, 1, true)
+	_, err = cipher.open(nil, sealed, 1, false)
+	require.Error(t, err)
+	_, err = cipher.open(nil, sealed, 2, true)
+	require.Error(t, err)
+
+	opened, err = cipher.open(nil, sealed, 1, true)
+	require.NoError(t, err)
+	require.Equal(t, data, opened)
+}
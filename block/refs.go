@@ -0,0 +1,80 @@
+package block
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The file name suffix of the reference count sidecar kept next to a block shared by more than one file.
+	RefsSuffix = ".refs"
+)
+
+func refsPath(rootPath string, blockId string) string {
+	return filepath.Join(rootPath, blockId+RefsSuffix)
+}
+
+// Returns the number of references to a committed block.
+//
+// Blocks are written with a single reference and only get a sidecar once another is added, so a block without one has
+// a single reference. The block itself is not checked.
+func ReadReferences(rootPath string, blockId string) (uint64, error) {
+	value, err := ioutil.ReadFile(refsPath(rootPath, blockId))
+	if os.IsNotExist(err) {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	references, err := strconv.ParseUint(strings.TrimSpace(string(value)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse references to block %s - %v", blockId, err)
+	}
+
+	return references, nil
+}
+
+// Record the number of references to a committed block.
+//
+// The count is written to a temp file and renamed into place, so a crash leaves either the old or the new count. If
+// sync is set, the file is flushed to stable storage first.
+func WriteReferences(rootPath string, blockId string, references uint64, sync bool) error {
+	file, err := ioutil.TempFile(rootPath, fmt.Sprintf(".%s%s-", blockId, RefsSuffix))
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.WriteString(strconv.FormatUint(references, 10) + "\n"); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if sync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), refsPath(rootPath, blockId))
+}
+
+// Remove the reference count sidecar for the given block, if there is one.
+func RemoveReferences(rootPath string, blockId string) error {
+	if err := os.Remove(refsPath(rootPath, blockId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -2,7 +2,9 @@ package client
 
 import (
 	"bfs/config"
+	"bfs/service/blockservice"
 	"context"
+	"fmt"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/golang/protobuf/proto"
 	"path/filepath"
@@ -53,3 +55,53 @@ func (this *Client) ListVolumes() ([]*config.LogicalVolumeConfig, error) {
 
 	return lvConfigs, nil
 }
+
+// Set the operational state of a physical volume.
+//
+// The state is kept in etcd, from which the block server holding the volume picks it up while running. It persists
+// across restarts of the block server.
+func (this *Client) SetPhysicalVolumeState(pvId string, state string) error {
+	if !blockservice.IsOperatorState(state) {
+		return fmt.Errorf("invalid volume state '%s' - must be one of %v", state, blockservice.OperatorStates)
+	}
+
+	_, err := this.etcdClient.Put(
+		context.Background(),
+		filepath.Join(DefaultEtcdPrefix, EtcdVolumeStatePrefix, pvId),
+		state,
+	)
+
+	return err
+}
+
+// Add a physical volume to a running host.
+//
+// The volume's config is kept in etcd, from which the host's block server opens the volume at pvConfig.Path and
+// publishes it in its host config. The volume is opened again whenever the block server restarts.
+func (this *Client) AddPhysicalVolume(hostId string, pvConfig *config.PhysicalVolumeConfig) error {
+	if !filepath.IsAbs(pvConfig.Path) {
+		return fmt.Errorf("invalid volume path '%s' - must be absolute", pvConfig.Path)
+	}
+
+	_, err := this.etcdClient.Put(
+		context.Background(),
+		filepath.Join(DefaultEtcdPrefix, EtcdHostVolumesPrefix, hostId, pvConfig.Path),
+		proto.MarshalTextString(pvConfig),
+	)
+
+	return err
+}
+
+// Remove a physical volume added with AddPhysicalVolume() from a running host. Returns false if no such volume was
+// added.
+func (this *Client) RemovePhysicalVolume(hostId string, path string) (bool, error) {
+	resp, err := this.etcdClient.Delete(
+		context.Background(),
+		filepath.Join(DefaultEtcdPrefix, EtcdHostVolumesPrefix, hostId, path),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Deleted == 1, nil
+}
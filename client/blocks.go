@@ -0,0 +1,92 @@
+package client
+
+import (
+	"bfs/service/blockservice"
+	"bfs/util"
+	"bfs/util/logging"
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+)
+
+type BlockListEntry struct {
+	Block *blockservice.BlockInfo
+	Err   error
+}
+
+// List the blocks held by a physical volume.
+//
+// Results are streamed from the block server that owns the volume. A failure is delivered as a final entry with Err
+// set.
+func (this *Client) ListBlocks(pvId string) <-chan *BlockListEntry {
+	resultChan := make(chan *BlockListEntry, 1024)
+
+	go func() {
+		defer close(resultChan)
+
+		blockClient, err := this.blockClientForVolume(pvId)
+		if err != nil {
+			resultChan <- &BlockListEntry{Err: err}
+			return
+		}
+
+		listStream, err := blockClient.ListBlocks(context.Background(), &blockservice.ListBlocksRequest{VolumeId: pvId})
+		if err != nil {
+			resultChan <- &BlockListEntry{Err: err}
+			return
+		}
+
+		for {
+			resp, err := listStream.Recv()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				glog.V(logging.LogLevelTrace).Infof("Closing block list stream due to %v", err)
+				resultChan <- &BlockListEntry{Err: err}
+				return
+			}
+
+			for _, blockInfo := range resp.Blocks {
+				resultChan <- &BlockListEntry{Block: blockInfo}
+			}
+		}
+
+		glog.V(logging.LogLevelTrace).Infof("Block list stream complete")
+	}()
+
+	return resultChan
+}
+
+// Describe a single block on a physical volume.
+func (this *Client) StatBlock(pvId string, blockId string) (*blockservice.BlockInfo, error) {
+	blockClient, err := this.blockClientForVolume(pvId)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := blockClient.StatBlock(context.Background(), &blockservice.StatBlockRequest{
+		VolumeId: pvId,
+		BlockId:  blockId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Block, nil
+}
+
+// Find the block service client for the block server that owns a physical volume.
+func (this *Client) blockClientForVolume(pvId string) (blockservice.BlockServiceClient, error) {
+	pvConfig := this.clusterState.PhysicalVolumeConfig(pvId)
+	if pvConfig == nil {
+		return nil, fmt.Errorf("unknown physical volume %s", pvId)
+	}
+
+	obj, err := this.clientLRU.Get(pvConfig.Labels["endpoint"])
+	if err != nil {
+		return nil, err
+	}
+
+	return obj.(*util.ServiceCtx).BlockServiceClient, nil
+}
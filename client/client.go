@@ -1,12 +1,14 @@
 package client
 
 import (
+	"bfs/block"
 	"bfs/service/blockservice"
 	"bfs/config"
 	"bfs/file"
 	"bfs/lru"
 	"bfs/service/nameservice"
 	"bfs/util"
+	"bfs/util/erasure"
 	"bfs/util/etcd"
 	"bfs/util/logging"
 	"bfs/util/size"
@@ -19,6 +21,7 @@ import (
 	"google.golang.org/grpc"
 	"path/filepath"
 	"stathat.com/c/consistent"
+	"strconv"
 	"strings"
 	"time"
 	"unsafe"
@@ -33,6 +36,10 @@ type Client struct {
 
 	volumeWatcher *etcd.Watcher
 	hostWatcher   *etcd.Watcher
+
+	// The identity the client gives block servers, which may limit bandwidth per caller. Empty leaves the client
+	// unidentified. Set before the first request.
+	Caller string
 }
 
 func New(endpoints []string) (*Client, error) {
@@ -206,7 +213,8 @@ func NewWithEtcd(etcdClient *clientv3.Client) (*Client, error) {
 			glog.V(logging.LogLevelTrace).Infof("Creating new connection for %s", name)
 
 			ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-			conn, err := grpc.DialContext(ctx, name, grpc.WithBlock(), grpc.WithInsecure())
+			conn, err := grpc.DialContext(ctx, name, grpc.WithBlock(), grpc.WithInsecure(),
+				grpc.WithUnaryInterceptor(client.identifyUnary), grpc.WithStreamInterceptor(client.identifyStream))
 			if err != nil {
 				return nil, err
 			}
@@ -229,6 +237,28 @@ func NewWithEtcd(etcdClient *clientv3.Client) (*Client, error) {
 	return client, nil
 }
 
+// Attach the client's identity to unary requests.
+func (this *Client) identifyUnary(ctx context.Context, method string, req interface{}, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	if this.Caller != "" {
+		ctx = blockservice.WithCaller(ctx, this.Caller)
+	}
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// Attach the client's identity to streaming requests.
+func (this *Client) identifyStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+	streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+
+	if this.Caller != "" {
+		ctx = blockservice.WithCaller(ctx, this.Caller)
+	}
+
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
 func (this *Client) Hosts() []*config.HostConfig {
 	return this.clusterState.HostConfigs()
 }
@@ -238,37 +268,164 @@ func (this *Client) HostStatus() []*config.HostStatus {
 }
 
 func (this *Client) Create(path string, blockSize int) (file.Writer, error) {
-	var pvConfigs []*config.PhysicalVolumeConfig
+	volumeConfig, pvConfigs := this.volumeForPath(path)
+	if len(pvConfigs) == 0 {
+		return nil, fmt.Errorf("unable to find volume for file %s", path)
+	}
 
-	for _, lvConfig := range this.clusterState.LogicalVolumeConfigs() {
-		mount := lvConfig.Labels["mount"]
+	replicas, minimumReplicas, err := replicationForVolume(volumeConfig)
+	if err != nil {
+		return nil, err
+	}
 
-		glog.V(logging.LogLevelTrace).Infof("Checking volume mount %s for file %s", mount, path)
-		if strings.HasPrefix(path, mount) {
-			pvConfigs = this.clusterState.PhysicalVolumesForLogicalVolume(lvConfig.Id)
-			break
+	dataFragments, parityFragments, err := erasureCodingForVolume(volumeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := codecForVolume(volumeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	dedup, err := dedupForVolume(volumeConfig)
+	if err != nil {
+		return nil, err
+	} else if dedup && dataFragments > 0 {
+		return nil, fmt.Errorf("volume %s can not be both erasure-coded and deduplicated", volumeConfig.Id)
+	}
+
+	conn, _, err := this.connectionForPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if dataFragments > 0 {
+		// Every fragment of a stripe is required.
+		placementPolicy := file.NewLabelAwarePlacementPolicy(
+			pvConfigs,
+			"hostname",
+			false,
+			dataFragments+parityFragments,
+			dataFragments+parityFragments,
+			this.blockAcceptFunc,
+		)
+
+		writer, err := file.NewStripedWriter(conn.NameServiceClient, this.clientLRU, placementPolicy, path, blockSize,
+			dataFragments, parityFragments)
+		if err != nil {
+			return nil, err
 		}
+
+		writer.Codec = codec
+
+		return writer, nil
 	}
 
+	placementPolicy := file.NewLabelAwarePlacementPolicy(
+		pvConfigs,
+		"hostname",
+		false,
+		replicas,
+		minimumReplicas,
+		this.blockAcceptFunc,
+	)
+
+	writer, err := file.NewWriter(conn.NameServiceClient, this.clientLRU, placementPolicy, path, blockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	writer.Codec = codec
+
+	if dedup {
+		writer.Index = this.blockIndex(volumeConfig.Id)
+		writer.Locator = this.clusterState.PhysicalVolumeConfig
+	}
+
+	return writer, nil
+}
+
+// Open a writer that adds data to the end of an existing file.
+//
+// The file's entry is updated when the writer is closed. Readers see either the file as it was or with all of the
+// appended data. Closing fails with codes.Aborted if another client appended to the file first.
+func (this *Client) Append(path string) (file.Writer, error) {
+	volumeConfig, pvConfigs := this.volumeForPath(path)
 	if len(pvConfigs) == 0 {
 		return nil, fmt.Errorf("unable to find volume for file %s", path)
 	}
 
+	replicas, minimumReplicas, err := replicationForVolume(volumeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := codecForVolume(volumeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	dedup, err := dedupForVolume(volumeConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	conn, _, err := this.connectionForPath(path)
 	if err != nil {
 		return nil, err
 	}
 
+	getResp, err := conn.NameServiceClient.Get(context.Background(), &nameservice.GetRequest{Path: path})
+	if err != nil {
+		return nil, err
+	}
+
 	placementPolicy := file.NewLabelAwarePlacementPolicy(
 		pvConfigs,
 		"hostname",
 		false,
-		1,
-		1,
+		replicas,
+		minimumReplicas,
 		this.blockAcceptFunc,
 	)
 
-	return file.NewWriter(conn.NameServiceClient, this.clientLRU, placementPolicy, path, blockSize)
+	// The reader only reads data that was already in the file, which never changes, so it may see a later entry.
+	reader := file.NewReader(conn.NameServiceClient, this.clientLRU, this.clusterState.PhysicalVolumeConfig, path)
+	if err := reader.Open(); err != nil {
+		return nil, err
+	}
+
+	writer, err := file.NewAppendWriter(conn.NameServiceClient, this.clientLRU, placementPolicy, getResp.Entry, reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	writer.Codec = codec
+
+	// The replicas of a replaced last block are located to remove them once the append is committed.
+	writer.Locator = this.clusterState.PhysicalVolumeConfig
+
+	if dedup {
+		writer.Index = this.blockIndex(volumeConfig.Id)
+	}
+
+	return writer, nil
+}
+
+// Find the logical volume mounted at a path, and its physical volumes.
+func (this *Client) volumeForPath(path string) (*config.LogicalVolumeConfig, []*config.PhysicalVolumeConfig) {
+	for _, lvConfig := range this.clusterState.LogicalVolumeConfigs() {
+		mount := lvConfig.Labels["mount"]
+
+		glog.V(logging.LogLevelTrace).Infof("Checking volume mount %s for file %s", mount, path)
+		if strings.HasPrefix(path, mount) {
+			return lvConfig, this.clusterState.PhysicalVolumesForLogicalVolume(lvConfig.Id)
+		}
+	}
+
+	return nil, nil
 }
 
 func (this *Client) Open(path string) (file.Reader, error) {
@@ -277,7 +434,7 @@ func (this *Client) Open(path string) (file.Reader, error) {
 		return nil, err
 	}
 
-	reader := file.NewReader(conn.NameServiceClient, conn.BlockServiceClient, path)
+	reader := file.NewReader(conn.NameServiceClient, this.clientLRU, this.clusterState.PhysicalVolumeConfig, path)
 	return reader, reader.Open()
 }
 
@@ -446,11 +603,39 @@ func (this *Client) blockAcceptFunc(node *file.ValueNode) bool {
 			glog.V(logging.LogLevelTrace).Infof("Found pv id: %s for id: %s", volumeStatus.Id, node.Value.Id)
 
 			fsStats := volumeStatus.FileSystemStatus
+			if fsStats == nil {
+				glog.V(logging.LogLevelTrace).Infof("No capacity for PV %s on host %s", node.Value.Id, node.LabelValue)
+				return false
+			}
+
 			bytesAvailable := fsStats.BlocksAvailable * uint64(fsStats.BlockSize)
 
-			// 4. Have enough space available.
+			// 4. Accept new blocks. Read-only and draining volumes don't; volumes that don't report a state do.
+			if volumeStatus.State != "" && volumeStatus.State != blockservice.StateOpen {
+				glog.V(logging.LogLevelTrace).Infof("PV %s on host %s is %s", node.Value.Id, node.LabelValue,
+					volumeStatus.State)
+				return false
+			}
+
+			// 5. Be within its quota.
+			if volumeStatus.MaxBytes > 0 && volumeStatus.UsedBytes >= volumeStatus.MaxBytes {
+				glog.V(logging.LogLevelTrace).Infof("PV %s on host %s is at its quota of %d bytes", node.Value.Id,
+					node.LabelValue, volumeStatus.MaxBytes)
+				return false
+			}
+
+			// 6. Have enough space available beyond the volume's reserved space. The block service enforces the
+			// reservation itself; this only avoids volumes that are known to be full. Memory volumes report the room
+			// left in their quota, so any space will do.
+			minimumAvailable := uint64(DefaultMinimumAvailableBytes)
+			if volumeStatus.ReservedBytes > 0 {
+				minimumAvailable = volumeStatus.ReservedBytes
+			} else if node.Value.Storage == config.VolumeStorage_STORAGE_MEMORY {
+				minimumAvailable = 0
+			}
+
 			gbAvail := size.Bytes(float64(bytesAvailable)).ToGigabytes()
-			if gbAvail >= 10 {
+			if bytesAvailable > minimumAvailable {
 				glog.V(logging.LogLevelTrace).Infof("Found enough space %.03fGB on %s", gbAvail, volumeStatus.Id)
 				return true
 			}
@@ -462,3 +647,91 @@ func (this *Client) blockAcceptFunc(node *file.ValueNode) bool {
 	glog.V(logging.LogLevelTrace).Infof("No PV %s on host %s", node.Value.Id, node.LabelValue)
 	return false
 }
+
+// Determine the desired and minimum number of replicas for blocks in a logical volume.
+//
+// These are taken from the volume's "replicas" and "minimum-replicas" labels. Volumes without labels store a single
+// replica, and the minimum defaults to the desired number of replicas.
+func replicationForVolume(lvConfig *config.LogicalVolumeConfig) (int, int, error) {
+	replicas := DefaultReplicas
+
+	if value, ok := lvConfig.Labels[LabelReplicas]; ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return 0, 0, fmt.Errorf("volume %s has an invalid %s label '%s'", lvConfig.Id, LabelReplicas, value)
+		}
+
+		replicas = parsed
+	}
+
+	minimumReplicas := replicas
+
+	if value, ok := lvConfig.Labels[LabelMinimumReplicas]; ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > replicas {
+			return 0, 0, fmt.Errorf("volume %s has an invalid %s label '%s'", lvConfig.Id, LabelMinimumReplicas,
+				value)
+		}
+
+		minimumReplicas = parsed
+	}
+
+	return replicas, minimumReplicas, nil
+}
+
+// Determine the erasure coding layout of a logical volume from its "ec" label.
+//
+// The label's value is the number of data and parity fragments in each stripe, such as 6+3. Volumes without the label
+// are replicated, and 0, 0 is returned.
+func erasureCodingForVolume(lvConfig *config.LogicalVolumeConfig) (int, int, error) {
+	value, ok := lvConfig.Labels[LabelErasureCoding]
+	if !ok {
+		return 0, 0, nil
+	}
+
+	invalid := fmt.Errorf("volume %s has an invalid %s label '%s' - expected data+parity fragments, e.g. 6+3",
+		lvConfig.Id, LabelErasureCoding, value)
+
+	parts := strings.Split(value, "+")
+	if len(parts) != 2 {
+		return 0, 0, invalid
+	}
+
+	dataFragments, err := strconv.Atoi(parts[0])
+	if err != nil || dataFragments < 1 {
+		return 0, 0, invalid
+	}
+
+	parityFragments, err := strconv.Atoi(parts[1])
+	if err != nil || parityFragments < 1 || dataFragments+parityFragments > erasure.MaxShards {
+		return 0, 0, invalid
+	}
+
+	return dataFragments, parityFragments, nil
+}
+
+// Determine the block codec for a logical volume from its "codec" label.
+func codecForVolume(lvConfig *config.LogicalVolumeConfig) (string, error) {
+	name := lvConfig.Labels[LabelCodec]
+
+	if _, err := block.LookupCodec(name); err != nil {
+		return "", fmt.Errorf("volume %s has an invalid %s label - %v", lvConfig.Id, LabelCodec, err)
+	}
+
+	return name, nil
+}
+
+// Determine whether a logical volume deduplicates blocks from its "dedup" label.
+func dedupForVolume(lvConfig *config.LogicalVolumeConfig) (bool, error) {
+	value, ok := lvConfig.Labels[LabelDedup]
+	if !ok {
+		return false, nil
+	}
+
+	dedup, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("volume %s has an invalid %s label '%s'", lvConfig.Id, LabelDedup, value)
+	}
+
+	return dedup, nil
+}
@@ -0,0 +1,202 @@
+package client
+
+import (
+	"bfs/config"
+	"bfs/file"
+	"bfs/service/blockservice"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestReplicationForVolume(t *testing.T) {
+	tests := []struct {
+		labels          map[string]string
+		replicas        int
+		minimumReplicas int
+		valid           bool
+	}{
+		{labels: map[string]string{}, replicas: 1, minimumReplicas: 1, valid: true},
+		{labels: map[string]string{"replicas": "3"}, replicas: 3, minimumReplicas: 3, valid: true},
+		{labels: map[string]string{"replicas": "3", "minimum-replicas": "2"}, replicas: 3, minimumReplicas: 2, valid: true},
+		{labels: map[string]string{"replicas": "0"}},
+		{labels: map[string]string{"replicas": "x"}},
+		{labels: map[string]string{"replicas": "2", "minimum-replicas": "3"}},
+		{labels: map[string]string{"minimum-replicas": "0"}},
+	}
+
+	for _, test := range tests {
+		replicas, minimumReplicas, err := replicationForVolume(&config.LogicalVolumeConfig{Id: "lv1", Labels: test.labels})
+
+		if !test.valid {
+			require.Error(t, err, "labels: %v", test.labels)
+			continue
+		}
+
+		require.NoError(t, err, "labels: %v", test.labels)
+		require.Equal(t, test.replicas, replicas)
+		require.Equal(t, test.minimumReplicas, minimumReplicas)
+	}
+}
+
+func TestCodecForVolume(t *testing.T) {
+	codec, err := codecForVolume(&config.LogicalVolumeConfig{Id: "lv1", Labels: map[string]string{}})
+	require.NoError(t, err)
+	require.Empty(t, codec)
+
+	codec, err = codecForVolume(&config.LogicalVolumeConfig{Id: "lv1", Labels: map[string]string{"codec": "gzip"}})
+	require.NoError(t, err)
+	require.Equal(t, "gzip", codec)
+
+	_, err = codecForVolume(&config.LogicalVolumeConfig{Id: "lv1", Labels: map[string]string{"codec": "lzma"}})
+	require.Error(t, err)
+}
+
+func TestDedupForVolume(t *testing.T) {
+	dedup, err := dedupForVolume(&config.LogicalVolumeConfig{Id: "lv1", Labels: map[string]string{}})
+	require.NoError(t, err)
+	require.False(t, dedup)
+
+	dedup, err = dedupForVolume(&config.LogicalVolumeConfig{Id: "lv1", Labels: map[string]string{"dedup": "true"}})
+	require.NoError(t, err)
+	require.True(t, dedup)
+
+	_, err = dedupForVolume(&config.LogicalVolumeConfig{Id: "lv1", Labels: map[string]string{"dedup": "sometimes"}})
+	require.Error(t, err)
+}
+
+func TestErasureCodingForVolume(t *testing.T) {
+	tests := []struct {
+		label           string
+		valid           bool
+		dataFragments   int
+		parityFragments int
+	}{
+		{label: "6+3", valid: true, dataFragments: 6, parityFragments: 3},
+		{label: "1+1", valid: true, dataFragments: 1, parityFragments: 1},
+		{label: "6", valid: false},
+		{label: "6+0", valid: false},
+		{label: "0+3", valid: false},
+		{label: "a+b", valid: false},
+		{label: "200+100", valid: false},
+	}
+
+	dataFragments, parityFragments, err := erasureCodingForVolume(&config.LogicalVolumeConfig{Id: "lv1"})
+	require.NoError(t, err)
+	require.Equal(t, 0, dataFragments)
+	require.Equal(t, 0, parityFragments)
+
+	for _, test := range tests {
+		dataFragments, parityFragments, err := erasureCodingForVolume(&config.LogicalVolumeConfig{
+			Id:     "lv1",
+			Labels: map[string]string{"ec": test.label},
+		})
+
+		if !test.valid {
+			require.Error(t, err, "label: %s", test.label)
+			continue
+		}
+
+		require.NoError(t, err, "label: %s", test.label)
+		require.Equal(t, test.dataFragments, dataFragments)
+		require.Equal(t, test.parityFragments, parityFragments)
+	}
+}
+
+func TestClient_BlockAcceptFunc(t *testing.T) {
+	client := &Client{clusterState: NewClusterState()}
+
+	client.clusterState.AddHostConfig(&config.HostConfig{
+		Id:                 "h1",
+		Hostname:           "host1",
+		BlockServiceConfig: &config.BlockServiceConfig{},
+	})
+
+	volumeStatus := &config.PhysicalVolumeStatus{
+		Id: "pv1",
+		FileSystemStatus: &config.FileSystemStatus{
+			BlockSize:       4096,
+			BlocksAvailable: 1024 * 1024 * 1024,
+		},
+	}
+
+	client.clusterState.AddHostStatus(&config.HostStatus{
+		Id:           "h1",
+		VolumeStatus: map[string]*config.PhysicalVolumeStatus{"pv1": volumeStatus},
+	})
+
+	node := &file.ValueNode{Value: &config.PhysicalVolumeConfig{Id: "pv1"}, LabelValue: "host1"}
+
+	tests := []struct {
+		state  string
+		accept bool
+	}{
+		{state: "", accept: true},
+		{state: blockservice.StateOpen, accept: true},
+		{state: blockservice.StateReadOnly, accept: false},
+		{state: blockservice.StateDraining, accept: false},
+	}
+
+	for _, test := range tests {
+		volumeStatus.State = test.state
+		require.Equal(t, test.accept, client.blockAcceptFunc(node), "state: %s", test.state)
+	}
+
+	require.False(t, client.blockAcceptFunc(&file.ValueNode{Value: &config.PhysicalVolumeConfig{Id: "pv2"}, LabelValue: "host1"}))
+	require.False(t, client.blockAcceptFunc(&file.ValueNode{Value: &config.PhysicalVolumeConfig{Id: "pv1"}, LabelValue: "host2"}))
+}
+
+func TestClient_PlaceOnMemoryVolume(t *testing.T) {
+	pv := blockservice.NewMemoryPhysicalVolume()
+	pv.MaxBytes = 64 * 1024 * 1024
+	require.NoError(t, pv.Open(false))
+	defer pv.Close()
+
+	pvConfig := &config.PhysicalVolumeConfig{
+		Id:      pv.ID.String(),
+		Path:    "scratch",
+		Storage: config.VolumeStorage_STORAGE_MEMORY,
+		Labels:  map[string]string{"hostname": "host1"},
+	}
+
+	client := &Client{clusterState: NewClusterState()}
+
+	client.clusterState.AddHostConfig(&config.HostConfig{
+		Id:       "h1",
+		Hostname: "host1",
+		BlockServiceConfig: &config.BlockServiceConfig{
+			VolumeConfigs: []*config.PhysicalVolumeConfig{pvConfig},
+		},
+	})
+
+	// Publish the status the server's health routine would.
+	client.clusterState.AddHostStatus(&config.HostStatus{
+		Id:           "h1",
+		VolumeStatus: map[string]*config.PhysicalVolumeStatus{pvConfig.Id: pv.Status()},
+	})
+
+	placementPolicy := file.NewLabelAwarePlacementPolicy(
+		[]*config.PhysicalVolumeConfig{pvConfig},
+		"hostname",
+		false,
+		1,
+		1,
+		client.blockAcceptFunc,
+	)
+
+	selected, err := placementPolicy.Next()
+	require.NoError(t, err)
+	require.Equal(t, []*config.PhysicalVolumeConfig{pvConfig}, selected)
+
+	// A memory volume at its limit takes no more blocks.
+	full := pv.Status()
+	full.UsedBytes = full.MaxBytes
+	full.FileSystemStatus.BlocksAvailable = 0
+
+	client.clusterState.AddHostStatus(&config.HostStatus{
+		Id:           "h1",
+		VolumeStatus: map[string]*config.PhysicalVolumeStatus{pvConfig.Id: full},
+	})
+
+	_, err = placementPolicy.Next()
+	require.Error(t, err)
+}
@@ -1,5 +1,7 @@
 package client
 
+import "bfs/util/size"
+
 const (
 	// The default etcd key prefix. All keys will be prefixed with this value unless overridden.
 	DefaultEtcdPrefix = "/bfs"
@@ -13,4 +15,40 @@ const (
 	EtcdHostsConfigPrefix = "/config"
 	// The etcd key prefix under which host status is kept. This value is appended to EtcdHostsPrefix.
 	EtcdHostsStatusPrefix = "/status"
+	// The etcd key prefix under which operator-set physical volume states are kept, one key per PV ID.
+	// This value is appended to the configured prefix or DefaultEtcdPrefix, otherwise.
+	EtcdVolumeStatePrefix = "/pvstate"
+	// The etcd key prefix under which the progress of physical volume decommissions is kept, one key per PV ID.
+	// This value is appended to the configured prefix or DefaultEtcdPrefix, otherwise.
+	EtcdDecommissionPrefix = "/decommission"
+	// The etcd key prefix under which physical volumes are added to running hosts, one key per host ID and volume
+	// path (e.g. /pvconfig/host1/data/pv3) holding the volume's config. Deleting a key removes its volume.
+	// This value is appended to the configured prefix or DefaultEtcdPrefix, otherwise.
+	EtcdHostVolumesPrefix = "/pvconfig"
+	// The etcd key prefix under which the content-addressed blocks of deduplicating logical volumes are indexed, one
+	// key per volume and block ID (e.g. /dedup/lv1/<blockId>) holding the block's metadata.
+	// This value is appended to the configured prefix or DefaultEtcdPrefix, otherwise.
+	EtcdDedupPrefix = "/dedup"
+)
+
+const (
+	// The logical volume label holding the desired number of replicas for each block.
+	LabelReplicas = "replicas"
+	// The logical volume label holding the number of replicas that must acknowledge a block before it is committed.
+	LabelMinimumReplicas = "minimum-replicas"
+	// The number of replicas for volumes without a replicas label.
+	DefaultReplicas = 1
+	// The logical volume label holding the name of the codec used to compress blocks (e.g. gzip or flate). Volumes
+	// without a codec label store blocks uncompressed.
+	LabelCodec = "codec"
+	// The logical volume label selecting erasure coding instead of replication, as data+parity fragments per stripe
+	// (e.g. 6+3). Fragments of a stripe are placed on distinct hosts.
+	LabelErasureCoding = "ec"
+	// The logical volume label enabling block deduplication (true or false). Blocks of deduplicating volumes are named
+	// by their content, and a block matching one already in the volume references it instead of being stored again.
+	// Erasure-coded volumes can not deduplicate.
+	LabelDedup = "dedup"
+	// The space that must be available on a physical volume that doesn't report a reservation for blocks to be
+	// placed on it.
+	DefaultMinimumAvailableBytes = 10 * size.GB
 )
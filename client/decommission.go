@@ -0,0 +1,569 @@
+package client
+
+import (
+	"bfs/config"
+	"bfs/file"
+	"bfs/service/blockservice"
+	"bfs/service/nameservice"
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// How often decommission progress is saved to etcd and reported.
+	decommissionSaveInterval = 5 * time.Second
+)
+
+// A callback invoked as a decommission progresses.
+type DecommissionProgressFunc func(status *config.DecommissionStatus)
+
+// Move every block replica off a physical volume and retire it.
+//
+// The volume is first made DRAINING so it accepts no new blocks. Each pass over the namespace copies the replicas held
+// by the volume to volumes chosen by the placement policy of the file's logical volume, verifies the copy against the
+// block's checksum, points the file's entry at the new replica, and deletes the old one. Passes repeat until one finds
+// nothing to move. Once the volume is empty it's made RETIRED.
+//
+// Blocks then left on the volume aren't referenced by any file, but may belong to a file still being written, which
+// isn't added to the namespace until it's closed. They're only reported, and the volume isn't retired, unless force is
+// given, when those written before the decommission started are removed.
+//
+// Progress is kept in etcd and reported to progressFunc, which may be nil. Every step may be safely repeated, so an
+// interrupted decommission is resumed by calling Decommission again. A crash between copying a replica and updating
+// its entry leaves an unreferenced copy on the target volume.
+func (this *Client) Decommission(pvId string, force bool, progressFunc DecommissionProgressFunc) error {
+	if this.clusterState.PhysicalVolumeConfig(pvId) == nil {
+		return fmt.Errorf("unknown physical volume %s", pvId)
+	}
+
+	decomStatus, err := this.DecommissionStatus(pvId)
+	if err != nil {
+		return err
+	}
+
+	if decomStatus == nil {
+		decomStatus = &config.DecommissionStatus{PvId: pvId, Started: time.Now().UnixNano()}
+	} else if decomStatus.State == config.DecommissionState_DECOMMISSION_COMPLETE {
+		glog.Infof("Volume %s is already decommissioned", pvId)
+		return nil
+	} else {
+		glog.Infof("Resuming decommission of volume %s after %d passes", pvId, decomStatus.Passes)
+	}
+
+	decom := &decommission{
+		client:       this,
+		status:       decomStatus,
+		force:        force,
+		progressFunc: progressFunc,
+		policies:     make(map[string]file.BlockPlacementPolicy),
+	}
+
+	if err := decom.run(); err != nil {
+		decomStatus.LastError = err.Error()
+		decom.save(true)
+
+		return err
+	}
+
+	return nil
+}
+
+// Get the progress of a physical volume's decommission, or nil if it's never been decommissioned.
+func (this *Client) DecommissionStatus(pvId string) (*config.DecommissionStatus, error) {
+	getResp, err := this.etcdClient.Get(
+		context.Background(),
+		filepath.Join(DefaultEtcdPrefix, EtcdDecommissionPrefix, pvId),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(getResp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	decomStatus := &config.DecommissionStatus{}
+	if err := proto.UnmarshalText(string(getResp.Kvs[0].Value), decomStatus); err != nil {
+		return nil, err
+	}
+
+	return decomStatus, nil
+}
+
+// The state of one run of a decommission.
+type decommission struct {
+	client       *Client
+	status       *config.DecommissionStatus
+	force        bool
+	progressFunc DecommissionProgressFunc
+	lastSaved    time.Time
+
+	// Placement policies by logical volume ID. Policies are kept for the whole run so targets are spread out.
+	policies map[string]file.BlockPlacementPolicy
+
+	// The volumes and hosts holding other replicas of the block being moved, which can't be used as its target.
+	excludedPvIds     map[string]bool
+	excludedHostnames map[string]bool
+}
+
+func (this *decommission) run() error {
+	pvId := this.status.PvId
+
+	if err := this.client.SetPhysicalVolumeState(pvId, blockservice.StateDraining); err != nil {
+		return err
+	}
+
+	this.save(true)
+
+	for {
+		blocks, err := this.volumeBlocks()
+		if err != nil {
+			return err
+		}
+
+		this.status.BlocksOnVolume = uint64(len(blocks))
+		this.status.BlocksFailed = 0
+
+		moved, err := this.pass()
+		if err != nil {
+			return err
+		}
+
+		this.status.Passes++
+		this.save(true)
+
+		if this.status.BlocksFailed > 0 {
+			return fmt.Errorf("unable to move %d blocks off volume %s - decommission again to retry",
+				this.status.BlocksFailed, pvId)
+		}
+
+		if moved == 0 {
+			break
+		}
+	}
+
+	remaining, err := this.removeUnreferenced()
+	if err != nil {
+		return err
+	}
+
+	if !this.force && this.status.BlocksUnreferenced > 0 {
+		return fmt.Errorf("%d blocks on volume %s aren't referenced by any file but may belong to files still being"+
+			" written - decommission again once writes in progress complete, or with force to remove them",
+			this.status.BlocksUnreferenced, pvId)
+	}
+
+	if remaining > 0 {
+		return fmt.Errorf("%d blocks on volume %s were written after its decommission started or belong to files added"+
+			" since its last pass - decommission again once writes in progress complete", remaining, pvId)
+	}
+
+	if err := this.client.SetPhysicalVolumeState(pvId, blockservice.StateRetired); err != nil {
+		return err
+	}
+
+	this.status.State = config.DecommissionState_DECOMMISSION_COMPLETE
+	this.status.BlocksOnVolume = 0
+	this.status.LastError = ""
+	this.save(true)
+
+	glog.Infof("Decommissioned volume %s - moved %d blocks (%d bytes)", pvId, this.status.BlocksMoved,
+		this.status.BytesMoved)
+
+	return nil
+}
+
+// Move the volume's replicas of every block referenced by the namespace. Returns the number of replicas moved.
+func (this *decommission) pass() (int, error) {
+	moved := 0
+
+	for listEntry := range this.client.List("", "") {
+		if listEntry.Err != nil {
+			return moved, listEntry.Err
+		}
+
+		entry := listEntry.Entry
+
+		for _, block := range entry.Blocks {
+			if !containsString(block.PvIds, this.status.PvId) {
+				continue
+			}
+
+			ok, err := this.moveReplica(entry, block)
+			if err != nil {
+				glog.Errorf("Unable to move block %s of %s off volume %s - %v", block.BlockId, entry.Path,
+					this.status.PvId, err)
+
+				this.status.BlocksFailed++
+				this.status.LastError = fmt.Sprintf("%s block %s - %v", entry.Path, block.BlockId, err)
+			} else if ok {
+				moved++
+				this.status.BlocksMoved++
+				if block.StoredSize > 0 {
+					this.status.BytesMoved += block.StoredSize
+				} else {
+					this.status.BytesMoved += block.Size
+				}
+			}
+
+			this.save(false)
+		}
+	}
+
+	return moved, nil
+}
+
+// Move the volume's replica of a block to another volume.
+//
+// Returns false if the entry changed so that it no longer references the replica, such as when the file was removed
+// during the move.
+func (this *decommission) moveReplica(entry *nameservice.Entry, block *nameservice.BlockMetadata) (bool, error) {
+	pvId := this.status.PvId
+
+	lvConfig, pvConfigs := this.client.volumeForPath(entry.Path)
+	if lvConfig == nil {
+		return false, fmt.Errorf("unable to find volume for file %s", entry.Path)
+	}
+
+	codec, err := codecForVolume(lvConfig)
+	if err != nil {
+		return false, err
+	}
+
+	dedup, err := dedupForVolume(lvConfig)
+	if err != nil {
+		return false, err
+	}
+
+	targetPvId, err := this.target(lvConfig, pvConfigs, block.BlockId, placementPeers(entry, block))
+	if err != nil {
+		return false, err
+	}
+
+	if err := this.copyReplica(block, targetPvId, codec, dedup); err != nil {
+		return false, err
+	}
+
+	conn, _, err := this.client.connectionForPath(entry.Path)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = conn.NameServiceClient.ReplaceReplica(context.Background(), &nameservice.ReplaceReplicaRequest{
+		Path:    entry.Path,
+		BlockId: block.BlockId,
+		OldPvId: pvId,
+		NewPvId: targetPvId,
+	})
+	if status.Code(err) == codes.NotFound {
+		// Neither copy is referenced any more.
+		glog.Warningf("File %s no longer references block %s on volume %s - discarding its copy", entry.Path,
+			block.BlockId, pvId)
+
+		this.deleteReplica(targetPvId, block.BlockId)
+		this.deleteReplica(pvId, block.BlockId)
+
+		return false, nil
+	} else if err != nil {
+		this.deleteReplica(targetPvId, block.BlockId)
+		return false, err
+	}
+
+	this.deleteReplica(pvId, block.BlockId)
+
+	return true, nil
+}
+
+// Choose the volume to receive a block's replica using the logical volume's placement policy.
+//
+// The given volumes, which hold the block's replicas or its stripe's fragments, and their hosts are excluded.
+func (this *decommission) target(lvConfig *config.LogicalVolumeConfig, pvConfigs []*config.PhysicalVolumeConfig,
+	blockId string, peerPvIds []string) (string, error) {
+
+	policy, ok := this.policies[lvConfig.Id]
+	if !ok {
+		policy = file.NewLabelAwarePlacementPolicy(pvConfigs, "hostname", false, 1, 1, this.acceptTarget)
+		this.policies[lvConfig.Id] = policy
+	}
+
+	this.excludedPvIds = make(map[string]bool, len(peerPvIds))
+	this.excludedHostnames = make(map[string]bool, len(peerPvIds))
+
+	for _, replicaPvId := range peerPvIds {
+		this.excludedPvIds[replicaPvId] = true
+
+		if replicaPvId == this.status.PvId {
+			continue
+		}
+
+		if pvConfig := this.client.clusterState.PhysicalVolumeConfig(replicaPvId); pvConfig != nil {
+			this.excludedHostnames[pvConfig.Labels["hostname"]] = true
+		}
+	}
+
+	targets, err := policy.Next()
+	if err != nil {
+		return "", fmt.Errorf("no volume available for block %s - %v", blockId, err)
+	}
+
+	return targets[0].Id, nil
+}
+
+// Returns the volumes holding a block's replicas or, for erasure-coded files, its stripe's fragments. A moved replica
+// must not share a host with any of them.
+func placementPeers(entry *nameservice.Entry, block *nameservice.BlockMetadata) []string {
+	if entry.ErasureCoding == nil {
+		return block.PvIds
+	}
+
+	fragments := int(entry.ErasureCoding.DataFragments + entry.ErasureCoding.ParityFragments)
+
+	for i, stripeBlock := range entry.Blocks {
+		if stripeBlock != block {
+			continue
+		}
+
+		start := i - i%fragments
+		end := start + fragments
+		if end > len(entry.Blocks) {
+			end = len(entry.Blocks)
+		}
+
+		var pvIds []string
+		for _, fragment := range entry.Blocks[start:end] {
+			pvIds = append(pvIds, fragment.PvIds...)
+		}
+
+		return pvIds
+	}
+
+	return block.PvIds
+}
+
+func (this *decommission) acceptTarget(node *file.ValueNode) bool {
+	if this.excludedPvIds[node.Value.Id] || this.excludedHostnames[node.LabelValue] {
+		return false
+	}
+
+	return this.client.blockAcceptFunc(node)
+}
+
+// Copy a block from one of its replicas to a volume and verify the copy.
+//
+// The decommissioned volume's replica is copied first. Other replicas are tried if it can't be. Block servers copy
+// the data between themselves and discard copies that don't match the block's checksum. Blocks of deduplicating
+// volumes are copied as content-addressed blocks, so a target that already holds the block adds a reference to it.
+func (this *decommission) copyReplica(block *nameservice.BlockMetadata, targetPvId string, codec string,
+	dedup bool) error {
+
+	targetConfig := this.client.clusterState.PhysicalVolumeConfig(targetPvId)
+	if targetConfig == nil {
+		return fmt.Errorf("unknown physical volume %s", targetPvId)
+	}
+
+	sources := make([]string, 0, len(block.PvIds))
+	sources = append(sources, this.status.PvId)
+
+	for _, replicaPvId := range block.PvIds {
+		if replicaPvId != this.status.PvId {
+			sources = append(sources, replicaPvId)
+		}
+	}
+
+	var err error
+
+	for _, sourcePvId := range sources {
+		var resp *blockservice.ReplicateResponse
+
+		resp, err = this.client.replicateBlock(sourcePvId, block, targetConfig, codec, dedup)
+		if err != nil {
+			glog.Warningf("Unable to copy block %s from volume %s to %s - %v", block.BlockId, sourcePvId,
+				targetPvId, err)
+			continue
+		}
+
+		if resp.Size != block.Size {
+			this.deleteReplica(targetPvId, block.BlockId)
+
+			err = fmt.Errorf("copy of block %s from volume %s has size %d, expected size %d", block.BlockId,
+				sourcePvId, resp.Size, block.Size)
+			glog.Warning(err)
+			continue
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+// Delete a replica, logging failures. Replicas left on the decommissioned volume are removed at the end of the
+// decommission.
+func (this *decommission) deleteReplica(pvId string, blockId string) {
+	blockClient, err := this.client.blockClientForVolume(pvId)
+	if err == nil {
+		_, err = blockClient.Delete(context.Background(), &blockservice.ReadRequest{VolumeId: pvId, BlockId: blockId})
+	}
+
+	if err != nil {
+		glog.Warningf("Unable to delete block %s from volume %s - %v", blockId, pvId, err)
+	}
+}
+
+// Delete every reference to a block, logging failures. Blocks of deduplicating volumes may hold references no file
+// makes, such as those taken by a writer that failed.
+func (this *decommission) removeBlock(pvId string, blockId string) {
+	blockClient, err := this.client.blockClientForVolume(pvId)
+
+	for err == nil {
+		var resp *blockservice.DeleteResponse
+
+		resp, err = blockClient.Delete(context.Background(), &blockservice.ReadRequest{VolumeId: pvId, BlockId: blockId})
+		if err == nil && resp.References == 0 {
+			return
+		}
+	}
+
+	glog.Warningf("Unable to delete block %s from volume %s - %v", blockId, pvId, err)
+}
+
+// List the blocks on the decommissioned volume.
+func (this *decommission) volumeBlocks() ([]*blockservice.BlockInfo, error) {
+	var blocks []*blockservice.BlockInfo
+
+	for listEntry := range this.client.ListBlocks(this.status.PvId) {
+		if listEntry.Err != nil {
+			return nil, listEntry.Err
+		}
+
+		blocks = append(blocks, listEntry.Block)
+	}
+
+	return blocks, nil
+}
+
+// List the blocks the namespace references on the decommissioned volume.
+func (this *decommission) referencedBlocks() (map[string]bool, error) {
+	referenced := make(map[string]bool)
+
+	for listEntry := range this.client.List("", "") {
+		if listEntry.Err != nil {
+			return nil, listEntry.Err
+		}
+
+		for _, block := range listEntry.Entry.Blocks {
+			if containsString(block.PvIds, this.status.PvId) {
+				referenced[block.BlockId] = true
+			}
+		}
+	}
+
+	return referenced, nil
+}
+
+// Count, and with force remove, the blocks no file references on the decommissioned volume. Returns the number of
+// blocks left.
+//
+// The namespace is checked again after listing the volume, so a block referenced by a file added since the last pass
+// is left to be moved by the next decommission. Only blocks written before the decommission started are removed; newer
+// blocks may belong to files still being written when the volume was made DRAINING.
+func (this *decommission) removeUnreferenced() (int, error) {
+	blocks, err := this.volumeBlocks()
+	if err != nil {
+		return 0, err
+	}
+
+	referenced, err := this.referencedBlocks()
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := 0
+	this.status.BlocksUnreferenced = 0
+
+	for _, blockInfo := range blocks {
+		if referenced[blockInfo.BlockId] || blockInfo.Mtime >= this.status.Started {
+			remaining++
+			continue
+		}
+
+		if !this.force {
+			glog.Warningf("Block %s on volume %s isn't referenced by any file", blockInfo.BlockId, this.status.PvId)
+
+			this.status.BlocksUnreferenced++
+			remaining++
+			continue
+		}
+
+		glog.Infof("Removing unreferenced block %s from volume %s", blockInfo.BlockId, this.status.PvId)
+
+		this.removeBlock(this.status.PvId, blockInfo.BlockId)
+		this.status.BlocksRemoved++
+	}
+
+	return remaining, nil
+}
+
+// Save progress to etcd and report it, at most every decommissionSaveInterval unless forced.
+func (this *decommission) save(force bool) {
+	now := time.Now()
+
+	if !force && now.Sub(this.lastSaved) < decommissionSaveInterval {
+		return
+	}
+
+	this.lastSaved = now
+	this.status.Updated = now.UnixNano()
+
+	_, err := this.client.etcdClient.Put(
+		context.Background(),
+		filepath.Join(DefaultEtcdPrefix, EtcdDecommissionPrefix, this.status.PvId),
+		proto.MarshalTextString(this.status),
+	)
+	if err != nil {
+		glog.Errorf("Unable to save decommission progress of volume %s - %v", this.status.PvId, err)
+	}
+
+	if this.progressFunc != nil {
+		this.progressFunc(this.status)
+	}
+}
+
+// Have the block server owning a volume copy one of its blocks to another volume, giving the copy the same block ID.
+//
+// The copy is checked against the block's recorded checksum, unless it was written before checksums were recorded.
+func (this *Client) replicateBlock(sourcePvId string, block *nameservice.BlockMetadata,
+	targetConfig *config.PhysicalVolumeConfig, codec string, dedup bool) (*blockservice.ReplicateResponse, error) {
+
+	sourceClient, err := this.blockClientForVolume(sourcePvId)
+	if err != nil {
+		return nil, err
+	}
+
+	return sourceClient.Replicate(context.Background(), &blockservice.ReplicateRequest{
+		VolumeId:            sourcePvId,
+		BlockId:             block.BlockId,
+		TargetVolumeId:      targetConfig.Id,
+		TargetEndpoint:      targetConfig.Labels["endpoint"],
+		Codec:               codec,
+		ExpectedChecksum:    block.Checksum,
+		HasExpectedChecksum: block.HasChecksum,
+		Dedup:               dedup,
+	})
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
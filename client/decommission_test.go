@@ -0,0 +1,100 @@
+package client
+
+import (
+	"bfs/config"
+	"bfs/file"
+	"bfs/service/nameservice"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDecommission_Target(t *testing.T) {
+	client := &Client{clusterState: NewClusterState()}
+
+	hosts := map[string][]string{
+		"host1": {"pv1", "pv2"},
+		"host2": {"pv3"},
+		"host3": {"pv4"},
+	}
+
+	var pvConfigs []*config.PhysicalVolumeConfig
+
+	for hostname, pvIds := range hosts {
+		hostConfig := &config.HostConfig{Id: hostname, Hostname: hostname, BlockServiceConfig: &config.BlockServiceConfig{}}
+		hostStatus := &config.HostStatus{Id: hostname, VolumeStatus: map[string]*config.PhysicalVolumeStatus{}}
+
+		for _, pvId := range pvIds {
+			pvConfig := &config.PhysicalVolumeConfig{Id: pvId, Labels: map[string]string{"hostname": hostname}}
+			hostConfig.BlockServiceConfig.VolumeConfigs = append(hostConfig.BlockServiceConfig.VolumeConfigs, pvConfig)
+			pvConfigs = append(pvConfigs, pvConfig)
+
+			hostStatus.VolumeStatus[pvId] = &config.PhysicalVolumeStatus{
+				Id:               pvId,
+				FileSystemStatus: &config.FileSystemStatus{BlockSize: 4096, BlocksAvailable: 1024 * 1024 * 1024},
+			}
+		}
+
+		client.clusterState.AddHostConfig(hostConfig)
+		client.clusterState.AddHostStatus(hostStatus)
+	}
+
+	decom := &decommission{
+		client:   client,
+		status:   &config.DecommissionStatus{PvId: "pv1"},
+		policies: make(map[string]file.BlockPlacementPolicy),
+	}
+
+	lvConfig := &config.LogicalVolumeConfig{Id: "lv1"}
+	block := &nameservice.BlockMetadata{BlockId: "b1", PvIds: []string{"pv1", "pv3"}}
+
+	// Volumes holding a replica and hosts holding another replica are never chosen.
+	targets := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		pvId, err := decom.target(lvConfig, pvConfigs, block.BlockId, block.PvIds)
+		require.NoError(t, err)
+		targets[pvId] = true
+	}
+
+	require.Equal(t, map[string]bool{"pv2": true, "pv4": true}, targets)
+
+	// Volumes that don't accept new blocks aren't chosen either.
+	_, hostStatus := client.clusterState.Host("host3")
+	hostStatus.VolumeStatus["pv4"].State = "DRAINING"
+
+	for i := 0; i < 5; i++ {
+		pvId, err := decom.target(lvConfig, pvConfigs, block.BlockId, block.PvIds)
+		require.NoError(t, err)
+		require.Equal(t, "pv2", pvId)
+	}
+
+	block.PvIds = []string{"pv1", "pv2", "pv3"}
+
+	_, err := decom.target(lvConfig, pvConfigs, block.BlockId, block.PvIds)
+	require.Error(t, err)
+}
+
+func TestDecommission_PlacementPeers(t *testing.T) {
+	entry := &nameservice.Entry{
+		Blocks: []*nameservice.BlockMetadata{
+			{BlockId: "b1", PvIds: []string{"pv1", "pv2"}},
+		},
+	}
+
+	require.Equal(t, []string{"pv1", "pv2"}, placementPeers(entry, entry.Blocks[0]))
+
+	// Fragments share placement with the rest of their stripe.
+	entry = &nameservice.Entry{
+		ErasureCoding: &nameservice.ErasureCoding{DataFragments: 2, ParityFragments: 1},
+		Blocks: []*nameservice.BlockMetadata{
+			{BlockId: "s1d1", PvIds: []string{"pv1"}},
+			{BlockId: "s1d2", PvIds: []string{"pv2"}},
+			{BlockId: "s1p1", PvIds: []string{"pv3"}},
+			{BlockId: "s2d1", PvIds: []string{"pv4"}},
+			{BlockId: "s2d2"},
+			{BlockId: "s2p1", PvIds: []string{"pv5"}},
+		},
+	}
+
+	require.Equal(t, []string{"pv1", "pv2", "pv3"}, placementPeers(entry, entry.Blocks[1]))
+	require.Equal(t, []string{"pv4", "pv5"}, placementPeers(entry, entry.Blocks[5]))
+}
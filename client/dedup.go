@@ -0,0 +1,52 @@
+package client
+
+import (
+	"bfs/file"
+	"bfs/service/nameservice"
+	"context"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/protobuf/proto"
+	"path/filepath"
+)
+
+// An index of a logical volume's content-addressed blocks, kept in etcd with one key per block holding its metadata.
+type etcdBlockIndex struct {
+	etcdClient *clientv3.Client
+	prefix     string
+}
+
+// Returns the index of a deduplicating logical volume's blocks.
+func (this *Client) blockIndex(lvId string) file.BlockIndex {
+	return &etcdBlockIndex{
+		etcdClient: this.etcdClient,
+		prefix:     filepath.Join(DefaultEtcdPrefix, EtcdDedupPrefix, lvId),
+	}
+}
+
+func (this *etcdBlockIndex) Lookup(blockId string) (*nameservice.BlockMetadata, error) {
+	getResp, err := this.etcdClient.Get(context.Background(), filepath.Join(this.prefix, blockId))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(getResp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	blockMetadata := &nameservice.BlockMetadata{}
+	if err := proto.UnmarshalText(string(getResp.Kvs[0].Value), blockMetadata); err != nil {
+		return nil, err
+	}
+
+	return blockMetadata, nil
+}
+
+func (this *etcdBlockIndex) Record(blockMetadata *nameservice.BlockMetadata) error {
+	_, err := this.etcdClient.Put(
+		context.Background(),
+		filepath.Join(this.prefix, blockMetadata.BlockId),
+		proto.MarshalTextString(blockMetadata),
+	)
+
+	return err
+}
@@ -17,6 +17,10 @@ type BlockPlacementPolicy interface {
 	// for a replica. An error is returned if the required number of replicas can not be satisfied. Implementations may
 	// specify additional conditions and constraints on the returned values.
 	Next() ([]*config.PhysicalVolumeConfig, error)
+
+	// Returns the desired and minimum number of replicas for each block. Writers consider a block committed once at
+	// least the minimum number of replicas acknowledge it.
+	Replication() (replicas int, minimumReplicas int)
 }
 
 // Distribute replicas across PVs with different values for a given label.
@@ -43,6 +47,9 @@ type LabelAwarePlacementPolicy struct {
 	AcceptanceFunc func(node *ValueNode) bool
 
 	ring *ring.Ring
+
+	// The number of PVs in the ring.
+	size int
 }
 
 type ValueNode struct {
@@ -92,6 +99,7 @@ func NewLabelAwarePlacementPolicy(volumeConfigs []*config.PhysicalVolumeConfig,
 		}
 
 		newNode := &ring.Ring{Value: &ValueNode{LabelValue: labelValue, Value: pvConfig}}
+		this.size++
 
 		if val, ok := ringIndex[labelValue]; !ok {
 			ringIndex[labelValue] = newNode
@@ -117,6 +125,10 @@ func NewLabelAwarePlacementPolicy(volumeConfigs []*config.PhysicalVolumeConfig,
 	return this
 }
 
+func (this *LabelAwarePlacementPolicy) Replication() (int, int) {
+	return this.Replicas, this.MinimumReplicas
+}
+
 func (this *LabelAwarePlacementPolicy) Next() ([]*config.PhysicalVolumeConfig, error) {
 	glog.V(3).Infof("Next replica set for %s (desired replicas: %d, min replicas: %d)",
 		this.LabelName, this.Replicas, this.MinimumReplicas)
@@ -126,6 +138,11 @@ func (this *LabelAwarePlacementPolicy) Next() ([]*config.PhysicalVolumeConfig, e
 
 	firstPV := ""
 
+	// Rejections in total and for the current label value. Once every PV with a label value has been rejected, the next
+	// value is tried; once more PVs than exist have been rejected, there's nothing left to try.
+	rejected := 0
+	valueRejected := 0
+
 	for i := 1; i <= this.Replicas; {
 		rootNode := this.ring
 		valueNode := rootNode.Value.(*ring.Ring)
@@ -146,18 +163,29 @@ func (this *LabelAwarePlacementPolicy) Next() ([]*config.PhysicalVolumeConfig, e
 		if this.AcceptanceFunc != nil && !this.AcceptanceFunc(value) {
 			glog.V(3).Infof("Replica %d/%d selection disallowed by accept func", i, this.Replicas)
 
-			if valueNode == valueNode.Next() {
-				// Special case: If the label value only has one element in the ring, it will loop forever. Advance root.
+			rejected++
+			valueRejected++
+
+			if rejected > this.size {
+				glog.V(3).Infof("Every PV disallowed by accept func - exhausted everything")
+				break
+			}
+
+			if valueRejected >= valueNode.Len() {
+				// Every PV with this label value was rejected. Advance root.
 				if this.ring == this.ring.Next() {
 					// Special case: If the root value only has one element in the ring, it will loop forever. Give up.
 					break
 				}
 
 				this.ring = rootNode.Next()
+				valueRejected = 0
 			} else {
 				rootNode.Value = valueNode.Next()
 			}
 		} else {
+			valueRejected = 0
+
 			if _, ok := selectedValues[value.LabelValue]; !ok {
 				glog.V(3).Infof("Replica %d/%d selection: %s pv: %s",
 					i, this.Replicas, value.LabelValue, value.Value.Id)
@@ -62,3 +62,37 @@ func TestLabelAwarePlacementPolicy(t *testing.T) {
 		glog.V(logging.LogLevelTrace).Infof("Request: %d - Selected: %v - Error: %v", i, pvs, err)
 	}
 }
+
+func TestLabelAwarePlacementPolicy_Rejections(t *testing.T) {
+	defer glog.Flush()
+
+	pvConfigs := []*config.PhysicalVolumeConfig{
+		{Id: "a1", Labels: map[string]string{"hostname": "a"}},
+		{Id: "a2", Labels: map[string]string{"hostname": "a"}},
+		{Id: "b1", Labels: map[string]string{"hostname": "b"}},
+		{Id: "c1", Labels: map[string]string{"hostname": "c"}},
+	}
+
+	accepted := map[string]bool{"c1": true}
+
+	pp := NewLabelAwarePlacementPolicy(pvConfigs, "hostname", false, 1, 1, func(node *ValueNode) bool {
+		return accepted[node.Value.Id]
+	})
+
+	// Every PV of a label value being rejected moves selection on to the next value.
+	for i := 0; i < 10; i++ {
+		selectedPVs, err := pp.Next()
+		require.NoError(t, err)
+		require.Len(t, selectedPVs, 1)
+		require.Equal(t, "c1", selectedPVs[0].Id)
+	}
+
+	// Rejecting every PV ends the search.
+	accepted = map[string]bool{}
+
+	for i := 0; i < 10; i++ {
+		selectedPVs, err := pp.Next()
+		require.Error(t, err)
+		require.Empty(t, selectedPVs)
+	}
+}
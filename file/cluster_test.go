@@ -0,0 +1,170 @@
+package file
+
+import (
+	"bfs/config"
+	"bfs/lru"
+	"bfs/server/blockserver"
+	"bfs/server/nameserver"
+	"bfs/service/blockservice"
+	"bfs/service/nameservice"
+	"bfs/test"
+	"bfs/util"
+	"bfs/util/size"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// A block server and name server sharing an RPC server, and a client connection to both.
+type testCluster struct {
+	testDir     *test.Directory
+	blockServer *blockserver.BlockServer
+
+	nameClient  nameservice.NameServiceClient
+	blockClient blockservice.BlockServiceClient
+
+	// Returns the client connection for every endpoint.
+	clientFactory *lru.LRUCache
+
+	// Undo each step of starting the cluster, in reverse order.
+	stops []func()
+}
+
+// Start a cluster whose block server has the given number of volumes, each labelled as its own disk. The RPC server
+// and the name server's etcd listen on free ports, and options are added to those of the RPC server.
+func startCluster(t testing.TB, volumes int, options ...grpc.ServerOption) *testCluster {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+
+	this := &testCluster{testDir: testDir}
+	this.onStop(func() { testDir.Destroy() })
+
+	started := false
+	defer func() {
+		if !started {
+			this.stop()
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	rpcPort := listener.Addr().(*net.TCPAddr).Port
+	bindAddress := fmt.Sprintf("%s:%d", "localhost", rpcPort)
+
+	rpcServer := grpc.NewServer(append([]grpc.ServerOption{
+		grpc.WriteBufferSize(size.MB * 8),
+		grpc.ReadBufferSize(size.MB * 8),
+		grpc.MaxRecvMsgSize(size.MB * 10),
+		grpc.MaxSendMsgSize(size.MB * 10),
+	}, options...)...)
+	this.onStop(rpcServer.GracefulStop)
+
+	var volumeConfigs []*config.PhysicalVolumeConfig
+	for i := 1; i <= volumes; i++ {
+		volumeConfigs = append(volumeConfigs, &config.PhysicalVolumeConfig{
+			Path:                filepath.Join(testDir.Path, fmt.Sprintf("pv%d", i)),
+			AllowAutoInitialize: true,
+			Labels:              map[string]string{"disk": fmt.Sprintf("%d", i)},
+		})
+	}
+
+	this.blockServer = blockserver.New(
+		&config.BlockServiceConfig{
+			Hostname:      "localhost",
+			Port:          int32(rpcPort),
+			VolumeConfigs: volumeConfigs,
+		},
+		rpcServer,
+	)
+
+	require.NoError(t, this.blockServer.Start())
+	this.onStop(func() { assert.NoError(t, this.blockServer.Stop()) })
+
+	etcdPorts := freePorts(t, 2)
+
+	nameServer := nameserver.New(
+		&config.NameServiceConfig{
+			Hostname: "localhost",
+			Port:     int32(rpcPort),
+			Path:     filepath.Join(testDir.Path, "ns"),
+			GroupId:  "ns-shard-1",
+			Nodes: []*config.NameServiceNodeConfig{
+				{Id: "localhost", Hostname: "localhost", BindAddress: "0.0.0.0", ClientPort: int32(etcdPorts[0]),
+					PeerPort: int32(etcdPorts[1])},
+			},
+		},
+		rpcServer,
+	)
+	require.NoError(t, nameServer.Start())
+	this.onStop(func() { assert.NoError(t, nameServer.Stop()) })
+
+	go func() {
+		assert.NoError(t, rpcServer.Serve(listener))
+	}()
+
+	conn, err := grpc.Dial(
+		bindAddress,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithWriteBufferSize(size.MB*8),
+		grpc.WithReadBufferSize(size.MB*8),
+		grpc.WithInitialWindowSize(size.MB),
+	)
+	require.NoError(t, err)
+	this.onStop(func() { conn.Close() })
+
+	this.nameClient = nameservice.NewNameServiceClient(conn)
+	this.blockClient = blockservice.NewBlockServiceClient(conn)
+
+	serviceCtx := &util.ServiceCtx{
+		Conn:               conn,
+		BlockServiceClient: this.blockClient,
+		NameServiceClient:  this.nameClient,
+	}
+
+	this.clientFactory = lru.NewCache(
+		2,
+		func(name string) (interface{}, error) {
+			return serviceCtx, nil
+		},
+		lru.DefaultDestroyFunc,
+	)
+	this.onStop(func() { this.clientFactory.Purge() })
+
+	started = true
+
+	return this
+}
+
+func (this *testCluster) onStop(stop func()) {
+	this.stops = append(this.stops, stop)
+}
+
+// Stop the cluster and remove its data.
+func (this *testCluster) stop() {
+	for i := len(this.stops) - 1; i >= 0; i-- {
+		this.stops[i]()
+	}
+
+	this.stops = nil
+}
+
+// Returns ports nothing is listening on. Another process may take them before they are used.
+func freePorts(t testing.TB, n int) []int {
+	ports := make([]int, n)
+
+	for i := range ports {
+		listener, err := net.Listen("tcp", ":0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		ports[i] = listener.Addr().(*net.TCPAddr).Port
+	}
+
+	return ports
+}
@@ -0,0 +1,180 @@
+package file
+
+import (
+	"bfs/service/blockservice"
+	"bfs/service/nameservice"
+	"bfs/util/logging"
+	"bfs/util/size"
+	"context"
+	"github.com/golang/glog"
+)
+
+/*
+ * Block deduplication.
+ *
+ * A writer that deduplicates holds each block in memory until it is complete, then names it by its content (see
+ * blockservice.ContentBlockId). If the logical volume's index already records the block, the writer adds a reference
+ * to each recorded replica rather than writing the data again. Otherwise the block is written in dedup mode, in which
+ * a volume that already holds the block also just adds a reference, and recorded in the index once committed.
+ */
+
+const (
+	// The amount of block data sent in each write request when a deduplicated block is written.
+	dedupChunkSize = size.MB
+)
+
+// An index of the content-addressed blocks of a logical volume.
+type BlockIndex interface {
+	// Find the metadata recorded for a block, or nil if it isn't in the index.
+	Lookup(blockId string) (*nameservice.BlockMetadata, error)
+
+	// Record the metadata of a committed block, replacing any already recorded.
+	Record(block *nameservice.BlockMetadata) error
+}
+
+// Add a buffer to the blocks held in memory, writing each block as it is completed.
+func (this *LocalFileWriter) buffer(buffer []byte) (int, error) {
+	totalWritten := 0
+
+	for len(buffer) > 0 {
+		if len(this.pending) == this.blockSize {
+			if err := this.Flush(); err != nil {
+				return totalWritten, err
+			}
+		}
+
+		if this.pending == nil {
+			this.pending = make([]byte, 0, this.blockSize)
+			this.blockCount++
+		}
+
+		writeLen := this.blockSize - len(this.pending)
+		if writeLen > len(buffer) {
+			writeLen = len(buffer)
+		}
+
+		this.pending = append(this.pending, buffer[:writeLen]...)
+		this.filePos += writeLen
+		totalWritten += writeLen
+		buffer = buffer[writeLen:]
+	}
+
+	return totalWritten, nil
+}
+
+// Reference or start writing the block held in memory. Returns true if existing replicas were referenced, in which
+// case the block is complete; otherwise the block is left open on its new replicas.
+func (this *LocalFileWriter) flushPending() (bool, error) {
+	data := this.pending
+	blockId := blockservice.ContentBlockIdOf(data)
+
+	if blockMetadata := this.referenceExisting(blockId); blockMetadata != nil {
+		this.pending = nil
+		this.blockList = append(this.blockList, blockMetadata)
+
+		glog.V(logging.LogLevelDebug).Infof("Deduplicated block %d (%s) of %s on %d replicas", this.blockCount,
+			blockId, this.filename, len(blockMetadata.PvIds))
+
+		return true, nil
+	}
+
+	// The block is kept in memory until it reaches its replicas so a failure to allocate it may be retried.
+	if err := this.openReplicas(blockId); err != nil {
+		return false, err
+	}
+
+	this.pending = nil
+
+	for pos := 0; ; pos += dedupChunkSize {
+		end := pos + dedupChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := this.send(data[pos:end]); err != nil {
+			return false, err
+		}
+
+		this.blockPos = end
+
+		if end == len(data) {
+			break
+		}
+	}
+
+	return false, nil
+}
+
+// Add a reference to the replicas of a block recorded in the index, returning the block's metadata, or nil if the
+// block isn't in the index or too few of its replicas could be referenced. References are released if too few are
+// taken.
+func (this *LocalFileWriter) referenceExisting(blockId string) *nameservice.BlockMetadata {
+	recorded, err := this.Index.Lookup(blockId)
+	if err != nil {
+		glog.Warningf("Unable to look up block %s of %s - %v", blockId, this.filename, err)
+		return nil
+	} else if recorded == nil {
+		return nil
+	}
+
+	replicas, minimumReplicas := this.placementPolicy.Replication()
+
+	blockMetadata := &nameservice.BlockMetadata{
+		BlockId:     blockId,
+		Size:        recorded.Size,
+		Checksum:    recorded.Checksum,
+		StoredSize:  recorded.StoredSize,
+		HasChecksum: recorded.HasChecksum,
+		PvIds:       make([]string, 0, replicas),
+	}
+
+	for _, pvId := range recorded.PvIds {
+		if len(blockMetadata.PvIds) == replicas {
+			break
+		}
+
+		blockClient, err := this.blockClient(pvId)
+		if err != nil {
+			glog.Warningf("Unable to reference block %s on pv %s - %v", blockId, pvId, err)
+			continue
+		}
+
+		response, err := blockClient.Reference(context.Background(), &blockservice.ReferenceRequest{
+			VolumeId: pvId,
+			BlockId:  blockId,
+		})
+		if err != nil {
+			glog.Warningf("Unable to reference block %s on pv %s - %v", blockId, pvId, err)
+			continue
+		}
+
+		if response.Size != recorded.Size || response.Checksum != recorded.Checksum {
+			glog.Warningf("Replica of block %s on pv %s has size %d checksum %08x, expected %d %08x - ignoring it",
+				blockId, pvId, response.Size, response.Checksum, recorded.Size, recorded.Checksum)
+			this.release(blockId, pvId)
+			continue
+		}
+
+		blockMetadata.PvIds = append(blockMetadata.PvIds, pvId)
+	}
+
+	if len(blockMetadata.PvIds) < minimumReplicas {
+		glog.V(logging.LogLevelDebug).Infof("Referenced %d replicas of block %s, minimum %d - writing it again",
+			len(blockMetadata.PvIds), blockId, minimumReplicas)
+
+		for _, pvId := range blockMetadata.PvIds {
+			this.release(blockId, pvId)
+		}
+
+		return nil
+	}
+
+	return blockMetadata
+}
+
+// Record a committed block in the index. Blocks missing from the index are only written again, so failures are logged.
+func (this *LocalFileWriter) record(blockMetadata *nameservice.BlockMetadata) {
+	if err := this.Index.Record(blockMetadata); err != nil {
+		glog.Warningf("Unable to record block %s of %s - %v", blockMetadata.BlockId, this.filename, err)
+	}
+}
@@ -1,11 +1,16 @@
 package file
 
 import (
+	"bfs/config"
+	"bfs/lru"
 	"bfs/service/blockservice"
 	"bfs/service/nameservice"
+	"bfs/util"
 	"bfs/util/logging"
 	"bfs/util/size"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/golang/glog"
 	"io"
 )
@@ -13,24 +18,38 @@ import (
 type Reader interface {
 	io.Reader
 	io.Closer
+	io.Seeker
+	io.ReaderAt
 
 	Open() error
 }
 
+// Find the configuration of a physical volume by ID.
+//
+// Readers use the returned config's endpoint label to locate the block server that owns the volume. Implementations
+// return nil for unknown volumes.
+type PhysicalVolumeLocator func(pvId string) *config.PhysicalVolumeConfig
+
 type LocalFileReader struct {
 	// Configuration
-	nameClient  nameservice.NameServiceClient
-	blockClient blockservice.BlockServiceClient
-	filename    string
+	nameClient    nameservice.NameServiceClient
+	clientFactory *lru.LRUCache
+	pvLocator     PhysicalVolumeLocator
+	filename      string
 
 	// Reader state
 	entry    *nameservice.Entry
 	blockIdx int
+	filePos  int64
 
 	// Current block state
-	blockReader blockservice.BlockService_ReadClient
-	blockBuf    []byte
-	blockPos    int
+	blockReader   blockservice.BlockService_ReadClient
+	blockCancel   context.CancelFunc
+	blockBuf      []byte
+	blockPos      int
+	blockOffset   uint64
+	blockReplica  int
+	blockFailures int
 
 	// Metrics
 	readCalls     int
@@ -39,11 +58,14 @@ type LocalFileReader struct {
 	readLoopIters int
 }
 
-func NewReader(nameClient nameservice.NameServiceClient, blockClient blockservice.BlockServiceClient, path string) *LocalFileReader {
+func NewReader(nameClient nameservice.NameServiceClient, clientFactory *lru.LRUCache, pvLocator PhysicalVolumeLocator,
+	path string) *LocalFileReader {
+
 	return &LocalFileReader{
-		nameClient:  nameClient,
-		blockClient: blockClient,
-		filename:    path,
+		nameClient:    nameClient,
+		clientFactory: clientFactory,
+		pvLocator:     pvLocator,
+		filename:      path,
 	}
 }
 
@@ -60,12 +82,11 @@ func (this *LocalFileReader) Open() error {
 	// Set up reader state.
 	glog.V(logging.LogLevelTrace).Infof("Entry: %v", resp.Entry)
 	this.entry = resp.Entry
-	this.blockIdx = 0
+	this.filePos = 0
 
 	// Set up initial block state.
-	this.blockReader = nil
-	this.blockPos = 0
-	this.blockBuf = nil
+	this.closeBlock()
+	this.resetBlock(0)
 
 	return nil
 }
@@ -76,25 +97,40 @@ func (this *LocalFileReader) Read(buffer []byte) (int, error) {
 	totalRead := 0
 	this.readCalls++
 
+	if this.entry.ErasureCoding != nil {
+		totalRead, err := this.readStripedAt(buffer, this.filePos)
+		this.filePos += int64(totalRead)
+
+		return totalRead, err
+	}
+
 	for {
 		this.readLoopIters++
 
 		if this.blockReader == nil {
-			glog.V(logging.LogLevelTrace).Infof("Opening block reader %d for block %v", this.blockIdx, this.entry.Blocks[this.blockIdx])
+			if this.blockIdx >= len(this.entry.Blocks) {
+				glog.V(logging.LogLevelTrace).Info("Detected file EOF")
+				return totalRead, io.EOF
+			}
+
+			glog.V(logging.LogLevelTrace).Infof("Opening block reader %d for block %v replica %d at %d", this.blockIdx,
+				this.entry.Blocks[this.blockIdx], this.blockReplica, this.blockOffset)
 
-			blockEntry := this.entry.Blocks[this.blockIdx]
+			ctx, cancel := context.WithCancel(context.Background())
 
-			readStream, err := this.blockClient.Read(context.Background(), &blockservice.ReadRequest{
-				VolumeId:  blockEntry.PvId,
-				BlockId:   blockEntry.BlockId,
-				ChunkSize: size.MB,
-				Position:  0,
-			})
+			readStream, err := this.openBlock(ctx, this.blockIdx, this.blockReplica, this.blockOffset, 0)
 			if err != nil {
-				return 0, err
+				cancel()
+
+				if this.failover(err) {
+					continue
+				}
+
+				return totalRead, err
 			}
 
 			this.blockReader = readStream
+			this.blockCancel = cancel
 			this.blockPos = 0
 			this.blockBuf = nil
 		}
@@ -109,30 +145,29 @@ func (this *LocalFileReader) Read(buffer []byte) (int, error) {
 
 			if err != nil {
 				if err != io.EOF {
-					return totalRead, err
-				}
+					this.closeBlock()
+
+					if this.failover(err) {
+						continue
+					}
 
-				glog.V(logging.LogLevelTrace).Info("Detected block EOF")
-				if err := this.blockReader.CloseSend(); err != nil {
 					return totalRead, err
 				}
 
-				this.blockIdx++
-				this.blockReader = nil
+				glog.V(logging.LogLevelTrace).Info("Detected block EOF")
+				this.closeBlock()
+				this.resetBlock(this.blockIdx + 1)
 
-				if this.blockIdx >= len(this.entry.Blocks) {
-					glog.V(logging.LogLevelTrace).Info("Detected file EOF")
-					return totalRead, io.EOF
-				} else {
-					continue
-				}
+				continue
 			}
 
 			this.blockBuf = readResp.Buffer
 		}
 
-		glog.V(logging.LogLevelTrace).Infof("Read buffer: %d/%d, Block buffer %d/%d",
-			totalRead, len(buffer), this.blockPos, len(this.blockBuf))
+		if glog.V(logging.LogLevelTrace) {
+			glog.Infof("Read buffer: %d/%d, Block buffer %d/%d", totalRead, len(buffer), this.blockPos,
+				len(this.blockBuf))
+		}
 
 		readMax := len(buffer[totalRead:])
 
@@ -147,21 +182,252 @@ func (this *LocalFileReader) Read(buffer []byte) (int, error) {
 
 			amountRead := copy(buffer[totalRead:totalRead+readMax], this.blockBuf[this.blockPos:this.blockPos+readMax])
 			this.blockPos += amountRead
+			this.blockOffset += uint64(amountRead)
+			this.filePos += int64(amountRead)
 			totalRead += amountRead
-		} else {
-			if this.blockPos >= len(this.blockBuf) {
-				glog.V(logging.LogLevelTrace).Info("Exhausted block buffer")
-				this.blockBuf = nil
-			} else {
-				glog.V(logging.LogLevelTrace).Info("Exhausted read buffer")
-				break
-			}
+		}
+
+		// Chunks are released as soon as they are consumed, and no chunk is received until there's room for it, so
+		// an idle reader holds at most one partially read chunk.
+		if this.blockPos >= len(this.blockBuf) {
+			glog.V(logging.LogLevelTrace).Info("Exhausted block buffer")
+			this.blockBuf = nil
+		}
+
+		if totalRead == len(buffer) {
+			glog.V(logging.LogLevelTrace).Info("Exhausted read buffer")
+			break
+		}
+	}
+
+	return totalRead, nil
+}
+
+// Set the offset for the next Read.
+//
+// File offsets are mapped to blocks using the entry's block size. Seeking discards any open block stream; the next
+// Read opens a new stream starting at the appropriate position within the block. Seeking past the end of the file is
+// allowed, in which case subsequent reads return io.EOF.
+func (this *LocalFileReader) Seek(offset int64, whence int) (int64, error) {
+	var filePos int64
+
+	switch whence {
+	case io.SeekStart:
+		filePos = offset
+	case io.SeekCurrent:
+		filePos = this.filePos + offset
+	case io.SeekEnd:
+		filePos = int64(this.entry.Size) + offset
+	default:
+		return this.filePos, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if filePos < 0 {
+		return this.filePos, errors.New("negative position")
+	}
+
+	glog.V(logging.LogLevelTrace).Infof("Seek %s to %d", this.filename, filePos)
+
+	this.closeBlock()
+
+	blockIdx, blockOffset := this.locate(filePos)
+
+	this.filePos = filePos
+	this.resetBlock(blockIdx)
+	this.blockOffset = blockOffset
+
+	return filePos, nil
+}
+
+// Read len(buffer) bytes starting at the given file offset.
+//
+// ReadAt does not use or modify the reader's current offset and may be called from multiple goroutines at once. Each
+// call opens its own ranged block streams.
+func (this *LocalFileReader) ReadAt(buffer []byte, offset int64) (int, error) {
+	glog.V(logging.LogLevelTrace).Infof("Read up to %d bytes from %s at %d", len(buffer), this.filename, offset)
+
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if this.entry.ErasureCoding != nil {
+		return this.readStripedAt(buffer, offset)
+	}
+
+	totalRead := 0
+
+	for totalRead < len(buffer) {
+		filePos := offset + int64(totalRead)
+
+		if filePos >= int64(this.entry.Size) {
+			return totalRead, io.EOF
+		}
+
+		blockIdx, blockOffset := this.locate(filePos)
+		if blockIdx >= len(this.entry.Blocks) {
+			return totalRead, io.EOF
+		}
+
+		length := uint64(len(buffer) - totalRead)
+		if blockRemaining := this.entry.BlockSize - blockOffset; length > blockRemaining {
+			length = blockRemaining
+		}
+
+		readLen, err := this.readBlockAt(buffer[totalRead:totalRead+int(length)], blockIdx, blockOffset)
+		totalRead += readLen
+
+		if err != nil {
+			return totalRead, err
+		}
+
+		if uint64(readLen) < length {
+			// A short block marks the end of the available data.
+			return totalRead, io.EOF
 		}
 	}
 
 	return totalRead, nil
 }
 
+// Fill buffer with data from the given block starting at blockOffset, stopping early if the block ends.
+//
+// Replicas are tried in order. If a replica fails, reading resumes from the next replica where the failed one left off.
+func (this *LocalFileReader) readBlockAt(buffer []byte, blockIdx int, blockOffset uint64) (int, error) {
+	totalRead := 0
+	replicaCount := len(this.entry.Blocks[blockIdx].PvIds)
+
+	err := fmt.Errorf("block %s has no replicas", this.entry.Blocks[blockIdx].BlockId)
+
+	for replicaIdx := 0; replicaIdx < replicaCount; replicaIdx++ {
+		var readLen int
+
+		readLen, err = this.readReplicaAt(buffer[totalRead:], blockIdx, replicaIdx, blockOffset+uint64(totalRead))
+		totalRead += readLen
+
+		if err == nil {
+			return totalRead, nil
+		}
+
+		glog.Warningf("Read of block %s from pv %s failed at %d - %v", this.entry.Blocks[blockIdx].BlockId,
+			this.entry.Blocks[blockIdx].PvIds[replicaIdx], blockOffset+uint64(totalRead), err)
+	}
+
+	return totalRead, err
+}
+
+// Fill buffer with data from one replica of a block, stopping early if the block ends.
+func (this *LocalFileReader) readReplicaAt(buffer []byte, blockIdx int, replicaIdx int, blockOffset uint64) (int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	readStream, err := this.openBlock(ctx, blockIdx, replicaIdx, blockOffset, uint64(len(buffer)))
+	if err != nil {
+		return 0, err
+	}
+
+	totalRead := 0
+
+	for {
+		readResp, err := readStream.Recv()
+		if err == io.EOF {
+			return totalRead, nil
+		} else if err != nil {
+			return totalRead, err
+		}
+
+		totalRead += copy(buffer[totalRead:], readResp.Buffer)
+	}
+}
+
+// Open a read stream on a replica of the given block.
+//
+// The stream is routed to the block server that owns the replica's physical volume.
+func (this *LocalFileReader) openBlock(ctx context.Context, blockIdx int, replicaIdx int, position uint64,
+	length uint64) (blockservice.BlockService_ReadClient, error) {
+
+	blockEntry := this.entry.Blocks[blockIdx]
+	if replicaIdx >= len(blockEntry.PvIds) {
+		return nil, fmt.Errorf("block %s has no replicas", blockEntry.BlockId)
+	}
+
+	pvId := blockEntry.PvIds[replicaIdx]
+
+	pvConfig := this.pvLocator(pvId)
+	if pvConfig == nil {
+		return nil, fmt.Errorf("unable to locate pv %s for block %s", pvId, blockEntry.BlockId)
+	}
+
+	endpoint := pvConfig.Labels["endpoint"]
+	if endpoint == "" {
+		return nil, fmt.Errorf("pv %s for block %s has no endpoint", pvId, blockEntry.BlockId)
+	}
+
+	serviceCtx, err := this.clientFactory.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return serviceCtx.(*util.ServiceCtx).BlockServiceClient.Read(ctx, &blockservice.ReadRequest{
+		VolumeId:  pvId,
+		BlockId:   blockEntry.BlockId,
+		ChunkSize: size.MB,
+		Position:  position,
+		Length:    length,
+	})
+}
+
+// Move the current block to its next replica after a failure.
+//
+// Returns false if every replica of the block has failed, in which case the error should be returned to the caller.
+// The next Read resumes from the current block offset.
+func (this *LocalFileReader) failover(err error) bool {
+	blockEntry := this.entry.Blocks[this.blockIdx]
+	if len(blockEntry.PvIds) == 0 {
+		return false
+	}
+
+	glog.Warningf("Read of block %s from pv %s failed at %d - %v", blockEntry.BlockId,
+		blockEntry.PvIds[this.blockReplica], this.blockOffset, err)
+
+	this.blockFailures++
+	if this.blockFailures >= len(blockEntry.PvIds) {
+		return false
+	}
+
+	this.blockReplica = (this.blockReplica + 1) % len(blockEntry.PvIds)
+
+	return true
+}
+
+// Map a file offset to a block index and an offset within that block.
+func (this *LocalFileReader) locate(filePos int64) (int, uint64) {
+	if this.entry.BlockSize == 0 {
+		return len(this.entry.Blocks), 0
+	}
+
+	return int(uint64(filePos) / this.entry.BlockSize), uint64(filePos) % this.entry.BlockSize
+}
+
+// Make blockIdx the current block, starting from its first replica.
+func (this *LocalFileReader) resetBlock(blockIdx int) {
+	this.blockIdx = blockIdx
+	this.blockOffset = 0
+	this.blockReplica = 0
+	this.blockFailures = 0
+}
+
+// Abandon the current block stream, if any.
+func (this *LocalFileReader) closeBlock() {
+	if this.blockCancel != nil {
+		this.blockCancel()
+	}
+
+	this.blockReader = nil
+	this.blockCancel = nil
+	this.blockBuf = nil
+	this.blockPos = 0
+}
+
 func (this *LocalFileReader) Close() error {
 	glog.V(logging.LogLevelDebug).Infof("Closing reader for %s", this.filename)
 
@@ -181,9 +447,7 @@ func (this *LocalFileReader) Close() error {
 		)
 	}
 
-	if this.blockReader != nil {
-		return this.blockReader.CloseSend()
-	}
+	this.closeBlock()
 
 	return nil
 }
@@ -11,13 +11,16 @@ import (
 	"bfs/util"
 	"bfs/util/size"
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -81,19 +84,6 @@ func TestLocalFileReader_Read(t *testing.T) {
 		assert.NoError(t, rpcServer.Serve(listener))
 	}()
 
-	blockConn, err := grpc.Dial(
-		bindAddress,
-		grpc.WithInsecure(),
-		grpc.WithBlock(),
-		grpc.WithWriteBufferSize(size.MB*8),
-		grpc.WithReadBufferSize(size.MB*8),
-		grpc.WithInitialWindowSize(size.MB),
-	)
-	require.NoError(t, err)
-	defer blockConn.Close()
-
-	blockClient := blockservice.NewBlockServiceClient(blockConn)
-
 	nameConn, err := grpc.Dial(
 		bindAddress,
 		grpc.WithInsecure(),
@@ -152,7 +142,7 @@ func TestLocalFileReader_Read(t *testing.T) {
 
 	require.NoError(t, writer.Close())
 
-	reader := NewReader(nameClient, blockClient, "/test.txt")
+	reader := NewReader(nameClient, clientFactory, volumeLocator(blockServer.Config.VolumeConfigs), "/test.txt")
 	require.NoError(t, reader.Open())
 
 	totalRead := 0
@@ -176,3 +166,195 @@ func TestLocalFileReader_Read(t *testing.T) {
 
 	require.NoError(t, reader.Close())
 }
+
+func TestLocalFileReader_SeekReadAt(t *testing.T) {
+	defer glog.Flush()
+
+	cluster := startCluster(t, 2)
+	defer cluster.stop()
+
+	blockServer := cluster.blockServer
+	nameClient := cluster.nameClient
+	clientFactory := cluster.clientFactory
+
+	placementPolicy := NewLabelAwarePlacementPolicy(
+		blockServer.Config.VolumeConfigs,
+		"hostname",
+		true,
+		1,
+		1,
+		nil,
+	)
+
+	// Three and a half blocks of data where each byte identifies its position in the file.
+	data := make([]byte, size.MB*3+size.MB/2)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	writer, err := NewWriter(nameClient, clientFactory, placementPolicy, "/test.txt", size.MB)
+	require.NoError(t, err)
+
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+
+	require.NoError(t, writer.Close())
+
+	reader := NewReader(nameClient, clientFactory, volumeLocator(blockServer.Config.VolumeConfigs), "/test.txt")
+	require.NoError(t, reader.Open())
+
+	readBuf := make([]byte, 1000)
+
+	// Seek into the middle of the second block.
+	pos, err := reader.Seek(size.MB+100, io.SeekStart)
+	require.NoError(t, err)
+	require.Equal(t, int64(size.MB+100), pos)
+
+	_, err = io.ReadFull(reader, readBuf)
+	require.NoError(t, err)
+	require.Equal(t, data[size.MB+100:size.MB+1100], readBuf)
+
+	// Reads that cross block boundaries continue into the next block.
+	pos, err = reader.Seek(size.MB-500, io.SeekCurrent)
+	require.NoError(t, err)
+	require.Equal(t, int64(size.MB*2+600), pos)
+
+	_, err = reader.Seek(-500, io.SeekCurrent)
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(reader, readBuf)
+	require.NoError(t, err)
+	require.Equal(t, data[size.MB*2+100:size.MB*2+1100], readBuf)
+
+	// The tail of the file.
+	pos, err = reader.Seek(-10, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)-10), pos)
+
+	readLen, err := io.ReadFull(reader, readBuf)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	require.Equal(t, 10, readLen)
+	require.Equal(t, data[len(data)-10:], readBuf[:readLen])
+
+	_, err = reader.Seek(-1, io.SeekStart)
+	require.Error(t, err)
+
+	// Concurrent ReadAt calls spanning blocks, including one that runs off the end of the file.
+	offsets := []int64{0, size.MB - 10, size.MB * 2, int64(len(data) - 100)}
+	errs := make(chan error, len(offsets))
+
+	for _, offset := range offsets {
+		go func(offset int64) {
+			buf := make([]byte, 1000)
+
+			readLen, err := reader.ReadAt(buf, offset)
+
+			expected := data[offset:]
+			if len(expected) > len(buf) {
+				expected = expected[:len(buf)]
+				if err != nil {
+					errs <- err
+					return
+				}
+			} else if err != io.EOF {
+				errs <- fmt.Errorf("expected EOF at %d, got %v", offset, err)
+				return
+			}
+
+			if !bytes.Equal(expected, buf[:readLen]) {
+				errs <- fmt.Errorf("data mismatch at %d", offset)
+				return
+			}
+
+			errs <- nil
+		}(offset)
+	}
+
+	for range offsets {
+		assert.NoError(t, <-errs)
+	}
+
+	require.NoError(t, reader.Close())
+}
+
+func TestLocalFileReader_Failover(t *testing.T) {
+	defer glog.Flush()
+
+	cluster := startCluster(t, 2)
+	defer cluster.stop()
+
+	blockServer := cluster.blockServer
+	nameClient := cluster.nameClient
+	clientFactory := cluster.clientFactory
+
+	placementPolicy := NewLabelAwarePlacementPolicy(
+		blockServer.Config.VolumeConfigs,
+		"disk",
+		false,
+		2,
+		2,
+		nil,
+	)
+
+	data := make([]byte, size.MB*2+size.MB/2)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	writer, err := NewWriter(nameClient, clientFactory, placementPolicy, "/test.txt", size.MB)
+	require.NoError(t, err)
+
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+
+	require.NoError(t, writer.Close())
+
+	getResp, err := nameClient.Get(context.Background(), &nameservice.GetRequest{Path: "/test.txt"})
+	require.NoError(t, err)
+	require.Len(t, getResp.Entry.Blocks, 3)
+
+	pvs := make(map[string]*blockservice.PhysicalVolume, len(blockServer.PhysicalVolumes))
+	for _, pv := range blockServer.PhysicalVolumes {
+		pvs[pv.ID.String()] = pv
+	}
+
+	// Corrupt the middle of the first replica of the first block so its stream fails part way through.
+	firstBlock := getResp.Entry.Blocks[0]
+	f, err := os.OpenFile(pvs[firstBlock.PvIds[0]].BlockPath(firstBlock.BlockId), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, size.KB*600)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Remove the first replica of the second block entirely.
+	secondBlock := getResp.Entry.Blocks[1]
+	require.NoError(t, pvs[secondBlock.PvIds[0]].Delete(secondBlock.BlockId))
+
+	reader := NewReader(nameClient, clientFactory, volumeLocator(blockServer.Config.VolumeConfigs), "/test.txt")
+	require.NoError(t, reader.Open())
+
+	readData, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, readData), "data mismatch after failover")
+
+	readBuf := make([]byte, size.KB*200)
+	readLen, err := reader.ReadAt(readBuf, size.KB*500)
+	require.NoError(t, err)
+	require.Equal(t, len(readBuf), readLen)
+	require.True(t, bytes.Equal(data[size.KB*500:size.KB*700], readBuf), "data mismatch after failover")
+
+	require.NoError(t, reader.Close())
+}
+
+// Locate PVs from a block server's volume configs.
+func volumeLocator(volumeConfigs []*config.PhysicalVolumeConfig) PhysicalVolumeLocator {
+	return func(pvId string) *config.PhysicalVolumeConfig {
+		for _, pvConfig := range volumeConfigs {
+			if pvConfig.Id == pvId {
+				return pvConfig
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,107 @@
+package file
+
+import (
+	"bfs/service/nameservice"
+	"bfs/util/size"
+)
+
+const (
+	// The cell size of erasure-coded files whose block size is a multiple of it. Other files use their block size.
+	DefaultCellSize = 1 * size.MB
+)
+
+// The position of data in an erasure-coded file.
+//
+// A file is divided into stripes, each with dataFragments + parityFragments fragments of at most blockSize bytes. A
+// stripe's data is laid out row by row: each row holds one cell of cellSize bytes for each data fragment, followed
+// by the parity cells computed from them. Only the last row of a file may be short. Its data cells are filled in
+// order, so some may be short or empty, and its parity cells are as long as its first data cell.
+type stripeLayout struct {
+	dataFragments   int
+	parityFragments int
+	blockSize       uint64
+	cellSize        uint64
+	fileSize        uint64
+}
+
+func newStripeLayout(entry *nameservice.Entry) *stripeLayout {
+	return &stripeLayout{
+		dataFragments:   int(entry.ErasureCoding.DataFragments),
+		parityFragments: int(entry.ErasureCoding.ParityFragments),
+		blockSize:       entry.BlockSize,
+		cellSize:        entry.ErasureCoding.CellSize,
+		fileSize:        entry.Size,
+	}
+}
+
+// Choose the cell size for an erasure-coded file with the given block size.
+func cellSizeFor(blockSize int) int {
+	if blockSize%DefaultCellSize == 0 {
+		return DefaultCellSize
+	}
+
+	return blockSize
+}
+
+// Returns the number of fragments in each stripe.
+func (this *stripeLayout) fragments() int {
+	return this.dataFragments + this.parityFragments
+}
+
+// Returns the number of bytes of file data in a full stripe.
+func (this *stripeLayout) stripeSize() uint64 {
+	return uint64(this.dataFragments) * this.blockSize
+}
+
+// Returns the number of bytes of file data in a full row.
+func (this *stripeLayout) rowSize() uint64 {
+	return uint64(this.dataFragments) * this.cellSize
+}
+
+// Map a file offset to its stripe, row within the stripe, data fragment, and offset within the cell.
+func (this *stripeLayout) locate(filePos uint64) (uint64, uint64, int, uint64) {
+	stripe := filePos / this.stripeSize()
+	stripePos := filePos % this.stripeSize()
+
+	row := stripePos / this.rowSize()
+	rowPos := stripePos % this.rowSize()
+
+	return stripe, row, int(rowPos / this.cellSize), rowPos % this.cellSize
+}
+
+// Returns the number of bytes of file data in a row.
+func (this *stripeLayout) rowLength(stripe uint64, row uint64) uint64 {
+	start := stripe*this.stripeSize() + row*this.rowSize()
+	if start >= this.fileSize {
+		return 0
+	}
+
+	if remaining := this.fileSize - start; remaining < this.rowSize() {
+		return remaining
+	}
+
+	return this.rowSize()
+}
+
+// Returns the length of a fragment's cell in a row. Parity cells are as long as the row's first data cell.
+func (this *stripeLayout) cellLength(stripe uint64, row uint64, fragment int) uint64 {
+	if fragment >= this.dataFragments {
+		fragment = 0
+	}
+
+	rowLength := this.rowLength(stripe, row)
+	cellStart := uint64(fragment) * this.cellSize
+
+	if rowLength <= cellStart {
+		return 0
+	} else if rowLength-cellStart < this.cellSize {
+		return rowLength - cellStart
+	}
+
+	return this.cellSize
+}
+
+// Returns the index in the entry's blocks of a stripe's fragment.
+func (this *stripeLayout) blockIndex(stripe uint64, fragment int) int {
+	return int(stripe)*this.fragments() + fragment
+}
@@ -0,0 +1,150 @@
+package file
+
+import (
+	"bfs/service/blockservice"
+	"bfs/service/nameservice"
+	"bfs/util/size"
+	"bytes"
+	"context"
+	"github.com/golang/glog"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStripeLayout(t *testing.T) {
+	layout := &stripeLayout{
+		dataFragments:   3,
+		parityFragments: 2,
+		blockSize:       4 * size.KB,
+		cellSize:        size.KB,
+		fileSize:        14*size.KB + 100,
+	}
+
+	require.Equal(t, 5, layout.fragments())
+	require.Equal(t, uint64(12*size.KB), layout.stripeSize())
+	require.Equal(t, uint64(3*size.KB), layout.rowSize())
+
+	stripe, row, fragment, cellOffset := layout.locate(0)
+	require.Equal(t, []uint64{0, 0, 0}, []uint64{stripe, row, cellOffset})
+	require.Equal(t, 0, fragment)
+
+	stripe, row, fragment, cellOffset = layout.locate(7*size.KB + 10)
+	require.Equal(t, []uint64{0, 2, 10}, []uint64{stripe, row, cellOffset})
+	require.Equal(t, 1, fragment)
+
+	stripe, row, fragment, cellOffset = layout.locate(13*size.KB + 50)
+	require.Equal(t, []uint64{1, 0, 50}, []uint64{stripe, row, cellOffset})
+	require.Equal(t, 1, fragment)
+
+	require.Equal(t, 10, layout.blockIndex(2, 0))
+
+	// Full rows have full cells.
+	require.Equal(t, uint64(3*size.KB), layout.rowLength(0, 3))
+	require.Equal(t, uint64(size.KB), layout.cellLength(0, 3, 2))
+	require.Equal(t, uint64(size.KB), layout.cellLength(0, 3, 4))
+
+	// The last row is filled cell by cell and parity matches its first cell.
+	require.Equal(t, uint64(2*size.KB+100), layout.rowLength(1, 0))
+	require.Equal(t, uint64(size.KB), layout.cellLength(1, 0, 0))
+	require.Equal(t, uint64(size.KB), layout.cellLength(1, 0, 1))
+	require.Equal(t, uint64(100), layout.cellLength(1, 0, 2))
+	require.Equal(t, uint64(size.KB), layout.cellLength(1, 0, 3))
+
+	// Rows past the end of the file are empty.
+	require.Equal(t, uint64(0), layout.rowLength(1, 1))
+	require.Equal(t, uint64(0), layout.cellLength(1, 1, 3))
+}
+
+func TestStripedFileWriter_ReadWrite(t *testing.T) {
+	defer glog.Flush()
+
+	cluster := startCluster(t, 5)
+	defer cluster.stop()
+
+	blockServer := cluster.blockServer
+	nameClient := cluster.nameClient
+	clientFactory := cluster.clientFactory
+
+	// Every fragment of a 3+2 stripe lands on its own disk.
+	placementPolicy := NewLabelAwarePlacementPolicy(
+		blockServer.Config.VolumeConfigs,
+		"disk",
+		false,
+		5,
+		5,
+		nil,
+	)
+
+	// One full stripe of two rows, then a stripe with a single short row.
+	data := make([]byte, size.MB*7+size.KB*300)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	writer, err := NewStripedWriter(nameClient, clientFactory, placementPolicy, "/test.txt", size.MB*2, 3, 2)
+	require.NoError(t, err)
+
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+
+	require.NoError(t, writer.Close())
+
+	getResp, err := nameClient.Get(context.Background(), &nameservice.GetRequest{Path: "/test.txt"})
+	require.NoError(t, err)
+	require.Len(t, getResp.Entry.Blocks, 10)
+	require.NotNil(t, getResp.Entry.ErasureCoding)
+	require.Equal(t, uint32(3), getResp.Entry.ErasureCoding.DataFragments)
+	require.Equal(t, uint32(2), getResp.Entry.ErasureCoding.ParityFragments)
+	require.Equal(t, uint64(size.MB), getResp.Entry.ErasureCoding.CellSize)
+
+	expectedSizes := []uint64{
+		size.MB * 2, size.MB * 2, size.MB * 2, size.MB * 2, size.MB * 2,
+		size.MB, size.KB * 300, 0, size.MB, size.MB,
+	}
+
+	for i, block := range getResp.Entry.Blocks {
+		require.Len(t, block.PvIds, 1)
+		require.Equal(t, expectedSizes[i], block.Size, "fragment %d", i)
+	}
+
+	pvs := make(map[string]*blockservice.PhysicalVolume, len(blockServer.PhysicalVolumes))
+	for _, pv := range blockServer.PhysicalVolumes {
+		pvs[pv.ID.String()] = pv
+	}
+
+	reader := NewReader(nameClient, clientFactory, volumeLocator(blockServer.Config.VolumeConfigs), "/test.txt")
+	require.NoError(t, reader.Open())
+
+	readData, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, readData), "data mismatch")
+
+	// Lose as many fragments as there are parity fragments in each stripe.
+	for _, blockIdx := range []int{1, 3, 5, 6} {
+		block := getResp.Entry.Blocks[blockIdx]
+		require.NoError(t, pvs[block.PvIds[0]].Delete(block.BlockId))
+	}
+
+	_, err = reader.Seek(0, 0)
+	require.NoError(t, err)
+
+	readData, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, readData), "data mismatch after reconstruction")
+
+	readBuf := make([]byte, size.KB*1500)
+	readLen, err := reader.ReadAt(readBuf, size.MB*5)
+	require.NoError(t, err)
+	require.Equal(t, len(readBuf), readLen)
+	require.True(t, bytes.Equal(data[size.MB*5:size.MB*5+size.KB*1500], readBuf), "data mismatch after reconstruction")
+
+	// A third lost fragment is more than the stripe can survive.
+	block := getResp.Entry.Blocks[0]
+	require.NoError(t, pvs[block.PvIds[0]].Delete(block.BlockId))
+
+	_, err = reader.ReadAt(readBuf, 0)
+	require.Error(t, err)
+
+	require.NoError(t, reader.Close())
+}
@@ -0,0 +1,107 @@
+package file
+
+import (
+	"bfs/util/erasure"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+)
+
+// Fill buffer with data from an erasure-coded file starting at the given offset.
+//
+// Data is read directly from the data fragments a cell at a time. If a cell can not be read, its row is rebuilt from
+// the other fragments of its stripe.
+func (this *LocalFileReader) readStripedAt(buffer []byte, offset int64) (int, error) {
+	layout := newStripeLayout(this.entry)
+	totalRead := 0
+
+	for totalRead < len(buffer) {
+		filePos := uint64(offset) + uint64(totalRead)
+
+		if filePos >= layout.fileSize {
+			return totalRead, io.EOF
+		}
+
+		stripe, row, fragment, cellOffset := layout.locate(filePos)
+
+		length := layout.cellLength(stripe, row, fragment) - cellOffset
+		if remaining := uint64(len(buffer) - totalRead); length > remaining {
+			length = remaining
+		}
+
+		cellBuffer := buffer[totalRead : totalRead+int(length)]
+		blockIdx := layout.blockIndex(stripe, fragment)
+
+		readLen, err := this.readFragmentAt(cellBuffer, blockIdx, row*layout.cellSize+cellOffset)
+		if err != nil {
+			glog.Warningf("Rebuilding row %d of stripe %d of %s - %v", row, stripe, this.filename, err)
+
+			cells, err := this.reconstructRow(layout, stripe, row)
+			if err != nil {
+				return totalRead, err
+			}
+
+			readLen = copy(cellBuffer, cells[fragment][cellOffset:])
+		}
+
+		totalRead += readLen
+	}
+
+	return totalRead, nil
+}
+
+// Fill buffer with data from a fragment, failing if the fragment ends first.
+func (this *LocalFileReader) readFragmentAt(buffer []byte, blockIdx int, blockOffset uint64) (int, error) {
+	if blockIdx >= len(this.entry.Blocks) {
+		return 0, fmt.Errorf("%s has no block %d", this.filename, blockIdx)
+	}
+
+	readLen, err := this.readBlockAt(buffer, blockIdx, blockOffset)
+	if err == nil && readLen < len(buffer) {
+		err = fmt.Errorf("block %s ended at %d", this.entry.Blocks[blockIdx].BlockId, blockOffset+uint64(readLen))
+	}
+
+	return readLen, err
+}
+
+// Rebuild the data cells of a row from the first of the stripe's fragments that can be read.
+func (this *LocalFileReader) reconstructRow(layout *stripeLayout, stripe uint64, row uint64) ([][]byte, error) {
+	code, err := erasure.New(layout.dataFragments, layout.parityFragments)
+	if err != nil {
+		return nil, err
+	}
+
+	shardLen := layout.cellLength(stripe, row, 0)
+	shards := make([][]byte, layout.fragments())
+	present := 0
+
+	for fragment := 0; fragment < len(shards) && present < layout.dataFragments; fragment++ {
+		cellLen := layout.cellLength(stripe, row, fragment)
+
+		// Data cells shorter than the first are padded with zeros when parity is computed.
+		shard := make([]byte, shardLen)
+
+		if cellLen > 0 {
+			_, err := this.readFragmentAt(shard[:cellLen], layout.blockIndex(stripe, fragment), row*layout.cellSize)
+			if err != nil {
+				glog.Warningf("Unable to read fragment %d of stripe %d of %s - %v", fragment, stripe, this.filename,
+					err)
+				continue
+			}
+		}
+
+		shards[fragment] = shard
+		present++
+	}
+
+	if err := code.Reconstruct(shards, true); err != nil {
+		return nil, fmt.Errorf("unable to rebuild row %d of stripe %d of %s - %v", row, stripe, this.filename, err)
+	}
+
+	cells := shards[:layout.dataFragments]
+	for fragment := range cells {
+		cells[fragment] = cells[fragment][:layout.cellLength(stripe, row, fragment)]
+	}
+
+	return cells, nil
+}
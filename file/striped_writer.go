@@ -0,0 +1,396 @@
+package file
+
+import (
+	"bfs/lru"
+	"bfs/service/blockservice"
+	"bfs/service/nameservice"
+	"bfs/util"
+	"bfs/util/erasure"
+	"bfs/util/logging"
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pborman/uuid"
+	"io"
+	"time"
+)
+
+/*
+ * StripedFileWriter
+ */
+
+// A writer for erasure-coded files.
+//
+// Data is buffered a row at a time. Each full row is split into cells, parity cells are computed, and every cell is
+// sent to its fragment's block. Once a stripe's fragments reach the block size, the stripe is committed and a new one
+// started. Every fragment of a stripe must be written for the stripe to commit.
+type StripedFileWriter struct {
+	// Configuration
+	nameClient      nameservice.NameServiceClient
+	clientFactory   *lru.LRUCache
+	placementPolicy BlockPlacementPolicy
+	blockSize       int
+	cellSize        int
+	filename        string
+	code            *erasure.Code
+
+	// The name of the block codec used to store fragments, or empty to store them as written. Set before the first
+	// Write().
+	Codec string
+
+	// File state.
+	filePos     int
+	stripeCount int
+	blockList   []*nameservice.BlockMetadata
+
+	// Current stripe state.
+	row       []byte
+	rowCount  int
+	fragments []*fragmentWriter
+	parity    [][]byte
+
+	// The error that caused a stripe to be lost, if any. Once set, the file can not be completed.
+	err error
+}
+
+// The write stream for one fragment of the current stripe.
+type fragmentWriter struct {
+	replicaWriter
+	blockId string
+	pos     int
+}
+
+func NewStripedWriter(nameClient nameservice.NameServiceClient, clientFactory *lru.LRUCache,
+	placementPolicy BlockPlacementPolicy, filename string, blockSize int, dataFragments int,
+	parityFragments int) (*StripedFileWriter, error) {
+
+	glog.V(logging.LogLevelTrace).Infof("Allocate striped writer for %v with blockSize %d and layout %d+%d", filename,
+		blockSize, dataFragments, parityFragments)
+
+	code, err := erasure.New(dataFragments, parityFragments)
+	if err != nil {
+		return nil, err
+	}
+
+	if replicas, _ := placementPolicy.Replication(); replicas != code.Shards() {
+		return nil, fmt.Errorf("placement policy provides %d volumes per block, %d fragments needed", replicas,
+			code.Shards())
+	}
+
+	cellSize := cellSizeFor(blockSize)
+
+	parity := make([][]byte, parityFragments)
+	for i := range parity {
+		parity[i] = make([]byte, cellSize)
+	}
+
+	return &StripedFileWriter{
+		nameClient:      nameClient,
+		clientFactory:   clientFactory,
+		placementPolicy: placementPolicy,
+		blockSize:       blockSize,
+		cellSize:        cellSize,
+		filename:        filename,
+		code:            code,
+		blockList:       make([]*nameservice.BlockMetadata, 0, 16),
+		row:             make([]byte, 0, dataFragments*cellSize),
+		parity:          parity,
+	}, nil
+}
+
+func (this *StripedFileWriter) Write(buffer []byte) (int, error) {
+	if this.err != nil {
+		return 0, this.err
+	}
+
+	totalWritten := 0
+
+	for totalWritten < len(buffer) {
+		writeLen := copy(this.row[len(this.row):cap(this.row)], buffer[totalWritten:])
+		this.row = this.row[:len(this.row)+writeLen]
+
+		totalWritten += writeLen
+		this.filePos += writeLen
+
+		if len(this.row) == cap(this.row) {
+			if err := this.writeRow(); err != nil {
+				return totalWritten, err
+			}
+		}
+	}
+
+	return totalWritten, nil
+}
+
+// Encode the buffered row and send its cells to the stripe's fragments, starting a stripe if necessary.
+func (this *StripedFileWriter) writeRow() error {
+	if this.fragments == nil {
+		if err := this.openStripe(); err != nil {
+			this.err = err
+			return err
+		}
+	}
+
+	dataFragments := this.code.DataShards
+	shards := make([][]byte, this.code.Shards())
+
+	for i := 0; i < dataFragments; i++ {
+		start, end := i*this.cellSize, (i+1)*this.cellSize
+		if start > len(this.row) {
+			start = len(this.row)
+		}
+		if end > len(this.row) {
+			end = len(this.row)
+		}
+
+		shards[i] = this.row[start:end]
+	}
+
+	// Only the last row of a file is short. Its parity is computed over cells padded to the length of the first.
+	shardLen := len(shards[0])
+
+	for i := 0; i < dataFragments; i++ {
+		if len(shards[i]) < shardLen {
+			padded := make([]byte, shardLen)
+			copy(padded, shards[i])
+			shards[i] = padded
+		}
+	}
+
+	for i := range this.parity {
+		shards[dataFragments+i] = this.parity[i][:shardLen]
+	}
+
+	if err := this.code.Encode(shards); err != nil {
+		this.abortStripe()
+		this.err = err
+		return err
+	}
+
+	for i, fragment := range this.fragments {
+		cell := shards[i]
+		if i < dataFragments {
+			cell = cell[:this.cellLength(i)]
+		}
+
+		if len(cell) == 0 {
+			continue
+		}
+
+		if err := this.send(fragment, cell); err != nil {
+			return err
+		}
+	}
+
+	this.row = this.row[:0]
+	this.rowCount++
+
+	if this.rowCount*this.cellSize == this.blockSize {
+		return this.closeStripe()
+	}
+
+	return nil
+}
+
+// Returns the length of a data fragment's cell in the buffered row.
+func (this *StripedFileWriter) cellLength(fragment int) int {
+	remaining := len(this.row) - fragment*this.cellSize
+
+	if remaining < 0 {
+		return 0
+	} else if remaining > this.cellSize {
+		return this.cellSize
+	}
+
+	return remaining
+}
+
+// Allocate a block for each fragment of a new stripe on the volumes returned by the placement policy.
+func (this *StripedFileWriter) openStripe() error {
+	pvs, err := this.placementPolicy.Next()
+	if err != nil {
+		return err
+	}
+
+	if len(pvs) < this.code.Shards() {
+		return fmt.Errorf("unable to allocate stripe %d of %s - %d of %d volumes available", this.stripeCount,
+			this.filename, len(pvs), this.code.Shards())
+	}
+
+	this.stripeCount++
+	this.rowCount = 0
+	this.fragments = make([]*fragmentWriter, 0, len(pvs))
+
+	for _, pv := range pvs {
+		fragment := &fragmentWriter{blockId: uuid.NewRandom().String()}
+		fragment.pv = pv
+
+		blockClient, err := this.clientFactory.Get(pv.Labels["endpoint"])
+		if err != nil {
+			this.abortStripe()
+			return fmt.Errorf("unable to connect to %s for block %s on pv %s - %v", pv.Labels["endpoint"],
+				fragment.blockId, pv.Id, err)
+		}
+
+		// Streams are cancelled, rather than closed, when a stripe is abandoned so the block service never commits
+		// a partial fragment.
+		ctx, cancel := context.WithCancel(context.Background())
+
+		fragment.cancel = cancel
+		fragment.writeStream, err = blockClient.(*util.ServiceCtx).BlockServiceClient.Write(ctx)
+		if err != nil {
+			cancel()
+			this.abortStripe()
+			return fmt.Errorf("unable to open block %s on pv %s - %v", fragment.blockId, pv.Id, err)
+		}
+
+		this.fragments = append(this.fragments, fragment)
+	}
+
+	glog.V(logging.LogLevelDebug).Infof("Allocated stripe %d of %s on %d volumes - filePos: %d", this.stripeCount,
+		this.filename, len(this.fragments), this.filePos)
+
+	return nil
+}
+
+// Send a buffer to a fragment of the current stripe. Losing any fragment loses the stripe.
+func (this *StripedFileWriter) send(fragment *fragmentWriter, buffer []byte) error {
+	request := &blockservice.WriteRequest{
+		VolumeId: fragment.pv.Id,
+		Buffer:   buffer,
+	}
+
+	if fragment.pos == 0 {
+		request.BlockId = fragment.blockId
+		request.Codec = this.Codec
+	}
+
+	if err := fragment.writeStream.Send(request); err != nil {
+		// The stream was ended by the block service; its status explains why.
+		if err == io.EOF {
+			_, err = fragment.writeStream.CloseAndRecv()
+		}
+
+		this.abortStripe()
+		this.err = replicaError(err, "lost fragment block %s of stripe %d on pv %s", fragment.blockId,
+			this.stripeCount, fragment.pv.Id)
+
+		return this.err
+	}
+
+	fragment.pos += len(buffer)
+
+	return nil
+}
+
+// Commit the current stripe's fragments.
+func (this *StripedFileWriter) closeStripe() error {
+	fragments := this.fragments
+	stripeBlocks := make([]*nameservice.BlockMetadata, 0, len(fragments))
+
+	for _, fragment := range fragments {
+		// Fragments that received no data still need a request to create their block.
+		if fragment.pos == 0 {
+			if err := this.send(fragment, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	this.fragments = nil
+
+	for i, fragment := range fragments {
+		response, err := fragment.writeStream.CloseAndRecv()
+		fragment.cancel()
+
+		if err == nil && response.BlockId != fragment.blockId {
+			err = fmt.Errorf("stored as block %s", response.BlockId)
+		}
+
+		if err != nil {
+			for _, remaining := range fragments[i+1:] {
+				remaining.cancel()
+			}
+
+			this.err = replicaError(err, "unable to commit fragment block %s of stripe %d on pv %s",
+				fragment.blockId, this.stripeCount, fragment.pv.Id)
+			return this.err
+		}
+
+		glog.V(logging.LogLevelTrace).Infof("Received block writer response: %v", response)
+
+		stripeBlocks = append(stripeBlocks, &nameservice.BlockMetadata{
+			BlockId:     response.BlockId,
+			PvIds:       []string{response.VolumeId},
+			Checksum:    response.Checksum,
+			Size:        uint64(response.Size),
+			StoredSize:  response.StoredSize,
+			HasChecksum: true,
+		})
+	}
+
+	this.blockList = append(this.blockList, stripeBlocks...)
+
+	glog.V(logging.LogLevelTrace).Infof("Committed stripe %d of %s", this.stripeCount, this.filename)
+
+	return nil
+}
+
+// Abandon the current stripe on all fragments.
+func (this *StripedFileWriter) abortStripe() {
+	for _, fragment := range this.fragments {
+		fragment.cancel()
+	}
+
+	this.fragments = nil
+}
+
+func (this *StripedFileWriter) Close() error {
+	glog.V(logging.LogLevelDebug).Infof("Closing striped writer for file %v.", this.filename)
+
+	if this.err != nil {
+		return this.err
+	}
+
+	if len(this.row) > 0 {
+		if err := this.writeRow(); err != nil {
+			return err
+		}
+	}
+
+	if this.fragments != nil {
+		if err := this.closeStripe(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	nowTime := &nameservice.Time{Seconds: now.Unix(), Nanos: int64(now.Nanosecond())}
+
+	_, err := this.nameClient.Add(context.Background(), &nameservice.AddRequest{
+		Entry: &nameservice.Entry{
+			Path:             this.filename,
+			Blocks:           this.blockList,
+			Permissions:      0,
+			LvId:             "/",
+			ReplicationLevel: 1,
+			BlockSize:        uint64(this.blockSize),
+			Size:             uint64(this.filePos),
+			Ctime:            nowTime,
+			Mtime:            nowTime,
+			ErasureCoding: &nameservice.ErasureCoding{
+				DataFragments:   uint32(this.code.DataShards),
+				ParityFragments: uint32(this.code.ParityShards),
+				CellSize:        uint64(this.cellSize),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	glog.V(logging.LogLevelDebug).Infof("Closed striped writer for %s. Wrote %d bytes to %d stripes", this.filename,
+		this.filePos, this.stripeCount)
+
+	return nil
+}
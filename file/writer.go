@@ -7,9 +7,17 @@ import (
 	"bfs/service/nameservice"
 	"bfs/util"
 	"bfs/util/logging"
+	"bfs/util/size"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/golang/glog"
+	"github.com/pborman/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hash/crc32"
 	"io"
+	"sync"
 	"time"
 )
 
@@ -17,6 +25,28 @@ import (
  * LocalFileWriter
  */
 
+const (
+	// How long a writer waits for the remaining replicas of a block once enough have acknowledged it, unless it
+	// configures a grace period.
+	DefaultReplicaGracePeriod = 10 * time.Second
+
+	// How long the block an append replaces is kept once the append is committed, unless the writer configures a
+	// grace period.
+	DefaultReplacedBlockGracePeriod = time.Minute
+
+	// How many times a writer resumes each replica of a block after its stream fails, unless it configures a limit.
+	DefaultMaxReplicaResumes = 3
+
+	// How often, and how many times, a replica's volume is asked about an interrupted write it hasn't yet noticed.
+	resumeStatusInterval = 100 * time.Millisecond
+	resumeStatusAttempts = 10
+
+	// The largest request sent when resuming a replica.
+	resumeChunkSize = size.MB
+)
+
+var resumeCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type Writer interface {
 	io.Writer
 	io.Closer
@@ -30,18 +60,85 @@ type LocalFileWriter struct {
 	blockSize       int
 	filename        string
 
+	// The name of the block codec used to store blocks, or empty to store them as written. Set before the first
+	// Write().
+	Codec string
+
+	// The index of the logical volume's content-addressed blocks. When set, blocks are named by their content, and
+	// blocks already in the index are referenced rather than written again. Set before the first Write(), along with
+	// Locator.
+	Index BlockIndex
+
+	// The locator of volumes the writer didn't write to: those of indexed blocks, and those of the last block an append
+	// replaces, which are removed once the append is committed.
+	Locator PhysicalVolumeLocator
+
+	// How long the last block an append replaces is kept once the append is committed, so readers that opened the file
+	// before the append can still read it. Its volumes remove it once the period ends, even if the process exits first.
+	ReplacedBlockGracePeriod time.Duration
+
+	// How long to wait for the remaining replicas of a block once the minimum number have acknowledged it. Replicas
+	// that don't acknowledge in time are abandoned.
+	ReplicaGracePeriod time.Duration
+
+	// How many times each replica of a block is resumed from the data its volume holds when its stream fails. The data
+	// of the current block is kept in memory so it can be sent again; zero disables resuming, and keeping the data.
+	MaxReplicaResumes int
+
 	// File state.
 	filePos    int
 	blockCount int
 	blockList  []*nameservice.BlockMetadata
 
-	// Block service state.
+	// Current block writer state.
+	blockPos int
+	blockId  string
+	replicas []*replicaWriter
+
+	// The data sent for the current block, kept to resume replicas when MaxReplicaResumes is set.
+	blockData []byte
+
+	// The volumes replicas have been written to, by ID, so blocks the file won't use can be removed from them.
+	volumes map[string]*config.PhysicalVolumeConfig
+
+	// The data of the current block when deduplicating. Blocks are only written once complete, as their ID depends on
+	// their content.
+	pending []byte
+
+	// The error that caused a block to be lost, if any. Once set, the file can not be completed.
+	err error
+
+	// Append state, set when appending to an existing file. Blocks are immutable, so a last block that isn't full is
+	// replaced: its data is copied from tail to the first new block before anything is appended.
+	entry           *nameservice.Entry
+	source          Reader
+	tail            *io.SectionReader
+	replacedBlockId string
+}
+
+// The write stream for one replica of the current block.
+type replicaWriter struct {
+	pv          *config.PhysicalVolumeConfig
 	writeStream blockservice.BlockService_WriteClient
+	cancel      context.CancelFunc
 
-	// Current block writer state.
-	blockPos    int
+	// What's needed to resume the write on a new stream, and the number of times it has been resumed.
 	blockClient blockservice.BlockServiceClient
-	selectedPv  *config.PhysicalVolumeConfig
+	blockId     string
+	codec       string
+	dedup       bool
+	resumes     int
+
+	// Guards the stream and its cancel func while the replica is resumed, as it may be abandoned at the same time.
+	mut       sync.Mutex
+	abandoned bool
+}
+
+// The outcome of closing a replica's write stream.
+type replicaResult struct {
+	replica  *replicaWriter
+	response *blockservice.WriteResponse
+	err      error
 }
 
 func NewWriter(nameClient nameservice.NameServiceClient, clientFactory *lru.LRUCache,
@@ -50,26 +147,95 @@ func NewWriter(nameClient nameservice.NameServiceClient, clientFactory *lru.LRUC
 	glog.V(logging.LogLevelTrace).Infof("Allocate writer for %v with blockSize %d", filename, blockSize)
 
 	return &LocalFileWriter{
-		nameClient:      nameClient,
-		clientFactory:   clientFactory,
-		placementPolicy: placementPolicy,
-		blockSize:       blockSize,
-		filename:        filename,
-		blockList:       make([]*nameservice.BlockMetadata, 0, 16),
+		nameClient:         nameClient,
+		clientFactory:      clientFactory,
+		placementPolicy:    placementPolicy,
+		blockSize:          blockSize,
+		filename:           filename,
+		ReplicaGracePeriod: DefaultReplicaGracePeriod,
+		MaxReplicaResumes:  DefaultMaxReplicaResumes,
+		blockList:          make([]*nameservice.BlockMetadata, 0, 16),
+		volumes:            make(map[string]*config.PhysicalVolumeConfig),
 	}, nil
 }
 
+// Open a writer that appends to the file described by entry.
+//
+// The data of a last block that isn't full is read back through source, which is closed along with the writer. The
+// file's entry is updated when the writer is closed, and only if no other client appended to it first.
+func NewAppendWriter(nameClient nameservice.NameServiceClient, clientFactory *lru.LRUCache,
+	placementPolicy BlockPlacementPolicy, entry *nameservice.Entry, source Reader) (*LocalFileWriter, error) {
+
+	glog.V(logging.LogLevelTrace).Infof("Allocate writer to append to %v at %d", entry.Path, entry.Size)
+
+	if entry.ErasureCoding != nil {
+		return nil, fmt.Errorf("unable to append to %s - erasure-coded files can not be appended to", entry.Path)
+	} else if entry.BlockSize == 0 {
+		return nil, fmt.Errorf("unable to append to %s - no block size", entry.Path)
+	}
+
+	fullBlocks := entry.Size / entry.BlockSize
+	tailSize := entry.Size % entry.BlockSize
+
+	expectedBlocks := fullBlocks
+	if tailSize > 0 {
+		expectedBlocks++
+	}
+
+	if uint64(len(entry.Blocks)) != expectedBlocks {
+		return nil, fmt.Errorf("unable to append to %s - %d blocks hold %d bytes", entry.Path, len(entry.Blocks),
+			entry.Size)
+	}
+
+	writer := &LocalFileWriter{
+		nameClient:               nameClient,
+		clientFactory:            clientFactory,
+		placementPolicy:          placementPolicy,
+		blockSize:                int(entry.BlockSize),
+		filename:                 entry.Path,
+		filePos:                  int(fullBlocks * entry.BlockSize),
+		ReplicaGracePeriod:       DefaultReplicaGracePeriod,
+		ReplacedBlockGracePeriod: DefaultReplacedBlockGracePeriod,
+		MaxReplicaResumes:        DefaultMaxReplicaResumes,
+		blockList:                make([]*nameservice.BlockMetadata, 0, 16),
+		volumes:                  make(map[string]*config.PhysicalVolumeConfig),
+		entry:                    entry,
+		source:                   source,
+	}
+
+	if tailSize > 0 {
+		writer.tail = io.NewSectionReader(source, int64(writer.filePos), int64(tailSize))
+		writer.replacedBlockId = entry.Blocks[len(entry.Blocks)-1].BlockId
+	}
+
+	return writer, nil
+}
+
 func (this *LocalFileWriter) Write(buffer []byte) (int, error) {
 	bufferPos := 0
 	bufferRemaining := len(buffer)
 	totalWritten := 0
 
+	if this.err != nil {
+		return 0, this.err
+	}
+
+	if this.tail != nil && len(buffer) > 0 {
+		if err := this.copyTail(); err != nil {
+			return 0, err
+		}
+	}
+
+	if this.Index != nil {
+		return this.buffer(buffer)
+	}
+
 	// While there is more buffer data to write...
 	for bufferRemaining > 0 {
 		writeLen := 0
 
 		// If we've reached the end of a block, it time to start a new one.
-		if this.blockPos == this.blockSize || this.blockCount == 0 {
+		if this.blockPos == this.blockSize || this.replicas == nil {
 			if this.blockCount != 0 {
 				if err := this.Flush(); err != nil {
 					return totalWritten, err
@@ -78,28 +244,12 @@ func (this *LocalFileWriter) Write(buffer []byte) (int, error) {
 
 			this.blockCount++
 
-			// Gather replica locations.
-			if pvs, err := this.placementPolicy.Next(); err != nil {
+			if err := this.openReplicas(uuid.NewRandom().String()); err != nil {
 				return totalWritten, err
-			} else {
-				this.selectedPv = pvs[0]
-				this.blockPos = 0
 			}
 
-			if blockClient, err := this.clientFactory.Get(this.selectedPv.Labels["endpoint"]); err != nil {
-				return totalWritten, err
-			} else {
-				this.blockClient = blockClient.(*util.ServiceCtx).BlockServiceClient
-			}
-
-			// Allocate a new block by creating a new write stream.
-			if writeStream, err := this.blockClient.Write(context.Background()); err != nil {
-				return totalWritten, err
-			} else {
-				this.writeStream = writeStream
-			}
-
-			glog.V(logging.LogLevelDebug).Infof("Allocated new block %d on %s - filePos: %d", this.blockCount, this.selectedPv, this.filePos)
+			glog.V(logging.LogLevelDebug).Infof("Allocated new block %d (%s) on %d replicas - filePos: %d",
+				this.blockCount, this.blockId, len(this.replicas), this.filePos)
 		}
 
 		// Decide how much of the buffer to write.
@@ -111,13 +261,10 @@ func (this *LocalFileWriter) Write(buffer []byte) (int, error) {
 
 		// If there's data left to write, write it.
 		if writeLen > 0 {
-			glog.V(logging.LogLevelTrace).Infof("Write %d:%d of %d bytes to %v on %s", bufferPos, bufferPos+writeLen, len(buffer),
-				this.filename, this.selectedPv)
+			glog.V(logging.LogLevelTrace).Infof("Write %d:%d of %d bytes to %v block %s", bufferPos, bufferPos+writeLen,
+				len(buffer), this.filename, this.blockId)
 
-			if err := this.writeStream.Send(&blockservice.WriteRequest{
-				VolumeId: this.selectedPv.Id,
-				Buffer:   buffer[bufferPos:bufferPos+writeLen],
-			}); err != nil {
+			if err := this.send(buffer[bufferPos : bufferPos+writeLen]); err != nil {
 				return totalWritten, err
 			}
 
@@ -131,7 +278,343 @@ func (this *LocalFileWriter) Write(buffer []byte) (int, error) {
 	}
 
 	return totalWritten, nil
-};
+}
+
+// Copy the data of the last block of the file being appended to into the first new block.
+func (this *LocalFileWriter) copyTail() error {
+	tail := this.tail
+	this.tail = nil
+
+	copied, err := io.Copy(this, tail)
+	if err == nil && copied != tail.Size() {
+		err = fmt.Errorf("read %d of %d bytes", copied, tail.Size())
+	}
+
+	if err != nil {
+		// Failures writing the copy have already lost the block.
+		if this.err == nil {
+			this.abortReplicas()
+			this.err = fmt.Errorf("unable to copy block %s of %s - %v", this.replacedBlockId, this.filename, err)
+		}
+
+		return this.err
+	}
+
+	glog.V(logging.LogLevelDebug).Infof("Copied %d bytes of block %s of %s to block %s", copied,
+		this.replacedBlockId, this.filename, this.blockId)
+
+	return nil
+}
+
+// Allocate a new block with the given ID on each replica returned by the placement policy.
+//
+// Replicas that can not be reached are dropped, so long as at least the minimum number of replicas remain.
+func (this *LocalFileWriter) openReplicas(blockId string) error {
+	pvs, err := this.placementPolicy.Next()
+	if err != nil {
+		return err
+	}
+
+	_, minimumReplicas := this.placementPolicy.Replication()
+
+	this.blockId = blockId
+	this.blockPos = 0
+	this.blockData = this.blockData[:0]
+	this.replicas = make([]*replicaWriter, 0, len(pvs))
+
+	for _, pv := range pvs {
+		blockClient, err := this.clientFactory.Get(pv.Labels["endpoint"])
+		if err != nil {
+			glog.Warningf("Unable to connect to %s for block %s on pv %s - %v", pv.Labels["endpoint"], this.blockId,
+				pv.Id, err)
+			continue
+		}
+
+		// Allocate a new block by creating a new write stream. Streams are cancelled, rather than closed, when a block
+		// is abandoned so the block service never commits a partial block.
+		ctx, cancel := context.WithCancel(context.Background())
+
+		writeStream, err := blockClient.(*util.ServiceCtx).BlockServiceClient.Write(ctx)
+		if err != nil {
+			cancel()
+			glog.Warningf("Unable to open block %s on pv %s - %v", this.blockId, pv.Id, err)
+			continue
+		}
+
+		this.replicas = append(this.replicas, &replicaWriter{
+			pv:          pv,
+			writeStream: writeStream,
+			cancel:      cancel,
+			blockClient: blockClient.(*util.ServiceCtx).BlockServiceClient,
+			blockId:     this.blockId,
+			codec:       this.Codec,
+			dedup:       this.Index != nil,
+		})
+		this.volumes[pv.Id] = pv
+	}
+
+	if len(this.replicas) < minimumReplicas {
+		err := fmt.Errorf("unable to allocate block %s - %d of %d replicas available, minimum %d", this.blockId,
+			len(this.replicas), len(pvs), minimumReplicas)
+		this.abortReplicas()
+
+		return err
+	}
+
+	return nil
+}
+
+// Send a buffer to every live replica of the current block.
+//
+// A replica that fails is dropped from the block. An error is returned only if too few replicas remain.
+func (this *LocalFileWriter) send(buffer []byte) error {
+	_, minimumReplicas := this.placementPolicy.Replication()
+
+	replicas := this.replicas[:0]
+	var replicaErr error
+
+	if this.MaxReplicaResumes > 0 {
+		this.blockData = append(this.blockData, buffer...)
+	}
+
+	for _, replica := range this.replicas {
+		request := &blockservice.WriteRequest{
+			VolumeId: replica.pv.Id,
+			Buffer:   buffer,
+		}
+
+		if this.blockPos == 0 {
+			request.BlockId = this.blockId
+			request.Codec = this.Codec
+			request.Dedup = this.Index != nil
+		}
+
+		if err := replica.writeStream.Send(request); err != nil {
+			// The stream was ended by the block service; its status explains why.
+			if err == io.EOF {
+				_, err = replica.writeStream.CloseAndRecv()
+			}
+
+			// A resumed replica is sent everything its volume is missing, including this buffer.
+			if err = replica.resume(this.blockData, this.MaxReplicaResumes, err); err == nil {
+				replicas = append(replicas, replica)
+				continue
+			}
+
+			glog.Warningf("Dropping replica of block %s on pv %s - %v", this.blockId, replica.pv.Id, err)
+			replica.cancelStream()
+			replicaErr = err
+			continue
+		}
+
+		replicas = append(replicas, replica)
+	}
+
+	this.replicas = replicas
+
+	if len(this.replicas) < minimumReplicas {
+		this.err = replicaError(replicaErr, "too few replicas for block %s - %d remain, minimum %d", this.blockId,
+			len(this.replicas), minimumReplicas)
+		this.abortReplicas()
+
+		return this.err
+	}
+
+	return nil
+}
+
+// Resume a replica's write on a new stream after its stream failed with cause, returning cause if it can't be resumed.
+//
+// The replica's volume is asked how much of the block it holds, and is sent the rest of data, everything sent for the
+// block so far. Writes are resumed at most maxResumes times, and only after failures of the stream itself; a volume
+// that refused the block isn't asked again.
+func (this *replicaWriter) resume(data []byte, maxResumes int, cause error) error {
+	switch status.Code(cause) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+	default:
+		return cause
+	}
+
+	if this.resumes >= maxResumes {
+		return cause
+	}
+
+	this.resumes++
+	this.cancelStream()
+
+	// The volume may not yet have noticed the stream failed, in which case it still counts the write as active.
+	var writeStatus *blockservice.WriteStatusResponse
+	for attempt := 1; ; attempt++ {
+		var err error
+		writeStatus, err = this.blockClient.WriteStatus(context.Background(), &blockservice.WriteStatusRequest{
+			VolumeId: this.pv.Id,
+			BlockId:  this.blockId,
+		})
+		if err != nil {
+			glog.Warningf("Unable to resume block %s on pv %s - %v", this.blockId, this.pv.Id, err)
+			return cause
+		} else if !writeStatus.Active || attempt == resumeStatusAttempts {
+			break
+		}
+
+		time.Sleep(resumeStatusInterval)
+	}
+
+	if writeStatus.State != blockservice.WriteState_WRITE_IN_PROGRESS || writeStatus.Active ||
+		writeStatus.Size > uint64(len(data)) ||
+		writeStatus.Checksum != crc32.Checksum(data[:writeStatus.Size], resumeCrcTable) {
+
+		glog.Warningf("Unable to resume block %s on pv %s - %s at %d", this.blockId, this.pv.Id, writeStatus.State,
+			writeStatus.Size)
+		return cause
+	}
+
+	glog.Infof("Resuming block %s on pv %s at %d of %d bytes - %v", this.blockId, this.pv.Id, writeStatus.Size,
+		len(data), cause)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	writeStream, err := this.blockClient.Write(ctx)
+	if err != nil {
+		cancel()
+		return cause
+	}
+
+	if !this.replaceStream(writeStream, cancel) {
+		return cause
+	}
+
+	// The first request names the block and where it resumes, even when the volume holds all of it already.
+	for pos := writeStatus.Size; pos == writeStatus.Size || pos < uint64(len(data)); pos += resumeChunkSize {
+		end := pos + resumeChunkSize
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+
+		request := &blockservice.WriteRequest{VolumeId: this.pv.Id, Buffer: data[pos:end]}
+		if pos == writeStatus.Size {
+			request.BlockId = this.blockId
+			request.Offset = pos
+			request.Dedup = this.dedup
+
+			// A write that didn't reach its volume starts again from the beginning.
+			if pos == 0 {
+				request.Codec = this.codec
+			}
+		}
+
+		if err := writeStream.Send(request); err != nil {
+			if err == io.EOF {
+				_, err = writeStream.CloseAndRecv()
+			}
+
+			return this.resume(data, maxResumes, err)
+		}
+	}
+
+	return nil
+}
+
+// Switch the replica to a new stream, unless it was abandoned, in which case the new stream is cancelled.
+func (this *replicaWriter) replaceStream(writeStream blockservice.BlockService_WriteClient,
+	cancel context.CancelFunc) bool {
+
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	if this.abandoned {
+		cancel()
+		return false
+	}
+
+	this.writeStream = writeStream
+	this.cancel = cancel
+
+	return true
+}
+
+// Cancel the replica's current stream.
+func (this *replicaWriter) cancelStream() {
+	this.mut.Lock()
+	cancel := this.cancel
+	this.cancel = nil
+	this.mut.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Remove the blocks committed by abandoned replicas as their results arrive.
+func releaseAbandoned(results <-chan *replicaResult, count int) {
+	for i := 0; i < count; i++ {
+		result := <-results
+		result.replica.releaseAbandoned(result.response, result.err)
+	}
+}
+
+// Remove the block an abandoned replica committed, if it did.
+//
+// A replica that failed may still have committed the block if its stream was cancelled as the block was committed, so
+// its volume is asked once it notices the stream ended. Deduplicated blocks are left alone unless the replica
+// acknowledged them, as the volume may hold them for other files.
+func (this *replicaWriter) releaseAbandoned(response *blockservice.WriteResponse, err error) {
+	blockId := this.blockId
+
+	if err == nil {
+		blockId = response.BlockId
+	} else if this.dedup {
+		return
+	} else {
+		var writeStatus *blockservice.WriteStatusResponse
+		for attempt := 1; ; attempt++ {
+			writeStatus, err = this.blockClient.WriteStatus(context.Background(), &blockservice.WriteStatusRequest{
+				VolumeId: this.pv.Id,
+				BlockId:  this.blockId,
+			})
+			if err != nil || !writeStatus.Active || attempt == resumeStatusAttempts {
+				break
+			}
+
+			time.Sleep(resumeStatusInterval)
+		}
+
+		if err != nil {
+			glog.Warningf("Unable to check abandoned block %s on pv %s - %v", this.blockId, this.pv.Id, err)
+			return
+		} else if writeStatus.State != blockservice.WriteState_WRITE_COMMITTED {
+			return
+		}
+	}
+
+	glog.Warningf("Removing block %s committed by abandoned replica on pv %s", blockId, this.pv.Id)
+
+	_, err = this.blockClient.Delete(context.Background(), &blockservice.ReadRequest{
+		VolumeId: this.pv.Id,
+		BlockId:  blockId,
+	})
+	if err != nil {
+		glog.Warningf("Unable to remove block %s from pv %s - %v", blockId, this.pv.Id, err)
+	}
+}
+
+// Cancel the replica's stream, including any it is being resumed on.
+func (this *replicaWriter) abandon() {
+	this.mut.Lock()
+	this.abandoned = true
+	this.mut.Unlock()
+
+	this.cancelStream()
+}
+
+// Abandon the current block on all replicas.
+func (this *LocalFileWriter) abortReplicas() {
+	for _, replica := range this.replicas {
+		replica.cancelStream()
+	}
+
+	this.replicas = nil
+}
 
 // Flushes any remaining data to block storage.
 //
@@ -145,37 +628,231 @@ func (this *LocalFileWriter) Write(buffer []byte) (int, error) {
 func (this *LocalFileWriter) Flush() error {
 	glog.V(logging.LogLevelDebug).Infof("Flush writer for %s", this.filename)
 
-	// If a write stream is still open, close the block.
-	if this.writeStream != nil {
-		response, err := this.writeStream.CloseAndRecv()
+	if this.err != nil {
+		return this.err
+	}
+
+	if this.pending != nil {
+		if referenced, err := this.flushPending(); err != nil || referenced {
+			return err
+		}
+	}
+
+	// If write streams are still open, close the block.
+	if this.replicas != nil {
+		blockMetadata, err := this.closeReplicas()
 		if err != nil {
+			this.err = err
 			return err
 		}
 
-		blockId := response.BlockId
-		pvId := response.VolumeId
+		this.blockList = append(this.blockList, blockMetadata)
 
-		blockMetadata := &nameservice.BlockMetadata{
-			BlockId: blockId,
-			PvId:    pvId,
+		if this.Index != nil {
+			this.record(blockMetadata)
 		}
 
-		this.blockList = append(this.blockList, blockMetadata)
-		this.writeStream = nil
+		glog.V(logging.LogLevelTrace).Infof("Committed blockMetadata: %v", blockMetadata)
+	}
+
+	return nil
+}
+
+// Close the write streams of the current block's replicas at once, returning the metadata of those that commit it.
+//
+// Once the minimum number of replicas have acknowledged the block, the rest are given ReplicaGracePeriod before they
+// are abandoned. Abandoned replicas may still commit the block, so their results are drained in the background and any
+// block they commit is removed. If too few commit the block, those that did are removed again.
+func (this *LocalFileWriter) closeReplicas() (*nameservice.BlockMetadata, error) {
+	_, minimumReplicas := this.placementPolicy.Replication()
+
+	replicas := this.replicas
+	this.replicas = nil
+
+	blockData := this.blockData
+
+	results := make(chan *replicaResult, len(replicas))
+	for _, replica := range replicas {
+		go func(replica *replicaWriter) {
+			response, err := replica.writeStream.CloseAndRecv()
 
-		glog.V(logging.LogLevelTrace).Infof("Received block writer response: %v blockMetadata: %v", response, blockMetadata)
+			// Replicas that fail before committing the block are resumed and closed again.
+			for err != nil && replica.resume(blockData, this.MaxReplicaResumes, err) == nil {
+				response, err = replica.writeStream.CloseAndRecv()
+			}
+
+			results <- &replicaResult{replica: replica, response: response, err: err}
+		}(replica)
+	}
+
+	blockMetadata := &nameservice.BlockMetadata{
+		BlockId: this.blockId,
+		PvIds:   make([]string, 0, len(replicas)),
+	}
+
+	var replicaErr error
+	var graceTimer *time.Timer
+	var graceExpired <-chan time.Time
+
+wait:
+	for received := 0; received < len(replicas); {
+		select {
+		case result := <-results:
+			received++
+			result.replica.cancelStream()
+
+			if err := this.acceptReplica(blockMetadata, result); err != nil {
+				replicaErr = err
+			}
+
+			if graceTimer == nil && len(blockMetadata.PvIds) >= minimumReplicas && received < len(replicas) {
+				graceTimer = time.NewTimer(this.ReplicaGracePeriod)
+				defer graceTimer.Stop()
+				graceExpired = graceTimer.C
+			}
+		case <-graceExpired:
+			glog.Warningf("Abandoning %d replicas of block %s - not acknowledged within %s", len(replicas)-received,
+				this.blockId, this.ReplicaGracePeriod)
+
+			// Cancelling a stream that already finished has no effect.
+			for _, replica := range replicas {
+				replica.abandon()
+			}
+
+			go releaseAbandoned(results, len(replicas)-received)
+
+			// Abandoned replicas may still be reading the block's data, so the next block gets a new buffer.
+			this.blockData = nil
+
+			break wait
+		}
 	}
 
+	if len(blockMetadata.PvIds) < minimumReplicas {
+		for _, pvId := range blockMetadata.PvIds {
+			this.release(blockMetadata.BlockId, pvId)
+		}
+
+		return nil, replicaError(replicaErr, "unable to commit block %s - %d replicas acknowledged, minimum %d",
+			this.blockId, len(blockMetadata.PvIds), minimumReplicas)
+	}
+
+	return blockMetadata, nil
+}
+
+// Add a replica that acknowledged the current block to its metadata. Replicas that failed return their error, and
+// replicas that stored something other than the block are removed.
+func (this *LocalFileWriter) acceptReplica(blockMetadata *nameservice.BlockMetadata, result *replicaResult) error {
+	replica, response := result.replica, result.response
+
+	if result.err != nil {
+		glog.Warningf("Replica of block %s on pv %s failed - %v", this.blockId, replica.pv.Id, result.err)
+		return result.err
+	}
+
+	glog.V(logging.LogLevelTrace).Infof("Received block writer response: %v", response)
+
+	if response.BlockId != this.blockId {
+		glog.Warningf("Replica on pv %s stored block %s as %s - removing it", replica.pv.Id, this.blockId,
+			response.BlockId)
+		this.release(response.BlockId, replica.pv.Id)
+		return nil
+	}
+
+	if len(blockMetadata.PvIds) == 0 {
+		blockMetadata.Checksum = response.Checksum
+		blockMetadata.Size = uint64(response.Size)
+		blockMetadata.StoredSize = response.StoredSize
+		blockMetadata.HasChecksum = true
+	} else if response.Checksum != blockMetadata.Checksum {
+		glog.Warningf("Replica of block %s on pv %s has checksum %08x, expected %08x - removing it",
+			this.blockId, replica.pv.Id, response.Checksum, blockMetadata.Checksum)
+		this.release(this.blockId, replica.pv.Id)
+		return nil
+	}
+
+	blockMetadata.PvIds = append(blockMetadata.PvIds, response.VolumeId)
+
 	return nil
 }
 
+// Remove a block the file won't use from a volume, or, for a shared block, the file's reference to it. Failures are
+// logged, leaving the block in place.
+func (this *LocalFileWriter) release(blockId string, pvId string) {
+	this.releaseAfter(blockId, pvId, 0)
+}
+
+// Have a volume remove a block the file no longer uses once delay has passed. Failures are logged, leaving the block
+// in place.
+func (this *LocalFileWriter) releaseAfter(blockId string, pvId string, delay time.Duration) {
+	blockClient, err := this.blockClient(pvId)
+	if err == nil {
+		_, err = blockClient.Delete(context.Background(), &blockservice.ReadRequest{
+			VolumeId:           pvId,
+			BlockId:            blockId,
+			ReleaseAfterMillis: uint64(delay / time.Millisecond),
+		})
+	}
+
+	if err != nil {
+		glog.Warningf("Unable to remove block %s from pv %s - %v", blockId, pvId, err)
+	}
+}
+
+// Returns the block service client for a volume the writer has written to, or that Locator can find.
+func (this *LocalFileWriter) blockClient(pvId string) (blockservice.BlockServiceClient, error) {
+	pv := this.volumes[pvId]
+	if pv == nil && this.Locator != nil {
+		pv = this.Locator(pvId)
+	}
+
+	if pv == nil {
+		return nil, fmt.Errorf("unable to locate pv %s", pvId)
+	}
+
+	blockClient, err := this.clientFactory.Get(pv.Labels["endpoint"])
+	if err != nil {
+		return nil, err
+	}
+
+	return blockClient.(*util.ServiceCtx).BlockServiceClient, nil
+}
+
+// Build the error for a block that lost too many replicas.
+//
+// If the last replica lost was refused because its volume was full, the error carries codes.ResourceExhausted so
+// callers can recognize it with blockservice.IsVolumeFull().
+func replicaError(cause error, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	if cause != nil {
+		message += " - " + cause.Error()
+	}
+
+	if blockservice.IsVolumeFull(cause) {
+		return status.Error(codes.ResourceExhausted, message)
+	}
+
+	return errors.New(message)
+}
+
 func (this *LocalFileWriter) Close() error {
 	glog.V(logging.LogLevelDebug).Infof("Closing writer for file %v.", this.filename)
 
+	if this.source != nil {
+		defer this.source.Close()
+	}
+
 	if err := this.Flush(); err != nil {
+		this.releaseBlocks()
 		return err
 	}
 
+	if this.entry != nil {
+		return this.commitAppend()
+	}
+
+	replicas, _ := this.placementPolicy.Replication()
+
 	now := time.Now().UTC()
 	nowTime := &nameservice.Time{Seconds: now.Unix(), Nanos: int64(now.Nanosecond())}
 
@@ -185,7 +862,7 @@ func (this *LocalFileWriter) Close() error {
 			Blocks:           this.blockList,
 			Permissions:      0,
 			LvId:             "/",
-			ReplicationLevel: 1,
+			ReplicationLevel: uint32(replicas),
 			BlockSize:        uint64(this.blockSize),
 			Size:             uint64(this.filePos),
 			Ctime:            nowTime,
@@ -193,6 +870,7 @@ func (this *LocalFileWriter) Close() error {
 		},
 	})
 	if err != nil {
+		this.releaseBlocks()
 		return err
 	}
 
@@ -200,3 +878,69 @@ func (this *LocalFileWriter) Close() error {
 
 	return nil
 }
+
+// Abandon the file, leaving it as it was. The blocks written for it are removed, as are its references to blocks it
+// shares with other files. The writer can not be used once aborted.
+func (this *LocalFileWriter) Abort() error {
+	glog.V(logging.LogLevelDebug).Infof("Aborting writer for file %v.", this.filename)
+
+	if this.source != nil {
+		defer this.source.Close()
+	}
+
+	this.abortReplicas()
+	this.pending = nil
+	this.releaseBlocks()
+
+	if this.err == nil {
+		this.err = fmt.Errorf("writer for %s aborted", this.filename)
+	}
+
+	return nil
+}
+
+// Remove the blocks of a file that won't be committed from their volumes. Shared blocks lose the file's reference.
+func (this *LocalFileWriter) releaseBlocks() {
+	for _, blockMetadata := range this.blockList {
+		for _, pvId := range blockMetadata.PvIds {
+			this.release(blockMetadata.BlockId, pvId)
+		}
+	}
+
+	this.blockList = nil
+}
+
+// Add the blocks written to the end of the file being appended to.
+//
+// The volumes holding the block the append replaced are asked to remove it ReplacedBlockGracePeriod after it is
+// committed. If the append fails, including when another client appended first, the blocks written for it are removed
+// instead.
+func (this *LocalFileWriter) commitAppend() error {
+	if len(this.blockList) == 0 {
+		glog.V(logging.LogLevelDebug).Infof("Closed writer for %s. Nothing appended", this.filename)
+		return nil
+	}
+
+	appendResp, err := this.nameClient.Append(context.Background(), &nameservice.AppendRequest{
+		Path:            this.filename,
+		ExpectedSize:    this.entry.Size,
+		ReplacedBlockId: this.replacedBlockId,
+		Blocks:          this.blockList,
+		Size:            uint64(this.filePos),
+	})
+	if err != nil {
+		this.releaseBlocks()
+		return err
+	}
+
+	if replaced := appendResp.ReplacedBlock; replaced != nil {
+		for _, pvId := range replaced.PvIds {
+			this.releaseAfter(replaced.BlockId, pvId, this.ReplacedBlockGracePeriod)
+		}
+	}
+
+	glog.V(logging.LogLevelDebug).Infof("Closed writer for %s. Appended %d bytes in %d blocks", this.filename,
+		uint64(this.filePos)-this.entry.Size, this.blockCount)
+
+	return nil
+}
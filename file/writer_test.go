@@ -11,15 +11,23 @@ import (
 	"bfs/util"
 	"bfs/util/size"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLocalFileWriter_Write(t *testing.T) {
@@ -146,6 +154,405 @@ func TestLocalFileWriter_Write(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestLocalFileWriter_WriteReplicas(t *testing.T) {
+	defer glog.Flush()
+
+	cluster := startCluster(t, 2)
+	defer cluster.stop()
+
+	blockServer := cluster.blockServer
+	nameClient := cluster.nameClient
+	blockClient := cluster.blockClient
+	clientFactory := cluster.clientFactory
+
+	zeroBuf := bytes.Repeat([]byte{0}, size.MB)
+
+	// Replicas must land on PVs with distinct disk labels.
+	placementPolicy := NewLabelAwarePlacementPolicy(
+		blockServer.Config.VolumeConfigs,
+		"disk",
+		false,
+		2,
+		2,
+		nil,
+	)
+
+	writer, err := NewWriter(nameClient, clientFactory, placementPolicy, "/test.txt", size.MB)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = writer.Write(zeroBuf)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Close())
+
+	getResp, err := nameClient.Get(context.Background(), &nameservice.GetRequest{Path: "/test.txt"})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, getResp.Entry.ReplicationLevel)
+	require.Len(t, getResp.Entry.Blocks, 3)
+
+	for _, blockMetadata := range getResp.Entry.Blocks {
+		require.Len(t, blockMetadata.PvIds, 2)
+		require.NotEqual(t, blockMetadata.PvIds[0], blockMetadata.PvIds[1])
+
+		// Every replica holds the same block under the same ID.
+		for _, pvId := range blockMetadata.PvIds {
+			readStream, err := blockClient.Read(context.Background(), &blockservice.ReadRequest{
+				VolumeId:  pvId,
+				BlockId:   blockMetadata.BlockId,
+				ChunkSize: size.MB,
+			})
+			require.NoError(t, err)
+
+			blockLen := 0
+			for {
+				readResp, err := readStream.Recv()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+
+				blockLen += len(readResp.Buffer)
+			}
+
+			require.Equal(t, size.MB, blockLen)
+		}
+	}
+}
+
+func TestLocalFileWriter_Append(t *testing.T) {
+	defer glog.Flush()
+
+	cluster := startCluster(t, 1)
+	defer cluster.stop()
+
+	blockServer := cluster.blockServer
+	nameClient := cluster.nameClient
+	clientFactory := cluster.clientFactory
+
+	placementPolicy := NewLabelAwarePlacementPolicy(
+		blockServer.Config.VolumeConfigs,
+		"hostname",
+		true,
+		1,
+		1,
+		nil,
+	)
+
+	pvLocator := volumeLocator(blockServer.Config.VolumeConfigs)
+
+	data := make([]byte, size.KB*15)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	writer, err := NewWriter(nameClient, clientFactory, placementPolicy, "/test.txt", size.KB*4)
+	require.NoError(t, err)
+	_, err = writer.Write(data[:size.KB*10])
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	getResp, err := nameClient.Get(context.Background(), &nameservice.GetRequest{Path: "/test.txt"})
+	require.NoError(t, err)
+	original := getResp.Entry
+
+	appendTo := func(entry *nameservice.Entry, buffer []byte) error {
+		source := NewReader(nameClient, clientFactory, pvLocator, "/test.txt")
+		require.NoError(t, source.Open())
+
+		writer, err := NewAppendWriter(nameClient, clientFactory, placementPolicy, entry, source)
+		require.NoError(t, err)
+
+		writer.Locator = pvLocator
+		writer.ReplacedBlockGracePeriod = time.Second
+
+		_, err = writer.Write(buffer)
+		require.NoError(t, err)
+
+		return writer.Close()
+	}
+
+	// A reader that opens the file before the append.
+	earlyReader := NewReader(nameClient, clientFactory, pvLocator, "/test.txt")
+	require.NoError(t, earlyReader.Open())
+
+	// The partial last block is replaced; full blocks are kept.
+	require.NoError(t, appendTo(original, data[size.KB*10:]))
+
+	getResp, err = nameClient.Get(context.Background(), &nameservice.GetRequest{Path: "/test.txt"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(size.KB*15), getResp.Entry.Size)
+	require.Len(t, getResp.Entry.Blocks, 4)
+	require.Equal(t, original.Blocks[0].BlockId, getResp.Entry.Blocks[0].BlockId)
+	require.Equal(t, original.Blocks[1].BlockId, getResp.Entry.Blocks[1].BlockId)
+	require.NotEqual(t, original.Blocks[2].BlockId, getResp.Entry.Blocks[2].BlockId)
+	require.Equal(t, uint64(size.KB*4), getResp.Entry.Blocks[2].Size)
+	require.Equal(t, uint64(size.KB*3), getResp.Entry.Blocks[3].Size)
+
+	// The replaced block is kept for the early reader, which still reads the file as it was.
+	pv := blockServer.PhysicalVolumes[0]
+
+	blockIds, err := pv.BlockIds()
+	require.NoError(t, err)
+	require.Contains(t, blockIds, original.Blocks[2].BlockId)
+
+	references, err := pv.References(original.Blocks[2].BlockId)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, references)
+
+	earlyData, err := ioutil.ReadAll(earlyReader)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data[:size.KB*10], earlyData), "data mismatch")
+	require.NoError(t, earlyReader.Close())
+
+	// The replaced block's volume removes it once its grace period ends, though the writer has closed.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		blockIds, err = pv.BlockIds()
+		require.NoError(t, err)
+
+		if len(blockIds) == 4 || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	require.Len(t, blockIds, 4)
+	require.NotContains(t, blockIds, original.Blocks[2].BlockId)
+
+	_, err = pv.References(original.Blocks[2].BlockId)
+	require.True(t, os.IsNotExist(err), "unexpected error %v", err)
+
+	reader := NewReader(nameClient, clientFactory, pvLocator, "/test.txt")
+	require.NoError(t, reader.Open())
+
+	readData, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, readData), "data mismatch")
+	require.NoError(t, reader.Close())
+
+	// An append based on a stale entry loses to the one that got there first.
+	err = appendTo(original, data[:size.KB])
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	// The blocks written by the losing append are removed.
+	blockIds, err = pv.BlockIds()
+	require.NoError(t, err)
+	require.Len(t, blockIds, 4)
+
+	getResp, err = nameClient.Get(context.Background(), &nameservice.GetRequest{Path: "/test.txt"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(size.KB*15), getResp.Entry.Size)
+}
+
+// A server stream that fails once it has received failAt messages, or at its end if failAt is zero.
+type breakingServerStream struct {
+	grpc.ServerStream
+	failAt   int
+	received int
+}
+
+func (this *breakingServerStream) RecvMsg(m interface{}) error {
+	err := this.ServerStream.RecvMsg(m)
+	this.received++
+
+	if (this.failAt == 0 && err == io.EOF) || this.received == this.failAt {
+		return errors.New("stream broken")
+	}
+
+	return err
+}
+
+func TestLocalFileWriter_Resume(t *testing.T) {
+	defer glog.Flush()
+
+	// Break the next write stream at the given message, or at its end.
+	var breakMut sync.Mutex
+	breakAt := -1
+
+	interceptor := grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+
+		breakMut.Lock()
+		failAt := breakAt
+		if info.FullMethod == "/blockservice.BlockService/Write" {
+			breakAt = -1
+		}
+		breakMut.Unlock()
+
+		if info.FullMethod == "/blockservice.BlockService/Write" && failAt >= 0 {
+			stream = &breakingServerStream{ServerStream: stream, failAt: failAt}
+		}
+
+		return handler(srv, stream)
+	})
+
+	cluster := startCluster(t, 2, interceptor)
+	defer cluster.stop()
+
+	blockServer := cluster.blockServer
+	nameClient := cluster.nameClient
+	clientFactory := cluster.clientFactory
+
+	placementPolicy := NewLabelAwarePlacementPolicy(
+		blockServer.Config.VolumeConfigs,
+		"disk",
+		false,
+		2,
+		2,
+		nil,
+	)
+
+	data := make([]byte, size.MB*5/2)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	writeFile := func(filename string, failAt int, maxResumes int) error {
+		breakMut.Lock()
+		breakAt = failAt
+		breakMut.Unlock()
+
+		writer, err := NewWriter(nameClient, clientFactory, placementPolicy, filename, size.MB*2)
+		require.NoError(t, err)
+
+		writer.MaxReplicaResumes = maxResumes
+
+		for pos := 0; pos < len(data); pos += size.KB * 256 {
+			if _, err := writer.Write(data[pos : pos+size.KB*256]); err != nil {
+				writer.Abort()
+				return err
+			}
+		}
+
+		return writer.Close()
+	}
+
+	// Replicas whose streams break part way through a block, or as it is committed, are resumed where they left off.
+	require.NoError(t, writeFile("/middle.txt", 3, DefaultMaxReplicaResumes))
+	require.NoError(t, writeFile("/end.txt", 0, DefaultMaxReplicaResumes))
+
+	for _, filename := range []string{"/middle.txt", "/end.txt"} {
+		getResp, err := nameClient.Get(context.Background(), &nameservice.GetRequest{Path: filename})
+		require.NoError(t, err)
+
+		for _, blockMetadata := range getResp.Entry.Blocks {
+			require.Len(t, blockMetadata.PvIds, 2)
+		}
+
+		reader := NewReader(nameClient, clientFactory, volumeLocator(blockServer.Config.VolumeConfigs), filename)
+		require.NoError(t, reader.Open())
+
+		readData, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, readData), "data mismatch in %s", filename)
+		require.NoError(t, reader.Close())
+	}
+
+	// Without resuming, the replica is lost, and with it the block.
+	require.Error(t, writeFile("/lost.txt", 3, 0))
+}
+
+// A server stream that waits before reporting the end of the stream, so its block is committed late.
+type slowServerStream struct {
+	grpc.ServerStream
+	delay time.Duration
+}
+
+func (this *slowServerStream) RecvMsg(m interface{}) error {
+	err := this.ServerStream.RecvMsg(m)
+	if err == io.EOF {
+		time.Sleep(this.delay)
+	}
+
+	return err
+}
+
+func TestLocalFileWriter_AbandonReplica(t *testing.T) {
+	defer glog.Flush()
+
+	// Slow down the first write stream only, noting when it has finished.
+	var slowMut sync.Mutex
+	slowed := false
+	slowDone := make(chan struct{})
+
+	interceptor := grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+
+		slowMut.Lock()
+		slow := !slowed && info.FullMethod == "/blockservice.BlockService/Write"
+		if slow {
+			slowed = true
+		}
+		slowMut.Unlock()
+
+		if slow {
+			defer close(slowDone)
+			stream = &slowServerStream{ServerStream: stream, delay: 500 * time.Millisecond}
+		}
+
+		return handler(srv, stream)
+	})
+
+	cluster := startCluster(t, 2, interceptor)
+	defer cluster.stop()
+
+	blockServer := cluster.blockServer
+	nameClient := cluster.nameClient
+	clientFactory := cluster.clientFactory
+
+	placementPolicy := NewLabelAwarePlacementPolicy(
+		blockServer.Config.VolumeConfigs,
+		"disk",
+		false,
+		2,
+		1,
+		nil,
+	)
+
+	writer, err := NewWriter(nameClient, clientFactory, placementPolicy, "/test.txt", size.MB)
+	require.NoError(t, err)
+
+	writer.ReplicaGracePeriod = 50 * time.Millisecond
+
+	_, err = writer.Write(bytes.Repeat([]byte{1}, size.KB))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	getResp, err := nameClient.Get(context.Background(), &nameservice.GetRequest{Path: "/test.txt"})
+	require.NoError(t, err)
+	require.Len(t, getResp.Entry.Blocks, 1)
+	require.Len(t, getResp.Entry.Blocks[0].PvIds, 1)
+
+	// The abandoned replica commits the block after the writer stops waiting for it, and the block is removed again.
+	<-slowDone
+
+	volumeBlocks := func() map[string][]string {
+		blocks := make(map[string][]string)
+		for _, pv := range blockServer.PhysicalVolumes {
+			blockIds, err := pv.BlockIds()
+			require.NoError(t, err)
+
+			if len(blockIds) > 0 {
+				blocks[pv.ID.String()] = blockIds
+			}
+		}
+
+		return blocks
+	}
+
+	expected := map[string][]string{
+		getResp.Entry.Blocks[0].PvIds[0]: {getResp.Entry.Blocks[0].BlockId},
+	}
+
+	for i := 0; i < 100 && len(volumeBlocks()) > 1; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	require.Equal(t, expected, volumeBlocks())
+}
+
 // Benchmark write speed through the block service.
 //
 // This benchmark performs writes through the block service at multiple multiple
@@ -322,3 +729,102 @@ func BenchmarkLocalFileWriter_Write(b *testing.B) {
 		)
 	}
 }
+
+// A block index held in memory.
+type memoryBlockIndex struct {
+	blocks map[string]*nameservice.BlockMetadata
+}
+
+func (this *memoryBlockIndex) Lookup(blockId string) (*nameservice.BlockMetadata, error) {
+	return this.blocks[blockId], nil
+}
+
+func (this *memoryBlockIndex) Record(blockMetadata *nameservice.BlockMetadata) error {
+	this.blocks[blockMetadata.BlockId] = blockMetadata
+	return nil
+}
+
+func TestLocalFileWriter_Dedup(t *testing.T) {
+	defer glog.Flush()
+
+	cluster := startCluster(t, 2)
+	defer cluster.stop()
+
+	blockServer := cluster.blockServer
+	nameClient := cluster.nameClient
+	clientFactory := cluster.clientFactory
+
+	placementPolicy := NewLabelAwarePlacementPolicy(
+		blockServer.Config.VolumeConfigs,
+		"disk",
+		false,
+		2,
+		2,
+		nil,
+	)
+
+	locator := volumeLocator(blockServer.Config.VolumeConfigs)
+	index := &memoryBlockIndex{blocks: make(map[string]*nameservice.BlockMetadata)}
+
+	// The first and last blocks of each file are the same.
+	data := make([]byte, size.MB*3)
+	for i := size.MB; i < size.MB*2; i++ {
+		data[i] = byte(i % 251)
+	}
+
+	for _, filename := range []string{"/first.txt", "/second.txt"} {
+		writer, err := NewWriter(nameClient, clientFactory, placementPolicy, filename, size.MB)
+		require.NoError(t, err)
+
+		writer.Index = index
+		writer.Locator = locator
+
+		_, err = writer.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		reader := NewReader(nameClient, clientFactory, locator, filename)
+		require.NoError(t, reader.Open())
+
+		readData, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, readData), "data mismatch in %s", filename)
+		require.NoError(t, reader.Close())
+	}
+
+	getResp, err := nameClient.Get(context.Background(), &nameservice.GetRequest{Path: "/second.txt"})
+	require.NoError(t, err)
+	require.Len(t, getResp.Entry.Blocks, 3)
+
+	blocks := getResp.Entry.Blocks
+	require.Equal(t, blockservice.ContentBlockIdOf(data[:size.MB]), blocks[0].BlockId)
+	require.Equal(t, blocks[0].BlockId, blocks[2].BlockId)
+	require.Len(t, index.blocks, 2)
+
+	// An abandoned file gives up its references and removes the blocks it wrote.
+	writer, err := NewWriter(nameClient, clientFactory, placementPolicy, "/abandoned.txt", size.MB)
+	require.NoError(t, err)
+
+	writer.Index = index
+	writer.Locator = locator
+
+	_, err = writer.Write(append(bytes.Repeat([]byte{1}, size.MB), data...))
+	require.NoError(t, err)
+	require.NoError(t, writer.Abort())
+	require.Error(t, writer.Close())
+
+	// Each volume stores each distinct block once, referenced by every block of every file with its content.
+	for _, pv := range blockServer.PhysicalVolumes {
+		blockIds, err := pv.BlockIds()
+		require.NoError(t, err)
+		require.Len(t, blockIds, 2)
+
+		references, err := pv.References(blocks[0].BlockId)
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), references)
+
+		references, err = pv.References(blocks[1].BlockId)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), references)
+	}
+}
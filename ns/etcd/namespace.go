@@ -24,6 +24,11 @@ const (
 	StateError   = "ERROR"
 )
 
+const (
+	// The number of times an update is attempted when the entry changes concurrently.
+	maxUpdateAttempts = 5
+)
+
 var stateFSM = fsm.New(StateInitial).
 	Allow(StateInitial, StateOpen).
 	Allow(StateInitial, StateClosed).
@@ -336,6 +341,182 @@ func (this *EtcdNamespace) Rename(source string, dest string) error {
 	return nil
 }
 
+// Replace the replica of a block on oldPvId with one on newPvId.
+//
+// The entry is updated only if it hasn't changed since it was read; concurrent changes cause the update to be retried.
+// Returns an *ns.Error if the entry doesn't exist, and ns.ErrNoSuchReplica if the entry holds no replica of the block on
+// oldPvId.
+func (this *EtcdNamespace) ReplaceReplica(path string, blockId string, oldPvId string, newPvId string) error {
+	glog.V(logging.LogLevelTrace).Infof("Replace replica of block %s in %s on %s with %s", blockId, path, oldPvId,
+		newPvId)
+
+	if err := this.fsm.Is(StateOpen); err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		// As with Rename(), the raw value is needed to detect concurrent changes.
+		getResp, err := this.client.Get(context.Background(), path)
+		if err != nil {
+			return err
+		}
+
+		if getResp.Count == 0 {
+			return &ns.Error{Path: path}
+		}
+
+		kv := getResp.Kvs[0]
+		entry := &ns.Entry{}
+		if err := json.Unmarshal(kv.Value, entry); err != nil {
+			return err
+		}
+
+		if !replaceReplica(entry, blockId, oldPvId, newPvId) {
+			return ns.ErrNoSuchReplica
+		}
+
+		jsonEntry, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		txResp, err := this.client.Txn(context.Background()).If(
+			clientv3.Compare(clientv3.Value(path), "=", string(kv.Value)),
+		).Then(
+			clientv3.OpPut(path, string(jsonEntry)),
+		).Commit()
+		if err != nil {
+			return err
+		}
+
+		if txResp.Succeeded {
+			return nil
+		}
+
+		if attempt == maxUpdateAttempts {
+			return fmt.Errorf("unable to update %s - changed concurrently %d times", path, attempt)
+		}
+
+		glog.V(logging.LogLevelDebug).Infof("Entry %s changed during replica replacement - retrying", path)
+	}
+}
+
+// Replace oldPvId with newPvId in the replicas of a block. Returns false if the block has no replica on oldPvId.
+func replaceReplica(entry *ns.Entry, blockId string, oldPvId string, newPvId string) bool {
+	for _, block := range entry.Blocks {
+		if block.Block != blockId {
+			continue
+		}
+
+		for i, pvId := range block.PVIDs {
+			if pvId == oldPvId {
+				block.PVIDs[i] = newPvId
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Add blocks to the end of an entry and set its size.
+//
+// The append only succeeds if the entry still has expectedSize bytes, so the blocks of concurrent appends are never
+// interleaved. If replacedBlockId is set, it must be the entry's last block, and the first of blocks takes its place.
+// Returns the replaced block, whose replicas are no longer referenced by the entry, or nil if no block was replaced.
+// Returns an *ns.Error if the entry doesn't exist, and ns.ErrEntryChanged if it changed size.
+func (this *EtcdNamespace) Append(path string, expectedSize uint64, replacedBlockId string, blocks []*ns.BlockMetadata,
+	size uint64) (*ns.BlockMetadata, error) {
+
+	glog.V(logging.LogLevelTrace).Infof("Append %d blocks to %s at %d replacing %q", len(blocks), path, expectedSize,
+		replacedBlockId)
+
+	if err := this.fsm.Is(StateOpen); err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		// As with Rename(), the raw value is needed to detect concurrent changes.
+		getResp, err := this.client.Get(context.Background(), path)
+		if err != nil {
+			return nil, err
+		}
+
+		if getResp.Count == 0 {
+			return nil, &ns.Error{Path: path}
+		}
+
+		kv := getResp.Kvs[0]
+		entry := &ns.Entry{}
+		if err := json.Unmarshal(kv.Value, entry); err != nil {
+			return nil, err
+		}
+
+		replaced, err := appendBlocks(entry, expectedSize, replacedBlockId, blocks, size)
+		if err != nil {
+			return nil, err
+		}
+
+		jsonEntry, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		txResp, err := this.client.Txn(context.Background()).If(
+			clientv3.Compare(clientv3.Value(path), "=", string(kv.Value)),
+		).Then(
+			clientv3.OpPut(path, string(jsonEntry)),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		if txResp.Succeeded {
+			return replaced, nil
+		}
+
+		if attempt == maxUpdateAttempts {
+			return nil, fmt.Errorf("unable to update %s - changed concurrently %d times", path, attempt)
+		}
+
+		glog.V(logging.LogLevelDebug).Infof("Entry %s changed during append - retrying", path)
+	}
+}
+
+// Add blocks to the end of an entry, replacing its last block if replacedBlockId is set. Returns the replaced block.
+func appendBlocks(entry *ns.Entry, expectedSize uint64, replacedBlockId string, blocks []*ns.BlockMetadata,
+	size uint64) (*ns.BlockMetadata, error) {
+
+	if entry.ErasureCoding != nil {
+		return nil, fmt.Errorf("unable to append to %s - erasure-coded files can not be appended to", entry.Path)
+	}
+
+	if entry.Size != expectedSize {
+		return nil, ns.ErrEntryChanged
+	}
+
+	var replaced *ns.BlockMetadata
+
+	if replacedBlockId != "" {
+		if len(entry.Blocks) == 0 || entry.Blocks[len(entry.Blocks)-1].Block != replacedBlockId {
+			return nil, ns.ErrEntryChanged
+		}
+
+		replaced = entry.Blocks[len(entry.Blocks)-1]
+		entry.Blocks = entry.Blocks[:len(entry.Blocks)-1]
+	}
+
+	for _, block := range blocks {
+		block.LVName = entry.VolumeName
+	}
+
+	entry.Blocks = append(entry.Blocks, blocks...)
+	entry.Size = size
+	entry.Mtime = time.Now().UTC()
+
+	return replaced, nil
+}
+
 func (this *EtcdNamespace) Close() error {
 	glog.V(logging.LogLevelDebug).Infof("Closing namespace at %s", this.config.Path)
 
@@ -36,10 +36,10 @@ func TestEtcdNamespace(t *testing.T) {
 		namespace.Add(&ns.Entry{
 			Path: fmt.Sprintf("/%d.txt", i),
 			Blocks: []*ns.BlockMetadata{
-				{PVID: "1", Block: "1", LVName: "/"},
-				{PVID: "2", Block: "2", LVName: "/"},
-				{PVID: "1", Block: "3", LVName: "/"},
-				{PVID: "2", Block: "4", LVName: "/"},
+				{PVIDs: []string{"1"}, Block: "1", LVName: "/"},
+				{PVIDs: []string{"2"}, Block: "2", LVName: "/"},
+				{PVIDs: []string{"1"}, Block: "3", LVName: "/"},
+				{PVIDs: []string{"2"}, Block: "4", LVName: "/"},
 			},
 		})
 	}
@@ -50,10 +50,10 @@ func TestEtcdNamespace(t *testing.T) {
 	require.Equal(t, &ns.Entry{
 		Path: "/0.txt",
 		Blocks: []*ns.BlockMetadata{
-			{PVID: "1", Block: "1", LVName: "/"},
-			{PVID: "2", Block: "2", LVName: "/"},
-			{PVID: "1", Block: "3", LVName: "/"},
-			{PVID: "2", Block: "4", LVName: "/"},
+			{PVIDs: []string{"1"}, Block: "1", LVName: "/"},
+			{PVIDs: []string{"2"}, Block: "2", LVName: "/"},
+			{PVIDs: []string{"1"}, Block: "3", LVName: "/"},
+			{PVIDs: []string{"2"}, Block: "4", LVName: "/"},
 		},
 	}, entry)
 
@@ -108,6 +108,69 @@ func TestEtcdNamespace(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, entry)
 
+	err = namespace.Add(&ns.Entry{
+		Path: "c",
+		Blocks: []*ns.BlockMetadata{
+			{PVIDs: []string{"1", "2"}, Block: "1", LVName: "/"},
+			{PVIDs: []string{"2"}, Block: "2", LVName: "/"},
+		},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, namespace.ReplaceReplica("c", "1", "2", "3"))
+	require.Equal(t, ns.ErrNoSuchReplica, namespace.ReplaceReplica("c", "1", "2", "3"))
+	require.Equal(t, ns.ErrNoSuchReplica, namespace.ReplaceReplica("c", "3", "2", "3"))
+	require.IsType(t, &ns.Error{}, namespace.ReplaceReplica("d", "1", "2", "3"))
+
+	entry, err = namespace.Get("c")
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "3"}, entry.Blocks[0].PVIDs)
+	require.Equal(t, []string{"2"}, entry.Blocks[1].PVIDs)
+
+	err = namespace.Add(&ns.Entry{
+		Path:      "e",
+		BlockSize: 10,
+		Size:      15,
+		Blocks: []*ns.BlockMetadata{
+			{PVIDs: []string{"1"}, Block: "1", Size: 10},
+			{PVIDs: []string{"1"}, Block: "2", Size: 5},
+		},
+	})
+	require.NoError(t, err)
+
+	appended := []*ns.BlockMetadata{
+		{PVIDs: []string{"2"}, Block: "3", Size: 10},
+		{PVIDs: []string{"2"}, Block: "4", Size: 2},
+	}
+
+	_, err = namespace.Append("e", 10, "2", appended, 22)
+	require.Equal(t, ns.ErrEntryChanged, err)
+	_, err = namespace.Append("e", 15, "1", appended, 22)
+	require.Equal(t, ns.ErrEntryChanged, err)
+	_, err = namespace.Append("f", 15, "2", appended, 22)
+	require.IsType(t, &ns.Error{}, err)
+
+	replaced, err := namespace.Append("e", 15, "2", appended, 22)
+	require.NoError(t, err)
+	require.Equal(t, "2", replaced.Block)
+	require.Equal(t, []string{"1"}, replaced.PVIDs)
+
+	entry, err = namespace.Get("e")
+	require.NoError(t, err)
+	require.Equal(t, uint64(22), entry.Size)
+	require.Len(t, entry.Blocks, 3)
+	require.Equal(t, []string{"1", "3", "4"}, []string{entry.Blocks[0].Block, entry.Blocks[1].Block,
+		entry.Blocks[2].Block})
+
+	// The first append wins.
+	_, err = namespace.Append("e", 15, "2", appended, 22)
+	require.Equal(t, ns.ErrEntryChanged, err)
+
+	// Appends after a full last block replace nothing.
+	replaced, err = namespace.Append("e", 22, "", appended[1:], 24)
+	require.NoError(t, err)
+	require.Nil(t, replaced)
+
 	assert.NoError(t, namespace.Close())
 }
 
@@ -145,17 +208,17 @@ func BenchmarkEtcdNamespace(b *testing.B) {
 					ReplicationLevel: 1,
 					Status:           ns.FileStatus_OK,
 					Blocks: []*ns.BlockMetadata{
-						{Block: "1", LVName: "/", PVID: "1"},
-						{Block: "2", LVName: "/", PVID: "1"},
-						{Block: "3", LVName: "/", PVID: "1"},
-						{Block: "4", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "6", LVName: "/", PVID: "1"},
-						{Block: "7", LVName: "/", PVID: "1"},
-						{Block: "8", LVName: "/", PVID: "1"},
-						{Block: "9", LVName: "/", PVID: "1"},
-						{Block: "10", LVName: "/", PVID: "1"},
+						{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "2", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "3", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "4", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "6", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "7", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "8", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "9", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "10", LVName: "/", PVIDs: []string{"1"}},
 					},
 					Ctime: now,
 					Mtime: now,
@@ -185,17 +248,17 @@ func BenchmarkEtcdNamespace(b *testing.B) {
 					ReplicationLevel: 1,
 					Status:           ns.FileStatus_OK,
 					Blocks: []*ns.BlockMetadata{
-						{Block: "1", LVName: "/", PVID: "1"},
-						{Block: "2", LVName: "/", PVID: "1"},
-						{Block: "3", LVName: "/", PVID: "1"},
-						{Block: "4", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "6", LVName: "/", PVID: "1"},
-						{Block: "7", LVName: "/", PVID: "1"},
-						{Block: "8", LVName: "/", PVID: "1"},
-						{Block: "9", LVName: "/", PVID: "1"},
-						{Block: "10", LVName: "/", PVID: "1"},
+						{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "2", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "3", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "4", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "6", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "7", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "8", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "9", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "10", LVName: "/", PVIDs: []string{"1"}},
 					},
 					Ctime: now,
 					Mtime: now,
@@ -225,17 +288,17 @@ func BenchmarkEtcdNamespace(b *testing.B) {
 					ReplicationLevel: 1,
 					Status:           ns.FileStatus_OK,
 					Blocks: []*ns.BlockMetadata{
-						{Block: "1", LVName: "/", PVID: "1"},
-						{Block: "2", LVName: "/", PVID: "1"},
-						{Block: "3", LVName: "/", PVID: "1"},
-						{Block: "4", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "6", LVName: "/", PVID: "1"},
-						{Block: "7", LVName: "/", PVID: "1"},
-						{Block: "8", LVName: "/", PVID: "1"},
-						{Block: "9", LVName: "/", PVID: "1"},
-						{Block: "10", LVName: "/", PVID: "1"},
+						{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "2", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "3", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "4", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "6", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "7", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "8", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "9", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "10", LVName: "/", PVIDs: []string{"1"}},
 					},
 					Ctime: now,
 					Mtime: now,
@@ -263,17 +326,17 @@ func BenchmarkEtcdNamespace(b *testing.B) {
 				ReplicationLevel: 1,
 				Status:           ns.FileStatus_OK,
 				Blocks: []*ns.BlockMetadata{
-					{Block: "1", LVName: "/", PVID: "1"},
-					{Block: "2", LVName: "/", PVID: "1"},
-					{Block: "3", LVName: "/", PVID: "1"},
-					{Block: "4", LVName: "/", PVID: "1"},
-					{Block: "5", LVName: "/", PVID: "1"},
-					{Block: "5", LVName: "/", PVID: "1"},
-					{Block: "6", LVName: "/", PVID: "1"},
-					{Block: "7", LVName: "/", PVID: "1"},
-					{Block: "8", LVName: "/", PVID: "1"},
-					{Block: "9", LVName: "/", PVID: "1"},
-					{Block: "10", LVName: "/", PVID: "1"},
+					{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "2", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "3", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "4", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "6", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "7", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "8", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "9", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "10", LVName: "/", PVIDs: []string{"1"}},
 				},
 				Ctime: now,
 				Mtime: now,
@@ -46,12 +46,46 @@ type Entry struct {
 	ReplicationLevel uint32
 	Ctime            time.Time
 	Mtime            time.Time
+	// The stripe geometry of erasure-coded files, or nil for replicated files.
+	ErasureCoding *ErasureCoding
+}
+
+type ErasureCoding struct {
+	DataFragments   uint32
+	ParityFragments uint32
+	CellSize        uint64
 }
 
 type BlockMetadata struct {
-	Block  string
-	LVName string
-	PVID   string
+	Block    string
+	LVName   string
+	PVIDs    []string
+	Checksum uint32
+	// The logical size of the block, and the size stored for each replica after encoding.
+	Size       uint64
+	StoredSize uint64
+	// Whether Checksum was recorded, which it isn't for blocks written before checksums were.
+	HasChecksum bool
+}
+
+// Decode block metadata, including entries written when a block had a single PVID.
+func (this *BlockMetadata) UnmarshalJSON(value []byte) error {
+	type blockMetadata BlockMetadata
+
+	legacy := struct {
+		*blockMetadata
+		PVID string
+	}{blockMetadata: (*blockMetadata)(this)}
+
+	if err := json.Unmarshal(value, &legacy); err != nil {
+		return err
+	}
+
+	if legacy.PVID != "" && len(this.PVIDs) == 0 {
+		this.PVIDs = []string{legacy.PVID}
+	}
+
+	return nil
 }
 
 type status int
@@ -90,6 +124,12 @@ func (this *Error) Error() string {
 
 var ErrNoSuchEntry = errors.New("no such entry")
 
+// The error returned when an entry has no replica of a block on a given physical volume.
+var ErrNoSuchReplica = errors.New("no such replica")
+
+// The error returned when an entry was changed by another client since it was read.
+var ErrEntryChanged = errors.New("entry changed")
+
 // Default LevelDB read and write options.
 var defaultReadOpts = &opt.ReadOptions{}
 var defaultWriteOpts = &opt.WriteOptions{Sync: true}
@@ -4,6 +4,7 @@ import (
 	"bfs/test"
 	"bfs/util/size"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/stretchr/testify/require"
@@ -29,8 +30,8 @@ func TestNamespace_Open(t *testing.T) {
 			VolumeName: "/",
 			Path:       "/a.txt",
 			Blocks: []*BlockMetadata{
-				{Block: "1", LVName: "/", PVID: "1"},
-				{Block: "2", LVName: "/", PVID: "1"},
+				{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+				{Block: "2", LVName: "/", PVIDs: []string{"1"}},
 			},
 		},
 	)
@@ -40,10 +41,10 @@ func TestNamespace_Open(t *testing.T) {
 			VolumeName: "/",
 			Path:       "/b.txt",
 			Blocks: []*BlockMetadata{
-				{Block: "3", LVName: "/", PVID: "1"},
-				{Block: "4", LVName: "/", PVID: "1"},
-				{Block: "5", LVName: "/", PVID: "1"},
-				{Block: "6", LVName: "/", PVID: "1"},
+				{Block: "3", LVName: "/", PVIDs: []string{"1"}},
+				{Block: "4", LVName: "/", PVIDs: []string{"1"}},
+				{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+				{Block: "6", LVName: "/", PVIDs: []string{"1"}},
 			},
 		},
 	)
@@ -58,8 +59,8 @@ func TestNamespace_Open(t *testing.T) {
 		VolumeName: "/",
 		Path:       "/a.txt",
 		Blocks: []*BlockMetadata{
-			{Block: "1", LVName: "/", PVID: "1"},
-			{Block: "2", LVName: "/", PVID: "1"},
+			{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+			{Block: "2", LVName: "/", PVIDs: []string{"1"}},
 		},
 		Permissions: 0,
 		Status:      FileStatus_Unknown,
@@ -80,14 +81,14 @@ func TestNamespace_Open(t *testing.T) {
 		t,
 		[]*Entry{
 			{VolumeName: "/", Path: "/a.txt", Blocks: []*BlockMetadata{
-				{Block: "1", LVName: "/", PVID: "1"},
-				{Block: "2", LVName: "/", PVID: "1"},
+				{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+				{Block: "2", LVName: "/", PVIDs: []string{"1"}},
 			}, Permissions: 0, Status: FileStatus_Unknown},
 			{VolumeName: "/", Path: "/b.txt", Blocks: []*BlockMetadata{
-				{Block: "3", LVName: "/", PVID: "1"},
-				{Block: "4", LVName: "/", PVID: "1"},
-				{Block: "5", LVName: "/", PVID: "1"},
-				{Block: "6", LVName: "/", PVID: "1"},
+				{Block: "3", LVName: "/", PVIDs: []string{"1"}},
+				{Block: "4", LVName: "/", PVIDs: []string{"1"}},
+				{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+				{Block: "6", LVName: "/", PVIDs: []string{"1"}},
 			}, Permissions: 0, Status: FileStatus_Unknown},
 			{VolumeName: "/", Path: "/c.txt", Blocks: []*BlockMetadata{}, Permissions: 0, Status: FileStatus_Unknown},
 		},
@@ -113,9 +114,9 @@ func TestNamespace_Open(t *testing.T) {
 				Ctime:            now,
 				Mtime:            now,
 				Blocks: []*BlockMetadata{
-					{LVName: "/", Block: "1", PVID: "1"},
-					{LVName: "/", Block: "2", PVID: "2"},
-					{LVName: "/", Block: "3", PVID: "1"},
+					{LVName: "/", Block: "1", PVIDs: []string{"1"}},
+					{LVName: "/", Block: "2", PVIDs: []string{"2"}},
+					{LVName: "/", Block: "3", PVIDs: []string{"1"}},
 				},
 			}))
 		}
@@ -170,6 +171,16 @@ func TestNamespace_keyFor(t *testing.T) {
 	)
 }
 
+func TestBlockMetadata_UnmarshalJSON(t *testing.T) {
+	blockMetadata := &BlockMetadata{}
+	require.NoError(t, json.Unmarshal([]byte(`{"Block":"1","LVName":"/","PVID":"a","Checksum":7}`), blockMetadata))
+	require.Equal(t, &BlockMetadata{Block: "1", LVName: "/", PVIDs: []string{"a"}, Checksum: 7}, blockMetadata)
+
+	blockMetadata = &BlockMetadata{}
+	require.NoError(t, json.Unmarshal([]byte(`{"Block":"1","LVName":"/","PVIDs":["a","b"]}`), blockMetadata))
+	require.Equal(t, &BlockMetadata{Block: "1", LVName: "/", PVIDs: []string{"a", "b"}}, blockMetadata)
+}
+
 func BenchmarkNamespace(b *testing.B) {
 	testDir := test.New("build", "test", b.Name())
 	err := testDir.Create()
@@ -196,17 +207,17 @@ func BenchmarkNamespace(b *testing.B) {
 					ReplicationLevel: 1,
 					Status:           FileStatus_OK,
 					Blocks: []*BlockMetadata{
-						{Block: "1", LVName: "/", PVID: "1"},
-						{Block: "2", LVName: "/", PVID: "1"},
-						{Block: "3", LVName: "/", PVID: "1"},
-						{Block: "4", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "6", LVName: "/", PVID: "1"},
-						{Block: "7", LVName: "/", PVID: "1"},
-						{Block: "8", LVName: "/", PVID: "1"},
-						{Block: "9", LVName: "/", PVID: "1"},
-						{Block: "10", LVName: "/", PVID: "1"},
+						{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "2", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "3", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "4", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "6", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "7", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "8", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "9", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "10", LVName: "/", PVIDs: []string{"1"}},
 					},
 					Ctime: now,
 					Mtime: now,
@@ -236,17 +247,17 @@ func BenchmarkNamespace(b *testing.B) {
 					ReplicationLevel: 1,
 					Status:           FileStatus_OK,
 					Blocks: []*BlockMetadata{
-						{Block: "1", LVName: "/", PVID: "1"},
-						{Block: "2", LVName: "/", PVID: "1"},
-						{Block: "3", LVName: "/", PVID: "1"},
-						{Block: "4", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "6", LVName: "/", PVID: "1"},
-						{Block: "7", LVName: "/", PVID: "1"},
-						{Block: "8", LVName: "/", PVID: "1"},
-						{Block: "9", LVName: "/", PVID: "1"},
-						{Block: "10", LVName: "/", PVID: "1"},
+						{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "2", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "3", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "4", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "6", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "7", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "8", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "9", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "10", LVName: "/", PVIDs: []string{"1"}},
 					},
 					Ctime: now,
 					Mtime: now,
@@ -276,17 +287,17 @@ func BenchmarkNamespace(b *testing.B) {
 					ReplicationLevel: 1,
 					Status:           FileStatus_OK,
 					Blocks: []*BlockMetadata{
-						{Block: "1", LVName: "/", PVID: "1"},
-						{Block: "2", LVName: "/", PVID: "1"},
-						{Block: "3", LVName: "/", PVID: "1"},
-						{Block: "4", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "5", LVName: "/", PVID: "1"},
-						{Block: "6", LVName: "/", PVID: "1"},
-						{Block: "7", LVName: "/", PVID: "1"},
-						{Block: "8", LVName: "/", PVID: "1"},
-						{Block: "9", LVName: "/", PVID: "1"},
-						{Block: "10", LVName: "/", PVID: "1"},
+						{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "2", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "3", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "4", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "6", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "7", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "8", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "9", LVName: "/", PVIDs: []string{"1"}},
+						{Block: "10", LVName: "/", PVIDs: []string{"1"}},
 					},
 					Ctime: now,
 					Mtime: now,
@@ -314,17 +325,17 @@ func BenchmarkNamespace(b *testing.B) {
 				ReplicationLevel: 1,
 				Status:           FileStatus_OK,
 				Blocks: []*BlockMetadata{
-					{Block: "1", LVName: "/", PVID: "1"},
-					{Block: "2", LVName: "/", PVID: "1"},
-					{Block: "3", LVName: "/", PVID: "1"},
-					{Block: "4", LVName: "/", PVID: "1"},
-					{Block: "5", LVName: "/", PVID: "1"},
-					{Block: "5", LVName: "/", PVID: "1"},
-					{Block: "6", LVName: "/", PVID: "1"},
-					{Block: "7", LVName: "/", PVID: "1"},
-					{Block: "8", LVName: "/", PVID: "1"},
-					{Block: "9", LVName: "/", PVID: "1"},
-					{Block: "10", LVName: "/", PVID: "1"},
+					{Block: "1", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "2", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "3", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "4", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "5", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "6", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "7", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "8", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "9", LVName: "/", PVIDs: []string{"1"}},
+					{Block: "10", LVName: "/", PVIDs: []string{"1"}},
 				},
 				Ctime: now,
 				Mtime: now,
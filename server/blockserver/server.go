@@ -1,6 +1,7 @@
 package blockserver
 
 import (
+	"bfs/block"
 	"bfs/config"
 	"bfs/service/blockservice"
 	"bfs/util/fsm"
@@ -8,6 +9,9 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 const (
@@ -25,12 +29,19 @@ var serviceFSM = fsm.New(StateInitial).
 	Allow(StateError, StateError)
 
 type BlockServer struct {
-	Config      *config.BlockServiceConfig
-	server      *grpc.Server
-	bindAddress string
-	fsm         *fsm.FSMInstance
+	Config       *config.BlockServiceConfig
+	server       *grpc.Server
+	bindAddress  string
+	fsm          *fsm.FSMInstance
+	blockService *blockservice.BlockService
 
 	PhysicalVolumes []*blockservice.PhysicalVolume
+
+	// Scrubbers for volumes with scrubbing enabled, keyed by PV ID.
+	Scrubbers map[string]*blockservice.Scrubber
+
+	// Guards PhysicalVolumes, Scrubbers, and Config.VolumeConfigs, which change as volumes are added and removed.
+	volumesMut sync.RWMutex
 }
 
 func New(config *config.BlockServiceConfig, server *grpc.Server) *BlockServer {
@@ -50,29 +61,229 @@ func (this *BlockServer) Start() error {
 	}
 
 	this.PhysicalVolumes = make([]*blockservice.PhysicalVolume, 0, len(this.Config.VolumeConfigs))
+	this.Scrubbers = make(map[string]*blockservice.Scrubber)
 
 	for _, pvConfig := range this.Config.VolumeConfigs {
-		pv := blockservice.NewPhysicalVolume(pvConfig.Path)
-
-		if err := pv.Open(pvConfig.AllowAutoInitialize); err != nil {
+		pv, err := this.openVolume(pvConfig)
+		if err != nil {
 			return this.fsm.ToWithErr(StateError, err)
 		}
 
-		// Hack for populating pv ID. Requiring mutability here sucks.
-		pvConfig.Id = pv.ID.String()
-		pvConfig.Labels["endpoint"] = this.bindAddress
-		pvConfig.Labels["hostname"] = this.Config.Hostname
 		this.PhysicalVolumes = append(this.PhysicalVolumes, pv)
+
+		if err := this.startScrubber(pvConfig, pv); err != nil {
+			return this.fsm.ToWithErr(StateError, err)
+		}
 	}
 
-	blockService := blockservice.New(this.PhysicalVolumes)
-	blockservice.RegisterBlockServiceServer(this.server, blockService)
+	this.blockService = blockservice.New(this.PhysicalVolumes)
+	blockservice.RegisterBlockServiceServer(this.server, this.blockService)
 
 	glog.V(logging.LogLevelDebug).Infof("Started block server %s", this.bindAddress)
 
 	return this.fsm.To(StateRunning)
 }
 
+// Open a physical volume, filling in its config's ID and endpoint labels.
+func (this *BlockServer) openVolume(pvConfig *config.PhysicalVolumeConfig) (*blockservice.PhysicalVolume, error) {
+	var pv *blockservice.PhysicalVolume
+	if pvConfig.Storage == config.VolumeStorage_STORAGE_MEMORY {
+		pv = blockservice.NewMemoryPhysicalVolume()
+	} else {
+		pv = blockservice.NewPhysicalVolume(pvConfig.Path)
+	}
+
+	pv.OrphanPolicy = pvConfig.OrphanPolicy
+	pv.Durability = pvConfig.Durability
+	pv.ReservedBytes = pvConfig.ReservedBytes
+	pv.MaxBytes = pvConfig.MaxBytes
+	pv.Throttle.ReadBytesPerSecond = pvConfig.ReadBytesPerSecond
+	pv.Throttle.WriteBytesPerSecond = pvConfig.WriteBytesPerSecond
+	pv.Throttle.CallerReadBytesPerSecond = pvConfig.CallerReadBytesPerSecond
+	pv.Throttle.CallerWriteBytesPerSecond = pvConfig.CallerWriteBytesPerSecond
+
+	if pvConfig.WriteGracePeriodSeconds > 0 {
+		pv.WriteGracePeriod = time.Duration(pvConfig.WriteGracePeriodSeconds) * time.Second
+	}
+
+	if pv.Durability == config.Durability_DURABILITY_DEFAULT {
+		pv.Durability = this.Config.Durability
+	}
+
+	if pvConfig.KeyFile != "" {
+		keys, err := block.LoadKeyRing(pvConfig.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pv.Keys = keys
+	}
+
+	if err := pv.Open(pvConfig.AllowAutoInitialize); err != nil {
+		return nil, err
+	}
+
+	// Hack for populating pv ID. Requiring mutability here sucks.
+	pvConfig.Id = pv.ID.String()
+	if pvConfig.Labels == nil {
+		pvConfig.Labels = make(map[string]string)
+	}
+	pvConfig.Labels["endpoint"] = this.bindAddress
+	pvConfig.Labels["hostname"] = this.Config.Hostname
+
+	return pv, nil
+}
+
+// Start scrubbing a volume if its config enables scrubbing.
+func (this *BlockServer) startScrubber(pvConfig *config.PhysicalVolumeConfig, pv *blockservice.PhysicalVolume) error {
+	if pvConfig.ScrubIntervalSeconds > 0 {
+		scrubber := blockservice.NewScrubber(pv, time.Duration(pvConfig.ScrubIntervalSeconds)*time.Second,
+			pvConfig.ScrubBytesPerSecond)
+
+		if err := scrubber.Start(); err != nil {
+			return err
+		}
+
+		this.Scrubbers[pvConfig.Id] = scrubber
+	}
+
+	return nil
+}
+
+// Open a physical volume and start serving it while the server runs.
+//
+// The volume's config is added to Config.VolumeConfigs with its ID and endpoint labels filled in. Volumes are not
+// added if their path, or the volume found there, is already served.
+func (this *BlockServer) AddVolume(pvConfig *config.PhysicalVolumeConfig) (*blockservice.PhysicalVolume, error) {
+	glog.Infof("Adding volume at %s to block server %s", pvConfig.Path, this.bindAddress)
+
+	if err := this.fsm.Is(StateRunning); err != nil {
+		return nil, err
+	}
+
+	this.volumesMut.Lock()
+	defer this.volumesMut.Unlock()
+
+	for _, existing := range this.Config.VolumeConfigs {
+		if filepath.Clean(existing.Path) == filepath.Clean(pvConfig.Path) {
+			return nil, fmt.Errorf("volume at %s is already served as %s", pvConfig.Path, existing.Id)
+		}
+	}
+
+	pv, err := this.openVolume(pvConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, existing := range this.PhysicalVolumes {
+		if existing.ID.String() == pv.ID.String() {
+			pv.Close()
+			return nil, fmt.Errorf("volume %s at %s is already served from %s", pv.ID, pvConfig.Path,
+				existing.RootPath)
+		}
+	}
+
+	if err := this.startScrubber(pvConfig, pv); err != nil {
+		pv.Close()
+		return nil, err
+	}
+
+	this.PhysicalVolumes = append(this.PhysicalVolumes, pv)
+	this.Config.VolumeConfigs = append(this.Config.VolumeConfigs, pvConfig)
+	this.blockService.AddVolume(pv)
+
+	glog.Infof("Added volume %s at %s to block server %s", pv.ID, pvConfig.Path, this.bindAddress)
+
+	return pv, nil
+}
+
+// Stop serving a physical volume and close it.
+//
+// New requests for the volume are refused. Reads in progress finish with the files they have open, but can not open
+// more, and writes in progress fail unless they are already committing their block.
+func (this *BlockServer) RemoveVolume(pvId string) error {
+	glog.Infof("Removing volume %s from block server %s", pvId, this.bindAddress)
+
+	if err := this.fsm.Is(StateRunning); err != nil {
+		return err
+	}
+
+	this.volumesMut.Lock()
+	defer this.volumesMut.Unlock()
+
+	var pv *blockservice.PhysicalVolume
+
+	for i, candidate := range this.PhysicalVolumes {
+		if candidate.ID.String() == pvId {
+			pv = candidate
+			this.PhysicalVolumes = append(this.PhysicalVolumes[:i:i], this.PhysicalVolumes[i+1:]...)
+			break
+		}
+	}
+
+	if pv == nil {
+		return fmt.Errorf("no such volume id '%s'", pvId)
+	}
+
+	volumeConfigs := make([]*config.PhysicalVolumeConfig, 0, len(this.Config.VolumeConfigs))
+	for _, pvConfig := range this.Config.VolumeConfigs {
+		if pvConfig.Id != pvId {
+			volumeConfigs = append(volumeConfigs, pvConfig)
+		}
+	}
+	this.Config.VolumeConfigs = volumeConfigs
+
+	this.blockService.RemoveVolume(pvId)
+
+	if err := this.closeVolume(pv); err != nil {
+		return err
+	}
+
+	glog.Infof("Removed volume %s from block server %s", pvId, this.bindAddress)
+
+	return nil
+}
+
+// Stop a volume's scrubber, if any, and close it. Called with volumesMut held.
+func (this *BlockServer) closeVolume(pv *blockservice.PhysicalVolume) error {
+	if scrubber, ok := this.Scrubbers[pv.ID.String()]; ok {
+		scrubber.Stop()
+		delete(this.Scrubbers, pv.ID.String())
+	}
+
+	return pv.Close()
+}
+
+// Returns the configs of the volumes currently served.
+func (this *BlockServer) VolumeConfigs() []*config.PhysicalVolumeConfig {
+	this.volumesMut.RLock()
+	defer this.volumesMut.RUnlock()
+
+	return append([]*config.PhysicalVolumeConfig(nil), this.Config.VolumeConfigs...)
+}
+
+// Find an open physical volume by ID.
+func (this *BlockServer) PhysicalVolume(pvId string) *blockservice.PhysicalVolume {
+	this.volumesMut.RLock()
+	defer this.volumesMut.RUnlock()
+
+	for _, pv := range this.PhysicalVolumes {
+		if pv.ID.String() == pvId {
+			return pv
+		}
+	}
+
+	return nil
+}
+
+// Find the scrubber of a physical volume by ID, or nil if it isn't scrubbed.
+func (this *BlockServer) Scrubber(pvId string) *blockservice.Scrubber {
+	this.volumesMut.RLock()
+	defer this.volumesMut.RUnlock()
+
+	return this.Scrubbers[pvId]
+}
+
 func (this *BlockServer) Stop() error {
 	glog.V(logging.LogLevelDebug).Infof("Stopping block server %s", this.bindAddress)
 
@@ -80,6 +291,19 @@ func (this *BlockServer) Stop() error {
 		return err
 	}
 
+	this.volumesMut.Lock()
+	defer this.volumesMut.Unlock()
+
+	for _, scrubber := range this.Scrubbers {
+		scrubber.Stop()
+	}
+
+	if this.blockService != nil {
+		if err := this.blockService.Close(); err != nil {
+			glog.Warningf("Unable to close connections to other block servers - %v", err)
+		}
+	}
+
 	if this.PhysicalVolumes != nil {
 		for _, pv := range this.PhysicalVolumes {
 			if err := pv.Close(); err != nil {
@@ -75,3 +75,82 @@ func TestBlockServer(t *testing.T) {
 	)
 	require.NoError(t, err)
 }
+
+func TestBlockServer_AddRemoveVolume(t *testing.T) {
+	defer glog.Flush()
+
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	bsc := &config.BlockServiceConfig{
+		Hostname: "localhost",
+		Port:     8097,
+		VolumeConfigs: []*config.PhysicalVolumeConfig{
+			{Path: filepath.Join(testDir.Path, "1"), AllowAutoInitialize: true, Labels: map[string]string{}},
+		},
+	}
+
+	bindAddress := fmt.Sprintf("%s:%d", "localhost", 8097)
+
+	listener, err := net.Listen("tcp", bindAddress)
+	require.NoError(t, err)
+	rpcServer := grpc.NewServer()
+	defer rpcServer.GracefulStop()
+
+	server := New(bsc, rpcServer)
+	require.NoError(t, server.Start())
+	defer func() { assert.NoError(t, server.Stop()) }()
+
+	go func() {
+		err := rpcServer.Serve(listener)
+		assert.NoError(t, err)
+	}()
+
+	conn, err := grpc.Dial(bindAddress, grpc.WithInsecure(), grpc.WithBlock())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	bsClient := blockservice.NewBlockServiceClient(conn)
+
+	write := func(pvId string) error {
+		writeStream, err := bsClient.Write(context.Background())
+		require.NoError(t, err)
+
+		if err := writeStream.Send(&blockservice.WriteRequest{VolumeId: pvId, Buffer: []byte{1, 2, 3}}); err != nil {
+			return err
+		}
+
+		_, err = writeStream.CloseAndRecv()
+		return err
+	}
+
+	pvConfig := &config.PhysicalVolumeConfig{Path: filepath.Join(testDir.Path, "2"), AllowAutoInitialize: true}
+
+	pv, err := server.AddVolume(pvConfig)
+	require.NoError(t, err)
+	require.Equal(t, pv.ID.String(), pvConfig.Id)
+	require.Equal(t, "localhost:8097", pvConfig.Labels["endpoint"])
+	require.Len(t, server.VolumeConfigs(), 2)
+	require.Equal(t, pv, server.PhysicalVolume(pv.ID.String()))
+
+	require.NoError(t, write(pv.ID.String()))
+
+	// A volume can't be served twice.
+	_, err = server.AddVolume(&config.PhysicalVolumeConfig{Path: pvConfig.Path})
+	require.Error(t, err)
+
+	require.NoError(t, server.RemoveVolume(pv.ID.String()))
+	require.Len(t, server.VolumeConfigs(), 1)
+	require.Nil(t, server.PhysicalVolume(pv.ID.String()))
+	require.Error(t, server.RemoveVolume(pv.ID.String()))
+
+	require.Error(t, write(pv.ID.String()))
+	require.NoError(t, write(server.PhysicalVolumes[0].ID.String()))
+
+	// Removed volumes can be added again.
+	pv, err = server.AddVolume(&config.PhysicalVolumeConfig{Path: pvConfig.Path})
+	require.NoError(t, err)
+	require.Equal(t, pvConfig.Id, pv.ID.String())
+	require.NoError(t, write(pv.ID.String()))
+}
@@ -72,10 +72,10 @@ func TestNameServer(t *testing.T) {
 				Size:             4 * size.MB,
 				ReplicationLevel: 1,
 				Blocks: []*nameservice.BlockMetadata{
-					{PvId: "pv1", BlockId: "b1"},
-					{PvId: "pv2", BlockId: "b2"},
-					{PvId: "pv1", BlockId: "b3"},
-					{PvId: "pv2", BlockId: "b4"},
+					{PvIds: []string{"pv1"}, BlockId: "b1"},
+					{PvIds: []string{"pv2"}, BlockId: "b2"},
+					{PvIds: []string{"pv1"}, BlockId: "b3"},
+					{PvIds: []string{"pv2"}, BlockId: "b4"},
 				},
 				Ctime: nowTime,
 				Mtime: nowTime,
@@ -0,0 +1,196 @@
+package blockservice
+
+import (
+	"bfs/test"
+	"bfs/util/size"
+	"context"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"io"
+	"math/rand"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	benchmarkBlockSize = 4 * size.MB
+	benchmarkChunkSize = size.MB
+	benchmarkBlocks    = 8
+
+	// Streams per GOMAXPROCS.
+	benchmarkParallelism = 8
+)
+
+// A read stream that discards what it is sent.
+type discardReadStream struct {
+	grpc.ServerStream
+}
+
+func (this *discardReadStream) Context() context.Context {
+	return context.Background()
+}
+
+func (this *discardReadStream) Send(*ReadResponse) error {
+	return nil
+}
+
+// A write stream that replays a block's chunks.
+type replayWriteStream struct {
+	grpc.ServerStream
+	requests []*WriteRequest
+	next     int
+}
+
+func (this *replayWriteStream) Context() context.Context {
+	return context.Background()
+}
+
+func (this *replayWriteStream) Recv() (*WriteRequest, error) {
+	if this.next == len(this.requests) {
+		return nil, io.EOF
+	}
+
+	this.next++
+
+	return this.requests[this.next-1], nil
+}
+
+func (this *replayWriteStream) SendAndClose(*WriteResponse) error {
+	return nil
+}
+
+// Open a volume holding benchmarkBlocks random blocks, returning the volume and the IDs of its blocks.
+func benchmarkVolume(b *testing.B) (*PhysicalVolume, []string, func()) {
+	testDir := test.New("build", "test", b.Name())
+	require.NoError(b, testDir.Create())
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(b, pv.Open(true))
+
+	data := make([]byte, benchmarkBlockSize)
+	rand.Read(data)
+
+	blockIds := make([]string, benchmarkBlocks)
+	for i := range blockIds {
+		blockIds[i] = uuid.NewRandom().String()
+
+		writer, err := pv.OpenWrite(blockIds[i])
+		require.NoError(b, err)
+
+		_, err = writer.Write(data)
+		require.NoError(b, err)
+		require.NoError(b, writer.Close())
+	}
+
+	return pv, blockIds, func() {
+		pv.Close()
+		testDir.Destroy()
+	}
+}
+
+// Run body on many concurrent streams, reporting throughput and allocations per MB moved.
+func runParallel(b *testing.B, body func(pb *testing.PB)) {
+	b.SetBytes(benchmarkBlockSize)
+	b.SetParallelism(benchmarkParallelism)
+	b.ReportAllocs()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b.ResetTimer()
+	b.RunParallel(body)
+	b.StopTimer()
+
+	runtime.ReadMemStats(&after)
+
+	megabytes := float64(b.N) * benchmarkBlockSize / size.MB
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/megabytes, "allocs/MB")
+	b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/megabytes, "B/MB")
+}
+
+func BenchmarkBlockService_Read(b *testing.B) {
+	pv, blockIds, cleanup := benchmarkVolume(b)
+	defer cleanup()
+
+	blockService := New([]*PhysicalVolume{pv})
+
+	var next uint64
+
+	runParallel(b, func(pb *testing.PB) {
+		stream := &discardReadStream{}
+
+		for pb.Next() {
+			request := &ReadRequest{
+				VolumeId:  pv.ID.String(),
+				BlockId:   blockIds[atomic.AddUint64(&next, 1)%benchmarkBlocks],
+				ChunkSize: benchmarkChunkSize,
+			}
+
+			if err := blockService.Read(request, stream); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBlockService_Write(b *testing.B) {
+	pv, _, cleanup := benchmarkVolume(b)
+	defer cleanup()
+
+	blockService := New([]*PhysicalVolume{pv})
+
+	data := make([]byte, benchmarkBlockSize)
+	rand.Read(data)
+
+	var requests []*WriteRequest
+	for pos := 0; pos < len(data); pos += benchmarkChunkSize {
+		requests = append(requests, &WriteRequest{VolumeId: pv.ID.String(), Buffer: data[pos : pos+benchmarkChunkSize]})
+	}
+
+	runParallel(b, func(pb *testing.PB) {
+		stream := &replayWriteStream{requests: requests}
+
+		for pb.Next() {
+			stream.next = 0
+
+			if err := blockService.Write(stream); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Read blocks over RPC, including the cost of the transport.
+func BenchmarkBlockService_ReadRPC(b *testing.B) {
+	pv, blockIds, cleanup := benchmarkVolume(b)
+	defer cleanup()
+
+	blockClient, _, stop := startBlockServer(b, New([]*PhysicalVolume{pv}), grpc.MaxSendMsgSize(size.MB*10))
+	defer stop()
+
+	var next uint64
+
+	runParallel(b, func(pb *testing.PB) {
+		for pb.Next() {
+			readStream, err := blockClient.Read(context.Background(), &ReadRequest{
+				VolumeId:  pv.ID.String(),
+				BlockId:   blockIds[atomic.AddUint64(&next, 1)%benchmarkBlocks],
+				ChunkSize: benchmarkChunkSize,
+			}, grpc.MaxCallRecvMsgSize(size.MB*10))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for {
+				if _, err := readStream.Recv(); err == io.EOF {
+					break
+				} else if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
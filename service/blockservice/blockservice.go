@@ -2,21 +2,36 @@ package blockservice
 
 import (
 	"bfs/block"
+	"bfs/util/bufpool"
 	"bfs/util/logging"
 	"bfs/util/size"
 	"context"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/pborman/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
 	DefaultMaxReadSize = 8 * size.MB
+
+	// The number of blocks sent in each ListBlocks response.
+	DefaultListBatchSize = 512
 )
 
 type BlockService struct {
+	// Served volumes by ID. Volumes may be added and removed while requests are in flight.
 	volumeIdx map[string]*PhysicalVolume
+	volumeMut sync.RWMutex
+
+	// Connections to the block servers Replicate copies blocks to.
+	targets *targetPool
 }
 
 func New(volumes []*PhysicalVolume) *BlockService {
@@ -28,32 +43,101 @@ func New(volumes []*PhysicalVolume) *BlockService {
 
 	this := &BlockService{
 		volumeIdx: volumeIdx,
+		targets:   newTargetPool(),
 	}
 
 	return this
 }
 
-func (this *BlockService) Write(stream BlockService_WriteServer) error {
+// Close the service's connections to other block servers. Volumes are left open.
+func (this *BlockService) Close() error {
+	return this.targets.Close()
+}
+
+// Start serving requests for a volume.
+func (this *BlockService) AddVolume(pv *PhysicalVolume) {
+	this.volumeMut.Lock()
+	defer this.volumeMut.Unlock()
+
+	this.volumeIdx[pv.ID.String()] = pv
+}
+
+// Stop serving requests for a volume. Requests already in progress keep the volume they started with. Returns false
+// if the volume isn't served.
+func (this *BlockService) RemoveVolume(volumeId string) bool {
+	this.volumeMut.Lock()
+	defer this.volumeMut.Unlock()
+
+	if _, ok := this.volumeIdx[volumeId]; !ok {
+		return false
+	}
+
+	delete(this.volumeIdx, volumeId)
+
+	return true
+}
+
+// Find a served volume by ID.
+func (this *BlockService) volume(volumeId string) (*PhysicalVolume, bool) {
+	this.volumeMut.RLock()
+	defer this.volumeMut.RUnlock()
+
+	pv, ok := this.volumeIdx[volumeId]
+
+	return pv, ok
+}
+
+// The IDs of all served volumes, in order.
+func (this *BlockService) volumeIds() []string {
+	this.volumeMut.RLock()
+	defer this.volumeMut.RUnlock()
+
+	volumeIds := make([]string, 0, len(this.volumeIdx))
+	for volumeId := range this.volumeIdx {
+		volumeIds = append(volumeIds, volumeId)
+	}
+
+	sort.Strings(volumeIds)
+
+	return volumeIds
+}
+
+func (this *BlockService) Write(stream BlockService_WriteServer) (err error) {
 	glog.V(logging.LogLevelDebug).Info("Received write request")
 
+	var pv *PhysicalVolume
 	var writer block.BlockWriter
 	var blockId string
 	var volumeId string
+	var dedup bool
+
+	var writeLimiter limiter
 
 	totalWritten := 0
 
-	for chunkIter := 0; ; chunkIter++ {
-		glog.V(logging.LogLevelTrace).Infof("Writer iter %d - start", chunkIter)
+	defer func() {
+		if writer != nil {
+			pv.IO.endWrite(err)
+		}
+	}()
 
+	for chunkIter := 0; ; chunkIter++ {
 		request, err := stream.Recv()
 
 		if err == io.EOF {
-			glog.V(logging.LogLevelTrace).Infof("Writer iter %d - EOF", chunkIter)
+			if glog.V(logging.LogLevelTrace) {
+				glog.Infof("Writer iter %d - EOF", chunkIter)
+			}
 
 			break
 		} else if err != nil {
 			glog.Errorf("Writer iter %d - Error receiving write request - %v", chunkIter, err)
 
+			// Keep what arrived so the client can resume.
+			if writer != nil {
+				pv.SuspendWrite(writer)
+			}
+
 			return err
 		}
 
@@ -61,46 +145,112 @@ func (this *BlockService) Write(stream BlockService_WriteServer) error {
 			glog.V(logging.LogLevelTrace).Infof("Writer iter %d - Start writer", chunkIter)
 
 			volumeId = request.VolumeId
-			pv, ok := this.volumeIdx[volumeId]
+			var ok bool
+			pv, ok = this.volume(volumeId)
 			if !ok {
 				return fmt.Errorf("no such volume id '%s'", volumeId)
 			}
 
-			blockUUID := uuid.NewRandom()
-			blockId = blockUUID.String()
+			dedup = request.Dedup
+
+			if request.BlockId == "" {
+				if request.Offset > 0 {
+					return status.Error(codes.InvalidArgument, "a block id is required to resume a write")
+				} else if dedup {
+					return status.Error(codes.InvalidArgument, "a block id is required to write a dedup block")
+				}
+
+				blockId = uuid.NewRandom().String()
+			} else if blockUUID := uuid.Parse(request.BlockId); blockUUID != nil {
+				blockId = blockUUID.String()
+			} else {
+				return status.Errorf(codes.InvalidArgument, "invalid block id '%s'", request.BlockId)
+			}
+
+			if request.Offset > 0 {
+				writer, err = pv.ResumeWrite(blockId, request.Offset)
+				totalWritten = int(request.Offset)
+			} else {
+				var codec block.Codec
+				codec, err = block.LookupCodec(request.Codec)
+				if err != nil {
+					return status.Error(codes.InvalidArgument, err.Error())
+				}
+
+				if dedup {
+					writer, err = pv.OpenDedupWrite(blockId, codec)
+				} else {
+					writer, err = pv.OpenWriteWithCodec(blockId, codec)
+				}
+			}
 
-			var err error
-			writer, err = pv.OpenWrite(blockId)
 			if err != nil {
-				return err
+				glog.Warningf("Refusing block %s - %v", blockId, err)
+				return writeError(err)
 			}
+
+			pv.IO.startWrite()
+			writeLimiter = pv.Throttle.writes(CallerFrom(stream.Context()))
 		}
 
-		glog.V(logging.LogLevelTrace).Infof(
-			"Write iter %d - Received request size: %d",
-			chunkIter,
-			len(request.Buffer),
-		)
+		// Trace logging is checked first as formatting arguments allocate on every chunk.
+		if glog.V(logging.LogLevelTrace) {
+			glog.Infof("Write iter %d - Received request size: %d", chunkIter, len(request.Buffer))
+		}
+
+		waited, err := writeLimiter.Wait(stream.Context(), len(request.Buffer))
+		pv.IO.writeThrottled(waited)
+
+		if err != nil {
+			// The client went away while the stream was slowed. Keep what arrived so it can resume.
+			pv.SuspendWrite(writer)
+			return err
+		}
 
+		start := time.Now()
 		writeLen, err := writer.Write(request.Buffer)
+		pv.IO.write(writeLen, time.Since(start))
+
 		if err != nil {
 			glog.Errorf("Write failed - %v", err)
+			writer.Abort()
 			return err
 		}
 
 		totalWritten += writeLen
 	}
 
+	var checksum uint32
+	var storedSize uint64
+	var references uint64
+
 	if writer != nil {
-		if err := writer.Close(); err != nil {
-			return nil
+		// Close() returns once the block is as durable as the volume requires, so the block is only acknowledged after.
+		start := time.Now()
+		err := writer.Close()
+		pv.IO.commit(time.Since(start))
+
+		if _, ok := err.(*ContentMismatchError); ok {
+			return status.Error(codes.InvalidArgument, err.Error())
+		} else if err != nil {
+			return err
+		}
+
+		checksum = writer.Checksum()
+		storedSize = writer.StoredSize()
+
+		if volumeWriter, ok := writer.(*volumeWriter); ok {
+			references = volumeWriter.references
 		}
 	}
 
 	if err := stream.SendAndClose(&WriteResponse{
-		BlockId:  blockId,
-		VolumeId: volumeId,
-		Size:     uint32(totalWritten),
+		BlockId:    blockId,
+		VolumeId:   volumeId,
+		Size:       uint32(totalWritten),
+		Checksum:   checksum,
+		StoredSize: storedSize,
+		References: references,
 	}); err != nil {
 		return err
 	}
@@ -110,54 +260,116 @@ func (this *BlockService) Write(stream BlockService_WriteServer) error {
 	return nil
 }
 
-func (this *BlockService) Read(request *ReadRequest, stream BlockService_ReadServer) error {
-	glog.V(logging.LogLevelDebug).Infof("Read - volumeId: %s blockId: %s", request.VolumeId, request.BlockId)
+// Map an error starting or resuming a write to the status reported to the client.
+func writeError(err error) error {
+	switch err.(type) {
+	case *WriteActiveError:
+		return status.Error(codes.Aborted, err.Error())
+	case *WriteOffsetError:
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+
+	switch {
+	case IsVolumeFull(err):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case IsVolumeNotWritable(err):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case os.IsExist(err):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case err == ErrNoSuchWrite:
+		return status.Error(codes.NotFound, err.Error())
+	default:
+		return err
+	}
+}
+
+func (this *BlockService) Read(request *ReadRequest, stream BlockService_ReadServer) (err error) {
+	glog.V(logging.LogLevelDebug).Infof("Read - volumeId: %s blockId: %s position: %d length: %d",
+		request.VolumeId, request.BlockId, request.Position, request.Length)
 
 	volumeId := request.VolumeId
-	pv, ok := this.volumeIdx[volumeId]
+	pv, ok := this.volume(volumeId)
 	if !ok {
 		return fmt.Errorf("no such volume id '%s'", volumeId)
 	}
 
-	reader, err := pv.OpenRead(request.BlockId)
+	if uuid.Parse(request.BlockId) == nil {
+		return status.Errorf(codes.InvalidArgument, "invalid block id '%s'", request.BlockId)
+	}
+
+	pv.IO.startRead()
+	defer func() { pv.IO.endRead(err) }()
+
+	reader, err := pv.OpenReadRange(request.BlockId, request.Position, request.Length)
 	if err != nil {
-		return err
+		return blockError(volumeId, err)
 	}
 
 	defer reader.Close()
 
+	// Requests without a chunk size get the largest.
 	chunkSize := DefaultMaxReadSize
-	if request.ChunkSize < DefaultMaxReadSize {
+	if request.ChunkSize > 0 && request.ChunkSize < DefaultMaxReadSize {
 		chunkSize = int(request.ChunkSize)
 	}
 
-	buffer := make([]byte, chunkSize)
+	// Buffers are pooled as parallel readers would otherwise allocate up to DefaultMaxReadSize per request.
+	buffer := bufpool.Get(chunkSize)
+	defer bufpool.Put(buffer)
+
+	readLimiter := pv.Throttle.reads(CallerFrom(stream.Context()))
+
+	// A response is marshaled before Send returns, so one response and buffer serve every chunk.
+	response := &ReadResponse{
+		VolumeId: volumeId,
+		BlockId:  request.BlockId,
+	}
+
 	readCalls := 0
 	sendCalls := 0
 	totalRead := 0
 
-	for i := 0; true; i++ {
-		readLen, err := reader.Read(buffer)
-		totalRead += readLen
-		readCalls++
+	for done := false; !done; {
+		// Fill the buffer before sending, as the block reader returns at most a checksum chunk per call.
+		chunkLen := 0
 
-		if readLen > 0 {
-			response := &ReadResponse{
-				VolumeId: pv.ID.String(),
-				BlockId:  request.BlockId,
-				Buffer:   buffer[:readLen],
+		for chunkLen < chunkSize {
+			start := time.Now()
+			readLen, readErr := reader.Read(buffer.Bytes[chunkLen:])
+			pv.IO.read(readLen, time.Since(start))
+
+			chunkLen += readLen
+			readCalls++
+
+			if readErr == io.EOF {
+				done = true
+				break
+			} else if readErr != nil {
+				err = readErr
+				break
+			}
+		}
+
+		totalRead += chunkLen
+
+		if chunkLen > 0 {
+			waited, err := readLimiter.Wait(stream.Context(), chunkLen)
+			pv.IO.readThrottled(waited)
+
+			if err != nil {
+				return err
 			}
 
+			response.Buffer = buffer.Bytes[:chunkLen]
+
 			if err := stream.Send(response); err != nil {
 				return err
 			}
 			sendCalls++
 		}
 
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
+		if err != nil {
+			return blockError(volumeId, err)
 		}
 	}
 
@@ -178,29 +390,217 @@ func (this *BlockService) Read(request *ReadRequest, stream BlockService_ReadSer
 
 func (this *BlockService) Delete(context context.Context, request *ReadRequest) (*DeleteResponse, error) {
 	glog.V(logging.LogLevelDebug).Infof(
-		"Delete request received - volumeId: %s blockId: %s",
+		"Delete request received - volumeId: %s blockId: %s releaseAfterMillis: %d",
 		request.VolumeId,
 		request.BlockId,
+		request.ReleaseAfterMillis,
 	)
 
 	volumeId := request.VolumeId
-	pv, ok := this.volumeIdx[volumeId]
+	pv, ok := this.volume(volumeId)
 	if !ok {
 		return nil, fmt.Errorf("no such volume id '%s'", volumeId)
 	}
 
-	err := pv.Delete(request.BlockId)
+	if uuid.Parse(request.BlockId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid block id '%s'", request.BlockId)
+	}
+
+	var references uint64
+	var err error
+
+	if request.ReleaseAfterMillis > 0 {
+		err = pv.ReleaseAfter(request.BlockId, time.Duration(request.ReleaseAfterMillis)*time.Millisecond)
+		if err == nil {
+			references, err = pv.References(request.BlockId)
+		}
+	} else {
+		references, err = pv.Release(request.BlockId)
+	}
+
+	pv.IO.delete(err)
 
 	if err != nil {
 		return nil, err
 	}
 
 	response := &DeleteResponse{
-		VolumeId: request.VolumeId,
-		Status:   Status_SUCCESS,
+		VolumeId:   request.VolumeId,
+		Status:     Status_SUCCESS,
+		References: references,
 	}
 
 	glog.V(logging.LogLevelDebug).Infof("Delete request complete - %v", response)
 
 	return response, nil
 }
+
+func (this *BlockService) ListBlocks(request *ListBlocksRequest, stream BlockService_ListBlocksServer) error {
+	glog.V(logging.LogLevelDebug).Infof("List blocks - volumeId: %s", request.VolumeId)
+
+	volumeId := request.VolumeId
+	pv, ok := this.volume(volumeId)
+	if !ok {
+		return fmt.Errorf("no such volume id '%s'", volumeId)
+	}
+
+	blocks := make([]*BlockInfo, 0, DefaultListBatchSize)
+	blockCount := 0
+
+	err := pv.List(func(info *block.BlockInfo) (bool, error) {
+		blocks = append(blocks, blockInfo(volumeId, info))
+		blockCount++
+
+		if len(blocks) == DefaultListBatchSize {
+			if err := stream.Send(&ListBlocksResponse{Blocks: blocks}); err != nil {
+				return false, err
+			}
+
+			blocks = make([]*BlockInfo, 0, DefaultListBatchSize)
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(blocks) > 0 {
+		if err := stream.Send(&ListBlocksResponse{Blocks: blocks}); err != nil {
+			return err
+		}
+	}
+
+	glog.V(logging.LogLevelDebug).Infof("List blocks complete - volumeId: %s blocks: %d", volumeId, blockCount)
+
+	return nil
+}
+
+func (this *BlockService) StatBlock(ctx context.Context, request *StatBlockRequest) (*StatBlockResponse, error) {
+	glog.V(logging.LogLevelDebug).Infof("Stat block - volumeId: %s blockId: %s", request.VolumeId, request.BlockId)
+
+	volumeId := request.VolumeId
+	pv, ok := this.volume(volumeId)
+	if !ok {
+		return nil, fmt.Errorf("no such volume id '%s'", volumeId)
+	}
+
+	if uuid.Parse(request.BlockId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid block id '%s'", request.BlockId)
+	}
+
+	info, err := pv.Stat(request.BlockId)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "no such block '%s' on volume '%s'", request.BlockId, volumeId)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &StatBlockResponse{Block: blockInfo(volumeId, info)}, nil
+}
+
+func (this *BlockService) Reference(ctx context.Context, request *ReferenceRequest) (*ReferenceResponse, error) {
+	glog.V(logging.LogLevelDebug).Infof("Reference block - volumeId: %s blockId: %s", request.VolumeId, request.BlockId)
+
+	volumeId := request.VolumeId
+	pv, ok := this.volume(volumeId)
+	if !ok {
+		return nil, fmt.Errorf("no such volume id '%s'", volumeId)
+	}
+
+	if uuid.Parse(request.BlockId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid block id '%s'", request.BlockId)
+	}
+
+	reference, err := pv.Reference(request.BlockId)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "no such block '%s' on volume '%s'", request.BlockId, volumeId)
+	} else if IsVolumeNotWritable(err) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &ReferenceResponse{
+		VolumeId:   volumeId,
+		BlockId:    request.BlockId,
+		Size:       reference.Size,
+		Checksum:   reference.Checksum,
+		StoredSize: reference.StoredSize,
+		References: reference.References,
+	}, nil
+}
+
+func (this *BlockService) WriteStatus(ctx context.Context, request *WriteStatusRequest) (*WriteStatusResponse, error) {
+	glog.V(logging.LogLevelDebug).Infof("Write status - volumeId: %s blockId: %s", request.VolumeId, request.BlockId)
+
+	volumeId := request.VolumeId
+	pv, ok := this.volume(volumeId)
+	if !ok {
+		return nil, fmt.Errorf("no such volume id '%s'", volumeId)
+	}
+
+	if uuid.Parse(request.BlockId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid block id '%s'", request.BlockId)
+	}
+
+	progress, err := pv.WriteProgress(request.BlockId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WriteStatusResponse{
+		VolumeId: volumeId,
+		BlockId:  request.BlockId,
+		State:    progress.State,
+		Size:     progress.Size,
+		Checksum: progress.Checksum,
+		Active:   progress.Active,
+	}, nil
+}
+
+func (this *BlockService) Stats(ctx context.Context, request *StatsRequest) (*StatsResponse, error) {
+	glog.V(logging.LogLevelDebug).Infof("Stats - volumeIds: %v", request.VolumeIds)
+
+	volumeIds := request.VolumeIds
+	if len(volumeIds) == 0 {
+		volumeIds = this.volumeIds()
+	}
+
+	response := &StatsResponse{Volumes: make([]*VolumeStats, 0, len(volumeIds))}
+
+	for _, volumeId := range volumeIds {
+		pv, ok := this.volume(volumeId)
+		if !ok {
+			return nil, fmt.Errorf("no such volume id '%s'", volumeId)
+		}
+
+		stats := pv.IO.toProto(volumeId)
+		stats.Throttle = pv.Throttle.toProto()
+
+		response.Volumes = append(response.Volumes, stats)
+	}
+
+	return response, nil
+}
+
+func blockInfo(volumeId string, info *block.BlockInfo) *BlockInfo {
+	return &BlockInfo{
+		VolumeId: volumeId,
+		BlockId:  info.BlockId,
+		Size:     info.Size,
+		Mtime:    info.ModTime.UnixNano(),
+	}
+}
+
+// Convert block layer errors to their RPC equivalents.
+//
+// Integrity failures are reported with codes.DataLoss so clients can distinguish corrupt data from other failures.
+func blockError(volumeId string, err error) error {
+	if corruptErr, ok := err.(*block.CorruptBlockError); ok {
+		glog.Errorf("Read failed - volumeId: %s - %v", volumeId, corruptErr)
+		return status.Error(codes.DataLoss, corruptErr.Error())
+	}
+
+	return err
+}
@@ -6,16 +6,55 @@ import (
 	"bytes"
 	"context"
 	"github.com/golang/glog"
+	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"os"
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
+// Serve a block service on a free port, returning a client connected to it, the address it listens on, and a function
+// that stops the server and closes the service. Options are passed to the RPC server.
+func startBlockServer(t testing.TB, blockService *BlockService,
+	options ...grpc.ServerOption) (BlockServiceClient, string, func()) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer(options...)
+	RegisterBlockServiceServer(server, blockService)
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			glog.Errorf("RPC server failed - %v", err)
+		}
+	}()
+
+	address := listener.Addr().String()
+
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		server.Stop()
+		require.NoError(t, err)
+	}
+
+	return NewBlockServiceClient(conn), address, func() {
+		conn.Close()
+		server.GracefulStop()
+		blockService.Close()
+	}
+}
+
 func TestBlockService_Read(t *testing.T) {
 	testDir := test.New("build", "test", t.Name())
 	err := testDir.Create()
@@ -215,3 +254,765 @@ func TestBlockService_Delete(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, deleteResp)
 }
+
+func TestBlockService_ReadRange(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockService := New([]*PhysicalVolume{pv})
+
+	blockClient, _, stop := startBlockServer(t, blockService)
+	defer stop()
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+
+	writerStream, err := blockClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: data}))
+
+	writeResp, err := writerStream.CloseAndRecv()
+	require.NoError(t, err)
+
+	readStream, err := blockClient.Read(context.Background(), &ReadRequest{
+		VolumeId:  pv.ID.String(),
+		BlockId:   writeResp.BlockId,
+		Position:  100*1024 + 13,
+		Length:    64 * 1024,
+		ChunkSize: 4096,
+	})
+	require.NoError(t, err)
+
+	var received []byte
+	for {
+		readResp, err := readStream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		received = append(received, readResp.Buffer...)
+	}
+
+	require.Equal(t, data[100*1024+13:164*1024+13], received)
+
+	// Requests without a chunk size are sent the whole range in one chunk.
+	readStream, err = blockClient.Read(context.Background(), &ReadRequest{
+		VolumeId: pv.ID.String(),
+		BlockId:  writeResp.BlockId,
+	})
+	require.NoError(t, err)
+
+	readResp, err := readStream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, data, readResp.Buffer)
+
+	_, err = readStream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestBlockService_WriteCodec(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockService := New([]*PhysicalVolume{pv})
+
+	blockClient, _, stop := startBlockServer(t, blockService)
+	defer stop()
+
+	data := bytes.Repeat([]byte("2018-01-01 00:00:00 INFO request complete\n"), 8*1024)
+
+	writerStream, err := blockClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: data[:1000], Codec: "gzip"}))
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: data[1000:]}))
+
+	writeResp, err := writerStream.CloseAndRecv()
+	require.NoError(t, err)
+	require.Equal(t, uint32(len(data)), writeResp.Size)
+	require.True(t, writeResp.StoredSize < uint64(len(data))/5, "stored %d of %d bytes", writeResp.StoredSize,
+		len(data))
+
+	readStream, err := blockClient.Read(context.Background(), &ReadRequest{
+		VolumeId:  pv.ID.String(),
+		BlockId:   writeResp.BlockId,
+		Position:  100*1024 + 13,
+		Length:    64 * 1024,
+		ChunkSize: 4096,
+	})
+	require.NoError(t, err)
+
+	var received []byte
+	for {
+		readResp, err := readStream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		received = append(received, readResp.Buffer...)
+	}
+
+	require.Equal(t, data[100*1024+13:164*1024+13], received)
+
+	// Unknown codecs are rejected.
+	writerStream, err = blockClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: data, Codec: "lzma"}))
+
+	_, err = writerStream.CloseAndRecv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestBlockService_WriteVolumeFull(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	pv.MaxBytes = 1
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockService := New([]*PhysicalVolume{pv})
+
+	blockClient, _, stop := startBlockServer(t, blockService)
+	defer stop()
+
+	writeBlock := func() error {
+		writerStream, err := blockClient.Write(context.Background())
+		require.NoError(t, err)
+
+		if err := writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: []byte{1, 2, 3}}); err != nil {
+			return err
+		}
+
+		_, err = writerStream.CloseAndRecv()
+		return err
+	}
+
+	require.NoError(t, writeBlock())
+
+	err := writeBlock()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.True(t, IsVolumeFull(err))
+}
+
+func TestBlockService_ListBlocks(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockService := New([]*PhysicalVolume{pv})
+
+	blockClient, _, stop := startBlockServer(t, blockService)
+	defer stop()
+
+	// Enough blocks to span multiple list batches.
+	blockCount := DefaultListBatchSize + 10
+	blockSizes := make(map[string]uint64, blockCount)
+
+	for i := 0; i < blockCount; i++ {
+		writerStream, err := blockClient.Write(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: make([]byte, i%7+1)}))
+
+		writeResp, err := writerStream.CloseAndRecv()
+		require.NoError(t, err)
+
+		blockSizes[writeResp.BlockId] = uint64(i%7 + 1)
+	}
+
+	listStream, err := blockClient.ListBlocks(context.Background(), &ListBlocksRequest{VolumeId: pv.ID.String()})
+	require.NoError(t, err)
+
+	listedSizes := make(map[string]uint64, blockCount)
+	for {
+		listResp, err := listStream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		for _, blockInfo := range listResp.Blocks {
+			require.Equal(t, pv.ID.String(), blockInfo.VolumeId)
+			require.NotZero(t, blockInfo.Mtime)
+			listedSizes[blockInfo.BlockId] = blockInfo.Size
+		}
+	}
+
+	require.Equal(t, blockSizes, listedSizes)
+
+	for blockId, blockSize := range blockSizes {
+		statResp, err := blockClient.StatBlock(context.Background(), &StatBlockRequest{
+			VolumeId: pv.ID.String(),
+			BlockId:  blockId,
+		})
+		require.NoError(t, err)
+		require.Equal(t, blockSize, statResp.Block.Size)
+		break
+	}
+
+	_, err = blockClient.StatBlock(context.Background(), &StatBlockRequest{
+		VolumeId: pv.ID.String(),
+		BlockId:  uuid.NewRandom().String(),
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestBlockService_InvalidBlockId(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(filepath.Join(testDir.Path, "pv"))
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockClient, _, stop := startBlockServer(t, New([]*PhysicalVolume{pv}))
+	defer stop()
+
+	// A file outside the volume that a path in place of a block ID would reach.
+	outsidePath := filepath.Join(testDir.Path, "outside")
+	require.NoError(t, ioutil.WriteFile(outsidePath, []byte("not a block"), 0644))
+
+	for _, blockId := range []string{"../../outside", "../outside", ""} {
+		readStream, err := blockClient.Read(context.Background(), &ReadRequest{VolumeId: pv.ID.String(), BlockId: blockId})
+		require.NoError(t, err)
+
+		_, err = readStream.Recv()
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "block id: %s", blockId)
+
+		_, err = blockClient.Delete(context.Background(), &ReadRequest{VolumeId: pv.ID.String(), BlockId: blockId})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), "block id: %s", blockId)
+	}
+
+	_, err := os.Stat(outsidePath)
+	require.NoError(t, err)
+}
+
+func TestBlockService_Replicate(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	startServer := func(name string) (*PhysicalVolume, BlockServiceClient, string, func()) {
+		pv := NewPhysicalVolume(filepath.Join(testDir.Path, name))
+		require.NoError(t, pv.Open(true))
+
+		client, address, stop := startBlockServer(t, New([]*PhysicalVolume{pv}))
+
+		return pv, client, address, func() {
+			stop()
+			pv.Close()
+		}
+	}
+
+	sourcePv, sourceClient, _, stopSource := startServer("source")
+	defer stopSource()
+
+	targetPv, targetClient, targetAddress, stopTarget := startServer("target")
+	defer stopTarget()
+
+	data := make([]byte, DefaultReplicateChunkSize*2+1234)
+	rand.Read(data)
+
+	writerStream, err := sourceClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: sourcePv.ID.String(), Buffer: data}))
+	writeResp, err := writerStream.CloseAndRecv()
+	require.NoError(t, err)
+
+	request := &ReplicateRequest{
+		VolumeId:         sourcePv.ID.String(),
+		BlockId:          writeResp.BlockId,
+		TargetVolumeId:   targetPv.ID.String(),
+		TargetEndpoint:   targetAddress,
+		Codec:            "gzip",
+		ExpectedChecksum: writeResp.Checksum,
+
+		HasExpectedChecksum: true,
+	}
+
+	replicateResp, err := sourceClient.Replicate(context.Background(), request)
+	require.NoError(t, err)
+	require.Equal(t, targetPv.ID.String(), replicateResp.VolumeId)
+	require.Equal(t, writeResp.BlockId, replicateResp.BlockId)
+	require.Equal(t, uint64(len(data)), replicateResp.Size)
+	require.Equal(t, writeResp.Checksum, replicateResp.Checksum)
+	require.NotZero(t, replicateResp.StoredSize)
+
+	readStream, err := targetClient.Read(context.Background(), &ReadRequest{
+		VolumeId:  targetPv.ID.String(),
+		BlockId:   writeResp.BlockId,
+		ChunkSize: 64 * 1024,
+	})
+	require.NoError(t, err)
+
+	var received []byte
+	for {
+		readResp, err := readStream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		received = append(received, readResp.Buffer...)
+	}
+
+	require.True(t, bytes.Equal(data, received))
+
+	// A copy that doesn't match the expected checksum is discarded.
+	require.NoError(t, targetPv.Delete(writeResp.BlockId))
+
+	request.ExpectedChecksum = writeResp.Checksum + 1
+	_, err = sourceClient.Replicate(context.Background(), request)
+	require.Equal(t, codes.DataLoss, status.Code(err))
+
+	_, err = targetClient.StatBlock(context.Background(), &StatBlockRequest{
+		VolumeId: targetPv.ID.String(),
+		BlockId:  writeResp.BlockId,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Zero is a checksum like any other when one is expected.
+	request.ExpectedChecksum = 0
+	_, err = sourceClient.Replicate(context.Background(), request)
+	require.Equal(t, codes.DataLoss, status.Code(err))
+
+	// Missing blocks and target failures are reported.
+	request.HasExpectedChecksum = false
+	request.BlockId = uuid.NewRandom().String()
+	_, err = sourceClient.Replicate(context.Background(), request)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Only blocks may be copied, not other files reachable by path.
+	request.BlockId = "../id"
+	_, err = sourceClient.Replicate(context.Background(), request)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	request.BlockId = writeResp.BlockId
+	request.TargetVolumeId = uuid.NewRandom().String()
+	_, err = sourceClient.Replicate(context.Background(), request)
+	require.Error(t, err)
+}
+
+func TestBlockService_ResumeWrite(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockService := New([]*PhysicalVolume{pv})
+
+	blockClient, _, stop := startBlockServer(t, blockService)
+	defer stop()
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+
+	blockId := uuid.NewRandom().String()
+	statusRequest := &WriteStatusRequest{VolumeId: pv.ID.String(), BlockId: blockId}
+
+	waitForStatus := func(cond func(*WriteStatusResponse) bool) *WriteStatusResponse {
+		for i := 0; i < 100; i++ {
+			statusResp, err := blockClient.WriteStatus(context.Background(), statusRequest)
+			require.NoError(t, err)
+
+			if cond(statusResp) {
+				return statusResp
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		require.FailNow(t, "timed out waiting for write status")
+		return nil
+	}
+
+	statusResp := waitForStatus(func(*WriteStatusResponse) bool { return true })
+	require.Equal(t, WriteState_WRITE_UNKNOWN, statusResp.State)
+
+	// Interrupt a write part way through.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	writerStream, err := blockClient.Write(ctx)
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), BlockId: blockId, Buffer: data[:1000]}))
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: data[1000:5000]}))
+
+	waitForStatus(func(resp *WriteStatusResponse) bool { return resp.Size == 5000 })
+	cancel()
+
+	statusResp = waitForStatus(func(resp *WriteStatusResponse) bool { return !resp.Active })
+	require.Equal(t, WriteState_WRITE_IN_PROGRESS, statusResp.State)
+	require.Equal(t, uint64(5000), statusResp.Size)
+	require.Equal(t, crc32.Checksum(data[:5000], crc32.MakeTable(crc32.Castagnoli)), statusResp.Checksum)
+
+	// Resuming anywhere but the end of the data held is refused.
+	writerStream, err = blockClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), BlockId: blockId, Offset: 1000,
+		Buffer: data[1000:]}))
+	_, err = writerStream.CloseAndRecv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	writerStream, err = blockClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), BlockId: blockId, Offset: 5000,
+		Buffer: data[5000:]}))
+
+	writeResp, err := writerStream.CloseAndRecv()
+	require.NoError(t, err)
+	require.Equal(t, blockId, writeResp.BlockId)
+	require.Equal(t, uint32(len(data)), writeResp.Size)
+	require.Equal(t, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)), writeResp.Checksum)
+
+	statusResp, err = blockClient.WriteStatus(context.Background(), statusRequest)
+	require.NoError(t, err)
+	require.Equal(t, WriteState_WRITE_COMMITTED, statusResp.State)
+	require.Equal(t, uint64(len(data)), statusResp.Size)
+	require.Equal(t, writeResp.Checksum, statusResp.Checksum)
+	require.False(t, statusResp.Active)
+
+	// Committed blocks can't be written again, and writes the volume doesn't know about can't be resumed.
+	writerStream, err = blockClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), BlockId: blockId, Buffer: data}))
+	_, err = writerStream.CloseAndRecv()
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	writerStream, err = blockClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), BlockId: uuid.NewRandom().String(),
+		Offset: 5000, Buffer: data[5000:]}))
+	_, err = writerStream.CloseAndRecv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestBlockService_Stats(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockService := New([]*PhysicalVolume{pv})
+
+	blockClient, _, stop := startBlockServer(t, blockService)
+	defer stop()
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+
+	writerStream, err := blockClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: data[:32*1024]}))
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: data[32*1024:]}))
+
+	writeResp, err := writerStream.CloseAndRecv()
+	require.NoError(t, err)
+
+	readStream, err := blockClient.Read(context.Background(), &ReadRequest{
+		VolumeId:  pv.ID.String(),
+		BlockId:   writeResp.BlockId,
+		ChunkSize: 16 * 1024,
+	})
+	require.NoError(t, err)
+
+	for {
+		if _, err := readStream.Recv(); err == io.EOF {
+			break
+		} else {
+			require.NoError(t, err)
+		}
+	}
+
+	_, err = blockClient.Delete(context.Background(), &ReadRequest{VolumeId: pv.ID.String(), BlockId: writeResp.BlockId})
+	require.NoError(t, err)
+
+	_, err = blockClient.Delete(context.Background(), &ReadRequest{VolumeId: pv.ID.String(), BlockId: writeResp.BlockId})
+	require.Error(t, err)
+
+	statsResp, err := blockClient.Stats(context.Background(), &StatsRequest{})
+	require.NoError(t, err)
+	require.Len(t, statsResp.Volumes, 1)
+
+	stats := statsResp.Volumes[0]
+	require.Equal(t, pv.ID.String(), stats.VolumeId)
+	require.Equal(t, uint64(len(data)), stats.BytesWritten)
+	require.Equal(t, uint64(len(data)), stats.BytesRead)
+	require.Equal(t, uint64(1), stats.Writes)
+	require.Equal(t, uint64(1), stats.Reads)
+	require.Equal(t, uint64(2), stats.Deletes)
+	require.Equal(t, uint64(0), stats.WriteErrors)
+	require.Equal(t, uint64(0), stats.ReadErrors)
+	// Deleting a missing block is refused rather than failed by the volume's disk.
+	require.Equal(t, uint64(0), stats.DeleteErrors)
+	require.Equal(t, int64(0), stats.ActiveReads)
+	require.Equal(t, int64(0), stats.ActiveWrites)
+
+	// Each chunk written, the commit, and each chunk read and the final EOF, are timed.
+	require.Len(t, stats.WriteLatency.Counts, len(LatencyBuckets)+1)
+	require.Equal(t, uint64(2), sum(stats.WriteLatency.Counts))
+	require.Equal(t, uint64(1), sum(stats.CommitLatency.Counts))
+	require.Equal(t, uint64(5), sum(stats.ReadLatency.Counts))
+
+	summary := pv.IO.Summary()
+	require.Equal(t, stats.BytesRead, summary.BytesRead)
+	require.NotZero(t, summary.WriteLatencyP99)
+
+	_, err = blockClient.Stats(context.Background(), &StatsRequest{VolumeIds: []string{uuid.NewRandom().String()}})
+	require.Error(t, err)
+}
+
+func sum(counts []uint64) uint64 {
+	var total uint64
+	for _, count := range counts {
+		total += count
+	}
+
+	return total
+}
+
+func TestBlockService_Throttle(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	pv.Throttle.CallerReadBytesPerSecond = 128 * 1024
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockService := New([]*PhysicalVolume{pv})
+
+	blockClient, _, stop := startBlockServer(t, blockService)
+	defer stop()
+
+	data := make([]byte, 192*1024)
+	rand.Read(data)
+
+	writerStream, err := blockClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: data}))
+
+	writeResp, err := writerStream.CloseAndRecv()
+	require.NoError(t, err)
+
+	readBlock := func(ctx context.Context) time.Duration {
+		start := time.Now()
+
+		readStream, err := blockClient.Read(ctx, &ReadRequest{
+			VolumeId:  pv.ID.String(),
+			BlockId:   writeResp.BlockId,
+			ChunkSize: 64 * 1024,
+		})
+		require.NoError(t, err)
+
+		var readData []byte
+		for {
+			readResp, err := readStream.Recv()
+			if err == io.EOF {
+				break
+			}
+
+			require.NoError(t, err)
+			readData = append(readData, readResp.Buffer...)
+		}
+
+		require.True(t, bytes.Equal(data, readData), "data mismatch")
+
+		return time.Since(start)
+	}
+
+	// A caller is slowed, not refused, once past a second of its budget.
+	require.True(t, readBlock(WithCaller(context.Background(), "batch")) >= 400*time.Millisecond)
+
+	// Unidentified callers share a budget of their own.
+	require.True(t, readBlock(context.Background()) >= 400*time.Millisecond)
+
+	statsResp, err := blockClient.Stats(context.Background(), &StatsRequest{})
+	require.NoError(t, err)
+
+	throttle := statsResp.Volumes[0].Throttle
+	require.Equal(t, uint64(128*1024), throttle.CallerReadBytesPerSecond)
+	require.Len(t, throttle.Buckets, 2)
+	require.Equal(t, UnidentifiedCaller, throttle.Buckets[0].Caller)
+	require.Equal(t, "batch", throttle.Buckets[1].Caller)
+
+	for _, bucket := range throttle.Buckets {
+		require.False(t, bucket.Write)
+		require.Equal(t, uint64(1), bucket.Waits)
+		require.True(t, bucket.WaitMicros >= 400000)
+	}
+
+	require.True(t, pv.IO.Summary().ReadThrottledMicros >= 800000)
+}
+
+func TestBlockService_Dedup(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockClient, _, stop := startBlockServer(t, New([]*PhysicalVolume{pv}))
+	defer stop()
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+
+	blockId := ContentBlockIdOf(data)
+
+	write := func(blockId string) (*WriteResponse, error) {
+		writerStream, err := blockClient.Write(context.Background())
+		require.NoError(t, err)
+
+		err = writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), BlockId: blockId, Codec: "gzip", Dedup: true})
+		require.NoError(t, err)
+		require.NoError(t, writerStream.Send(&WriteRequest{Buffer: data}))
+
+		return writerStream.CloseAndRecv()
+	}
+
+	writeResp, err := write(blockId)
+	require.NoError(t, err)
+	require.Equal(t, blockId, writeResp.BlockId)
+	require.Equal(t, uint64(1), writeResp.References)
+
+	// The same content written again is referenced, and reports the stored block.
+	dupResp, err := write(blockId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), dupResp.References)
+	require.Equal(t, writeResp.Checksum, dupResp.Checksum)
+	require.Equal(t, writeResp.StoredSize, dupResp.StoredSize)
+
+	refResp, err := blockClient.Reference(context.Background(), &ReferenceRequest{
+		VolumeId: pv.ID.String(),
+		BlockId:  blockId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), refResp.References)
+	require.Equal(t, uint64(len(data)), refResp.Size)
+	require.Equal(t, writeResp.Checksum, refResp.Checksum)
+	require.Equal(t, writeResp.StoredSize, refResp.StoredSize)
+
+	_, err = write(uuid.NewRandom().String())
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = blockClient.Reference(context.Background(), &ReferenceRequest{
+		VolumeId: pv.ID.String(),
+		BlockId:  uuid.NewRandom().String(),
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Each delete removes a reference. The block goes with the last.
+	for expected := uint64(2); ; expected-- {
+		deleteResp, err := blockClient.Delete(context.Background(), &ReadRequest{
+			VolumeId: pv.ID.String(),
+			BlockId:  blockId,
+		})
+		require.NoError(t, err)
+		require.Equal(t, expected, deleteResp.References)
+
+		_, err = blockClient.StatBlock(context.Background(), &StatBlockRequest{
+			VolumeId: pv.ID.String(),
+			BlockId:  blockId,
+		})
+
+		if expected == 0 {
+			require.Equal(t, codes.NotFound, status.Code(err))
+			break
+		}
+
+		require.NoError(t, err)
+	}
+}
+
+func TestBlockService_MemoryVolume(t *testing.T) {
+	pv := NewMemoryPhysicalVolume()
+	require.NoError(t, pv.Open(false))
+	defer pv.Close()
+
+	blockClient, _, stop := startBlockServer(t, New([]*PhysicalVolume{pv}))
+	defer stop()
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+
+	writerStream, err := blockClient.Write(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, writerStream.Send(&WriteRequest{VolumeId: pv.ID.String(), Buffer: data[:100*1024]}))
+	require.NoError(t, writerStream.Send(&WriteRequest{Buffer: data[100*1024:]}))
+
+	writeResp, err := writerStream.CloseAndRecv()
+	require.NoError(t, err)
+	require.Equal(t, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)), writeResp.Checksum)
+	require.Equal(t, uint64(len(data)), writeResp.StoredSize)
+
+	readStream, err := blockClient.Read(context.Background(), &ReadRequest{
+		VolumeId:  pv.ID.String(),
+		BlockId:   writeResp.BlockId,
+		Position:  100*1024 + 13,
+		Length:    64 * 1024,
+		ChunkSize: 4096,
+	})
+	require.NoError(t, err)
+
+	var received []byte
+	for {
+		readResp, err := readStream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		received = append(received, readResp.Buffer...)
+	}
+
+	require.Equal(t, data[100*1024+13:164*1024+13], received)
+
+	listStream, err := blockClient.ListBlocks(context.Background(), &ListBlocksRequest{VolumeId: pv.ID.String()})
+	require.NoError(t, err)
+
+	listResp, err := listStream.Recv()
+	require.NoError(t, err)
+	require.Len(t, listResp.Blocks, 1)
+	require.Equal(t, writeResp.BlockId, listResp.Blocks[0].BlockId)
+	require.Equal(t, uint64(len(data)), listResp.Blocks[0].Size)
+
+	_, err = blockClient.Delete(context.Background(), &ReadRequest{
+		VolumeId: pv.ID.String(),
+		BlockId:  writeResp.BlockId,
+	})
+	require.NoError(t, err)
+
+	_, err = blockClient.StatBlock(context.Background(), &StatBlockRequest{
+		VolumeId: pv.ID.String(),
+		BlockId:  writeResp.BlockId,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.Zero(t, pv.UsedBytes())
+}
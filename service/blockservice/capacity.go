@@ -0,0 +1,275 @@
+package blockservice
+
+import (
+	"bfs/block"
+	"bfs/config"
+	"bfs/util/logging"
+	"fmt"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hash"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// The error returned when a volume refuses a new block because it is out of space.
+//
+// The block service reports it to clients with codes.ResourceExhausted.
+type VolumeFullError struct {
+	VolumeId string
+	Reason   string
+}
+
+func (this *VolumeFullError) Error() string {
+	return fmt.Sprintf("volume %s is full - %s", this.VolumeId, this.Reason)
+}
+
+// Determine whether an error, local or received from the block service, means a volume refused a block for lack of
+// space.
+func IsVolumeFull(err error) bool {
+	if _, ok := err.(*VolumeFullError); ok {
+		return true
+	}
+
+	return status.Code(err) == codes.ResourceExhausted
+}
+
+// Returns the number of bytes of committed block data on the volume.
+func (this *PhysicalVolume) UsedBytes() uint64 {
+	return uint64(atomic.LoadInt64(&this.usedBytes))
+}
+
+// Returns the number of bytes available to the block service in the volume's storage.
+func (this *PhysicalVolume) FreeBytes() (uint64, error) {
+	return this.Storage.FreeBytes()
+}
+
+// Describe the volume's state, usage, and I/O for its host status.
+//
+// Filesystem status is only filled in for memory volumes, which have no filesystem. Their capacity is given as one-byte
+// blocks up to MaxBytes, or as the storage's free bytes if the volume has no limit. The caller fills it in for volumes
+// on local disk.
+func (this *PhysicalVolume) Status() *config.PhysicalVolumeStatus {
+	volumeStatus := &config.PhysicalVolumeStatus{
+		Id:            this.ID.String(),
+		State:         this.State(),
+		UsedBytes:     this.UsedBytes(),
+		ReservedBytes: this.ReservedBytes,
+		MaxBytes:      this.MaxBytes,
+		Io:            this.IO.Summary(),
+	}
+
+	if _, ok := this.Storage.(*MemoryStorage); ok {
+		capacity := this.MaxBytes
+		if capacity == 0 {
+			capacity, _ = this.FreeBytes()
+		}
+
+		available := uint64(0)
+		if capacity > volumeStatus.UsedBytes {
+			available = capacity - volumeStatus.UsedBytes
+		}
+
+		volumeStatus.FileSystemStatus = &config.FileSystemStatus{
+			DevicePath:      "memory",
+			MountPath:       "memory",
+			BlockSize:       1,
+			Blocks:          capacity,
+			BlocksFree:      available,
+			BlocksAvailable: available,
+		}
+	}
+
+	return volumeStatus
+}
+
+// Decide whether the volume can accept a new block.
+//
+// A block is refused if the volume holds MaxBytes or more, or if no more than ReservedBytes remain free in its
+// storage. Only new blocks are checked, so blocks already being written may take a volume past either limit by up to
+// one block each.
+func (this *PhysicalVolume) admit() error {
+	if this.MaxBytes > 0 {
+		if used := this.UsedBytes(); used >= this.MaxBytes {
+			return &VolumeFullError{
+				VolumeId: this.ID.String(),
+				Reason:   fmt.Sprintf("%d of %d bytes used", used, this.MaxBytes),
+			}
+		}
+	}
+
+	if this.ReservedBytes > 0 {
+		free, err := this.FreeBytes()
+		if err != nil {
+			return err
+		}
+
+		if free <= this.ReservedBytes {
+			return &VolumeFullError{
+				VolumeId: this.ID.String(),
+				Reason:   fmt.Sprintf("%d bytes free, %d reserved", free, this.ReservedBytes),
+			}
+		}
+	}
+
+	return nil
+}
+
+// Total the size of all committed blocks on the volume.
+func (this *PhysicalVolume) loadUsage() error {
+	var usedBytes int64
+
+	err := this.list(func(info *block.BlockInfo) (bool, error) {
+		usedBytes += int64(info.Size)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&this.usedBytes, usedBytes)
+
+	return nil
+}
+
+// A block writer that counts the block toward its volume's usage once committed, and reports I/O errors to its volume.
+//
+// The volume tracks the writer until it is committed or aborted so an interrupted write may be resumed.
+type volumeWriter struct {
+	block.BlockWriter
+	volume  *PhysicalVolume
+	blockId string
+
+	// The number of bytes written and their checksum, whether a stream is writing the block, and when the write was
+	// last suspended. Guarded by the volume's writesMut.
+	size      uint64
+	checksum  uint32
+	active    bool
+	suspended time.Time
+
+	// The SHA-256 of the data written to a content-addressed block, or nil for other blocks.
+	digest hash.Hash
+
+	// The number of references to the block once committed. Blocks that already existed on the volume have more than
+	// one, and the size of their existing block file.
+	references     uint64
+	existingStored uint64
+}
+
+func (this *volumeWriter) Write(buffer []byte) (int, error) {
+	// Writes in progress when the volume closes can't be committed.
+	if err := this.volume.checkReadable(); err != nil {
+		return 0, err
+	}
+
+	n, err := this.BlockWriter.Write(buffer)
+	this.volume.recordIOResult(err)
+
+	if this.digest != nil {
+		this.digest.Write(buffer[:n])
+	}
+
+	checksum := this.BlockWriter.Checksum()
+
+	this.volume.writesMut.Lock()
+	this.size += uint64(n)
+	this.checksum = checksum
+	this.volume.writesMut.Unlock()
+
+	return n, err
+}
+
+func (this *volumeWriter) Abort() error {
+	this.volume.finishWrite(this)
+
+	return this.BlockWriter.Abort()
+}
+
+// Commit the block, failing if the volume has closed since the write started.
+func (this *volumeWriter) Close() error {
+	this.volume.commitMut.RLock()
+	defer this.volume.commitMut.RUnlock()
+
+	if err := this.volume.checkReadable(); err != nil {
+		if abortErr := this.Abort(); abortErr != nil {
+			glog.Errorf("Unable to remove block %s on volume %s - %v", this.blockId, this.volume.ID, abortErr)
+		}
+
+		return err
+	}
+
+	if this.digest != nil {
+		return this.closeDedup()
+	}
+
+	return this.commit()
+}
+
+// Commit a content-addressed block, or add a reference to it if the volume already holds it.
+func (this *volumeWriter) closeDedup() error {
+	if actualId := ContentBlockId(this.digest.Sum(nil)); actualId != this.blockId {
+		if err := this.Abort(); err != nil {
+			glog.Errorf("Unable to remove mismatched block %s on volume %s - %v", this.blockId, this.volume.ID, err)
+		}
+
+		return &ContentMismatchError{BlockId: this.blockId, ActualId: actualId}
+	}
+
+	this.volume.refsMut.Lock()
+	defer this.volume.refsMut.Unlock()
+
+	info, err := this.volume.Storage.Stat(this.blockId)
+	if os.IsNotExist(err) {
+		return this.commit()
+	} else if err != nil {
+		this.Abort()
+		return err
+	}
+
+	if err := this.Abort(); err != nil {
+		glog.Errorf("Unable to remove duplicate of block %s on volume %s - %v", this.blockId, this.volume.ID, err)
+	}
+
+	references, err := this.volume.addReference(this.blockId)
+	if err != nil {
+		return err
+	}
+
+	this.references = references
+	this.existingStored = info.Size
+
+	glog.V(logging.LogLevelDebug).Infof("Deduplicated block %s on volume %s - %d references", this.blockId,
+		this.volume.ID, references)
+
+	return nil
+}
+
+// Returns the number of bytes stored for the block, which for a duplicate is the size of the block it references.
+func (this *volumeWriter) StoredSize() uint64 {
+	if this.references > 1 {
+		return this.existingStored
+	}
+
+	return this.BlockWriter.StoredSize()
+}
+
+func (this *volumeWriter) commit() error {
+	err := this.BlockWriter.Close()
+	this.volume.recordIOResult(err)
+	if err != nil {
+		if abortErr := this.Abort(); abortErr != nil {
+			glog.Errorf("Unable to remove failed block %s on volume %s - %v", this.blockId, this.volume.ID, abortErr)
+		}
+
+		return err
+	}
+
+	this.volume.finishWrite(this)
+	this.references = 1
+
+	atomic.AddInt64(&this.volume.usedBytes, int64(this.StoredSize()))
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package blockservice
+
+import (
+	"bfs/block"
+	"bfs/util/logging"
+	"crypto/sha256"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pborman/uuid"
+	"sync/atomic"
+)
+
+/*
+ * Content-addressed blocks.
+ *
+ * A block written in dedup mode is named by its contents: its ID is a name-based UUID of the SHA-256 of its data, so
+ * identical blocks get the same ID wherever they are written. Volumes verify the ID of each such block as it is
+ * written. Writing a block the volume already holds adds a reference to it instead of a second copy, and deleting a
+ * block removes a reference, only removing its data with the last one.
+ */
+
+// The namespace of content block IDs.
+var contentNamespace = uuid.Parse("6c1e2d0a-3f4b-4e8a-9d57-b0c2a1f8e934")
+
+// The error returned when a block written in dedup mode does not have the ID of its contents.
+type ContentMismatchError struct {
+	BlockId  string
+	ActualId string
+}
+
+func (this *ContentMismatchError) Error() string {
+	return fmt.Sprintf("block %s has the contents of block %s", this.BlockId, this.ActualId)
+}
+
+// Returns the ID of the content-addressed block whose data has the given SHA-256 digest.
+func ContentBlockId(digest []byte) string {
+	return uuid.NewSHA1(contentNamespace, digest).String()
+}
+
+// Returns the ID of the content-addressed block holding data.
+func ContentBlockIdOf(data []byte) string {
+	digest := sha256.Sum256(data)
+	return ContentBlockId(digest[:])
+}
+
+// A reference taken to a committed block.
+type BlockReference struct {
+	// The logical size of the block and its CRC32C, as recorded when it was written.
+	Size     uint64
+	Checksum uint32
+	// The size of the block file.
+	StoredSize uint64
+	// The number of references the block has, including this one.
+	References uint64
+}
+
+// Open a writer for a content-addressed block, encoding its data with codec.
+//
+// The data written must have the block's ID. If the volume already holds the block when the writer is closed, the
+// data is discarded and a reference is added to the existing block instead. Streams may write the same block at once,
+// as happens when several clients store the same data; the first to close stores it and the rest reference it.
+func (this *PhysicalVolume) OpenDedupWrite(blockId string, codec block.Codec) (block.BlockWriter, error) {
+	return this.openWrite(blockId, codec, true)
+}
+
+// Add a reference to a committed block, such as from a file whose data matches it.
+//
+// Errors satisfying os.IsNotExist() are returned for blocks the volume does not hold, and blocks written before
+// checksums were recorded can not be referenced.
+func (this *PhysicalVolume) Reference(blockId string) (*BlockReference, error) {
+	if err := this.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	this.refsMut.Lock()
+	defer this.refsMut.Unlock()
+
+	info, err := this.Stat(blockId)
+	if err != nil {
+		return nil, err
+	}
+
+	size, checksum, err := this.Storage.ReadChecksum(blockId, this.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	references, err := this.addReference(blockId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockReference{Size: size, Checksum: checksum, StoredSize: info.Size, References: references}, nil
+}
+
+// Increment the reference count of a committed block, returning the new count. Called with refsMut held.
+func (this *PhysicalVolume) addReference(blockId string) (uint64, error) {
+	references, err := this.Storage.ReadReferences(blockId)
+	if err != nil {
+		return 0, err
+	}
+
+	references++
+
+	if err := this.writeReferences(blockId, references); err != nil {
+		return 0, err
+	}
+
+	glog.V(logging.LogLevelDebug).Infof("Added reference to block %s on volume %s - %d references", blockId, this.ID,
+		references)
+
+	return references, nil
+}
+
+// Record the reference count of a block, flushing it to stable storage if the volume syncs its blocks. Called with
+// refsMut held.
+func (this *PhysicalVolume) writeReferences(blockId string, references uint64) error {
+	err := this.Storage.WriteReferences(blockId, references, syncMode(this.Durability) != block.SyncNone)
+	this.recordIOResult(err)
+
+	return err
+}
+
+// Returns the number of references to a committed block.
+func (this *PhysicalVolume) References(blockId string) (uint64, error) {
+	if err := this.checkReadable(); err != nil {
+		return 0, err
+	}
+
+	if _, err := this.Storage.Stat(blockId); err != nil {
+		return 0, err
+	}
+
+	return this.Storage.ReadReferences(blockId)
+}
+
+// Remove a reference to a block, returning the number that remain. The block is removed from the volume with its last
+// reference.
+//
+// References may be released on read-only, draining, and retired volumes so files can still be removed and volumes
+// emptied.
+func (this *PhysicalVolume) Release(blockId string) (uint64, error) {
+	if err := this.checkReadable(); err != nil {
+		return 0, err
+	}
+
+	this.refsMut.Lock()
+	defer this.refsMut.Unlock()
+
+	info, err := this.Storage.Stat(blockId)
+	if err != nil {
+		return 0, err
+	}
+
+	references, err := this.Storage.ReadReferences(blockId)
+	if err != nil {
+		return 0, err
+	}
+
+	if references > 1 {
+		references--
+
+		if err := this.writeReferences(blockId, references); err != nil {
+			return 0, err
+		}
+
+		return references, nil
+	}
+
+	if err := this.Storage.Delete(blockId); err != nil {
+		return 0, err
+	}
+
+	atomic.AddInt64(&this.usedBytes, -int64(info.Size))
+
+	return 0, nil
+}
@@ -0,0 +1,222 @@
+package blockservice
+
+import (
+	"bfs/block"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pborman/uuid"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * On-disk layout of block files within a physical volume.
+ */
+
+const (
+	// Block files are stored directly in the volume root. Volumes without a layout file use this layout.
+	LayoutFlat = 0
+	// Block files are stored in one of 256 subdirectories of the volume root, named by the first two hex digits of the
+	// block ID.
+	LayoutFanOut = 1
+
+	// The layout used for new volumes, and to which older volumes are migrated when opened.
+	CurrentLayout = LayoutFanOut
+
+	// The name of the file in the volume root, next to the id file, holding the layout version.
+	layoutFile = "layout"
+
+	// The number of characters of the block ID used to name its fan-out directory.
+	fanOutPrefixLength = 2
+
+	// The number of directory entries read at a time when migrating a volume.
+	migrateBatchSize = 1024
+)
+
+// Return the directory holding the given block's files.
+func (this *LocalStorage) blockDir(blockId string) string {
+	if this.Layout == LayoutFlat || len(blockId) < fanOutPrefixLength {
+		return this.RootPath
+	}
+
+	return filepath.Join(this.RootPath, blockId[:fanOutPrefixLength])
+}
+
+// Return the path of the given block's data file.
+func (this *LocalStorage) BlockPath(blockId string) string {
+	return filepath.Join(this.blockDir(blockId), blockId)
+}
+
+// Return the path of the given block's data file on a volume on local disk.
+func (this *PhysicalVolume) BlockPath(blockId string) string {
+	return (&LocalStorage{RootPath: this.RootPath, Layout: this.Layout}).BlockPath(blockId)
+}
+
+// Return all directories that may hold block files under the current layout.
+func (this *LocalStorage) blockDirs() []string {
+	if this.Layout == LayoutFlat {
+		return []string{this.RootPath}
+	}
+
+	return fanOutDirs(this.RootPath)
+}
+
+func fanOutDirs(rootPath string) []string {
+	dirs := make([]string, 0, 256)
+
+	for i := 0; i < 256; i++ {
+		dirs = append(dirs, filepath.Join(rootPath, fmt.Sprintf("%02x", i)))
+	}
+
+	return dirs
+}
+
+func createFanOutDirs(rootPath string) error {
+	for _, dir := range fanOutDirs(rootPath) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read the layout version of the volume. Volumes that predate layout versioning are flat.
+func readLayout(rootPath string) (int, error) {
+	value, err := ioutil.ReadFile(filepath.Join(rootPath, layoutFile))
+	if os.IsNotExist(err) {
+		return LayoutFlat, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	layout, err := strconv.Atoi(strings.TrimSpace(string(value)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid layout file %s - %v", filepath.Join(rootPath, layoutFile), err)
+	}
+
+	return layout, nil
+}
+
+func writeLayout(rootPath string, layout int) error {
+	file, err := ioutil.TempFile(rootPath, "."+layoutFile+"-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.WriteString(strconv.Itoa(layout) + "\n"); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), filepath.Join(rootPath, layoutFile))
+}
+
+// Initialize the current layout in a new, empty volume.
+func (this *PhysicalVolume) initializeLayout() error {
+	if err := createFanOutDirs(this.RootPath); err != nil {
+		return err
+	}
+
+	if err := writeLayout(this.RootPath, CurrentLayout); err != nil {
+		return err
+	}
+
+	this.Layout = CurrentLayout
+
+	return nil
+}
+
+// Move the block files of a flat volume into fan-out directories.
+//
+// Each file is moved with a single rename, and the layout file is only updated once every file has been moved, so an
+// interrupted migration is simply repeated the next time the volume is opened.
+func (this *PhysicalVolume) migrateLayout() error {
+	glog.Infof("Migrating volume %s at %s from layout %d to %d", this.ID, this.RootPath, this.Layout, CurrentLayout)
+
+	if err := createFanOutDirs(this.RootPath); err != nil {
+		return err
+	}
+
+	totalMoved := 0
+
+	// Renaming entries while reading a directory may cause some to be skipped; repeat until nothing is left to move.
+	for {
+		moved, err := moveFlatBlockFiles(this.RootPath)
+		if err != nil {
+			return err
+		}
+
+		if moved == 0 {
+			break
+		}
+
+		totalMoved += moved
+	}
+
+	if err := writeLayout(this.RootPath, CurrentLayout); err != nil {
+		return err
+	}
+
+	this.Layout = CurrentLayout
+
+	glog.Infof("Migrated volume %s to layout %d - moved %d files", this.ID, CurrentLayout, totalMoved)
+
+	return nil
+}
+
+// Move block, checksum, and reference count files in the volume root into their fan-out directories, returning the number moved.
+func moveFlatBlockFiles(rootPath string) (int, error) {
+	dir, err := os.Open(rootPath)
+	if err != nil {
+		return 0, err
+	}
+
+	defer dir.Close()
+
+	moved := 0
+
+	for {
+		names, err := dir.Readdirnames(migrateBatchSize)
+		if err == io.EOF {
+			return moved, nil
+		} else if err != nil {
+			return moved, err
+		}
+
+		for _, name := range names {
+			if !isBlockFile(name) {
+				continue
+			}
+
+			path := filepath.Join(rootPath, name)
+			if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+
+			if err := os.Rename(path, filepath.Join(rootPath, name[:fanOutPrefixLength], name)); err != nil {
+				return moved, err
+			}
+
+			moved++
+		}
+	}
+}
+
+// Determine whether a file name is that of a committed block or one of its sidecars.
+func isBlockFile(name string) bool {
+	blockId := strings.TrimSuffix(strings.TrimSuffix(name, block.ChecksumSuffix), block.RefsSuffix)
+	blockUUID := uuid.Parse(blockId)
+
+	return blockUUID != nil && blockUUID.String() == blockId
+}
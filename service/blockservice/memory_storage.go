@@ -0,0 +1,224 @@
+package blockservice
+
+import (
+	"bfs/block"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// The error returned when a memory block writer is used after it is closed or aborted.
+var errMemoryWriterDone = errors.New("block writer is closed")
+
+var memoryCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Volume storage held in memory, for scratch data and tests. Its blocks are lost when the process exits.
+//
+// Blocks are held as written: codecs and keys are not applied, and sync modes have no effect. Memory storage has no
+// fixed size, so volumes that use it should be limited with MaxBytes.
+type MemoryStorage struct {
+	blocks map[string]*memoryBlock
+	mut    sync.RWMutex
+}
+
+// A committed block. Its data is never modified once committed, so readers share it.
+type memoryBlock struct {
+	data       []byte
+	checksum   uint32
+	references uint64
+	modTime    time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{blocks: make(map[string]*memoryBlock)}
+}
+
+func (this *MemoryStorage) get(op string, blockId string) (*memoryBlock, error) {
+	this.mut.RLock()
+	defer this.mut.RUnlock()
+
+	memBlock, ok := this.blocks[blockId]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: blockId, Err: os.ErrNotExist}
+	}
+
+	return memBlock, nil
+}
+
+func (this *MemoryStorage) OpenRead(blockId string, position uint64, length uint64,
+	keys *block.KeyRing) (block.BlockReader, error) {
+
+	memBlock, err := this.get("open", blockId)
+	if err != nil {
+		return nil, err
+	}
+
+	data := memBlock.data
+	if position > uint64(len(data)) {
+		position = uint64(len(data))
+	}
+
+	data = data[position:]
+	if length > 0 && length < uint64(len(data)) {
+		data = data[:length]
+	}
+
+	return &memoryBlockReader{Reader: bytes.NewReader(data)}, nil
+}
+
+func (this *MemoryStorage) OpenWrite(blockId string, codec block.Codec, key *block.Key,
+	sync block.SyncMode) (block.BlockWriter, error) {
+
+	return &memoryBlockWriter{storage: this, blockId: blockId}, nil
+}
+
+func (this *MemoryStorage) Stat(blockId string) (*block.BlockInfo, error) {
+	memBlock, err := this.get("stat", blockId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &block.BlockInfo{BlockId: blockId, Size: uint64(len(memBlock.data)), ModTime: memBlock.modTime}, nil
+}
+
+// Visit every committed block. Blocks committed or deleted while the visit is in progress may or may not be visited.
+func (this *MemoryStorage) List(visitor func(info *block.BlockInfo) (bool, error)) error {
+	this.mut.RLock()
+	infos := make([]*block.BlockInfo, 0, len(this.blocks))
+	for blockId, memBlock := range this.blocks {
+		infos = append(infos, &block.BlockInfo{BlockId: blockId, Size: uint64(len(memBlock.data)),
+			ModTime: memBlock.modTime})
+	}
+	this.mut.RUnlock()
+
+	for _, info := range infos {
+		if ok, err := visitor(info); err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *MemoryStorage) Delete(blockId string) error {
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	if _, ok := this.blocks[blockId]; !ok {
+		return &os.PathError{Op: "remove", Path: blockId, Err: os.ErrNotExist}
+	}
+
+	delete(this.blocks, blockId)
+
+	return nil
+}
+
+func (this *MemoryStorage) ReadChecksum(blockId string, keys *block.KeyRing) (uint64, uint32, error) {
+	memBlock, err := this.get("open", blockId)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uint64(len(memBlock.data)), memBlock.checksum, nil
+}
+
+func (this *MemoryStorage) ReadReferences(blockId string) (uint64, error) {
+	this.mut.RLock()
+	defer this.mut.RUnlock()
+
+	memBlock, ok := this.blocks[blockId]
+	if !ok {
+		return 0, &os.PathError{Op: "open", Path: blockId, Err: os.ErrNotExist}
+	}
+
+	return memBlock.references, nil
+}
+
+func (this *MemoryStorage) WriteReferences(blockId string, references uint64, sync bool) error {
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	memBlock, ok := this.blocks[blockId]
+	if !ok {
+		return &os.PathError{Op: "open", Path: blockId, Err: os.ErrNotExist}
+	}
+
+	memBlock.references = references
+
+	return nil
+}
+
+// Returns math.MaxUint64; memory storage does not track the memory available to it.
+func (this *MemoryStorage) FreeBytes() (uint64, error) {
+	return math.MaxUint64, nil
+}
+
+func (this *MemoryStorage) commit(blockId string, memBlock *memoryBlock) {
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	this.blocks[blockId] = memBlock
+}
+
+type memoryBlockReader struct {
+	*bytes.Reader
+}
+
+func (this *memoryBlockReader) Close() error {
+	return nil
+}
+
+// A writer that buffers a block in memory until it is committed.
+type memoryBlockWriter struct {
+	storage  *MemoryStorage
+	blockId  string
+	data     []byte
+	checksum uint32
+	done     bool
+}
+
+func (this *memoryBlockWriter) Write(buffer []byte) (int, error) {
+	if this.done {
+		return 0, errMemoryWriterDone
+	}
+
+	this.data = append(this.data, buffer...)
+	this.checksum = crc32.Update(this.checksum, memoryCRCTable, buffer)
+
+	return len(buffer), nil
+}
+
+func (this *memoryBlockWriter) Checksum() uint32 {
+	return this.checksum
+}
+
+func (this *memoryBlockWriter) StoredSize() uint64 {
+	return uint64(len(this.data))
+}
+
+func (this *memoryBlockWriter) Close() error {
+	if this.done {
+		return errMemoryWriterDone
+	}
+
+	this.done = true
+	this.storage.commit(this.blockId, &memoryBlock{
+		data:       this.data,
+		checksum:   this.checksum,
+		references: 1,
+		modTime:    time.Now(),
+	})
+
+	return nil
+}
+
+func (this *memoryBlockWriter) Abort() error {
+	this.done = true
+	this.data = nil
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package blockservice
+
+import (
+	"bfs/block"
+	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+	data := []byte("0123456789")
+
+	writer, err := storage.OpenWrite("1", nil, nil, block.SyncNone)
+	require.NoError(t, err)
+	_, err = writer.Write(data[:4])
+	require.NoError(t, err)
+	_, err = writer.Write(data[4:])
+	require.NoError(t, err)
+	require.Equal(t, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)), writer.Checksum())
+	require.Equal(t, uint64(len(data)), writer.StoredSize())
+
+	// Blocks aren't visible until committed.
+	_, err = storage.Stat("1")
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, writer.Close())
+	_, err = writer.Write(data)
+	require.Error(t, err)
+
+	info, err := storage.Stat("1")
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), info.Size)
+
+	size, checksum, err := storage.ReadChecksum("1", nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), size)
+	require.Equal(t, writer.Checksum(), checksum)
+
+	for _, tc := range []struct {
+		position uint64
+		length   uint64
+		expected string
+	}{
+		{0, 0, "0123456789"},
+		{3, 0, "3456789"},
+		{3, 4, "3456"},
+		{8, 10, "89"},
+		{20, 0, ""},
+	} {
+		reader, err := storage.OpenRead("1", tc.position, tc.length, nil)
+		require.NoError(t, err)
+		read, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, string(read), "position: %d length: %d", tc.position, tc.length)
+		require.NoError(t, reader.Close())
+	}
+
+	// Aborted writes leave nothing behind.
+	writer, err = storage.OpenWrite("2", nil, nil, block.SyncNone)
+	require.NoError(t, err)
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Abort())
+
+	_, err = storage.OpenRead("2", 0, 0, nil)
+	require.True(t, os.IsNotExist(err))
+
+	var listed []string
+	require.NoError(t, storage.List(func(info *block.BlockInfo) (bool, error) {
+		listed = append(listed, info.BlockId)
+		return true, nil
+	}))
+	require.Equal(t, []string{"1"}, listed)
+
+	references, err := storage.ReadReferences("1")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), references)
+
+	require.NoError(t, storage.WriteReferences("1", 3, true))
+	references, err = storage.ReadReferences("1")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), references)
+
+	require.NoError(t, storage.Delete("1"))
+	_, err = storage.Stat("1")
+	require.True(t, os.IsNotExist(err))
+	_, err = storage.ReadReferences("1")
+	require.True(t, os.IsNotExist(err))
+	require.True(t, os.IsNotExist(storage.Delete("1")))
+}
@@ -1,14 +1,20 @@
 package blockservice
 
 import (
+	"bfs/config"
 	"bfs/util/fsm"
 	"bfs/util/logging"
+	"crypto/sha256"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/pborman/uuid"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"bfs/block"
 )
@@ -18,42 +24,207 @@ import (
  */
 
 const (
-	StateInitial = "INITIAL"
-	StateOpen    = "OPEN"
-	StateClosed  = "CLOSED"
-	StateError   = "ERROR"
+	StateInitial  = "INITIAL"
+	StateOpen     = "OPEN"
+	StateReadOnly = "READ_ONLY"
+	StateDraining = "DRAINING"
+	StateRetired  = "RETIRED"
+	StateClosed   = "CLOSED"
+	StateError    = "ERROR"
 )
 
 var volumeFSM = fsm.New(StateInitial).
 	Allow(StateInitial, StateOpen).
 	Allow(StateInitial, StateError).
+	Allow(StateOpen, StateReadOnly).
+	Allow(StateOpen, StateDraining).
+	Allow(StateOpen, StateRetired).
 	Allow(StateOpen, StateClosed).
 	Allow(StateOpen, StateError).
+	Allow(StateReadOnly, StateOpen).
+	Allow(StateReadOnly, StateDraining).
+	Allow(StateReadOnly, StateRetired).
+	Allow(StateReadOnly, StateClosed).
+	Allow(StateReadOnly, StateError).
+	Allow(StateDraining, StateOpen).
+	Allow(StateDraining, StateReadOnly).
+	Allow(StateDraining, StateRetired).
+	Allow(StateDraining, StateClosed).
+	Allow(StateDraining, StateError).
+	Allow(StateRetired, StateOpen).
+	Allow(StateRetired, StateReadOnly).
+	Allow(StateRetired, StateDraining).
+	Allow(StateRetired, StateClosed).
+	Allow(StateRetired, StateError).
 	Allow(StateError, StateClosed)
 
+const (
+	// The directory in the volume root to which orphaned temp files are moved under ORPHAN_QUARANTINE.
+	QuarantineDir = "quarantine"
+)
+
 type PhysicalVolume struct {
-	ID       uuid.UUID
+	ID uuid.UUID
+
+	// Where the volume keeps its blocks. Volumes on local disk get a LocalStorage under RootPath when opened.
+	Storage VolumeStorage
+
+	// The directory holding a volume on local disk, or empty for volumes kept elsewhere.
 	RootPath string
 
-	fsm *fsm.FSMInstance
+	// The on-disk layout version of block files. See LayoutFlat and LayoutFanOut.
+	Layout int
+
+	// What to do with temp files left behind by incomplete writes. Set before Open().
+	OrphanPolicy config.OrphanPolicy
+
+	// How much of each block write reaches stable storage before it is acknowledged.
+	Durability config.Durability
+
+	// The keys used to encrypt new blocks and decrypt existing ones, or nil if the volume is unencrypted. Set before
+	// Open().
+	Keys *block.KeyRing
+
+	// The free space, in bytes, that must remain on the volume's file system for it to accept new blocks. Zero disables
+	// the check.
+	ReservedBytes uint64
+
+	// The maximum number of bytes of block data the volume may hold. Zero is unlimited.
+	MaxBytes uint64
+
+	// The number of bytes of committed block data. Accessed atomically.
+	usedBytes int64
+
+	// The number of consecutive I/O errors. Accessed atomically.
+	ioErrors int64
+
+	// The number of consecutive I/O errors after which the volume makes itself read-only. Zero disables the check.
+	IOErrorThreshold int
+
+	// Orphaned temp files found when the volume was opened.
+	Orphans OrphanStats
+
+	// The I/O the block service has performed on the volume.
+	IO IOStats
+
+	// Bandwidth limits on the block service's reads and writes. Set before Open().
+	Throttle Throttle
+
+	// How long an interrupted block write is kept so it may be resumed. Set before Open().
+	WriteGracePeriod time.Duration
+
+	// Serializes changes to the reference counts of blocks with their creation and removal.
+	refsMut sync.Mutex
+
+	// Blocks being written, and interrupted writes that may be resumed, keyed by block ID.
+	writes    map[string]*volumeWriter
+	writesMut sync.Mutex
+
+	// References to release once they are due. See releases.go.
+	releases    []*pendingRelease
+	releasesMut sync.Mutex
+
+	// Stops the reaper of expired suspended writes and due releases while the volume is open.
+	reaperStop chan struct{}
+	reaperWG   sync.WaitGroup
+
+	// Guards fsm once the volume is open, as its state may be changed while it serves requests.
+	stateMut sync.RWMutex
+	fsm      *fsm.FSMInstance
+
+	// Held for reading while a block is committed, and for writing while the volume closes, so blocks are never
+	// committed to a closed volume.
+	commitMut sync.RWMutex
+}
+
+// A summary of the orphaned temp files handled when a volume is opened.
+type OrphanStats struct {
+	// The number of orphaned files found.
+	Files int
+	// The total size of orphaned files found.
+	Bytes uint64
+	// The number of bytes freed by deleting orphaned files.
+	ReclaimedBytes uint64
+	// The number of orphaned files moved to quarantine.
+	QuarantinedFiles int
 }
 
 func NewPhysicalVolume(rootPath string) *PhysicalVolume {
 	glog.V(logging.LogLevelDebug).Infof("Create physical volume at %v", rootPath)
 
 	return &PhysicalVolume{
-		RootPath: rootPath,
-		fsm:      volumeFSM.NewInstance(),
+		RootPath:         rootPath,
+		IOErrorThreshold: DefaultIOErrorThreshold,
+		WriteGracePeriod: DefaultWriteGracePeriod,
+		writes:           make(map[string]*volumeWriter),
+		fsm:              volumeFSM.NewInstance(),
 	}
 }
 
-func (this *PhysicalVolume) Open(allowInitialization bool) error {
-	glog.Infof("Open physical volume at %v", this.RootPath)
+// Create a volume that keeps its blocks in memory. It is given a new ID each time it is opened, as its blocks do not
+// outlive it.
+func NewMemoryPhysicalVolume() *PhysicalVolume {
+	glog.V(logging.LogLevelDebug).Infof("Create in-memory physical volume")
 
+	return &PhysicalVolume{
+		Storage:          NewMemoryStorage(),
+		IOErrorThreshold: DefaultIOErrorThreshold,
+		WriteGracePeriod: DefaultWriteGracePeriod,
+		writes:           make(map[string]*volumeWriter),
+		fsm:              volumeFSM.NewInstance(),
+	}
+}
+
+func (this *PhysicalVolume) Open(allowInitialization bool) error {
 	if err := this.fsm.Is(StateInitial); err != nil {
 		return err
 	}
 
+	if this.Storage == nil {
+		if err := this.openLocal(allowInitialization); err != nil {
+			return err
+		}
+	} else {
+		this.ID = uuid.NewRandom()
+	}
+
+	if err := this.loadUsage(); err != nil {
+		this.fsm.To(StateError)
+		return err
+	}
+
+	if err := this.loadReleases(); err != nil {
+		this.fsm.To(StateError)
+		return err
+	}
+
+	glog.Infof("Opened physical volume %s at %s", this.ID, this.location())
+
+	this.stateMut.Lock()
+	defer this.stateMut.Unlock()
+
+	if err := this.fsm.To(StateOpen); err != nil {
+		return err
+	}
+
+	this.startReaper()
+
+	return nil
+}
+
+// Returns where the volume keeps its blocks, for logging.
+func (this *PhysicalVolume) location() string {
+	if _, ok := this.Storage.(*MemoryStorage); ok {
+		return "memory"
+	}
+
+	return this.RootPath
+}
+
+// Open a volume on local disk, initializing it if allowed, and migrating it to the current layout.
+func (this *PhysicalVolume) openLocal(allowInitialization bool) error {
+	glog.Infof("Open physical volume at %v", this.RootPath)
+
 	idPath := filepath.Join(this.RootPath, "id")
 
 	if info, err := os.Stat(idPath); err == nil {
@@ -68,6 +239,11 @@ func (this *PhysicalVolume) Open(allowInitialization bool) error {
 			glog.Infof("Volume path created at %v", this.RootPath)
 		}
 
+		if err := this.initializeLayout(); err != nil {
+			this.fsm.To(StateError)
+			return err
+		}
+
 		id := uuid.NewRandom()
 		if err := ioutil.WriteFile(idPath, id, 0644); err != nil {
 			this.fsm.To(StateError)
@@ -88,43 +264,289 @@ func (this *PhysicalVolume) Open(allowInitialization bool) error {
 
 	this.ID = id
 
-	glog.Infof("Opened physical volume %s at %s", this.ID, this.RootPath)
+	if this.Layout, err = readLayout(this.RootPath); err != nil {
+		this.fsm.To(StateError)
+		return err
+	}
+
+	if this.Layout > CurrentLayout {
+		this.fsm.To(StateError)
+		return fmt.Errorf("Unable to open volume %s - unsupported layout version %d", this.ID, this.Layout)
+	}
+
+	if err := this.cleanOrphans(); err != nil {
+		glog.Errorf("Unable to clean up orphaned temp files on volume %s - %v", this.ID, err)
+	}
+
+	if this.Layout < CurrentLayout {
+		if err := this.migrateLayout(); err != nil {
+			this.fsm.To(StateError)
+			return fmt.Errorf("Unable to migrate volume %s to layout %d - %v", this.ID, CurrentLayout, err)
+		}
+	}
+
+	this.Storage = &LocalStorage{RootPath: this.RootPath, Layout: this.Layout}
 
-	return this.fsm.To(StateOpen)
+	return nil
 }
 
+// Handle temp files left behind by writes that never completed, such as those interrupted by a crash, and sidecars
+// left behind by blocks that were never committed or were only partly removed.
+//
+// Each orphan is logged, then deleted or quarantined according to OrphanPolicy. Results are recorded in Orphans.
+func (this *PhysicalVolume) cleanOrphans() error {
+	stats := OrphanStats{}
+	defer func() { this.Orphans = stats }()
+
+	// Check every directory that may hold temp files, including fan-out directories left by an interrupted migration.
+	for _, dir := range append([]string{this.RootPath}, fanOutDirs(this.RootPath)...) {
+		if err := this.cleanOrphansIn(dir, &stats); err != nil {
+			return err
+		}
+	}
+
+	if stats.Files > 0 {
+		glog.Infof("Handled %d orphaned temp files (%d bytes) on volume %s - reclaimed %d bytes, quarantined %d files",
+			stats.Files, stats.Bytes, this.ID, stats.ReclaimedBytes, stats.QuarantinedFiles)
+	}
+
+	return nil
+}
+
+func (this *PhysicalVolume) cleanOrphansIn(dir string, stats *OrphanStats) error {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !(block.IsTempFile(info.Name()) || isVolumeTempFile(info.Name()) ||
+			this.isOrphanedSidecar(info.Name())) {
+			continue
+		}
+
+		path := filepath.Join(dir, info.Name())
+
+		glog.Warningf("Found orphaned temp file %s (%d bytes, modified %s) on volume %s", path, info.Size(),
+			info.ModTime(), this.ID)
+
+		stats.Files++
+		stats.Bytes += uint64(info.Size())
+
+		switch this.OrphanPolicy {
+		case config.OrphanPolicy_ORPHAN_QUARANTINE:
+			quarantinePath := filepath.Join(this.RootPath, QuarantineDir)
+
+			if err := os.MkdirAll(quarantinePath, 0700); err != nil {
+				return err
+			}
+
+			if err := os.Rename(path, filepath.Join(quarantinePath, info.Name())); err != nil {
+				return err
+			}
+
+			stats.QuarantinedFiles++
+		default:
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+
+			stats.ReclaimedBytes += uint64(info.Size())
+		}
+	}
+
+	return nil
+}
+
+// Determine whether a file is a committed checksum or reference count sidecar whose block is gone, as left by a crash
+// part way through committing or removing a block.
+//
+// The block is looked for both in the volume root and in its fan-out directory, as a layout migration may have been
+// interrupted between moving a block and its sidecars.
+func (this *PhysicalVolume) isOrphanedSidecar(name string) bool {
+	blockId, ok := block.SidecarBlockId(name)
+	if !ok {
+		return false
+	}
+
+	for _, path := range []string{
+		filepath.Join(this.RootPath, blockId),
+		filepath.Join(this.RootPath, blockId[:fanOutPrefixLength], blockId),
+	} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Determine whether a file name is that of a temp file for volume metadata, such as scrubber state.
+func isVolumeTempFile(name string) bool {
+	return strings.HasPrefix(name, "."+scrubStateFile+"-") || strings.HasPrefix(name, "."+layoutFile+"-") ||
+		strings.HasPrefix(name, "."+releasesFile+"-")
+}
+
+// Close the volume. Commits in progress finish first; writes still in progress then fail, and their data is discarded.
 func (this *PhysicalVolume) Close() error {
-	glog.Infof("Close physical volume at %v", this.RootPath)
+	glog.Infof("Close physical volume %s at %v", this.ID, this.location())
+
+	this.commitMut.Lock()
+	defer this.commitMut.Unlock()
+
+	// The reaper checks the volume's state as it releases blocks, so it's stopped first.
+	this.stopReaper()
+
+	this.stateMut.Lock()
+	defer this.stateMut.Unlock()
 
-	if err := this.fsm.IsOneOf(StateOpen, StateError); err != nil {
+	if err := this.fsm.IsOneOf(StateOpen, StateReadOnly, StateDraining, StateRetired, StateError); err != nil {
 		return err
 	}
 
+	// Suspended writes can't be resumed once the volume is closed.
+	this.writesMut.Lock()
+	for _, writer := range this.writes {
+		if !writer.active {
+			this.abortWrite(writer)
+		}
+	}
+	this.writesMut.Unlock()
+
 	return this.fsm.To(StateClosed)
 }
 
 func (this *PhysicalVolume) OpenRead(blockId string) (block.BlockReader, error) {
-	if err := this.fsm.Is(StateOpen); err != nil {
+	return this.OpenReadRange(blockId, 0, 0)
+}
+
+// Open a reader over a range of a block.
+//
+// The reader starts at position and returns at most length bytes. A length of zero reads to the end of the block.
+func (this *PhysicalVolume) OpenReadRange(blockId string, position uint64, length uint64) (block.BlockReader, error) {
+	if err := this.checkReadable(); err != nil {
 		return nil, err
 	}
 
-	return block.NewReader(this.RootPath, blockId)
+	reader, err := this.Storage.OpenRead(blockId, position, length, this.Keys)
+	this.recordIOResult(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &volumeReader{BlockReader: reader, volume: this}, nil
 }
 
 func (this *PhysicalVolume) OpenWrite(blockId string) (block.BlockWriter, error) {
-	if err := this.fsm.Is(StateOpen); err != nil {
+	return this.OpenWriteWithCodec(blockId, nil)
+}
+
+// Open a writer for a new block, encoding its data with codec. A nil codec stores data as written.
+//
+// A *VolumeFullError is returned if the volume is out of space, and a *VolumeNotWritableError if it's read-only or
+// draining. Errors satisfying os.IsExist() are returned if the block is already committed, and a *WriteActiveError if
+// another stream is writing it. A suspended write of the block is discarded.
+func (this *PhysicalVolume) OpenWriteWithCodec(blockId string, codec block.Codec) (block.BlockWriter, error) {
+	return this.openWrite(blockId, codec, false)
+}
+
+func (this *PhysicalVolume) openWrite(blockId string, codec block.Codec, dedup bool) (block.BlockWriter, error) {
+	if err := this.checkWritable(); err != nil {
 		return nil, err
 	}
 
-	return block.NewWriter(this.RootPath, blockId)
+	if _, err := this.Storage.Stat(blockId); err == nil && !dedup {
+		return nil, &os.PathError{Op: "open", Path: blockId, Err: os.ErrExist}
+	}
+
+	if err := this.admit(); err != nil {
+		return nil, err
+	}
+
+	var key *block.Key
+	if this.Keys != nil {
+		key = this.Keys.Current()
+	}
+
+	writer, err := this.Storage.OpenWrite(blockId, codec, key, syncMode(this.Durability))
+	this.recordIOResult(err)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeWriter := &volumeWriter{BlockWriter: writer, volume: this, blockId: blockId}
+
+	if dedup {
+		volumeWriter.digest = sha256.New()
+	}
+
+	if err := this.startWrite(volumeWriter); err != nil {
+		writer.Abort()
+		return nil, err
+	}
+
+	return volumeWriter, nil
 }
 
-func (this *PhysicalVolume) Delete(blockId string) error {
-	if err := this.fsm.Is(StateOpen); err != nil {
+func syncMode(durability config.Durability) block.SyncMode {
+	switch durability {
+	case config.Durability_DURABILITY_FSYNC_FILE:
+		return block.SyncFile
+	case config.Durability_DURABILITY_FSYNC_FILE_AND_DIR:
+		return block.SyncFileAndDir
+	default:
+		return block.SyncNone
+	}
+}
+
+// Describe a committed block on the volume.
+func (this *PhysicalVolume) Stat(blockId string) (*block.BlockInfo, error) {
+	if err := this.checkReadable(); err != nil {
+		return nil, err
+	}
+
+	return this.Storage.Stat(blockId)
+}
+
+// Visit every committed block on the volume, in no particular order.
+//
+// Temp files of in-progress writes, checksum sidecars, and volume metadata files are not included.
+func (this *PhysicalVolume) List(visitor func(info *block.BlockInfo) (bool, error)) error {
+	if err := this.checkReadable(); err != nil {
 		return err
 	}
 
-	path := filepath.Join(this.RootPath, blockId)
+	return this.list(visitor)
+}
+
+func (this *PhysicalVolume) list(visitor func(info *block.BlockInfo) (bool, error)) error {
+	return this.Storage.List(visitor)
+}
+
+// List the IDs of all committed blocks on the volume, in sorted order.
+func (this *PhysicalVolume) BlockIds() ([]string, error) {
+	blockIds := make([]string, 0, 1024)
+
+	err := this.List(func(info *block.BlockInfo) (bool, error) {
+		blockIds = append(blockIds, info.BlockId)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(blockIds)
 
-	return os.Remove(path)
+	return blockIds, nil
+}
+
+// Remove a block from the volume.
+//
+// Blocks with more than one reference only lose a reference; see Release(). Blocks may be deleted from read-only,
+// draining, and retired volumes so files can still be removed and volumes emptied.
+func (this *PhysicalVolume) Delete(blockId string) error {
+	_, err := this.Release(blockId)
+	return err
 }
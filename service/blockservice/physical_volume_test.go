@@ -1,12 +1,21 @@
 package blockservice
 
 import (
+	"bfs/block"
+	"bfs/config"
 	"bfs/test"
+	"bytes"
+	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestPhysicalVolume_Open(t *testing.T) {
@@ -152,3 +161,722 @@ func TestPhysicalVolume_ReaderWriter(t *testing.T) {
 	err = testDir.Destroy()
 	require.NoError(t, err)
 }
+
+func TestPhysicalVolume_Orphans(t *testing.T) {
+	for _, policy := range []config.OrphanPolicy{config.OrphanPolicy_ORPHAN_DELETE, config.OrphanPolicy_ORPHAN_QUARANTINE} {
+		t.Run(policy.String(), func(t *testing.T) {
+			testDir := test.New("build", "test", t.Name())
+			require.NoError(t, testDir.Create())
+			defer testDir.Destroy()
+
+			pv := NewPhysicalVolume(testDir.Path)
+			require.NoError(t, pv.Open(true))
+
+			blockId := uuid.NewRandom().String()
+
+			writer, err := pv.OpenWrite(blockId)
+			require.NoError(t, err)
+			_, err = writer.Write([]byte{1, 2, 3})
+			require.NoError(t, err)
+			require.NoError(t, writer.Close())
+
+			// Simulate a crash part way through another write.
+			orphanWriter, err := pv.OpenWrite(uuid.NewRandom().String())
+			require.NoError(t, err)
+			_, err = orphanWriter.Write(make([]byte, 100))
+			require.NoError(t, err)
+
+			// Simulate a crash part way through removing a block, leaving its sidecars.
+			removedId := uuid.NewRandom().String()
+			removedWriter, err := pv.OpenWrite(removedId)
+			require.NoError(t, err)
+			require.NoError(t, removedWriter.Close())
+			require.NoError(t, block.WriteReferences(filepath.Dir(pv.BlockPath(removedId)), removedId, 2, false))
+			require.NoError(t, os.Remove(pv.BlockPath(removedId)))
+
+			sidecarBytes := int64(0)
+			for _, suffix := range []string{block.ChecksumSuffix, block.RefsSuffix} {
+				info, err := os.Stat(pv.BlockPath(removedId) + suffix)
+				require.NoError(t, err)
+				sidecarBytes += info.Size()
+			}
+
+			unrelatedPath := filepath.Join(testDir.Path, ".unrelated")
+			require.NoError(t, ioutil.WriteFile(unrelatedPath, []byte{0}, 0644))
+
+			require.NoError(t, pv.Close())
+
+			pv = NewPhysicalVolume(testDir.Path)
+			pv.OrphanPolicy = policy
+			require.NoError(t, pv.Open(false))
+			defer pv.Close()
+
+			require.Equal(t, 3, pv.Orphans.Files)
+			require.EqualValues(t, 100+sidecarBytes, pv.Orphans.Bytes)
+
+			if policy == config.OrphanPolicy_ORPHAN_QUARANTINE {
+				require.Zero(t, pv.Orphans.ReclaimedBytes)
+				require.Equal(t, 3, pv.Orphans.QuarantinedFiles)
+
+				quarantined, err := ioutil.ReadDir(filepath.Join(testDir.Path, QuarantineDir))
+				require.NoError(t, err)
+				require.Len(t, quarantined, 3)
+			} else {
+				require.EqualValues(t, 100+sidecarBytes, pv.Orphans.ReclaimedBytes)
+				require.Zero(t, pv.Orphans.QuarantinedFiles)
+			}
+
+			for _, dir := range append([]string{testDir.Path}, fanOutDirs(testDir.Path)...) {
+				infos, err := ioutil.ReadDir(dir)
+				require.NoError(t, err)
+				for _, info := range infos {
+					require.False(t, block.IsTempFile(info.Name()), "temp file %s remains", info.Name())
+					require.False(t, strings.HasPrefix(info.Name(), removedId), "sidecar %s remains", info.Name())
+				}
+			}
+
+			// Committed blocks, their sidecars, and unrelated files are untouched.
+			_, err = pv.Stat(blockId)
+			require.NoError(t, err)
+			_, err = os.Stat(pv.BlockPath(blockId) + block.ChecksumSuffix)
+			require.NoError(t, err)
+			_, err = os.Stat(unrelatedPath)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestPhysicalVolume_Layout(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	require.Equal(t, CurrentLayout, pv.Layout)
+
+	layout, err := ioutil.ReadFile(filepath.Join(testDir.Path, layoutFile))
+	require.NoError(t, err)
+	require.Equal(t, "1\n", string(layout))
+
+	blockId := uuid.NewRandom().String()
+
+	writer, err := pv.OpenWrite(blockId)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	require.Equal(t, filepath.Join(testDir.Path, blockId[:2], blockId), pv.BlockPath(blockId))
+	_, err = os.Stat(pv.BlockPath(blockId))
+	require.NoError(t, err)
+
+	blockIds, err := pv.BlockIds()
+	require.NoError(t, err)
+	require.Equal(t, []string{blockId}, blockIds)
+}
+
+func TestPhysicalVolume_MigrateLayout(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	// Build a volume as written before layouts were versioned, with blocks directly in the root.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(testDir.Path, "id"), uuid.NewRandom(), 0644))
+
+	blockIds := make([]string, 10)
+	for i := range blockIds {
+		blockIds[i] = uuid.NewRandom().String()
+
+		writer, err := block.NewWriter(testDir.Path, blockIds[i])
+		require.NoError(t, err)
+		_, err = writer.Write(bytes.Repeat([]byte{byte(i)}, 100))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	}
+
+	sort.Strings(blockIds)
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(false))
+	defer pv.Close()
+
+	require.Equal(t, CurrentLayout, pv.Layout)
+
+	layout, err := readLayout(testDir.Path)
+	require.NoError(t, err)
+	require.Equal(t, CurrentLayout, layout)
+
+	migratedIds, err := pv.BlockIds()
+	require.NoError(t, err)
+	require.Equal(t, blockIds, migratedIds)
+
+	for i, blockId := range blockIds {
+		_, err := os.Stat(filepath.Join(testDir.Path, blockId))
+		require.True(t, os.IsNotExist(err))
+
+		reader, err := pv.OpenRead(blockId)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+
+		// Checksums moved along with the data; the reader verifies them.
+		require.Len(t, data, 100)
+		_, err = os.Stat(filepath.Join(testDir.Path, blockId[:2], blockId+block.ChecksumSuffix))
+		require.NoError(t, err, "block %d", i)
+	}
+}
+
+func TestPhysicalVolume_UnsupportedLayout(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(testDir.Path, "id"), uuid.NewRandom(), 0644))
+	require.NoError(t, writeLayout(testDir.Path, CurrentLayout+1))
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.Error(t, pv.Open(false))
+}
+
+func TestPhysicalVolume_Encryption(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	key1, err := block.NewKey("k1", bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	key2, err := block.NewKey("k2", bytes.Repeat([]byte{2}, 32))
+	require.NoError(t, err)
+
+	writeBlock := func(pv *PhysicalVolume) string {
+		blockId := uuid.NewRandom().String()
+
+		writer, err := pv.OpenWrite(blockId)
+		require.NoError(t, err)
+		_, err = writer.Write([]byte("top secret"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		return blockId
+	}
+
+	readBlock := func(pv *PhysicalVolume, blockId string) string {
+		reader, err := pv.OpenRead(blockId)
+		require.NoError(t, err)
+		defer reader.Close()
+
+		data, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+
+		return string(data)
+	}
+
+	pv := NewPhysicalVolume(testDir.Path)
+	pv.Keys, err = block.NewKeyRing(key1)
+	require.NoError(t, err)
+	require.NoError(t, pv.Open(true))
+
+	oldBlockId := writeBlock(pv)
+
+	stored, err := ioutil.ReadFile(pv.BlockPath(oldBlockId))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(stored, []byte("top secret")))
+	require.Equal(t, "top secret", readBlock(pv, oldBlockId))
+
+	require.NoError(t, pv.Close())
+
+	// After rotation, new blocks use the new key and old blocks remain readable.
+	pv = NewPhysicalVolume(testDir.Path)
+	pv.Keys, err = block.NewKeyRing(key1, key2)
+	require.NoError(t, err)
+	require.NoError(t, pv.Open(false))
+	defer pv.Close()
+
+	newBlockId := writeBlock(pv)
+
+	require.Equal(t, "top secret", readBlock(pv, oldBlockId))
+	require.Equal(t, "top secret", readBlock(pv, newBlockId))
+}
+
+func TestPhysicalVolume_Admission(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	pv.MaxBytes = 250
+	require.NoError(t, pv.Open(true))
+
+	writeBlock := func(writer block.BlockWriter) {
+		_, err := writer.Write(make([]byte, 100))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	}
+
+	blockIds := make([]string, 0, 3)
+
+	for i := 0; i < 2; i++ {
+		blockIds = append(blockIds, uuid.NewRandom().String())
+
+		writer, err := pv.OpenWrite(blockIds[i])
+		require.NoError(t, err)
+		writeBlock(writer)
+	}
+
+	// A block admitted while under quota may finish even though it takes the volume over.
+	blockIds = append(blockIds, uuid.NewRandom().String())
+	inFlight, err := pv.OpenWrite(blockIds[2])
+	require.NoError(t, err)
+	writeBlock(inFlight)
+	require.EqualValues(t, 300, pv.UsedBytes())
+
+	_, err = pv.OpenWrite(uuid.NewRandom().String())
+	require.Error(t, err)
+	require.True(t, IsVolumeFull(err))
+
+	// Deleting blocks frees quota.
+	require.NoError(t, pv.Delete(blockIds[0]))
+	require.EqualValues(t, 200, pv.UsedBytes())
+
+	writer, err := pv.OpenWrite(uuid.NewRandom().String())
+	require.NoError(t, err)
+	writeBlock(writer)
+
+	require.NoError(t, pv.Close())
+
+	// Usage is recomputed when a volume is opened.
+	pv = NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(false))
+	defer pv.Close()
+
+	require.EqualValues(t, 300, pv.UsedBytes())
+
+	// A reservation larger than the file system leaves no room for new blocks.
+	pv.ReservedBytes = 1 << 62
+
+	_, err = pv.OpenWrite(uuid.NewRandom().String())
+	require.True(t, IsVolumeFull(err))
+}
+
+func TestPhysicalVolume_State(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.Error(t, pv.SetState(StateReadOnly))
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	require.Equal(t, StateOpen, pv.State())
+
+	blockIds := make([]string, 2)
+	for i := range blockIds {
+		blockIds[i] = uuid.NewRandom().String()
+
+		writer, err := pv.OpenWrite(blockIds[i])
+		require.NoError(t, err)
+		_, err = writer.Write([]byte("data"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	}
+
+	require.Error(t, pv.SetState(StateClosed))
+	require.Error(t, pv.SetState("BOGUS"))
+
+	for _, state := range []string{StateReadOnly, StateDraining} {
+		require.NoError(t, pv.SetState(state))
+		require.NoError(t, pv.SetState(state))
+		require.Equal(t, state, pv.State())
+
+		// Existing blocks can be read but no new blocks are accepted.
+		_, err := pv.OpenWrite(uuid.NewRandom().String())
+		require.True(t, IsVolumeNotWritable(err))
+		require.False(t, IsVolumeFull(err))
+
+		reader, err := pv.OpenRead(blockIds[0])
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, "data", string(data))
+
+		ids, err := pv.BlockIds()
+		require.NoError(t, err)
+		require.Len(t, ids, 2)
+	}
+
+	// Blocks can be deleted from a draining volume.
+	require.NoError(t, pv.Delete(blockIds[1]))
+
+	require.NoError(t, pv.SetState(StateOpen))
+
+	writer, err := pv.OpenWrite(uuid.NewRandom().String())
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+}
+
+func TestPhysicalVolume_IOErrors(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	pv.IOErrorThreshold = 3
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	ioErr := &os.PathError{Op: "write", Path: pv.RootPath, Err: syscall.EIO}
+
+	// Errors that don't indicate a failing device and successes don't count.
+	pv.recordIOResult(ioErr)
+	pv.recordIOResult(ioErr)
+	pv.recordIOResult(&os.PathError{Op: "open", Path: pv.RootPath, Err: syscall.ENOENT})
+	pv.recordIOResult(&block.CorruptBlockError{})
+	require.Equal(t, StateOpen, pv.State())
+
+	pv.recordIOResult(nil)
+	pv.recordIOResult(ioErr)
+	pv.recordIOResult(ioErr)
+	require.Equal(t, StateOpen, pv.State())
+
+	pv.recordIOResult(ioErr)
+	require.Equal(t, StateReadOnly, pv.State())
+
+	_, err := pv.OpenWrite(uuid.NewRandom().String())
+	require.True(t, IsVolumeNotWritable(err))
+
+	// Reopening the volume clears the error count.
+	require.NoError(t, pv.SetState(StateOpen))
+	pv.recordIOResult(ioErr)
+	require.Equal(t, StateOpen, pv.State())
+
+	// Errors don't change the state of a draining volume.
+	require.NoError(t, pv.SetState(StateDraining))
+	for i := 0; i < 5; i++ {
+		pv.recordIOResult(ioErr)
+	}
+	require.Equal(t, StateDraining, pv.State())
+}
+
+func TestPhysicalVolume_SuspendWrite(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	pv.WriteGracePeriod = 50 * time.Millisecond
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockId := uuid.NewRandom().String()
+
+	writer, err := pv.OpenWrite(blockId)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+
+	// Only one stream may write a block at a time.
+	_, err = pv.OpenWrite(blockId)
+	require.IsType(t, &WriteActiveError{}, err)
+
+	pv.SuspendWrite(writer)
+
+	progress, err := pv.WriteProgress(blockId)
+	require.NoError(t, err)
+	require.Equal(t, WriteState_WRITE_IN_PROGRESS, progress.State)
+	require.Equal(t, uint64(3), progress.Size)
+	require.False(t, progress.Active)
+
+	_, err = pv.ResumeWrite(blockId, 2)
+	require.IsType(t, &WriteOffsetError{}, err)
+
+	writer, err = pv.ResumeWrite(blockId, 3)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte{4, 5})
+	require.NoError(t, err)
+
+	pv.SuspendWrite(writer)
+
+	tempFiles := func() int {
+		infos, err := ioutil.ReadDir(filepath.Dir(pv.BlockPath(blockId)))
+		require.NoError(t, err)
+
+		count := 0
+		for _, info := range infos {
+			if block.IsTempFile(info.Name()) {
+				count++
+			}
+		}
+
+		return count
+	}
+
+	require.Equal(t, 1, tempFiles())
+
+	// Writes that aren't resumed within the grace period are abandoned, even if nothing else happens on the volume.
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, 0, tempFiles())
+
+	progress, err = pv.WriteProgress(blockId)
+	require.NoError(t, err)
+	require.Equal(t, WriteState_WRITE_UNKNOWN, progress.State)
+
+	_, err = pv.ResumeWrite(blockId, 5)
+	require.Equal(t, ErrNoSuchWrite, err)
+}
+
+func TestPhysicalVolume_CloseActiveWrite(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+
+	blockId := uuid.NewRandom().String()
+
+	writer, err := pv.OpenWrite(blockId)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+
+	dedupData := []byte("dedup")
+	dedupWriter, err := pv.OpenDedupWrite(ContentBlockIdOf(dedupData), nil)
+	require.NoError(t, err)
+	_, err = dedupWriter.Write(dedupData)
+	require.NoError(t, err)
+
+	require.NoError(t, pv.Close())
+
+	// Writes still in progress when the volume closed fail, leaving nothing behind.
+	_, err = writer.Write([]byte{4, 5})
+	require.Error(t, err)
+	require.Error(t, writer.Close())
+	require.Error(t, dedupWriter.Close())
+
+	for _, blockId := range []string{blockId, ContentBlockIdOf(dedupData)} {
+		_, err = os.Stat(pv.BlockPath(blockId))
+		require.True(t, os.IsNotExist(err))
+
+		infos, err := ioutil.ReadDir(filepath.Dir(pv.BlockPath(blockId)))
+		require.NoError(t, err)
+		for _, info := range infos {
+			require.False(t, block.IsTempFile(info.Name()), "temp file %s remains", info.Name())
+		}
+	}
+}
+
+func TestPhysicalVolume_Dedup(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	data := []byte("nightly snapshot")
+	blockId := ContentBlockIdOf(data)
+
+	writeDedup := func(blockId string) (*volumeWriter, error) {
+		writer, err := pv.OpenDedupWrite(blockId, nil)
+		require.NoError(t, err)
+		_, err = writer.Write(data)
+		require.NoError(t, err)
+
+		return writer.(*volumeWriter), writer.Close()
+	}
+
+	writer, err := writeDedup(blockId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), writer.references)
+
+	// Writing the block again adds a reference rather than a copy.
+	writer, err = writeDedup(blockId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), writer.references)
+	require.Equal(t, uint64(len(data)), writer.StoredSize())
+	require.Equal(t, uint64(len(data)), pv.UsedBytes())
+
+	reference, err := pv.Reference(blockId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), reference.References)
+	require.Equal(t, uint64(len(data)), reference.Size)
+	require.Equal(t, writer.Checksum(), reference.Checksum)
+
+	blockIds, err := pv.BlockIds()
+	require.NoError(t, err)
+	require.Equal(t, []string{blockId}, blockIds)
+
+	// Data must have the ID of its content.
+	_, err = writeDedup(uuid.NewRandom().String())
+	require.IsType(t, &ContentMismatchError{}, err)
+
+	_, err = pv.Reference(uuid.NewRandom().String())
+	require.True(t, os.IsNotExist(err))
+
+	// The block is only removed with its last reference.
+	for expected := uint64(2); expected > 0; expected-- {
+		references, err := pv.Release(blockId)
+		require.NoError(t, err)
+		require.Equal(t, expected, references)
+
+		_, err = pv.Stat(blockId)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, pv.Delete(blockId))
+
+	_, err = pv.Stat(blockId)
+	require.True(t, os.IsNotExist(err))
+	require.Zero(t, pv.UsedBytes())
+
+	infos, err := ioutil.ReadDir(filepath.Dir(pv.BlockPath(blockId)))
+	require.NoError(t, err)
+	require.Empty(t, infos)
+
+	// A reference count left by an interrupted removal is not inherited when the content is written again.
+	require.NoError(t, block.WriteReferences(filepath.Dir(pv.BlockPath(blockId)), blockId, 5, false))
+
+	writer, err = writeDedup(blockId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), writer.references)
+
+	references, err := pv.References(blockId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), references)
+
+	references, err = pv.Release(blockId)
+	require.NoError(t, err)
+	require.Zero(t, references)
+
+	_, err = pv.Stat(blockId)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestPhysicalVolume_Memory(t *testing.T) {
+	pv := NewMemoryPhysicalVolume()
+	pv.MaxBytes = 16
+	require.NoError(t, pv.Open(false))
+	require.NotNil(t, pv.ID)
+	require.Empty(t, pv.RootPath)
+
+	data := []byte("scratch data")
+
+	writer, err := pv.OpenWrite("1")
+	require.NoError(t, err)
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.Equal(t, uint64(len(data)), pv.UsedBytes())
+
+	_, err = pv.OpenWrite("1")
+	require.True(t, os.IsExist(err))
+
+	reader, err := pv.OpenReadRange("1", 8, 0)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(read))
+	require.NoError(t, reader.Close())
+
+	progress, err := pv.WriteProgress("1")
+	require.NoError(t, err)
+	require.Equal(t, WriteState_WRITE_COMMITTED, progress.State)
+	require.Equal(t, writer.Checksum(), progress.Checksum)
+
+	// Memory volumes are limited by MaxBytes.
+	writer, err = pv.OpenWrite("2")
+	require.NoError(t, err)
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	_, err = pv.OpenWrite("3")
+	require.IsType(t, &VolumeFullError{}, err)
+
+	require.NoError(t, pv.Delete("2"))
+	pv.MaxBytes = 0
+
+	// Content-addressed blocks are reference counted as on disk.
+	dedupId := ContentBlockIdOf(data)
+	for i := 0; i < 2; i++ {
+		writer, err := pv.OpenDedupWrite(dedupId, nil)
+		require.NoError(t, err)
+		_, err = writer.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	}
+
+	references, err := pv.References(dedupId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), references)
+	require.Equal(t, uint64(2*len(data)), pv.UsedBytes())
+
+	blockIds, err := pv.BlockIds()
+	require.NoError(t, err)
+	require.Len(t, blockIds, 2)
+
+	require.NoError(t, pv.Delete(dedupId))
+	require.NoError(t, pv.Delete(dedupId))
+	require.NoError(t, pv.Delete("1"))
+	require.Zero(t, pv.UsedBytes())
+
+	require.NoError(t, pv.Close())
+
+	// Blocks don't outlive the volume, so it gets a new ID each time it is opened.
+	other := NewMemoryPhysicalVolume()
+	require.NoError(t, other.Open(false))
+	require.NotEqual(t, pv.ID.String(), other.ID.String())
+	require.NoError(t, other.Close())
+}
+
+func TestPhysicalVolume_ConcurrentDedup(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	data := []byte("nightly snapshot")
+	blockId := ContentBlockIdOf(data)
+
+	// Streams writing the same content at once all succeed, and only one copy is kept.
+	writers := make([]block.BlockWriter, 3)
+	for i := range writers {
+		writer, err := pv.OpenDedupWrite(blockId, nil)
+		require.NoError(t, err)
+		_, err = writer.Write(data)
+		require.NoError(t, err)
+
+		writers[i] = writer
+	}
+
+	_, err := pv.OpenWrite(blockId)
+	require.IsType(t, &WriteActiveError{}, err)
+
+	// A stream that breaks alongside another can't be resumed, so its data is dropped.
+	pv.SuspendWrite(writers[2])
+
+	for _, writer := range writers[:2] {
+		require.NoError(t, writer.Close())
+	}
+
+	references, err := pv.References(blockId)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), references)
+	require.Equal(t, uint64(len(data)), pv.UsedBytes())
+
+	infos, err := ioutil.ReadDir(filepath.Dir(pv.BlockPath(blockId)))
+	require.NoError(t, err)
+	for _, info := range infos {
+		require.False(t, block.IsTempFile(info.Name()), "temp file %s remains", info.Name())
+	}
+}
@@ -0,0 +1,174 @@
+package blockservice
+
+import (
+	"bfs/util/logging"
+	"encoding/json"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * Delayed releases.
+ *
+ * A reference to a block may be released after a delay rather than at once, such as when an append replaces the last
+ * block of a file that readers of the old entry may still be reading. Pending releases are persisted to the volume, so
+ * a release is carried out even if the server restarts before it is due, and are released by the volume's reaper once
+ * due.
+ */
+
+const (
+	// The name of the file in the volume root holding pending releases.
+	releasesFile = "releases"
+
+	// How often the reaper looks for releases that are due.
+	releaseInterval = time.Second
+)
+
+// A reference to a block that is to be released.
+type pendingRelease struct {
+	BlockId string `json:"blockId"`
+	// The time (in unix nanoseconds) at which the reference is released.
+	Due int64 `json:"due"`
+}
+
+// Release a reference to a committed block once delay has passed. Blocks the volume doesn't hold return errors
+// satisfying os.IsNotExist().
+func (this *PhysicalVolume) ReleaseAfter(blockId string, delay time.Duration) error {
+	if err := this.checkReadable(); err != nil {
+		return err
+	}
+
+	if _, err := this.Storage.Stat(blockId); err != nil {
+		return err
+	}
+
+	this.releasesMut.Lock()
+	defer this.releasesMut.Unlock()
+
+	releases := append(this.releases, &pendingRelease{BlockId: blockId, Due: time.Now().Add(delay).UnixNano()})
+	if err := this.saveReleases(releases); err != nil {
+		return err
+	}
+
+	this.releases = releases
+
+	glog.V(logging.LogLevelDebug).Infof("Releasing block %s on volume %s in %s", blockId, this.ID, delay)
+
+	return nil
+}
+
+// Release the references that are due.
+//
+// Releases are removed from the volume before they are carried out, so one interrupted by a crash leaves the block
+// with a reference too many rather than releasing it twice. Releases that fail are recorded again to be retried.
+func (this *PhysicalVolume) releaseDue() {
+	this.releasesMut.Lock()
+	defer this.releasesMut.Unlock()
+
+	now := time.Now().UnixNano()
+
+	var due, remaining []*pendingRelease
+	for _, pending := range this.releases {
+		if pending.Due <= now {
+			due = append(due, pending)
+		} else {
+			remaining = append(remaining, pending)
+		}
+	}
+
+	if len(due) == 0 {
+		return
+	}
+
+	if err := this.saveReleases(remaining); err != nil {
+		glog.Errorf("Unable to save pending releases on volume %s - %v", this.ID, err)
+		return
+	}
+
+	this.releases = remaining
+
+	var failed []*pendingRelease
+
+	for _, pending := range due {
+		references, err := this.Release(pending.BlockId)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			glog.Errorf("Unable to release block %s on volume %s - %v", pending.BlockId, this.ID, err)
+			failed = append(failed, pending)
+			continue
+		}
+
+		glog.V(logging.LogLevelDebug).Infof("Released block %s on volume %s - %d references", pending.BlockId,
+			this.ID, references)
+	}
+
+	// Failed releases are tried again, unless the volume can't record them.
+	if len(failed) > 0 {
+		releases := append(this.releases, failed...)
+		if err := this.saveReleases(releases); err != nil {
+			glog.Errorf("Unable to save pending releases on volume %s - %v", this.ID, err)
+			return
+		}
+
+		this.releases = releases
+	}
+}
+
+// Read the volume's pending releases.
+func (this *PhysicalVolume) loadReleases() error {
+	if this.RootPath == "" {
+		return nil
+	}
+
+	value, err := ioutil.ReadFile(filepath.Join(this.RootPath, releasesFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	this.releasesMut.Lock()
+	defer this.releasesMut.Unlock()
+
+	return json.Unmarshal(value, &this.releases)
+}
+
+// Persist pending releases to the volume. Memory volumes keep them only in memory. Called with releasesMut held.
+func (this *PhysicalVolume) saveReleases(releases []*pendingRelease) error {
+	if this.RootPath == "" {
+		return nil
+	}
+
+	value, err := json.Marshal(releases)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(this.RootPath, "."+releasesFile+"-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(value); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), filepath.Join(this.RootPath, releasesFile))
+}
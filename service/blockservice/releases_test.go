@@ -0,0 +1,74 @@
+package blockservice
+
+import (
+	"bfs/test"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPhysicalVolume_ReleaseAfter(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+
+	blockId := uuid.NewRandom().String()
+
+	writer, err := pv.OpenWrite(blockId)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("released later"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	_, err = pv.Reference(blockId)
+	require.NoError(t, err)
+
+	// Only blocks the volume holds can be released.
+	err = pv.ReleaseAfter(uuid.NewRandom().String(), time.Millisecond)
+	require.True(t, os.IsNotExist(err), "unexpected error %v", err)
+
+	// A pending release outlives the volume being closed before it's due.
+	require.NoError(t, pv.ReleaseAfter(blockId, 500*time.Millisecond))
+	require.NoError(t, pv.Close())
+
+	pv = NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(false))
+	defer pv.Close()
+
+	references, err := pv.References(blockId)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, references)
+
+	for deadline := time.Now().Add(5 * time.Second); references == 2 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+
+		references, err = pv.References(blockId)
+		require.NoError(t, err)
+	}
+
+	require.EqualValues(t, 1, references)
+
+	// Releasing the last reference removes the block, and the release isn't carried out again.
+	require.NoError(t, pv.ReleaseAfter(blockId, 0))
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if _, err = pv.Stat(blockId); os.IsNotExist(err) {
+			break
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	require.True(t, os.IsNotExist(err), "unexpected error %v", err)
+
+	pv.releaseDue()
+
+	pv.releasesMut.Lock()
+	require.Empty(t, pv.releases)
+	pv.releasesMut.Unlock()
+}
@@ -0,0 +1,364 @@
+package blockservice
+
+import (
+	"bfs/util/bufpool"
+	"bfs/util/logging"
+	"bfs/util/size"
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pborman/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// The amount of block data sent in each write request to the target of a Replicate call.
+	DefaultReplicateChunkSize = 1 * size.MB
+
+	// How long to wait for a connection to the target of a Replicate call.
+	DefaultReplicateDialTimeout = 10 * time.Second
+
+	// The number of connections to Replicate targets kept open while no call is using them.
+	maxIdleReplicateTargets = 16
+)
+
+var replicateCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Connections to the targets of Replicate calls, keyed by endpoint.
+//
+// Calls acquire a connection and release it when done. Connections in use are never closed, so any number of targets
+// may be copied to at once; once released, the most recently used maxIdleReplicateTargets are kept open for later
+// calls and the rest are closed. Connections are dialed without holding the pool's lock, so an unreachable target only
+// delays the calls copying to it.
+type targetPool struct {
+	dial func(ctx context.Context, endpoint string) (*grpc.ClientConn, error)
+
+	targets map[string]*replicateTarget
+	// Targets no call is using, most recently released first.
+	idle   *list.List
+	closed bool
+	mut    sync.Mutex
+}
+
+// A connection to a Replicate target, and the number of calls using it.
+type replicateTarget struct {
+	endpoint string
+	// Closed once the connection is dialed, successfully or not.
+	ready chan struct{}
+	conn  *grpc.ClientConn
+	err   error
+
+	// Guarded by the pool's mut.
+	dialed   bool
+	users    int
+	idleElem *list.Element
+}
+
+func newTargetPool() *targetPool {
+	return &targetPool{
+		dial: func(ctx context.Context, endpoint string) (*grpc.ClientConn, error) {
+			glog.V(logging.LogLevelTrace).Infof("Creating new connection for %s", endpoint)
+
+			ctx, cancel := context.WithTimeout(ctx, DefaultReplicateDialTimeout)
+			defer cancel()
+
+			return grpc.DialContext(ctx, endpoint, grpc.WithBlock(), grpc.WithInsecure())
+		},
+		targets: make(map[string]*replicateTarget),
+		idle:    list.New(),
+	}
+}
+
+// Acquire a connection to endpoint, dialing it if there isn't one. The target must be released once the caller is done
+// with its connection, including when an error is returned.
+func (this *targetPool) acquire(ctx context.Context, endpoint string) (*replicateTarget, error) {
+	this.mut.Lock()
+
+	target, ok := this.targets[endpoint]
+	if !ok {
+		target = &replicateTarget{endpoint: endpoint, ready: make(chan struct{})}
+		this.targets[endpoint] = target
+
+		// Dialed apart from the call, as other calls may share the connection.
+		go this.connect(target)
+	} else if target.idleElem != nil {
+		this.idle.Remove(target.idleElem)
+		target.idleElem = nil
+	}
+
+	target.users++
+
+	this.mut.Unlock()
+
+	select {
+	case <-target.ready:
+		return target, target.err
+	case <-ctx.Done():
+		return target, ctx.Err()
+	}
+}
+
+// Dial a target. Targets that fail to dial are dropped so the next call dials again.
+func (this *targetPool) connect(target *replicateTarget) {
+	conn, err := this.dial(context.Background(), target.endpoint)
+
+	this.mut.Lock()
+
+	target.conn = conn
+	target.err = err
+	target.dialed = true
+	close(target.ready)
+
+	var closing []*replicateTarget
+	if err != nil {
+		this.remove(target)
+	} else if target.users == 0 {
+		// Every call waiting for the connection gave up.
+		closing = this.park(target)
+	}
+
+	this.mut.Unlock()
+
+	this.closeTargets(closing)
+}
+
+// Release a target acquired from the pool.
+func (this *targetPool) release(target *replicateTarget) {
+	this.mut.Lock()
+
+	target.users--
+
+	var closing []*replicateTarget
+	if target.users == 0 && target.dialed && target.err == nil {
+		closing = this.park(target)
+	}
+
+	this.mut.Unlock()
+
+	this.closeTargets(closing)
+}
+
+// Keep a connection no call is using for later calls, returning the connections that should be closed to make room
+// for it. Guarded by mut.
+func (this *targetPool) park(target *replicateTarget) []*replicateTarget {
+	if this.closed {
+		this.remove(target)
+		return []*replicateTarget{target}
+	}
+
+	target.idleElem = this.idle.PushFront(target)
+
+	var closing []*replicateTarget
+	for this.idle.Len() > maxIdleReplicateTargets {
+		evicted := this.idle.Back().Value.(*replicateTarget)
+		this.remove(evicted)
+		closing = append(closing, evicted)
+	}
+
+	return closing
+}
+
+// Remove a target from the pool. Guarded by mut.
+func (this *targetPool) remove(target *replicateTarget) {
+	if this.targets[target.endpoint] == target {
+		delete(this.targets, target.endpoint)
+	}
+
+	if target.idleElem != nil {
+		this.idle.Remove(target.idleElem)
+		target.idleElem = nil
+	}
+}
+
+func (this *targetPool) closeTargets(targets []*replicateTarget) error {
+	var err error
+
+	for _, target := range targets {
+		glog.V(logging.LogLevelTrace).Infof("Destroying connection for %s", target.endpoint)
+
+		if closeErr := target.conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// Close the pool's idle connections. Connections in use are closed when they are released.
+func (this *targetPool) Close() error {
+	this.mut.Lock()
+
+	this.closed = true
+
+	closing := make([]*replicateTarget, 0, this.idle.Len())
+	for this.idle.Len() > 0 {
+		target := this.idle.Front().Value.(*replicateTarget)
+		this.remove(target)
+		closing = append(closing, target)
+	}
+
+	this.mut.Unlock()
+
+	return this.closeTargets(closing)
+}
+
+func (this *BlockService) Replicate(ctx context.Context, request *ReplicateRequest) (*ReplicateResponse, error) {
+	glog.V(logging.LogLevelDebug).Infof("Replicate - volumeId: %s blockId: %s target: %s on %s", request.VolumeId,
+		request.BlockId, request.TargetVolumeId, request.TargetEndpoint)
+
+	volumeId := request.VolumeId
+	pv, ok := this.volume(volumeId)
+	if !ok {
+		return nil, fmt.Errorf("no such volume id '%s'", volumeId)
+	}
+
+	if request.TargetVolumeId == "" || request.TargetEndpoint == "" {
+		return nil, status.Error(codes.InvalidArgument, "a target volume id and endpoint are required")
+	}
+
+	if uuid.Parse(request.BlockId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid block id '%s'", request.BlockId)
+	}
+
+	if _, err := pv.Stat(request.BlockId); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "no such block '%s' on volume '%s'", request.BlockId, volumeId)
+	} else if err != nil {
+		return nil, err
+	}
+
+	reader, err := pv.OpenRead(request.BlockId)
+	if err != nil {
+		return nil, blockError(volumeId, err)
+	}
+
+	defer reader.Close()
+
+	target, err := this.targets.acquire(ctx, request.TargetEndpoint)
+	defer this.targets.release(target)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to connect to %s - %v", request.TargetEndpoint, err)
+	}
+
+	targetClient := NewBlockServiceClient(target.conn)
+
+	// Cancelling the context abandons the copy if it fails part way.
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Copies are throttled as the caller's reads on this volume, and its writes on the target.
+	caller := CallerFrom(ctx)
+	readLimiter := pv.Throttle.reads(caller)
+
+	if caller != "" {
+		writeCtx = WithCaller(writeCtx, caller)
+	}
+
+	writeStream, err := targetClient.Write(writeCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	writeRequest := &WriteRequest{
+		VolumeId: request.TargetVolumeId,
+		BlockId:  request.BlockId,
+		Codec:    request.Codec,
+		Dedup:    request.Dedup,
+	}
+	pooled := bufpool.Get(DefaultReplicateChunkSize)
+	defer bufpool.Put(pooled)
+
+	buffer := pooled.Bytes
+
+	var checksum uint32
+	var totalRead uint64
+
+	for {
+		readLen, err := reader.Read(buffer)
+
+		if readLen > 0 {
+			waited, err := readLimiter.Wait(ctx, readLen)
+			pv.IO.readThrottled(waited)
+
+			if err != nil {
+				return nil, err
+			}
+
+			checksum = crc32.Update(checksum, replicateCrcTable, buffer[:readLen])
+			totalRead += uint64(readLen)
+
+			writeRequest.Buffer = buffer[:readLen]
+
+			if err := writeStream.Send(writeRequest); err != nil {
+				if err == io.EOF {
+					// The target ended the stream. Its status describes why.
+					_, err = writeStream.CloseAndRecv()
+				}
+
+				return nil, err
+			}
+
+			writeRequest = &WriteRequest{}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, blockError(volumeId, err)
+		}
+	}
+
+	// Empty blocks still need a request to create the copy.
+	if writeRequest.VolumeId != "" {
+		if err := writeStream.Send(writeRequest); err != nil {
+			return nil, err
+		}
+	}
+
+	writeResp, err := writeStream.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the copy against the data read, and the data read against what the caller expects.
+	var verifyErr error
+
+	if uint64(writeResp.Size) != totalRead || writeResp.Checksum != checksum {
+		verifyErr = fmt.Errorf("copy of block %s on volume %s has size %d checksum %08x, sent %d bytes checksum %08x",
+			request.BlockId, request.TargetVolumeId, writeResp.Size, writeResp.Checksum, totalRead, checksum)
+	} else if request.HasExpectedChecksum && checksum != request.ExpectedChecksum {
+		verifyErr = fmt.Errorf("block %s on volume %s has checksum %08x, expected %08x", request.BlockId, volumeId,
+			checksum, request.ExpectedChecksum)
+	}
+
+	if verifyErr != nil {
+		glog.Errorf("Replicate failed - %v", verifyErr)
+
+		_, err := targetClient.Delete(ctx, &ReadRequest{VolumeId: writeResp.VolumeId, BlockId: writeResp.BlockId})
+		if err != nil {
+			glog.Errorf("Unable to delete unverified copy of block %s from volume %s - %v", writeResp.BlockId,
+				writeResp.VolumeId, err)
+		}
+
+		return nil, status.Error(codes.DataLoss, verifyErr.Error())
+	}
+
+	glog.V(logging.LogLevelDebug).Infof("Replicate complete - block %s copied to volume %s (%d bytes)",
+		writeResp.BlockId, writeResp.VolumeId, totalRead)
+
+	return &ReplicateResponse{
+		VolumeId:   writeResp.VolumeId,
+		BlockId:    writeResp.BlockId,
+		Size:       totalRead,
+		Checksum:   writeResp.Checksum,
+		StoredSize: writeResp.StoredSize,
+	}, nil
+}
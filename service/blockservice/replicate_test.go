@@ -0,0 +1,87 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"testing"
+	"time"
+)
+
+func TestTargetPool(t *testing.T) {
+	pool := newTargetPool()
+	defer pool.Close()
+
+	unblock := make(chan struct{})
+
+	pool.dial = func(ctx context.Context, endpoint string) (*grpc.ClientConn, error) {
+		if endpoint == "unreachable:1" {
+			<-unblock
+			return nil, errors.New("unreachable")
+		}
+
+		return grpc.Dial(endpoint, grpc.WithInsecure())
+	}
+
+	// Targets in use stay open however many there are.
+	inUse := make([]*replicateTarget, 0, maxIdleReplicateTargets+4)
+	for i := 0; i < maxIdleReplicateTargets+4; i++ {
+		target, err := pool.acquire(context.Background(), fmt.Sprintf("localhost:%d", 10000+i))
+		require.NoError(t, err)
+		require.NotNil(t, target.conn)
+
+		inUse = append(inUse, target)
+	}
+
+	shared, err := pool.acquire(context.Background(), "localhost:10000")
+	require.NoError(t, err)
+	require.Equal(t, inUse[0].conn, shared.conn)
+	pool.release(shared)
+
+	require.Len(t, pool.targets, maxIdleReplicateTargets+4)
+	require.Zero(t, pool.idle.Len())
+
+	// A target being dialed doesn't hold up calls to others.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	slow, err := pool.acquire(ctx, "unreachable:1")
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	start := time.Now()
+	fast, err := pool.acquire(context.Background(), "localhost:20000")
+	require.NoError(t, err)
+	require.True(t, time.Since(start) < time.Second, "waited %s", time.Since(start))
+
+	inUse = append(inUse, fast)
+
+	// Targets that fail to dial are dropped.
+	pool.release(slow)
+	close(unblock)
+
+	for i := 0; i < 100; i++ {
+		pool.mut.Lock()
+		_, ok := pool.targets["unreachable:1"]
+		pool.mut.Unlock()
+
+		if !ok {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.NotContains(t, pool.targets, "unreachable:1")
+
+	// Only the most recently released idle targets are kept.
+	for _, target := range inUse {
+		pool.release(target)
+	}
+
+	require.Len(t, pool.targets, maxIdleReplicateTargets)
+	require.Equal(t, maxIdleReplicateTargets, pool.idle.Len())
+	require.Contains(t, pool.targets, "localhost:20000")
+	require.NotContains(t, pool.targets, "localhost:10000")
+}
@@ -0,0 +1,346 @@
+package blockservice
+
+import (
+	"bfs/block"
+	"bfs/util/bufpool"
+	"bfs/util/logging"
+	"bfs/util/size"
+	"encoding/json"
+	"errors"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// The scrub rate used when a volume does not configure one.
+	DefaultScrubBytesPerSecond = 10 * size.MB
+
+	// The name of the file in the volume root holding scrubber progress.
+	scrubStateFile = "scrub"
+
+	// The amount of data read between rate limiting checks.
+	scrubReadSize = block.ChecksumChunkSize
+)
+
+var errScrubStopped = errors.New("scrubber stopped")
+
+// Scrubber progress, persisted to the volume so a restart resumes an unfinished pass.
+type scrubState struct {
+	// The time (in unix nanoseconds) the current pass started, or zero if no pass is in progress.
+	PassStarted int64 `json:"passStarted"`
+	// The last block verified by the current pass. Blocks are scrubbed in sorted order.
+	LastBlockId string `json:"lastBlockId"`
+	// The time (in unix nanoseconds) the last complete pass finished.
+	LastCompleted int64 `json:"lastCompleted"`
+	// Blocks found to be corrupt.
+	CorruptBlockIds []string `json:"corruptBlockIds"`
+}
+
+// A background process that periodically re-reads and verifies every block on a physical volume.
+//
+// Each pass reads blocks in sorted order at no more than BytesPerSecond, verifying their checksums. Corrupt blocks are
+// retained in a list until they are deleted or verify successfully on a later pass. Progress is persisted to the
+// volume after each block.
+type Scrubber struct {
+	Volume         *PhysicalVolume
+	Interval       time.Duration
+	BytesPerSecond uint64
+
+	state    scrubState
+	stateMut sync.RWMutex
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewScrubber(volume *PhysicalVolume, interval time.Duration, bytesPerSecond uint64) *Scrubber {
+	if bytesPerSecond == 0 {
+		bytesPerSecond = DefaultScrubBytesPerSecond
+	}
+
+	return &Scrubber{
+		Volume:         volume,
+		Interval:       interval,
+		BytesPerSecond: bytesPerSecond,
+		stopChan:       make(chan struct{}),
+	}
+}
+
+func (this *Scrubber) Start() error {
+	glog.Infof("Starting scrubber for volume %s - interval: %s rate: %d bytes/s", this.Volume.ID, this.Interval,
+		this.BytesPerSecond)
+
+	if err := this.loadState(); err != nil {
+		return err
+	}
+
+	this.wg.Add(1)
+	go this.run()
+
+	return nil
+}
+
+func (this *Scrubber) Stop() {
+	glog.Infof("Stopping scrubber for volume %s", this.Volume.ID)
+
+	close(this.stopChan)
+	this.wg.Wait()
+}
+
+// Returns the IDs of blocks found to be corrupt.
+func (this *Scrubber) CorruptBlockIds() []string {
+	this.stateMut.RLock()
+	defer this.stateMut.RUnlock()
+
+	return append([]string(nil), this.state.CorruptBlockIds...)
+}
+
+// Returns the time the last complete pass finished, or the zero time if no pass has completed.
+func (this *Scrubber) LastCompleted() time.Time {
+	this.stateMut.RLock()
+	defer this.stateMut.RUnlock()
+
+	if this.state.LastCompleted == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, this.state.LastCompleted)
+}
+
+func (this *Scrubber) run() {
+	defer this.wg.Done()
+
+	for {
+		this.stateMut.RLock()
+		passStarted := this.state.PassStarted
+		lastCompleted := this.state.LastCompleted
+		this.stateMut.RUnlock()
+
+		// Resume an unfinished pass immediately, otherwise wait out the interval since the last pass.
+		var wait time.Duration
+		if passStarted == 0 && lastCompleted != 0 {
+			wait = this.Interval - time.Since(time.Unix(0, lastCompleted))
+		}
+
+		if wait > 0 {
+			glog.V(logging.LogLevelDebug).Infof("Next scrub of volume %s in %s", this.Volume.ID, wait)
+
+			timer := time.NewTimer(wait)
+
+			select {
+			case <-this.stopChan:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		if err := this.scrub(); err == errScrubStopped {
+			return
+		} else if err != nil {
+			glog.Errorf("Scrub of volume %s failed - %v", this.Volume.ID, err)
+
+			// Avoid spinning on persistent errors.
+			select {
+			case <-this.stopChan:
+				return
+			case <-time.After(time.Minute):
+			}
+		}
+	}
+}
+
+// Perform (or resume) a single pass over all blocks in the volume.
+func (this *Scrubber) scrub() error {
+	this.stateMut.Lock()
+	if this.state.PassStarted == 0 {
+		this.state.PassStarted = time.Now().UnixNano()
+		this.state.LastBlockId = ""
+	}
+	lastBlockId := this.state.LastBlockId
+	this.stateMut.Unlock()
+
+	glog.Infof("Scrubbing volume %s (resuming after: '%s')", this.Volume.ID, lastBlockId)
+
+	blockIds, err := this.Volume.BlockIds()
+	if err != nil {
+		return err
+	}
+
+	start := sort.SearchStrings(blockIds, lastBlockId)
+	if start < len(blockIds) && blockIds[start] == lastBlockId {
+		start++
+	}
+
+	var bytesScrubbed uint64
+	passStart := time.Now()
+
+	for _, blockId := range blockIds[start:] {
+		readLen, err := this.verify(blockId, passStart, bytesScrubbed)
+		bytesScrubbed += readLen
+
+		if err == errScrubStopped {
+			return err
+		}
+
+		this.stateMut.Lock()
+		if corruptErr, ok := err.(*block.CorruptBlockError); ok {
+			glog.Errorf("Scrubber found corrupt block on volume %s - %v", this.Volume.ID, corruptErr)
+			this.state.CorruptBlockIds = addBlockId(this.state.CorruptBlockIds, blockId)
+		} else if err == nil {
+			this.state.CorruptBlockIds = removeBlockId(this.state.CorruptBlockIds, blockId)
+		} else if !os.IsNotExist(err) {
+			glog.Warningf("Scrubber unable to read block %s on volume %s - %v", blockId, this.Volume.ID, err)
+		}
+		this.state.LastBlockId = blockId
+		this.stateMut.Unlock()
+
+		if err := this.saveState(); err != nil {
+			return err
+		}
+	}
+
+	this.stateMut.Lock()
+
+	// Forget corrupt blocks that have since been deleted.
+	corruptBlockIds := this.state.CorruptBlockIds[:0]
+	for _, blockId := range this.state.CorruptBlockIds {
+		if _, err := this.Volume.Storage.Stat(blockId); !os.IsNotExist(err) {
+			corruptBlockIds = append(corruptBlockIds, blockId)
+		}
+	}
+
+	this.state.CorruptBlockIds = corruptBlockIds
+	this.state.PassStarted = 0
+	this.state.LastBlockId = ""
+	this.state.LastCompleted = time.Now().UnixNano()
+	this.stateMut.Unlock()
+
+	glog.Infof("Scrubbed volume %s - %d blocks, %d bytes, %d corrupt", this.Volume.ID, len(blockIds)-start,
+		bytesScrubbed, len(corruptBlockIds))
+
+	return this.saveState()
+}
+
+// Read an entire block, verifying its checksums, without exceeding the configured rate.
+//
+// The rate is enforced over the whole pass; passStart and bytesScrubbed describe the pass so far.
+func (this *Scrubber) verify(blockId string, passStart time.Time, bytesScrubbed uint64) (uint64, error) {
+	reader, err := this.Volume.OpenRead(blockId)
+	if err != nil {
+		return 0, err
+	}
+
+	defer reader.Close()
+
+	pooled := bufpool.Get(scrubReadSize)
+	defer bufpool.Put(pooled)
+
+	buffer := pooled.Bytes
+	var totalRead uint64
+
+	for {
+		readLen, err := reader.Read(buffer)
+		totalRead += uint64(readLen)
+
+		if err == io.EOF {
+			return totalRead, nil
+		} else if err != nil {
+			return totalRead, err
+		}
+
+		// Sleep until the time at which the bytes read so far are allowed by the rate.
+		due := passStart.Add(time.Duration(float64(bytesScrubbed+totalRead) / float64(this.BytesPerSecond) *
+			float64(time.Second)))
+
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+
+			select {
+			case <-this.stopChan:
+				timer.Stop()
+				return totalRead, errScrubStopped
+			case <-timer.C:
+			}
+		} else {
+			select {
+			case <-this.stopChan:
+				return totalRead, errScrubStopped
+			default:
+			}
+		}
+	}
+}
+
+// Volumes kept in memory have no root path; their scrubber progress is not persisted.
+func (this *Scrubber) loadState() error {
+	if this.Volume.RootPath == "" {
+		return nil
+	}
+
+	value, err := ioutil.ReadFile(filepath.Join(this.Volume.RootPath, scrubStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	this.stateMut.Lock()
+	defer this.stateMut.Unlock()
+
+	return json.Unmarshal(value, &this.state)
+}
+
+func (this *Scrubber) saveState() error {
+	this.stateMut.RLock()
+	value, err := json.Marshal(&this.state)
+	this.stateMut.RUnlock()
+
+	if err != nil || this.Volume.RootPath == "" {
+		return err
+	}
+
+	file, err := ioutil.TempFile(this.Volume.RootPath, "."+scrubStateFile+"-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(value); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), filepath.Join(this.Volume.RootPath, scrubStateFile))
+}
+
+func addBlockId(blockIds []string, blockId string) []string {
+	for _, id := range blockIds {
+		if id == blockId {
+			return blockIds
+		}
+	}
+
+	return append(blockIds, blockId)
+}
+
+func removeBlockId(blockIds []string, blockId string) []string {
+	for i, id := range blockIds {
+		if id == blockId {
+			return append(blockIds[:i], blockIds[i+1:]...)
+		}
+	}
+
+	return blockIds
+}
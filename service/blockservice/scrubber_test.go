@@ -0,0 +1,95 @@
+package blockservice
+
+import (
+	"bfs/test"
+	"bfs/util/size"
+	"bytes"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestScrubber(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	blockIds := make([]string, 3)
+
+	for i := range blockIds {
+		blockIds[i] = uuid.NewRandom().String()
+
+		writer, err := pv.OpenWrite(blockIds[i])
+		require.NoError(t, err)
+		_, err = writer.Write(bytes.Repeat([]byte{byte(i)}, size.KB*100))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	}
+
+	sort.Strings(blockIds)
+
+	// Corrupt the second block.
+	f, err := os.OpenFile(pv.BlockPath(blockIds[1]), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, size.KB*80)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	scrubber := NewScrubber(pv, time.Hour, size.GB)
+	require.NoError(t, scrubber.scrub())
+	require.Equal(t, []string{blockIds[1]}, scrubber.CorruptBlockIds())
+	require.False(t, scrubber.LastCompleted().IsZero())
+
+	// State survives a restart.
+	restarted := NewScrubber(pv, time.Hour, size.GB)
+	require.NoError(t, restarted.loadState())
+	require.Equal(t, []string{blockIds[1]}, restarted.CorruptBlockIds())
+	require.Equal(t, scrubber.LastCompleted(), restarted.LastCompleted())
+
+	// An interrupted pass resumes after the last verified block. Only the third block is read, so the corrupt block is
+	// not seen again.
+	restarted.state.PassStarted = time.Now().UnixNano()
+	restarted.state.LastBlockId = blockIds[1]
+	restarted.state.CorruptBlockIds = nil
+	require.NoError(t, restarted.scrub())
+	require.Empty(t, restarted.CorruptBlockIds())
+
+	// Deleted blocks are dropped from the corrupt list.
+	require.NoError(t, scrubber.scrub())
+	require.Equal(t, []string{blockIds[1]}, scrubber.CorruptBlockIds())
+	require.NoError(t, pv.Delete(blockIds[1]))
+	require.NoError(t, scrubber.scrub())
+	require.Empty(t, scrubber.CorruptBlockIds())
+}
+
+func TestScrubber_StartStop(t *testing.T) {
+	testDir := test.New("build", "test", t.Name())
+	require.NoError(t, testDir.Create())
+	defer testDir.Destroy()
+
+	pv := NewPhysicalVolume(testDir.Path)
+	require.NoError(t, pv.Open(true))
+	defer pv.Close()
+
+	writer, err := pv.OpenWrite(uuid.NewRandom().String())
+	require.NoError(t, err)
+	_, err = writer.Write(bytes.Repeat([]byte{1}, size.MB))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	// At this rate a pass takes far longer than the test; Stop() must interrupt it.
+	scrubber := NewScrubber(pv, time.Hour, size.KB)
+	require.NoError(t, scrubber.Start())
+
+	time.Sleep(100 * time.Millisecond)
+	scrubber.Stop()
+
+	require.True(t, scrubber.LastCompleted().IsZero())
+}
@@ -0,0 +1,201 @@
+package blockservice
+
+import (
+	"bfs/block"
+	"fmt"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+/*
+ * Operational volume states.
+ *
+ * An open volume is in one of four states. OPEN volumes accept new blocks. READ_ONLY volumes serve and delete existing
+ * blocks but refuse new ones; volumes enter this state on their own after repeated I/O errors. DRAINING volumes behave
+ * like READ_ONLY volumes and additionally tell clients and operators that their blocks are being moved elsewhere.
+ * RETIRED volumes have been emptied by decommissioning and may be removed from service.
+ */
+
+const (
+	// The number of consecutive I/O errors after which an open volume makes itself read-only.
+	DefaultIOErrorThreshold = 5
+)
+
+// The states an operator may place an open volume in.
+var OperatorStates = []string{StateOpen, StateReadOnly, StateDraining, StateRetired}
+
+// Determine whether a state may be set by an operator.
+func IsOperatorState(state string) bool {
+	for _, operatorState := range OperatorStates {
+		if state == operatorState {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The error returned when a volume refuses a new block because it isn't writable.
+//
+// The block service reports it to clients with codes.FailedPrecondition.
+type VolumeNotWritableError struct {
+	VolumeId string
+	State    string
+}
+
+func (this *VolumeNotWritableError) Error() string {
+	return fmt.Sprintf("volume %s is %s and does not accept new blocks", this.VolumeId, this.State)
+}
+
+// Determine whether an error, local or received from the block service, means a volume refused a block because of its
+// state.
+func IsVolumeNotWritable(err error) bool {
+	if _, ok := err.(*VolumeNotWritableError); ok {
+		return true
+	}
+
+	return status.Code(err) == codes.FailedPrecondition
+}
+
+// Returns the volume's current state.
+func (this *PhysicalVolume) State() string {
+	this.stateMut.RLock()
+	defer this.stateMut.RUnlock()
+
+	return this.fsm.State().(string)
+}
+
+// Move an open volume to OPEN, READ_ONLY, DRAINING, or RETIRED.
+//
+// Setting a volume to its current state does nothing. Opening a volume clears its I/O error count.
+func (this *PhysicalVolume) SetState(state string) error {
+	if !IsOperatorState(state) {
+		return fmt.Errorf("invalid volume state '%s' - must be one of %v", state, OperatorStates)
+	}
+
+	this.stateMut.Lock()
+	defer this.stateMut.Unlock()
+
+	current := this.fsm.State()
+	if current == state {
+		return nil
+	}
+
+	if err := this.fsm.To(state); err != nil {
+		return err
+	}
+
+	if state == StateOpen {
+		atomic.StoreInt64(&this.ioErrors, 0)
+	}
+
+	glog.Infof("Volume %s changed state from %v to %s", this.ID, current, state)
+
+	return nil
+}
+
+// Check that the volume is in one of the given states.
+func (this *PhysicalVolume) checkState(states ...interface{}) error {
+	this.stateMut.RLock()
+	defer this.stateMut.RUnlock()
+
+	return this.fsm.IsOneOf(states...)
+}
+
+// Check that the volume can serve existing blocks.
+func (this *PhysicalVolume) checkReadable() error {
+	return this.checkState(StateOpen, StateReadOnly, StateDraining, StateRetired)
+}
+
+// Check that the volume accepts new blocks.
+func (this *PhysicalVolume) checkWritable() error {
+	this.stateMut.RLock()
+	defer this.stateMut.RUnlock()
+
+	switch state := this.fsm.State(); state {
+	case StateOpen:
+		return nil
+	case StateReadOnly, StateDraining, StateRetired:
+		return &VolumeNotWritableError{VolumeId: this.ID.String(), State: state.(string)}
+	default:
+		return this.fsm.Is(StateOpen)
+	}
+}
+
+// Record the outcome of an I/O operation on the volume.
+//
+// Consecutive I/O errors are counted and any success resets the count. Once the count reaches IOErrorThreshold an open
+// volume makes itself read-only so no new blocks are placed on a failing disk. Errors that don't indicate a device
+// problem, such as missing blocks or checksum mismatches, are ignored.
+//
+// This is called for every chunk read and written, so the volume's state is only locked when it has to change.
+func (this *PhysicalVolume) recordIOResult(err error) {
+	if err == nil {
+		// Avoid writing to the count on every success, as it's shared by every reader and writer of the volume.
+		if atomic.LoadInt64(&this.ioErrors) != 0 {
+			atomic.StoreInt64(&this.ioErrors, 0)
+		}
+
+		return
+	} else if !isIOError(err) {
+		return
+	}
+
+	ioErrors := atomic.AddInt64(&this.ioErrors, 1)
+
+	glog.Errorf("I/O error %d on volume %s - %v", ioErrors, this.ID, err)
+
+	if this.IOErrorThreshold <= 0 || ioErrors < int64(this.IOErrorThreshold) {
+		return
+	}
+
+	this.stateMut.Lock()
+	defer this.stateMut.Unlock()
+
+	if this.fsm.State() == StateOpen {
+		glog.Errorf("Volume %s had %d consecutive I/O errors - making it read-only", this.ID, ioErrors)
+
+		if err := this.fsm.To(StateReadOnly); err != nil {
+			glog.Errorf("Unable to make volume %s read-only - %v", this.ID, err)
+		}
+	}
+}
+
+// Determine whether an error indicates the underlying device failed an operation.
+func isIOError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+
+	switch err {
+	case syscall.EIO, syscall.EROFS, syscall.ENXIO, syscall.ENODEV:
+		return true
+	default:
+		return false
+	}
+}
+
+// A block reader that reports I/O errors to its volume.
+type volumeReader struct {
+	block.BlockReader
+	volume *PhysicalVolume
+}
+
+func (this *volumeReader) Read(buffer []byte) (int, error) {
+	n, err := this.BlockReader.Read(buffer)
+	if err != io.EOF {
+		this.volume.recordIOResult(err)
+	}
+
+	return n, err
+}
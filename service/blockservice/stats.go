@@ -0,0 +1,266 @@
+package blockservice
+
+import (
+	"bfs/config"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * I/O statistics.
+ *
+ * Each volume counts the block reads, writes, and deletes the block service performs on it, and keeps a histogram of
+ * the latency of each read from, and write to, its disk, and of each block commit. Latency is measured per disk call
+ * rather than per request so it reflects the volume rather than the client or the network.
+ */
+
+// The upper bound of each latency histogram bucket. Slower operations are counted in a final bucket.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// A histogram of operation latencies over LatencyBuckets.
+type Histogram struct {
+	mut    sync.Mutex
+	counts []uint64
+	sum    time.Duration
+}
+
+// Record the latency of an operation.
+func (this *Histogram) Observe(latency time.Duration) {
+	bucket := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	if this.counts == nil {
+		this.counts = make([]uint64, len(LatencyBuckets)+1)
+	}
+
+	this.counts[bucket]++
+	this.sum += latency
+}
+
+// Returns the number of operations in each bucket, including the final bucket, and their total latency.
+func (this *Histogram) Snapshot() ([]uint64, time.Duration) {
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	counts := make([]uint64, len(LatencyBuckets)+1)
+	copy(counts, this.counts)
+
+	return counts, this.sum
+}
+
+// Estimate a latency percentile (0 - 100) as the upper bound of the bucket it falls in. Percentiles that fall in the
+// final bucket are reported as the last bound. Returns zero if no operations were recorded.
+func (this *Histogram) Percentile(percentile float64) time.Duration {
+	counts, _ := this.Snapshot()
+
+	var total uint64
+	for _, count := range counts {
+		total += count
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(percentile / 100 * float64(total))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, bound := range LatencyBuckets {
+		seen += counts[i]
+		if seen >= rank {
+			return bound
+		}
+	}
+
+	return LatencyBuckets[len(LatencyBuckets)-1]
+}
+
+func (this *Histogram) toProto() *LatencyHistogram {
+	counts, sum := this.Snapshot()
+
+	bounds := make([]uint64, len(LatencyBuckets))
+	for i, bound := range LatencyBuckets {
+		bounds[i] = micros(bound)
+	}
+
+	return &LatencyHistogram{
+		Bounds: bounds,
+		Counts: counts,
+		Sum:    micros(sum),
+	}
+}
+
+// The I/O served by a volume. Counters are accessed atomically.
+type IOStats struct {
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// The number of block reads, writes, and deletes, and how many failed with an I/O error on the volume's disk.
+	// Requests that fail for other reasons, such as missing blocks, full volumes, or clients going away, are not
+	// counted as failures.
+	Reads        uint64
+	Writes       uint64
+	Deletes      uint64
+	ReadErrors   uint64
+	WriteErrors  uint64
+	DeleteErrors uint64
+
+	// The number of block reads and writes in progress.
+	ActiveReads  int64
+	ActiveWrites int64
+
+	// The total time block reads and writes were slowed by the volume's Throttle.
+	ReadThrottled  time.Duration
+	WriteThrottled time.Duration
+
+	// The latency of each read from, and write to, the volume's disk.
+	ReadLatency  Histogram
+	WriteLatency Histogram
+
+	// The latency of committing each written block, including making it as durable as the volume requires.
+	CommitLatency Histogram
+}
+
+func (this *IOStats) startRead() {
+	atomic.AddInt64(&this.ActiveReads, 1)
+}
+
+// Record a read from disk.
+func (this *IOStats) read(bytes int, latency time.Duration) {
+	atomic.AddUint64(&this.BytesRead, uint64(bytes))
+	this.ReadLatency.Observe(latency)
+}
+
+func (this *IOStats) readThrottled(waited time.Duration) {
+	if waited > 0 {
+		atomic.AddInt64((*int64)(&this.ReadThrottled), int64(waited))
+	}
+}
+
+func (this *IOStats) endRead(err error) {
+	atomic.AddInt64(&this.ActiveReads, -1)
+	atomic.AddUint64(&this.Reads, 1)
+
+	if failed(err) {
+		atomic.AddUint64(&this.ReadErrors, 1)
+	}
+}
+
+func (this *IOStats) startWrite() {
+	atomic.AddInt64(&this.ActiveWrites, 1)
+}
+
+// Record a write to disk.
+func (this *IOStats) write(bytes int, latency time.Duration) {
+	atomic.AddUint64(&this.BytesWritten, uint64(bytes))
+	this.WriteLatency.Observe(latency)
+}
+
+func (this *IOStats) writeThrottled(waited time.Duration) {
+	if waited > 0 {
+		atomic.AddInt64((*int64)(&this.WriteThrottled), int64(waited))
+	}
+}
+
+// Record the commit of a written block.
+func (this *IOStats) commit(latency time.Duration) {
+	this.CommitLatency.Observe(latency)
+}
+
+func (this *IOStats) endWrite(err error) {
+	atomic.AddInt64(&this.ActiveWrites, -1)
+	atomic.AddUint64(&this.Writes, 1)
+
+	if failed(err) {
+		atomic.AddUint64(&this.WriteErrors, 1)
+	}
+}
+
+func (this *IOStats) delete(err error) {
+	atomic.AddUint64(&this.Deletes, 1)
+
+	if failed(err) {
+		atomic.AddUint64(&this.DeleteErrors, 1)
+	}
+}
+
+// Summarize the volume's I/O for its host status.
+func (this *IOStats) Summary() *config.VolumeIOSummary {
+	return &config.VolumeIOSummary{
+		BytesRead:       atomic.LoadUint64(&this.BytesRead),
+		BytesWritten:    atomic.LoadUint64(&this.BytesWritten),
+		Reads:           atomic.LoadUint64(&this.Reads),
+		Writes:          atomic.LoadUint64(&this.Writes),
+		Deletes:         atomic.LoadUint64(&this.Deletes),
+		ReadErrors:      atomic.LoadUint64(&this.ReadErrors),
+		WriteErrors:     atomic.LoadUint64(&this.WriteErrors),
+		DeleteErrors:    atomic.LoadUint64(&this.DeleteErrors),
+		ActiveReads:     atomic.LoadInt64(&this.ActiveReads),
+		ActiveWrites:    atomic.LoadInt64(&this.ActiveWrites),
+		ReadLatencyP50:  micros(this.ReadLatency.Percentile(50)),
+		ReadLatencyP99:  micros(this.ReadLatency.Percentile(99)),
+		WriteLatencyP50: micros(this.WriteLatency.Percentile(50)),
+		WriteLatencyP99: micros(this.WriteLatency.Percentile(99)),
+
+		ReadThrottledMicros:  micros(time.Duration(atomic.LoadInt64((*int64)(&this.ReadThrottled)))),
+		WriteThrottledMicros: micros(time.Duration(atomic.LoadInt64((*int64)(&this.WriteThrottled)))),
+	}
+}
+
+func (this *IOStats) toProto(volumeId string) *VolumeStats {
+	return &VolumeStats{
+		VolumeId:     volumeId,
+		BytesRead:    atomic.LoadUint64(&this.BytesRead),
+		BytesWritten: atomic.LoadUint64(&this.BytesWritten),
+		Reads:        atomic.LoadUint64(&this.Reads),
+		Writes:       atomic.LoadUint64(&this.Writes),
+		Deletes:      atomic.LoadUint64(&this.Deletes),
+		ReadErrors:   atomic.LoadUint64(&this.ReadErrors),
+		WriteErrors:  atomic.LoadUint64(&this.WriteErrors),
+		DeleteErrors: atomic.LoadUint64(&this.DeleteErrors),
+		ActiveReads:  atomic.LoadInt64(&this.ActiveReads),
+		ActiveWrites: atomic.LoadInt64(&this.ActiveWrites),
+		ReadLatency:  this.ReadLatency.toProto(),
+		WriteLatency: this.WriteLatency.toProto(),
+
+		CommitLatency: this.CommitLatency.toProto(),
+	}
+}
+
+// Whether a request failed because the volume's disk failed an operation.
+func failed(err error) bool {
+	return err != nil && isIOError(err)
+}
+
+func micros(d time.Duration) uint64 {
+	return uint64(d / time.Microsecond)
+}
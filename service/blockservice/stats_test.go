@@ -0,0 +1,53 @@
+package blockservice
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHistogram_Percentile(t *testing.T) {
+	var histogram Histogram
+
+	require.Equal(t, time.Duration(0), histogram.Percentile(50))
+
+	for i := 0; i < 98; i++ {
+		histogram.Observe(200 * time.Microsecond)
+	}
+	histogram.Observe(3 * time.Millisecond)
+	histogram.Observe(time.Minute)
+
+	require.Equal(t, 250*time.Microsecond, histogram.Percentile(50))
+	require.Equal(t, 5*time.Millisecond, histogram.Percentile(99))
+	require.Equal(t, 10*time.Second, histogram.Percentile(100))
+
+	counts, total := histogram.Snapshot()
+	require.Equal(t, uint64(98), counts[1])
+	require.Equal(t, uint64(1), counts[len(LatencyBuckets)])
+	require.Equal(t, 98*200*time.Microsecond+3*time.Millisecond+time.Minute, total)
+}
+
+func TestIOStats_Errors(t *testing.T) {
+	var stats IOStats
+
+	// Only I/O errors from the volume's disk count as failures.
+	for _, err := range []error{
+		nil,
+		&os.PathError{Op: "open", Path: "1", Err: os.ErrNotExist},
+		&os.PathError{Op: "write", Path: "1", Err: syscall.ENOSPC},
+		context.Canceled,
+		&os.PathError{Op: "read", Path: "1", Err: syscall.EIO},
+	} {
+		stats.startRead()
+		stats.endRead(err)
+		stats.delete(err)
+	}
+
+	require.Equal(t, uint64(5), stats.Reads)
+	require.Equal(t, uint64(1), stats.ReadErrors)
+	require.Equal(t, uint64(5), stats.Deletes)
+	require.Equal(t, uint64(1), stats.DeleteErrors)
+}
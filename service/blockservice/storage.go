@@ -0,0 +1,161 @@
+package blockservice
+
+import (
+	"bfs/block"
+	"os"
+	"syscall"
+)
+
+/*
+ * Volume storage.
+ *
+ * A physical volume keeps the policy - state, admission, reference counting, resumable writes - and leaves holding
+ * block data to its storage. LocalStorage keeps blocks in files under the volume root and MemoryStorage keeps them in
+ * memory.
+ */
+
+// Where a physical volume keeps its blocks.
+//
+// Each committed block has its data, the logical size and CRC32C recorded when it was written, and a reference count.
+// Errors satisfying os.IsNotExist() are returned for blocks the storage does not hold.
+type VolumeStorage interface {
+	// Open a reader over a range of a committed block. The reader starts at position and returns at most length bytes;
+	// a length of zero reads to the end of the block. Encrypted blocks are decrypted with keys, which may be nil.
+	OpenRead(blockId string, position uint64, length uint64, keys *block.KeyRing) (block.BlockReader, error)
+
+	// Open a writer for a block, encoding its data with codec and encrypting it with key, either of which may be nil.
+	// The block is committed, replacing any block of the same ID, when the writer is closed, and discarded if it is
+	// aborted.
+	OpenWrite(blockId string, codec block.Codec, key *block.Key, sync block.SyncMode) (block.BlockWriter, error)
+
+	// Describe a committed block.
+	Stat(blockId string) (*block.BlockInfo, error)
+
+	// Visit every committed block, in no particular order, until visitor returns false or an error.
+	List(visitor func(info *block.BlockInfo) (bool, error)) error
+
+	// Remove a committed block with its checksums and reference count.
+	Delete(blockId string) error
+
+	// Returns the logical size and CRC32C of a committed block, as recorded when it was written. The checksums of
+	// encrypted blocks are opened with keys. Blocks written before checksums were recorded return errors satisfying
+	// os.IsNotExist().
+	ReadChecksum(blockId string, keys *block.KeyRing) (uint64, uint32, error)
+
+	// Returns the number of references to a committed block. Blocks are committed with a single reference.
+	ReadReferences(blockId string) (uint64, error)
+
+	// Record the number of references to a committed block, flushing it to stable storage if sync is set.
+	WriteReferences(blockId string, references uint64, sync bool) error
+
+	// Returns the number of bytes available for new blocks.
+	FreeBytes() (uint64, error)
+}
+
+// Volume storage in files under a directory on local disk. See layout.go for how block files are arranged.
+type LocalStorage struct {
+	RootPath string
+
+	// The on-disk layout version of block files. See LayoutFlat and LayoutFanOut.
+	Layout int
+}
+
+func (this *LocalStorage) OpenRead(blockId string, position uint64, length uint64,
+	keys *block.KeyRing) (block.BlockReader, error) {
+
+	return block.NewRangeReaderWithKeys(this.blockDir(blockId), blockId, position, length, keys)
+}
+
+func (this *LocalStorage) OpenWrite(blockId string, codec block.Codec, key *block.Key,
+	sync block.SyncMode) (block.BlockWriter, error) {
+
+	writer, err := block.NewWriter(this.blockDir(blockId), blockId)
+	if err != nil {
+		return nil, err
+	}
+
+	writer.Sync = sync
+	writer.Codec = codec
+	writer.Key = key
+
+	return &localBlockWriter{LocalBlockWriter: writer}, nil
+}
+
+func (this *LocalStorage) Stat(blockId string) (*block.BlockInfo, error) {
+	return block.Stat(this.blockDir(blockId), blockId)
+}
+
+func (this *LocalStorage) List(visitor func(info *block.BlockInfo) (bool, error)) error {
+	for _, dir := range this.blockDirs() {
+		stopped := false
+
+		err := block.List(dir, func(info *block.BlockInfo) (bool, error) {
+			ok, err := visitor(info)
+			stopped = !ok
+			return ok, err
+		})
+		if err != nil {
+			return err
+		} else if stopped {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Remove a committed block. The reference count goes first, so a block whose removal is interrupted is left with its
+// data and a single reference, and checksums go last; sidecars left without a block are removed when the volume is
+// next opened.
+func (this *LocalStorage) Delete(blockId string) error {
+	if _, err := os.Stat(this.BlockPath(blockId)); err != nil {
+		return err
+	}
+
+	if err := block.RemoveReferences(this.blockDir(blockId), blockId); err != nil {
+		return err
+	}
+
+	if err := os.Remove(this.BlockPath(blockId)); err != nil {
+		return err
+	}
+
+	return block.RemoveChecksums(this.blockDir(blockId), blockId)
+}
+
+func (this *LocalStorage) ReadChecksum(blockId string, keys *block.KeyRing) (uint64, uint32, error) {
+	return block.ReadChecksum(this.blockDir(blockId), blockId, keys)
+}
+
+func (this *LocalStorage) ReadReferences(blockId string) (uint64, error) {
+	return block.ReadReferences(this.blockDir(blockId), blockId)
+}
+
+func (this *LocalStorage) WriteReferences(blockId string, references uint64, sync bool) error {
+	return block.WriteReferences(this.blockDir(blockId), blockId, references, sync)
+}
+
+// Returns the number of bytes available to unprivileged users on the file system holding the volume.
+func (this *LocalStorage) FreeBytes() (uint64, error) {
+	fsStat := syscall.Statfs_t{}
+	if err := syscall.Statfs(this.RootPath, &fsStat); err != nil {
+		return 0, err
+	}
+
+	return uint64(fsStat.Bavail) * uint64(fsStat.Bsize), nil
+}
+
+// A block writer that commits blocks with a single reference.
+type localBlockWriter struct {
+	*block.LocalBlockWriter
+}
+
+// Commit the block, first removing any reference count left by an earlier block of the same ID whose removal was
+// interrupted. Content-addressed blocks are written again under the same ID, and would otherwise inherit it.
+func (this *localBlockWriter) Close() error {
+	if err := block.RemoveReferences(this.RootPath, this.BlockId); err != nil {
+		return err
+	}
+
+	return this.LocalBlockWriter.Close()
+}
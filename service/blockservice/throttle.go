@@ -0,0 +1,351 @@
+package blockservice
+
+import (
+	"context"
+	"google.golang.org/grpc/metadata"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * Bandwidth throttling.
+ *
+ * A volume limits the bandwidth of the block reads and writes it serves with token buckets: one for all reads and one
+ * for all writes, and optionally one of each per caller. A bucket holds up to a second of its rate. Before each chunk
+ * a stream takes the chunk's size from its buckets and, if that leaves a bucket in debt, waits for the debt to be
+ * repaid. Streams over budget are therefore slowed rather than rejected, and a busy caller only slows the others once
+ * the volume's own budget is spent.
+ *
+ * Callers that don't identify themselves share a single caller budget, as do callers beyond those a volume tracks.
+ */
+
+const (
+	// The gRPC metadata key with which callers identify themselves to block servers.
+	CallerMetadataKey = "bfs-caller"
+
+	// The name under which unidentified callers share a budget in throttle stats.
+	UnidentifiedCaller = "(unidentified)"
+
+	// The number of callers a volume tracks buckets for. Idle callers are discarded to make room for new ones, and
+	// callers that find no room share the budget of unidentified callers.
+	maxThrottledCallers = 1024
+)
+
+// Identify the caller making requests with a context.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, CallerMetadataKey, caller)
+}
+
+// Returns the identity of the caller making a request, or empty if the caller did not identify itself.
+func CallerFrom(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md[CallerMetadataKey]; len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	return ""
+}
+
+// A token bucket holding up to a second of bandwidth.
+type TokenBucket struct {
+	BytesPerSecond uint64
+
+	mut       sync.Mutex
+	available float64
+	last      time.Time
+
+	// The number of streams waiting now, how many times streams have waited, and for how long in total.
+	waiting int64
+	waits   uint64
+	waited  time.Duration
+}
+
+func NewTokenBucket(bytesPerSecond uint64) *TokenBucket {
+	return &TokenBucket{
+		BytesPerSecond: bytesPerSecond,
+		available:      float64(bytesPerSecond),
+		last:           time.Now(),
+	}
+}
+
+// Add the bandwidth accrued since the bucket was last used. Called with mut held.
+func (this *TokenBucket) refill() {
+	now := time.Now()
+	rate := float64(this.BytesPerSecond)
+
+	this.available += now.Sub(this.last).Seconds() * rate
+	if this.available > rate {
+		this.available = rate
+	}
+
+	this.last = now
+}
+
+// Take n bytes from the bucket, returning how long to wait before they may pass.
+func (this *TokenBucket) reserve(n int) time.Duration {
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	this.refill()
+	this.available -= float64(n)
+
+	if this.available >= 0 {
+		return 0
+	}
+
+	this.waiting++
+	this.waits++
+
+	return time.Duration(-this.available / float64(this.BytesPerSecond) * float64(time.Second))
+}
+
+// Wait until n bytes may pass, returning how long the caller was slowed. The wait ends early with the context's error
+// if the context is done first.
+func (this *TokenBucket) Wait(ctx context.Context, n int) (time.Duration, error) {
+	delay := this.reserve(n)
+	if delay == 0 {
+		return 0, nil
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(delay)
+
+	var err error
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		err = ctx.Err()
+	}
+
+	waited := time.Since(start)
+
+	this.mut.Lock()
+	this.waiting--
+	this.waited += waited
+	this.mut.Unlock()
+
+	return waited, err
+}
+
+// Whether the bucket is full and no streams are waiting for it.
+func (this *TokenBucket) idle() bool {
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	this.refill()
+
+	return this.waiting == 0 && this.available >= float64(this.BytesPerSecond)
+}
+
+func (this *TokenBucket) toProto(caller string, write bool) *BucketStats {
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	this.refill()
+
+	return &BucketStats{
+		Caller:         caller,
+		Write:          write,
+		BytesPerSecond: this.BytesPerSecond,
+		Available:      int64(this.available),
+		Waiting:        this.waiting,
+		Waits:          this.waits,
+		WaitMicros:     micros(this.waited),
+	}
+}
+
+// The token buckets a stream must pass through: the volume's, and its caller's. Either may be nil.
+type limiter struct {
+	volume *TokenBucket
+	caller *TokenBucket
+}
+
+// Wait until n bytes may pass both buckets, returning how long the stream was slowed.
+func (this limiter) Wait(ctx context.Context, n int) (time.Duration, error) {
+	var total time.Duration
+
+	for _, bucket := range []*TokenBucket{this.caller, this.volume} {
+		if bucket == nil || n == 0 {
+			continue
+		}
+
+		waited, err := bucket.Wait(ctx, n)
+		total += waited
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// The bandwidth limits of a volume. Limits are in bytes per second; zero is unlimited. Set limits before the volume
+// serves requests.
+type Throttle struct {
+	ReadBytesPerSecond        uint64
+	WriteBytesPerSecond       uint64
+	CallerReadBytesPerSecond  uint64
+	CallerWriteBytesPerSecond uint64
+
+	// Buckets are created as they are first needed.
+	mut          sync.Mutex
+	read         *TokenBucket
+	write        *TokenBucket
+	callers      map[string]*callerBuckets
+	unidentified *callerBuckets
+}
+
+type callerBuckets struct {
+	read  *TokenBucket
+	write *TokenBucket
+}
+
+// Whether the caller's buckets are at their full budget.
+func (this *callerBuckets) idle() bool {
+	return (this.read == nil || this.read.idle()) && (this.write == nil || this.write.idle())
+}
+
+// Returns the limiter for a caller's reads.
+func (this *Throttle) reads(caller string) limiter {
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	if this.read == nil && this.ReadBytesPerSecond > 0 {
+		this.read = NewTokenBucket(this.ReadBytesPerSecond)
+	}
+
+	limiter := limiter{volume: this.read}
+
+	if buckets := this.callerBuckets(caller); buckets != nil {
+		if buckets.read == nil && this.CallerReadBytesPerSecond > 0 {
+			buckets.read = NewTokenBucket(this.CallerReadBytesPerSecond)
+		}
+
+		limiter.caller = buckets.read
+	}
+
+	return limiter
+}
+
+// Returns the limiter for a caller's writes.
+func (this *Throttle) writes(caller string) limiter {
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	if this.write == nil && this.WriteBytesPerSecond > 0 {
+		this.write = NewTokenBucket(this.WriteBytesPerSecond)
+	}
+
+	limiter := limiter{volume: this.write}
+
+	if buckets := this.callerBuckets(caller); buckets != nil {
+		if buckets.write == nil && this.CallerWriteBytesPerSecond > 0 {
+			buckets.write = NewTokenBucket(this.CallerWriteBytesPerSecond)
+		}
+
+		limiter.caller = buckets.write
+	}
+
+	return limiter
+}
+
+// Find or add a caller's buckets, or return nil if callers aren't limited. Unidentified callers, and callers that
+// don't fit in the callers tracked, share one set of buckets. Called with mut held.
+func (this *Throttle) callerBuckets(caller string) *callerBuckets {
+	if this.CallerReadBytesPerSecond == 0 && this.CallerWriteBytesPerSecond == 0 {
+		return nil
+	}
+
+	if caller == "" || caller == UnidentifiedCaller {
+		return this.unidentifiedBuckets()
+	}
+
+	if buckets, ok := this.callers[caller]; ok {
+		return buckets
+	}
+
+	if this.callers == nil {
+		this.callers = make(map[string]*callerBuckets)
+	}
+
+	// Idle callers are at their full budget, so forgetting them changes nothing.
+	if len(this.callers) >= maxThrottledCallers {
+		for existing, buckets := range this.callers {
+			if buckets.idle() {
+				delete(this.callers, existing)
+			}
+		}
+	}
+
+	// Forgetting busy callers would refill their budgets, so new callers wait for room in the shared buckets instead.
+	if len(this.callers) >= maxThrottledCallers {
+		return this.unidentifiedBuckets()
+	}
+
+	buckets := &callerBuckets{}
+	this.callers[caller] = buckets
+
+	return buckets
+}
+
+// Returns the buckets shared by unidentified callers. Called with mut held.
+func (this *Throttle) unidentifiedBuckets() *callerBuckets {
+	if this.unidentified == nil {
+		this.unidentified = &callerBuckets{}
+	}
+
+	return this.unidentified
+}
+
+func (this *Throttle) toProto() *ThrottleStats {
+	this.mut.Lock()
+	defer this.mut.Unlock()
+
+	stats := &ThrottleStats{
+		ReadBytesPerSecond:        this.ReadBytesPerSecond,
+		WriteBytesPerSecond:       this.WriteBytesPerSecond,
+		CallerReadBytesPerSecond:  this.CallerReadBytesPerSecond,
+		CallerWriteBytesPerSecond: this.CallerWriteBytesPerSecond,
+	}
+
+	if this.read != nil {
+		stats.Buckets = append(stats.Buckets, this.read.toProto("", false))
+	}
+
+	if this.write != nil {
+		stats.Buckets = append(stats.Buckets, this.write.toProto("", true))
+	}
+
+	callers := make([]string, 0, len(this.callers))
+	for caller := range this.callers {
+		callers = append(callers, caller)
+	}
+
+	sort.Strings(callers)
+
+	if this.unidentified != nil {
+		callers = append([]string{UnidentifiedCaller}, callers...)
+	}
+
+	for _, caller := range callers {
+		buckets := this.callers[caller]
+		if caller == UnidentifiedCaller {
+			buckets = this.unidentified
+		}
+
+		if buckets.read != nil {
+			stats.Buckets = append(stats.Buckets, buckets.read.toProto(caller, false))
+		}
+
+		if buckets.write != nil {
+			stats.Buckets = append(stats.Buckets, buckets.write.toProto(caller, true))
+		}
+	}
+
+	return stats
+}
@@ -0,0 +1,97 @@
+package blockservice
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_Wait(t *testing.T) {
+	bucket := NewTokenBucket(100 * 1024)
+
+	// A second's worth of bandwidth passes immediately.
+	waited, err := bucket.Wait(context.Background(), 100*1024)
+	require.NoError(t, err)
+	require.Zero(t, waited)
+
+	// More must wait for the bucket to refill.
+	start := time.Now()
+	waited, err = bucket.Wait(context.Background(), 20*1024)
+	require.NoError(t, err)
+	require.True(t, time.Since(start) >= 150*time.Millisecond, "waited %s", time.Since(start))
+	require.True(t, waited >= 150*time.Millisecond, "reported %s", waited)
+
+	stats := bucket.toProto("", false)
+	require.Equal(t, uint64(1), stats.Waits)
+	require.Equal(t, int64(0), stats.Waiting)
+	require.True(t, stats.WaitMicros >= 150000)
+
+	// Waits end with the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = bucket.Wait(ctx, 100*1024)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, bucket.toProto("", false).Available < 0)
+}
+
+func TestThrottle_Callers(t *testing.T) {
+	throttle := &Throttle{ReadBytesPerSecond: 1000, CallerReadBytesPerSecond: 100}
+
+	reads := throttle.reads("batch")
+	require.NotNil(t, reads.volume)
+	require.NotNil(t, reads.caller)
+	require.Equal(t, uint64(100), reads.caller.BytesPerSecond)
+
+	// Callers share the volume's bucket, and each has its own.
+	require.Equal(t, reads.volume, throttle.reads("interactive").volume)
+	require.Equal(t, reads.caller, throttle.reads("batch").caller)
+	require.NotEqual(t, reads.caller, throttle.reads("interactive").caller)
+
+	// Unidentified callers share a bucket of their own, and unlimited writes pass through none.
+	unidentified := throttle.reads("").caller
+	require.NotNil(t, unidentified)
+	require.Equal(t, uint64(100), unidentified.BytesPerSecond)
+	require.Equal(t, unidentified, throttle.reads("").caller)
+	require.NotEqual(t, reads.caller, unidentified)
+	require.Nil(t, throttle.writes("batch").volume)
+	require.Nil(t, throttle.writes("batch").caller)
+
+	stats := throttle.toProto()
+	require.Equal(t, uint64(1000), stats.ReadBytesPerSecond)
+	require.Len(t, stats.Buckets, 4)
+	require.Equal(t, "", stats.Buckets[0].Caller)
+	require.Equal(t, UnidentifiedCaller, stats.Buckets[1].Caller)
+	require.Equal(t, "batch", stats.Buckets[2].Caller)
+	require.Equal(t, "interactive", stats.Buckets[3].Caller)
+
+	// Idle callers are forgotten once too many are tracked.
+	for i := 0; i < maxThrottledCallers; i++ {
+		throttle.reads(fmt.Sprintf("caller-%d", i))
+	}
+
+	require.True(t, len(throttle.callers) < maxThrottledCallers)
+
+	// Busy callers aren't, so callers that find no room share the unidentified callers' bucket.
+	busy := &Throttle{CallerReadBytesPerSecond: 100}
+	for i := 0; i < maxThrottledCallers; i++ {
+		busy.reads(fmt.Sprintf("caller-%d", i)).caller.reserve(200)
+	}
+
+	require.Len(t, busy.callers, maxThrottledCallers)
+	require.Equal(t, busy.reads("").caller, busy.reads("late").caller)
+	require.Len(t, busy.callers, maxThrottledCallers)
+}
+
+func TestCallerFrom(t *testing.T) {
+	require.Equal(t, "", CallerFrom(context.Background()))
+
+	outgoing := WithCaller(context.Background(), "batch")
+	md, ok := metadata.FromOutgoingContext(outgoing)
+	require.True(t, ok)
+
+	require.Equal(t, "batch", CallerFrom(metadata.NewIncomingContext(context.Background(), md)))
+}
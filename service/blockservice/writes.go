@@ -0,0 +1,265 @@
+package blockservice
+
+import (
+	"bfs/block"
+	"bfs/util/logging"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"os"
+	"time"
+)
+
+/*
+ * Resumable writes.
+ *
+ * A volume keeps track of every block being written to it. When a write's stream breaks before the block is committed,
+ * the write is suspended rather than abandoned: its temp file and checksum state are kept for WriteGracePeriod so the
+ * client can ask how much of the block arrived and resume from there. Suspended writes that aren't resumed in time are
+ * aborted by a reaper that runs while the volume is open, or sooner if the volume starts, resumes, or suspends a write,
+ * or reports on one, after they expire.
+ */
+
+const (
+	// How long an interrupted write is kept for volumes that do not configure a grace period.
+	DefaultWriteGracePeriod = 10 * time.Minute
+)
+
+// The error returned when resuming a write the volume has no record of.
+var ErrNoSuchWrite = errors.New("no such write")
+
+// The error returned when a write can't start or resume because another stream is writing the block.
+type WriteActiveError struct {
+	BlockId string
+}
+
+func (this *WriteActiveError) Error() string {
+	return fmt.Sprintf("block %s is being written by another stream", this.BlockId)
+}
+
+// The error returned when a write is resumed from an offset other than the size of the data the volume holds.
+type WriteOffsetError struct {
+	BlockId string
+	Offset  uint64
+	Size    uint64
+}
+
+func (this *WriteOffsetError) Error() string {
+	return fmt.Sprintf("can not resume block %s at %d - %d bytes held", this.BlockId, this.Offset, this.Size)
+}
+
+// The progress of a block write.
+type WriteProgress struct {
+	State WriteState
+	// The number of bytes held, and their CRC32C.
+	Size     uint64
+	Checksum uint32
+	// Whether a stream is currently writing the block.
+	Active bool
+}
+
+// Start tracking a new write, replacing any suspended write of the same block.
+//
+// A *WriteActiveError is returned if another stream is writing the block, unless both write it in dedup mode.
+func (this *PhysicalVolume) startWrite(writer *volumeWriter) error {
+	this.writesMut.Lock()
+	defer this.writesMut.Unlock()
+
+	this.reapWrites()
+
+	if existing, ok := this.writes[writer.blockId]; ok {
+		if existing.active && writer.digest != nil {
+			// Identical content written by two streams at once. Whichever commits first stores the block and the other
+			// adds a reference to it, so the second is written untracked; it can't be resumed, as its ID is taken.
+			glog.V(logging.LogLevelDebug).Infof("Writing block %s on volume %s alongside an active write",
+				writer.blockId, this.ID)
+			return nil
+		} else if existing.active {
+			return &WriteActiveError{BlockId: writer.blockId}
+		}
+
+		glog.Infof("Restarting suspended write of block %s on volume %s", writer.blockId, this.ID)
+		this.abortWrite(existing)
+	}
+
+	writer.active = true
+	this.writes[writer.blockId] = writer
+
+	return nil
+}
+
+// Resume a suspended write of a block at the given offset, which must be the number of bytes the volume holds.
+func (this *PhysicalVolume) ResumeWrite(blockId string, offset uint64) (block.BlockWriter, error) {
+	if err := this.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	this.writesMut.Lock()
+	defer this.writesMut.Unlock()
+
+	this.reapWrites()
+
+	writer, ok := this.writes[blockId]
+	if !ok {
+		return nil, ErrNoSuchWrite
+	} else if writer.active {
+		return nil, &WriteActiveError{BlockId: blockId}
+	} else if writer.size != offset {
+		return nil, &WriteOffsetError{BlockId: blockId, Offset: offset, Size: writer.size}
+	}
+
+	glog.Infof("Resuming write of block %s on volume %s at %d", blockId, this.ID, offset)
+
+	writer.active = true
+
+	return writer, nil
+}
+
+// Keep an interrupted write for WriteGracePeriod so it may be resumed.
+func (this *PhysicalVolume) SuspendWrite(writer block.BlockWriter) {
+	this.writesMut.Lock()
+	defer this.writesMut.Unlock()
+
+	volumeWriter, ok := writer.(*volumeWriter)
+	if !ok {
+		return
+	} else if this.writes[volumeWriter.blockId] != volumeWriter {
+		// Untracked writes, such as of a block another stream is also writing, can't be resumed.
+		if err := volumeWriter.BlockWriter.Abort(); err != nil {
+			glog.Errorf("Unable to abort write of block %s on volume %s - %v", volumeWriter.blockId, this.ID, err)
+		}
+
+		return
+	}
+
+	glog.Warningf("Suspending write of block %s on volume %s at %d", volumeWriter.blockId, this.ID,
+		volumeWriter.size)
+
+	volumeWriter.active = false
+	volumeWriter.suspended = time.Now()
+
+	this.reapWrites()
+}
+
+// Report the progress of a block's write.
+func (this *PhysicalVolume) WriteProgress(blockId string) (*WriteProgress, error) {
+	if err := this.checkReadable(); err != nil {
+		return nil, err
+	}
+
+	this.writesMut.Lock()
+	this.reapWrites()
+
+	if writer, ok := this.writes[blockId]; ok {
+		progress := &WriteProgress{
+			State:    WriteState_WRITE_IN_PROGRESS,
+			Size:     writer.size,
+			Checksum: writer.checksum,
+			Active:   writer.active,
+		}
+
+		this.writesMut.Unlock()
+		return progress, nil
+	}
+
+	this.writesMut.Unlock()
+
+	size, checksum, err := this.Storage.ReadChecksum(blockId, this.Keys)
+	if os.IsNotExist(err) {
+		// Blocks written before checksums were recorded are committed but can't report a checksum.
+		if info, err := this.Stat(blockId); err == nil {
+			return &WriteProgress{State: WriteState_WRITE_COMMITTED, Size: info.Size}, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		return &WriteProgress{State: WriteState_WRITE_UNKNOWN}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if _, err := this.Stat(blockId); os.IsNotExist(err) {
+		// The block's checksums are moved into place before the block itself.
+		return &WriteProgress{State: WriteState_WRITE_UNKNOWN}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &WriteProgress{State: WriteState_WRITE_COMMITTED, Size: size, Checksum: checksum}, nil
+}
+
+// Stop tracking a write once it is committed or aborted.
+func (this *PhysicalVolume) finishWrite(writer *volumeWriter) {
+	this.writesMut.Lock()
+	defer this.writesMut.Unlock()
+
+	if this.writes[writer.blockId] == writer {
+		delete(this.writes, writer.blockId)
+	}
+}
+
+// Start aborting expired suspended writes in the background, checking twice per grace period, and carrying out due
+// releases every releaseInterval, until stopReaper() is called.
+func (this *PhysicalVolume) startReaper() {
+	this.reaperStop = make(chan struct{})
+	this.reaperWG.Add(1)
+
+	go func() {
+		defer this.reaperWG.Done()
+
+		var writeTicks <-chan time.Time
+		if interval := this.WriteGracePeriod / 2; interval > 0 {
+			writeTicker := time.NewTicker(interval)
+			defer writeTicker.Stop()
+			writeTicks = writeTicker.C
+		}
+
+		releaseTicker := time.NewTicker(releaseInterval)
+		defer releaseTicker.Stop()
+
+		for {
+			select {
+			case <-this.reaperStop:
+				return
+			case <-writeTicks:
+				this.writesMut.Lock()
+				this.reapWrites()
+				this.writesMut.Unlock()
+			case <-releaseTicker.C:
+				this.releaseDue()
+			}
+		}
+	}()
+}
+
+// Stop the reaper started by startReaper(), waiting for it to finish.
+func (this *PhysicalVolume) stopReaper() {
+	if this.reaperStop == nil {
+		return
+	}
+
+	close(this.reaperStop)
+	this.reaperWG.Wait()
+	this.reaperStop = nil
+}
+
+// Abort suspended writes that have outlived the grace period. Called with writesMut held.
+func (this *PhysicalVolume) reapWrites() {
+	for _, writer := range this.writes {
+		if !writer.active && time.Since(writer.suspended) > this.WriteGracePeriod {
+			glog.Warningf("Abandoning write of block %s on volume %s - suspended at %d for %s", writer.blockId,
+				this.ID, writer.size, time.Since(writer.suspended))
+
+			this.abortWrite(writer)
+		}
+	}
+}
+
+// Abort a tracked write. Called with writesMut held.
+func (this *PhysicalVolume) abortWrite(writer *volumeWriter) {
+	delete(this.writes, writer.blockId)
+
+	if err := writer.BlockWriter.Abort(); err != nil {
+		glog.Errorf("Unable to abort write of block %s on volume %s - %v", writer.blockId, this.ID, err)
+	}
+}
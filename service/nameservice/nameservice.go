@@ -4,6 +4,8 @@ import (
 	"bfs/ns"
 	"bfs/ns/etcd"
 	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"io"
 	"time"
 )
@@ -32,8 +34,12 @@ func (this *NameService) Get(ctx context.Context, request *GetRequest) (*GetResp
 
 	for _, block := range entry.Blocks {
 		pBlock := &BlockMetadata{
-			BlockId: block.Block,
-			PvId:    block.PVID,
+			BlockId:     block.Block,
+			PvIds:       block.PVIDs,
+			Checksum:    block.Checksum,
+			Size:        block.Size,
+			StoredSize:  block.StoredSize,
+			HasChecksum: block.HasChecksum,
 		}
 
 		blocks = append(blocks, pBlock)
@@ -50,6 +56,7 @@ func (this *NameService) Get(ctx context.Context, request *GetRequest) (*GetResp
 			Size:             entry.Size,
 			Ctime:            &Time{entry.Ctime.Unix(), int64(entry.Ctime.Nanosecond())},
 			Mtime:            &Time{entry.Mtime.Unix(), int64(entry.Mtime.Nanosecond())},
+			ErasureCoding:    erasureCodingToProto(entry.ErasureCoding),
 		},
 	}, nil
 }
@@ -59,9 +66,13 @@ func (this *NameService) Add(ctx context.Context, request *AddRequest) (*AddResp
 
 	for _, pBlock := range request.Entry.Blocks {
 		blocks = append(blocks, &ns.BlockMetadata{
-			Block:  pBlock.BlockId,
-			LVName: request.Entry.LvId,
-			PVID:   pBlock.PvId,
+			Block:       pBlock.BlockId,
+			LVName:      request.Entry.LvId,
+			PVIDs:       pBlock.PvIds,
+			Checksum:    pBlock.Checksum,
+			Size:        pBlock.Size,
+			StoredSize:  pBlock.StoredSize,
+			HasChecksum: pBlock.HasChecksum,
 		})
 	}
 
@@ -76,6 +87,7 @@ func (this *NameService) Add(ctx context.Context, request *AddRequest) (*AddResp
 		ReplicationLevel: request.Entry.ReplicationLevel,
 		Ctime:            time.Unix(request.Entry.Ctime.Seconds, request.Entry.Ctime.Nanos).UTC(),
 		Mtime:            time.Unix(request.Entry.Mtime.Seconds, request.Entry.Mtime.Nanos).UTC(),
+		ErasureCoding:    erasureCodingFromProto(request.Entry.ErasureCoding),
 	}
 
 	if err := this.Namespace.Add(entry); err != nil {
@@ -102,6 +114,57 @@ func (this *NameService) Rename(ctx context.Context, request *RenameRequest) (*R
 	}, nil
 }
 
+func (this *NameService) ReplaceReplica(ctx context.Context, request *ReplaceReplicaRequest) (*ReplaceReplicaResponse, error) {
+	err := this.Namespace.ReplaceReplica(request.Path, request.BlockId, request.OldPvId, request.NewPvId)
+	if _, ok := err.(*ns.Error); ok || err == ns.ErrNoSuchReplica {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &ReplaceReplicaResponse{}, nil
+}
+
+func (this *NameService) Append(ctx context.Context, request *AppendRequest) (*AppendResponse, error) {
+	blocks := make([]*ns.BlockMetadata, 0, len(request.Blocks))
+
+	for _, pBlock := range request.Blocks {
+		blocks = append(blocks, &ns.BlockMetadata{
+			Block:       pBlock.BlockId,
+			PVIDs:       pBlock.PvIds,
+			Checksum:    pBlock.Checksum,
+			Size:        pBlock.Size,
+			StoredSize:  pBlock.StoredSize,
+			HasChecksum: pBlock.HasChecksum,
+		})
+	}
+
+	replaced, err := this.Namespace.Append(request.Path, request.ExpectedSize, request.ReplacedBlockId, blocks,
+		request.Size)
+	if _, ok := err.(*ns.Error); ok {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err == ns.ErrEntryChanged {
+		return nil, status.Errorf(codes.Aborted, "unable to append to %s - %v", request.Path, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	response := &AppendResponse{}
+
+	if replaced != nil {
+		response.ReplacedBlock = &BlockMetadata{
+			BlockId:     replaced.Block,
+			PvIds:       replaced.PVIDs,
+			Checksum:    replaced.Checksum,
+			Size:        replaced.Size,
+			StoredSize:  replaced.StoredSize,
+			HasChecksum: replaced.HasChecksum,
+		}
+	}
+
+	return response, nil
+}
+
 func (this *NameService) List(request *ListRequest, stream NameService_ListServer) error {
 	var pEntries []*Entry
 
@@ -140,8 +203,12 @@ func (this *NameService) List(request *ListRequest, stream NameService_ListServe
 
 		for _, block := range entry.Blocks {
 			pBlock := &BlockMetadata{
-				BlockId: block.Block,
-				PvId:    block.PVID,
+				BlockId:     block.Block,
+				PvIds:       block.PVIDs,
+				Checksum:    block.Checksum,
+				Size:        block.Size,
+				StoredSize:  block.StoredSize,
+				HasChecksum: block.HasChecksum,
 			}
 
 			blocks = append(blocks, pBlock)
@@ -157,6 +224,7 @@ func (this *NameService) List(request *ListRequest, stream NameService_ListServe
 			Blocks:           blocks,
 			Ctime:            &Time{Seconds: entry.Ctime.Unix(), Nanos: int64(entry.Ctime.Nanosecond())},
 			Mtime:            &Time{Seconds: entry.Mtime.Unix(), Nanos: int64(entry.Mtime.Nanosecond())},
+			ErasureCoding:    erasureCodingToProto(entry.ErasureCoding),
 		})
 
 		return true, nil
@@ -168,3 +236,27 @@ func (this *NameService) List(request *ListRequest, stream NameService_ListServe
 
 	return nil
 }
+
+func erasureCodingToProto(erasureCoding *ns.ErasureCoding) *ErasureCoding {
+	if erasureCoding == nil {
+		return nil
+	}
+
+	return &ErasureCoding{
+		DataFragments:   erasureCoding.DataFragments,
+		ParityFragments: erasureCoding.ParityFragments,
+		CellSize:        erasureCoding.CellSize,
+	}
+}
+
+func erasureCodingFromProto(erasureCoding *ErasureCoding) *ns.ErasureCoding {
+	if erasureCoding == nil {
+		return nil
+	}
+
+	return &ns.ErasureCoding{
+		DataFragments:   erasureCoding.DataFragments,
+		ParityFragments: erasureCoding.ParityFragments,
+		CellSize:        erasureCoding.CellSize,
+	}
+}
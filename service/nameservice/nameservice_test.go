@@ -77,8 +77,8 @@ func TestNameService(t *testing.T) {
 						Path:        fmt.Sprintf("/test%d.txt", i),
 						Permissions: 0,
 						Blocks: []*BlockMetadata{
-							{PvId: "a", BlockId: "1"},
-							{PvId: "a", BlockId: "2"},
+							{PvIds: []string{"a"}, BlockId: "1"},
+							{PvIds: []string{"a"}, BlockId: "2"},
 						},
 						Ctime: &Time{Seconds: now.Unix(), Nanos: int64(now.Nanosecond())},
 						Mtime: &Time{Seconds: now.Unix(), Nanos: int64(now.Nanosecond())},
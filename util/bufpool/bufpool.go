@@ -0,0 +1,67 @@
+package bufpool
+
+import (
+	"bfs/util/size"
+	"math/bits"
+	"sync"
+)
+
+/*
+ * Pooled byte buffers.
+ *
+ * Buffers are pooled by size class. Each class is a power of two from MinSize to MaxSize; a request is served from the
+ * smallest class that holds it. Requests larger than MaxSize are allocated as needed and never pooled.
+ */
+
+const (
+	MinSize = 4 * size.KB
+	MaxSize = 16 * size.MB
+)
+
+// A pooled buffer. Buffers are passed by pointer so they can be pooled without allocating.
+type Buffer struct {
+	Bytes []byte
+}
+
+var pools = make([]sync.Pool, class(MaxSize)+1)
+
+// Get a buffer whose Bytes are n bytes long. The contents of the buffer are undefined.
+func Get(n int) *Buffer {
+	idx := class(n)
+	if idx >= len(pools) {
+		return &Buffer{Bytes: make([]byte, n)}
+	}
+
+	if buffer, ok := pools[idx].Get().(*Buffer); ok {
+		buffer.Bytes = buffer.Bytes[:n]
+		return buffer
+	}
+
+	return &Buffer{Bytes: make([]byte, n, MinSize<<uint(idx))}
+}
+
+// Return a buffer to its pool. Neither the buffer nor any slice of its Bytes may be used afterwards.
+func Put(buffer *Buffer) {
+	if buffer == nil {
+		return
+	}
+
+	capacity := cap(buffer.Bytes)
+	idx := class(capacity)
+
+	// Buffers that didn't come from a pool are left to the garbage collector.
+	if idx >= len(pools) || MinSize<<uint(idx) != capacity {
+		return
+	}
+
+	pools[idx].Put(buffer)
+}
+
+// Returns the index of the smallest size class that holds n bytes.
+func class(n int) int {
+	if n <= MinSize {
+		return 0
+	}
+
+	return bits.Len(uint(n-1)) - bits.Len(uint(MinSize-1))
+}
@@ -0,0 +1,49 @@
+package bufpool
+
+import (
+	"bfs/util/size"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestClass(t *testing.T) {
+	require.Equal(t, 0, class(0))
+	require.Equal(t, 0, class(MinSize))
+	require.Equal(t, 1, class(MinSize+1))
+	require.Equal(t, 1, class(2*MinSize))
+	require.Equal(t, 8, class(size.MB))
+	require.Equal(t, len(pools)-1, class(MaxSize))
+	require.Equal(t, len(pools), class(MaxSize+1))
+}
+
+func TestGetPut(t *testing.T) {
+	buffer := Get(100)
+	require.Len(t, buffer.Bytes, 100)
+	require.Equal(t, MinSize, cap(buffer.Bytes))
+	Put(buffer)
+
+	buffer = Get(size.MB + 1)
+	require.Len(t, buffer.Bytes, size.MB+1)
+	require.Equal(t, 2*size.MB, cap(buffer.Bytes))
+	Put(buffer)
+
+	// Oversized buffers are allocated to fit and not pooled.
+	buffer = Get(MaxSize + 1)
+	require.Len(t, buffer.Bytes, MaxSize+1)
+	Put(buffer)
+
+	// Buffers not sized to a class are ignored.
+	Put(&Buffer{Bytes: make([]byte, 1000)})
+	Put(nil)
+
+	buffer = Get(MinSize)
+	require.Equal(t, MinSize, cap(buffer.Bytes))
+}
+
+func BenchmarkGetPut(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		Put(Get(size.MB))
+	}
+}
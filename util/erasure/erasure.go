@@ -0,0 +1,272 @@
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+ * Reed-Solomon erasure coding over GF(2^8).
+ *
+ * A code with k data shards and m parity shards computes m parity shards from k equally sized data shards such that
+ * any k of the k+m shards are enough to recover the rest. The encoding matrix is systematic: its first k rows are the
+ * identity, so data shards are stored as is, and its last m rows form a Cauchy matrix, so every k x k submatrix is
+ * invertible.
+ */
+
+// The largest number of shards a code may have.
+const MaxShards = 256
+
+var ErrTooFewShards = errors.New("too few shards to reconstruct")
+
+var ErrShardSize = errors.New("shards differ in size")
+
+type Code struct {
+	DataShards   int
+	ParityShards int
+
+	// The (DataShards+ParityShards) x DataShards encoding matrix.
+	matrix [][]byte
+}
+
+func New(dataShards int, parityShards int) (*Code, error) {
+	if dataShards < 1 || parityShards < 0 || dataShards+parityShards > MaxShards {
+		return nil, fmt.Errorf("invalid code %d+%d - at least one data shard and at most %d shards are allowed",
+			dataShards, parityShards, MaxShards)
+	}
+
+	this := &Code{
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		matrix:       make([][]byte, dataShards+parityShards),
+	}
+
+	for row := range this.matrix {
+		this.matrix[row] = make([]byte, dataShards)
+
+		if row < dataShards {
+			this.matrix[row][row] = 1
+			continue
+		}
+
+		// Rows and columns are given distinct field elements, so x + y is never zero.
+		for col := range this.matrix[row] {
+			this.matrix[row][col] = gfInverse(byte(row) ^ byte(col))
+		}
+	}
+
+	return this, nil
+}
+
+// Returns the total number of shards.
+func (this *Code) Shards() int {
+	return this.DataShards + this.ParityShards
+}
+
+// Compute the parity shards from the data shards.
+//
+// The first DataShards entries of shards hold the data and must all be the same length. Parity shards are allocated
+// if nil and overwritten otherwise.
+func (this *Code) Encode(shards [][]byte) error {
+	if len(shards) != this.Shards() {
+		return fmt.Errorf("expected %d shards, got %d", this.Shards(), len(shards))
+	}
+
+	shardSize := len(shards[0])
+
+	for _, shard := range shards[:this.DataShards] {
+		if len(shard) != shardSize {
+			return ErrShardSize
+		}
+	}
+
+	for i := this.DataShards; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, shardSize)
+		} else if len(shards[i]) != shardSize {
+			return ErrShardSize
+		}
+
+		mulRows(this.matrix[i], shards[:this.DataShards], shards[i])
+	}
+
+	return nil
+}
+
+// Recover missing shards in place.
+//
+// Missing shards are nil. Any DataShards of the shards must be present and the same length. Missing data shards are
+// always recovered; missing parity shards are recovered only if dataOnly is false.
+func (this *Code) Reconstruct(shards [][]byte, dataOnly bool) error {
+	if len(shards) != this.Shards() {
+		return fmt.Errorf("expected %d shards, got %d", this.Shards(), len(shards))
+	}
+
+	// Pick the first DataShards shards present. The rows of the encoding matrix that produced them, inverted, map them
+	// back to the data.
+	present := make([]int, 0, this.DataShards)
+	shardSize := -1
+	missingData := false
+
+	for i, shard := range shards {
+		if shard == nil {
+			if i < this.DataShards {
+				missingData = true
+			}
+
+			continue
+		}
+
+		if shardSize == -1 {
+			shardSize = len(shard)
+		} else if len(shard) != shardSize {
+			return ErrShardSize
+		}
+
+		if len(present) < this.DataShards {
+			present = append(present, i)
+		}
+	}
+
+	if len(present) < this.DataShards {
+		return ErrTooFewShards
+	}
+
+	if missingData {
+		subMatrix := make([][]byte, this.DataShards)
+		inputs := make([][]byte, this.DataShards)
+
+		for i, shardIdx := range present {
+			subMatrix[i] = this.matrix[shardIdx]
+			inputs[i] = shards[shardIdx]
+		}
+
+		decodeMatrix, err := invert(subMatrix)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < this.DataShards; i++ {
+			if shards[i] == nil {
+				shards[i] = make([]byte, shardSize)
+				mulRows(decodeMatrix[i], inputs, shards[i])
+			}
+		}
+	}
+
+	if !dataOnly {
+		for i := this.DataShards; i < len(shards); i++ {
+			if shards[i] == nil {
+				shards[i] = make([]byte, shardSize)
+				mulRows(this.matrix[i], shards[:this.DataShards], shards[i])
+			}
+		}
+	}
+
+	return nil
+}
+
+// Set output to the sum of the inputs, each multiplied by its coefficient.
+func mulRows(coefficients []byte, inputs [][]byte, output []byte) {
+	for i := range output {
+		output[i] = 0
+	}
+
+	for i, input := range inputs {
+		table := &mulTable[coefficients[i]]
+
+		for j, value := range input {
+			output[j] ^= table[value]
+		}
+	}
+}
+
+// Invert a square matrix by Gauss-Jordan elimination.
+func invert(matrix [][]byte) ([][]byte, error) {
+	size := len(matrix)
+
+	// Work on [matrix | identity]; once the left half is the identity, the right half is the inverse.
+	work := make([][]byte, size)
+	for i := range work {
+		work[i] = make([]byte, 2*size)
+		copy(work[i], matrix[i])
+		work[i][size+i] = 1
+	}
+
+	for col := 0; col < size; col++ {
+		pivot := col
+		for pivot < size && work[pivot][col] == 0 {
+			pivot++
+		}
+
+		if pivot == size {
+			return nil, errors.New("singular matrix")
+		}
+
+		work[col], work[pivot] = work[pivot], work[col]
+
+		if scale := work[col][col]; scale != 1 {
+			table := &mulTable[gfInverse(scale)]
+			for j := range work[col] {
+				work[col][j] = table[work[col][j]]
+			}
+		}
+
+		for row := 0; row < size; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+
+			table := &mulTable[work[row][col]]
+			for j := range work[row] {
+				work[row][j] ^= table[work[col][j]]
+			}
+		}
+	}
+
+	inverse := make([][]byte, size)
+	for i := range inverse {
+		inverse[i] = work[i][size:]
+	}
+
+	return inverse, nil
+}
+
+/*
+ * GF(2^8) arithmetic using the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+ */
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	value := 1
+
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(value)
+		expTable[i+255] = byte(value)
+		logTable[value] = byte(i)
+
+		value <<= 1
+		if value&0x100 != 0 {
+			value ^= 0x11d
+		}
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func gfInverse(value byte) byte {
+	if value == 0 {
+		panic("erasure: inverse of zero")
+	}
+
+	return expTable[255-int(logTable[value])]
+}
@@ -0,0 +1,66 @@
+package erasure
+
+import (
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+)
+
+func TestCode_EncodeReconstruct(t *testing.T) {
+	code, err := New(6, 3)
+	require.NoError(t, err)
+	require.Equal(t, 9, code.Shards())
+
+	random := rand.New(rand.NewSource(1))
+
+	original := make([][]byte, code.Shards())
+	for i := 0; i < code.DataShards; i++ {
+		original[i] = make([]byte, 1000)
+		random.Read(original[i])
+	}
+
+	require.NoError(t, code.Encode(original))
+
+	// Every combination of up to three lost shards can be recovered.
+	for a := 0; a < code.Shards(); a++ {
+		for b := a; b < code.Shards(); b++ {
+			for c := b; c < code.Shards(); c++ {
+				shards := make([][]byte, len(original))
+				copy(shards, original)
+				shards[a], shards[b], shards[c] = nil, nil, nil
+
+				require.NoError(t, code.Reconstruct(shards, false))
+				require.Equal(t, original, shards, "lost shards %d, %d, and %d", a, b, c)
+			}
+		}
+	}
+
+	// Data only reconstruction leaves parity alone.
+	shards := make([][]byte, len(original))
+	copy(shards, original)
+	shards[0], shards[7] = nil, nil
+
+	require.NoError(t, code.Reconstruct(shards, true))
+	require.Equal(t, original[0], shards[0])
+	require.Nil(t, shards[7])
+
+	// Four lost shards is one too many.
+	copy(shards, original)
+	shards[0], shards[1], shards[2], shards[8] = nil, nil, nil, nil
+	require.Equal(t, ErrTooFewShards, code.Reconstruct(shards, false))
+}
+
+func TestCode_Errors(t *testing.T) {
+	_, err := New(0, 3)
+	require.Error(t, err)
+
+	_, err = New(200, 57)
+	require.Error(t, err)
+
+	code, err := New(2, 1)
+	require.NoError(t, err)
+
+	require.Error(t, code.Encode([][]byte{{1}, {2}}))
+	require.Equal(t, ErrShardSize, code.Encode([][]byte{{1}, {2, 3}, nil}))
+	require.Equal(t, ErrShardSize, code.Reconstruct([][]byte{{1}, nil, {2, 3}}, false))
+}
@@ -159,6 +159,11 @@ func (this *FSMInstance) IsOneOf(expected ...interface{}) error {
 	}
 }
 
+// Returns the current state.
+func (this *FSMInstance) State() interface{} {
+	return this.state
+}
+
 // Clone the current instance.
 func (this *FSMInstance) Clone() *FSMInstance {
 	return &FSMInstance{
@@ -27,6 +27,7 @@ func TestFSM_Linear(t *testing.T) {
 
 		require.NoError(t, inst.To("b"))
 		require.NoError(t, inst.To("c"))
+		require.Equal(t, "c", inst.State())
 
 		err := inst.To("d")
 		require.Error(t, err)